@@ -0,0 +1,502 @@
+package bitmex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chuckpreslar/emission"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// privateTopics are what every account of an AccountManager subscribes to
+var privateTopics = []SubscribeInfo{
+	{Op: BitmexWSOrder},
+	{Op: BitmexWSExecution},
+	{Op: BitmexWSPosition},
+	{Op: BitmexWSMargin},
+}
+
+// AccountManager runs a client per account. Market data comes from one
+// public websocket shared by all of them, see Public, and the private tables
+// of every account, its orders, executions, positions and margin, are
+// streams of one /realtimemd connection, see Multiplexer, each authenticated
+// with the key of its account. The manager merges them into one stream
+// tagged with the account name.
+type AccountManager struct {
+	public  *BitMEX
+	mux     *Multiplexer
+	emitter *emission.Emitter
+
+	mu       sync.RWMutex
+	names    []string
+	accounts map[string]*account
+	adding   map[string]bool // names being added
+	started  bool
+	ctx      context.Context // of Start
+
+	muxMutex   sync.Mutex
+	muxStarted bool
+}
+
+type account struct {
+	name      string
+	b         *BitMEX
+	positions *tableCache
+	margins   *tableCache
+	detach    func() // removes the hooks and listeners of the manager
+}
+
+// NewAccountManager creates a manager, host is HostReal or HostTestnet
+func NewAccountManager(host string) *AccountManager {
+	return &AccountManager{
+		public:   New(nil, host, "", "", false),
+		mux:      NewMultiplexer(host),
+		emitter:  emission.NewEmitter(),
+		accounts: make(map[string]*account),
+		adding:   make(map[string]bool),
+	}
+}
+
+// Public returns the client of the shared market data websocket, Subscribe and On it as usual
+func (m *AccountManager) Public() *BitMEX {
+	return m.public
+}
+
+// Multiplexer returns the connection carrying the private streams, named
+// after the accounts
+func (m *AccountManager) Multiplexer() *Multiplexer {
+	return m.mux
+}
+
+// Add registers a client under name. Its websocket subscriptions are replaced
+// by the private tables, streamed over the Multiplexer instead of its own
+// StartWS. Once the manager is started the stream is opened right away, and
+// an account whose stream couldn't be opened isn't added.
+func (m *AccountManager) Add(name string, b *BitMEX) error {
+	m.mu.Lock()
+	if _, ok := m.accounts[name]; ok || m.adding[name] {
+		m.mu.Unlock()
+		return fmt.Errorf("account %q already added", name)
+	}
+	m.adding[name] = true
+	m.mu.Unlock()
+
+	// the stream is opened outside the lock, the other accounts stay readable
+	a := m.attach(name, b)
+	err := m.mux.Open(name, b)
+	opened := err == nil
+	if err == nil && m.isStarted() {
+		err = m.startMux()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.adding, name)
+	if err != nil {
+		a.detach()
+		if opened {
+			m.mux.CloseStream(name)
+		}
+		return err
+	}
+	m.accounts[name] = a
+	m.names = append(m.names, name)
+	sort.Strings(m.names)
+	return nil
+}
+
+// attach hooks the private tables of b into the manager
+func (m *AccountManager) attach(name string, b *BitMEX) *account {
+	a := &account{
+		name:      name,
+		b:         b,
+		positions: newTableCache("account", "symbol", "currency"),
+		margins:   newTableCache("account", "currency"),
+	}
+	removePositions := b.AddTableHook(BitmexWSPosition, a.positions.apply)
+	removeMargins := b.AddTableHook(BitmexWSMargin, a.margins.apply)
+	onOrder := func(orders []*swagger.Order, action string) {
+		m.emitter.Emit(BitmexWSOrder, name, orders, action)
+	}
+	onExecution := func(executions []*swagger.Execution, action string) {
+		m.emitter.Emit(BitmexWSExecution, name, executions, action)
+	}
+	onPosition := func(positions []*swagger.Position, action string) {
+		m.emitter.Emit(BitmexWSPosition, name, positions, action)
+	}
+	onMargin := func(margins []*swagger.Margin, action string) {
+		m.emitter.Emit(BitmexWSMargin, name, margins, action)
+	}
+	b.On(BitmexWSOrder, onOrder)
+	b.On(BitmexWSExecution, onExecution)
+	b.On(BitmexWSPosition, onPosition)
+	b.On(BitmexWSMargin, onMargin)
+	a.detach = func() {
+		removePositions()
+		removeMargins()
+		b.Off(BitmexWSOrder, onOrder)
+		b.Off(BitmexWSExecution, onExecution)
+		b.Off(BitmexWSPosition, onPosition)
+		b.Off(BitmexWSMargin, onMargin)
+	}
+	b.Subscribe(privateTopics)
+	return a
+}
+
+func (m *AccountManager) isStarted() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.started
+}
+
+// startMux connects the multiplexer once, with the context of Start
+func (m *AccountManager) startMux() error {
+	m.muxMutex.Lock()
+	defer m.muxMutex.Unlock()
+	if m.muxStarted {
+		return nil
+	}
+	m.mu.RLock()
+	ctx := m.ctx
+	m.mu.RUnlock()
+	if err := m.mux.Start(ctx); err != nil {
+		return fmt.Errorf("private websocket: %v", err)
+	}
+	m.muxStarted = true
+	return nil
+}
+
+// AddKey creates and adds a client for an api key
+func (m *AccountManager) AddKey(name string, key string, secret string) (*BitMEX, error) {
+	b := New(nil, m.public.host, key, secret, false)
+	if err := m.Add(name, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Remove closes the stream of an account and forgets it, the client is left
+// without the hooks and listeners of the manager
+func (m *AccountManager) Remove(name string) {
+	m.mu.Lock()
+	a, ok := m.accounts[name]
+	if ok {
+		delete(m.accounts, name)
+		for i, n := range m.names {
+			if n == name {
+				m.names = append(m.names[:i], m.names[i+1:]...)
+				break
+			}
+		}
+	}
+	m.mu.Unlock()
+	if ok {
+		a.detach()
+		m.mux.CloseStream(name)
+	}
+}
+
+// Account returns the client of an account, nil if there is none
+func (m *AccountManager) Account(name string) *BitMEX {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if a, ok := m.accounts[name]; ok {
+		return a.b
+	}
+	return nil
+}
+
+// Names returns the account names, sorted
+func (m *AccountManager) Names() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string(nil), m.names...)
+}
+
+func (m *AccountManager) list() []*account {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	accounts := make([]*account, 0, len(m.names))
+	for _, name := range m.names {
+		accounts = append(accounts, m.accounts[name])
+	}
+	return accounts
+}
+
+// On listens to the private tables of every account, listeners get the
+// account name first, e.g. func(account string, orders []*swagger.Order, action string)
+func (m *AccountManager) On(event interface{}, listener interface{}) *emission.Emitter {
+	return m.emitter.On(event, listener)
+}
+
+// Off removes a listener added with On
+func (m *AccountManager) Off(event interface{}, listener interface{}) *emission.Emitter {
+	return m.emitter.Off(event, listener)
+}
+
+// Start opens the public websocket, if anything was subscribed on it, and the
+// connection of the private streams until ctx is done or Close. A stream
+// failing to authenticate is logged, the others run.
+func (m *AccountManager) Start(ctx context.Context) error {
+	m.mu.Lock()
+	m.started = true
+	m.ctx = ctx
+	m.mu.Unlock()
+
+	if len(m.public.subscriptions()) > 0 {
+		if err := m.public.StartWS(ctx); err != nil {
+			return fmt.Errorf("public websocket: %v", err)
+		}
+	}
+	// an account being added opens its stream before checking started
+	if m.mux.len() > 0 {
+		return m.startMux()
+	}
+	return nil
+}
+
+// Close closes every websocket
+func (m *AccountManager) Close() {
+	m.mu.Lock()
+	started := m.started
+	m.started = false
+	m.mu.Unlock()
+	if !started {
+		return
+	}
+	if len(m.public.subscriptions()) > 0 {
+		m.public.CloseWS()
+	}
+	m.mux.Close()
+}
+
+// Wait waits for every websocket goroutine to exit after Close
+func (m *AccountManager) Wait() {
+	m.public.Wait()
+	m.mux.Wait()
+}
+
+// AccountErrors are the failures of a fan-out operation, by account name
+type AccountErrors map[string]error
+
+func (e AccountErrors) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString("; ")
+		}
+		fmt.Fprintf(&sb, "%v: %v", name, e[name])
+	}
+	return sb.String()
+}
+
+// Each runs fn for every account at once, the error is AccountErrors if any failed
+func (m *AccountManager) Each(fn func(name string, b *BitMEX) error) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = AccountErrors{}
+	)
+	for _, a := range m.list() {
+		wg.Add(1)
+		go func(a *account) {
+			defer wg.Done()
+			if err := fn(a.name, a.b); err != nil {
+				mu.Lock()
+				errs[a.name] = err
+				mu.Unlock()
+			}
+		}(a)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// CancelAll cancels the orders of symbol, "" for all symbols, on every account
+func (m *AccountManager) CancelAll(symbol string) error {
+	return m.Each(func(name string, b *BitMEX) error {
+		_, err := b.CancelAllOrders(symbol)
+		return err
+	})
+}
+
+// Refresh loads positions and margin over rest, the websockets keep them current after
+func (m *AccountManager) Refresh() error {
+	return m.Each(func(name string, b *BitMEX) error {
+		a := m.get(name)
+		if a == nil {
+			return nil
+		}
+		positions, err := b.GetPositions("")
+		if err != nil {
+			return err
+		}
+		margin, err := b.GetMargin()
+		if err != nil {
+			return err
+		}
+		data, _ := json.Marshal(positions)
+		a.positions.apply(bitmexActionInitialData, data)
+		data, _ = json.Marshal([]swagger.Margin{margin})
+		a.margins.apply(bitmexActionInitialData, data)
+		return nil
+	})
+}
+
+func (m *AccountManager) get(name string) *account {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.accounts[name]
+}
+
+// AccountPosition is a position of an account
+type AccountPosition struct {
+	Account string
+	swagger.Position
+}
+
+// Positions returns the open positions of every account, by account and symbol
+func (m *AccountManager) Positions() []AccountPosition {
+	var result []AccountPosition
+	for _, a := range m.list() {
+		var positions []swagger.Position
+		a.positions.decode(&positions)
+		sort.Slice(positions, func(i, j int) bool { return positions[i].Symbol < positions[j].Symbol })
+		for _, p := range positions {
+			if p.CurrentQty != 0 {
+				result = append(result, AccountPosition{Account: a.name, Position: p})
+			}
+		}
+	}
+	return result
+}
+
+// NetPosition sums the current quantity of symbol over every account
+func (m *AccountManager) NetPosition(symbol string) float32 {
+	var qty float32
+	for _, p := range m.Positions() {
+		if p.Symbol == symbol {
+			qty += p.CurrentQty
+		}
+	}
+	return qty
+}
+
+// AccountMargin is the margin of an account
+type AccountMargin struct {
+	Account string
+	swagger.Margin
+}
+
+// Margins returns the margin of every account, by account and currency
+func (m *AccountManager) Margins() []AccountMargin {
+	var result []AccountMargin
+	for _, a := range m.list() {
+		var margins []swagger.Margin
+		a.margins.decode(&margins)
+		sort.Slice(margins, func(i, j int) bool { return margins[i].Currency < margins[j].Currency })
+		for _, margin := range margins {
+			result = append(result, AccountMargin{Account: a.name, Margin: margin})
+		}
+	}
+	return result
+}
+
+// TotalMargin sums the balances, margins and pnl in currency (XBt) over every account
+func (m *AccountManager) TotalMargin(currency string) swagger.Margin {
+	total := swagger.Margin{Currency: currency}
+	for _, margin := range m.Margins() {
+		if margin.Currency != currency {
+			continue
+		}
+		total.Amount += margin.Amount
+		total.WalletBalance += margin.WalletBalance
+		total.MarginBalance += margin.MarginBalance
+		total.AvailableMargin += margin.AvailableMargin
+		total.InitMargin += margin.InitMargin
+		total.MaintMargin += margin.MaintMargin
+		total.RealisedPnl += margin.RealisedPnl
+		total.UnrealisedPnl += margin.UnrealisedPnl
+	}
+	return total
+}
+
+// tableCache keeps the rows of a ws table the way BitMEX sends them: partial
+// replaces, insert adds, update merges the fields sent and delete removes.
+// Rows stay raw so that fields updated to zero or false are kept.
+type tableCache struct {
+	keys []string
+
+	mu   sync.Mutex
+	rows map[string]map[string]json.RawMessage
+}
+
+func newTableCache(keys ...string) *tableCache {
+	return &tableCache{keys: keys, rows: make(map[string]map[string]json.RawMessage)}
+}
+
+func (c *tableCache) key(row map[string]json.RawMessage) string {
+	var sb strings.Builder
+	for _, k := range c.keys {
+		sb.Write(row[k])
+		sb.WriteByte('|')
+	}
+	return sb.String()
+}
+
+func (c *tableCache) apply(action string, data []byte) {
+	var rows []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if action == bitmexActionInitialData {
+		c.rows = make(map[string]map[string]json.RawMessage)
+	}
+	for _, row := range rows {
+		key := c.key(row)
+		switch action {
+		case bitmexActionInitialData, bitmexActionInsertData:
+			c.rows[key] = row
+		case bitmexActionUpdateData:
+			old, ok := c.rows[key]
+			if !ok {
+				c.rows[key] = row
+				continue
+			}
+			for k, v := range row {
+				old[k] = v
+			}
+		case bitmexActionDeleteData:
+			delete(c.rows, key)
+		}
+	}
+}
+
+// decode unmarshals the rows into a slice pointer
+func (c *tableCache) decode(v interface{}) error {
+	c.mu.Lock()
+	rows := make([]map[string]json.RawMessage, 0, len(c.rows))
+	for _, row := range c.rows {
+		rows = append(rows, row)
+	}
+	data, err := json.Marshal(rows)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,217 @@
+package bitmex
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// accountFrames are the position and margin partials of one account
+func accountFrames(account int, qty int, balance int) []string {
+	return []string{
+		fmt.Sprintf(`{"table":"position","action":"partial","data":[{"account":%d,"symbol":"XBTUSD","currency":"XBt","currentQty":%d,"isOpen":true,"avgEntryPrice":9000},{"account":%d,"symbol":"ETHUSD","currency":"XBt","currentQty":0}]}`,
+			account, qty, account),
+		fmt.Sprintf(`{"table":"margin","action":"partial","data":[{"account":%d,"currency":"XBt","walletBalance":%d,"marginBalance":%d,"availableMargin":%d}]}`,
+			account, balance, balance, balance),
+	}
+}
+
+// pushAccount sends the partials of an account to its stream once subscribed
+func pushAccount(t *testing.T, srv *bitmextest.Server, name string, account int, qty int, balance int) {
+	t.Helper()
+	waitFor(t, name+" subscribed", func() bool { return countWSMessages(srv, `"`+name+`"`, "subscribe", "margin") == 1 })
+	for _, frame := range accountFrames(account, qty, balance) {
+		srv.PushStream(name, frame)
+	}
+}
+
+func newAccountManagerForServer(srv *bitmextest.Server) *AccountManager {
+	m := NewAccountManager(HostTestnet)
+	m.Public().SetWSURL(srv.WSURL)
+	m.Public().ws.HandshakeTimeout = 100 * time.Millisecond
+	m.Multiplexer().SetWSURL(srv.MDURL)
+	m.Multiplexer().ws.HandshakeTimeout = 100 * time.Millisecond
+	return m
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAccountManager(t *testing.T) {
+	srvA := newTestServer(t) // the websockets and the rest api of a
+	srvB := newTestServer(t) // the rest api of b
+
+	m := newAccountManagerForServer(srvA)
+	m.Public().Subscribe([]SubscribeInfo{{Op: BitmexWSTrade, Param: "XBTUSD"}})
+	srvA.Script(bitmextest.ScriptOnSubscribe("trade:XBTUSD"),
+		`{"table":"trade","action":"insert","data":[{"symbol":"XBTUSD","side":"Buy","size":5,"price":9001}]}`)
+	var trades sync.WaitGroup
+	trades.Add(1)
+	m.Public().On(BitmexWSTrade, func([]*swagger.Trade, string) { trades.Done() })
+
+	if err := m.Add("a", newBitmexForServer(srvA, testKey, testSecret)); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Add("a", newBitmexForServer(srvA, testKey, testSecret)); err == nil {
+		t.Error("expect duplicate error")
+	}
+	var (
+		mu     sync.Mutex
+		orders []string
+	)
+	m.On(BitmexWSOrder, func(account string, o []*swagger.Order, action string) {
+		mu.Lock()
+		defer mu.Unlock()
+		orders = append(orders, account+" "+o[0].OrderID+" "+action)
+	})
+
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	// added after Start
+	if err := m.Add("b", newBitmexForServer(srvB, testKey, testSecret)); err != nil {
+		t.Fatal(err)
+	}
+	if names := m.Names(); strings.Join(names, ",") != "a,b" {
+		t.Errorf("names %v", names)
+	}
+	pushAccount(t, srvA, "a", 1, 100, 1000)
+	pushAccount(t, srvA, "b", 2, -30, 500)
+
+	trades.Wait()
+	waitFor(t, "positions", func() bool { return len(m.Positions()) == 2 && len(m.Margins()) == 2 })
+	if dials := srvA.Dials(); dials != 2 || srvB.Dials() != 0 {
+		t.Errorf("%d connections to A, %d to B, want public and multiplexed private", dials, srvB.Dials())
+	}
+	if net := m.NetPosition("XBTUSD"); net != 70 {
+		t.Errorf("net position %v", net)
+	}
+	positions := m.Positions()
+	if positions[0].Account != "a" || positions[0].CurrentQty != 100 || positions[1].Account != "b" || positions[1].CurrentQty != -30 {
+		t.Errorf("positions %+v", positions)
+	}
+	if total := m.TotalMargin("XBt"); total.WalletBalance != 1500 || total.AvailableMargin != 1500 {
+		t.Errorf("total margin %+v", total)
+	}
+
+	// closing is an update to zero
+	srvA.PushStream("b", `{"table":"position","action":"update","data":[{"account":2,"symbol":"XBTUSD","currency":"XBt","currentQty":0,"isOpen":false}]}`)
+	waitFor(t, "closed position", func() bool { return m.NetPosition("XBTUSD") == 100 })
+	if positions := m.Positions(); len(positions) != 1 || positions[0].AvgEntryPrice != 9000 {
+		t.Errorf("positions %+v", positions)
+	}
+
+	srvA.PushStream("b", `{"table":"order","action":"insert","data":[{"orderID":"o-b","symbol":"XBTUSD","ordStatus":"New"}]}`)
+	waitFor(t, "order", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(orders) == 1
+	})
+	if orders[0] != "b o-b insert" {
+		t.Errorf("orders %q", orders)
+	}
+
+	// fan-out
+	cancelA := srvA.Handle("DELETE", "/order/all", 200, []swagger.Order{})
+	srvB.HandleError("DELETE", "/order/all", 503, "HTTPError", "overloaded")
+	err := m.CancelAll("XBTUSD")
+	errs, ok := err.(AccountErrors)
+	if !ok || len(errs) != 1 || errs["b"] == nil {
+		t.Fatalf("got %v", err)
+	}
+	if cancelA.Hits() != 1 {
+		t.Error("account a not cancelled")
+	}
+	if !strings.HasPrefix(err.Error(), "b: ") {
+		t.Errorf("error %v", err)
+	}
+
+	m.Remove("b")
+	if m.Account("b") != nil || len(m.Positions()) != 1 {
+		t.Error("b not removed")
+	}
+	waitFor(t, "stream closed", func() bool { return strings.Join(srvA.Streams(), ",") == "a" })
+}
+
+func TestAccountManager_AddFails(t *testing.T) {
+	srv := newTestServer(t)
+	m := newAccountManagerForServer(srv)
+	m.Multiplexer().SetLogger(NopLogger)
+	srv.Close()
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	b := newBitmexForServer(srv, testKey, testSecret)
+	if err := m.Add("a", b); err == nil {
+		t.Fatal("expect dial error")
+	}
+	if m.Account("a") != nil || len(m.Names()) != 0 {
+		t.Errorf("failed account kept %v", m.Names())
+	}
+	if len(b.getTableHooks(BitmexWSPosition)) != 0 || b.emitter.GetListenerCount(BitmexWSOrder) != 0 {
+		t.Error("hooks and listeners kept")
+	}
+
+	// a retry isn't "already added"
+	if err := m.Add("a", b); err == nil || strings.Contains(err.Error(), "already added") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestAccountManager_KeepsHooks(t *testing.T) {
+	m := NewAccountManager(HostTestnet)
+	b := New(nil, HostTestnet, "", "", false)
+	b.SetLogger(NopLogger)
+	var own int
+	b.AddTableHook(BitmexWSPosition, func(action string, data []byte) { own++ })
+	b.On(BitmexWSOrder, func(orders []*swagger.Order, action string) { own++ })
+
+	if err := m.Add("a", b); err != nil {
+		t.Fatal(err)
+	}
+	b.processMessage([]byte(`{"table":"position","action":"partial","data":[{"account":1,"symbol":"XBTUSD","currency":"XBt","currentQty":5}]}`))
+	if own != 1 || len(m.Positions()) != 1 {
+		t.Fatalf("own hook %d, positions %v", own, m.Positions())
+	}
+
+	m.Remove("a")
+	b.processMessage([]byte(`{"table":"position","action":"update","data":[{"account":1,"symbol":"XBTUSD","currency":"XBt","currentQty":7}]}`))
+	b.processMessage([]byte(`{"table":"order","action":"insert","data":[{"orderID":"o-1","symbol":"XBTUSD"}]}`))
+	if own != 3 || b.emitter.GetListenerCount(BitmexWSOrder) != 1 || len(b.getTableHooks(BitmexWSPosition)) != 1 {
+		t.Errorf("own %d, %d order listeners", own, b.emitter.GetListenerCount(BitmexWSOrder))
+	}
+}
+
+func TestTableCache(t *testing.T) {
+	c := newTableCache("account", "symbol")
+	c.apply("partial", []byte(`[{"account":1,"symbol":"XBTUSD","currentQty":10,"markPrice":9000}]`))
+	c.apply("insert", []byte(`[{"account":1,"symbol":"ETHUSD","currentQty":3}]`))
+	c.apply("update", []byte(`[{"account":1,"symbol":"XBTUSD","currentQty":0}]`))
+	c.apply("delete", []byte(`[{"account":1,"symbol":"ETHUSD"}]`))
+	c.apply("update", []byte(`not json`))
+
+	var positions []swagger.Position
+	if err := c.decode(&positions); err != nil {
+		t.Fatal(err)
+	}
+	if len(positions) != 1 || positions[0].CurrentQty != 0 || positions[0].MarkPrice != 9000 {
+		t.Errorf("got %+v", positions)
+	}
+}
@@ -4,9 +4,7 @@ import (
 	"context"
 	"github.com/chuckpreslar/emission"
 	"github.com/frankrap/bitmex-api/recws"
-	"golang.org/x/net/proxy"
-	"log"
-	"net"
+	"strings"
 	"time"
 
 	//"github.com/recws-org/recws"
@@ -14,6 +12,7 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -32,11 +31,16 @@ type BitMEX struct {
 	Key       string
 	Secret    string
 	host      string
-	proxyURL  string
+	wsURL     string
+	proxy     *url.URL        // rest and websocket, see SetProxyURL
+	dial      DialContextFunc // rest and websocket, see SetDialContext
 	debugMode bool
 
 	ctx                  context.Context
 	timeout              time.Duration
+	baseClient           *http.Client    // as given, the proxy and dialer go into a copy
+	transport            TransportConfig // of SetTransport, for WarmUp
+	warmConns            *connTracker    // rest connections of SetTransport, for KeepWarm
 	httpClient           *http.Client
 	cfg                  *swagger.Configuration
 	client               *swagger.APIClient
@@ -47,10 +51,39 @@ type BitMEX struct {
 
 	ws              recws.RecConn
 	emitter         *emission.Emitter
+	subscribeMutex  sync.Mutex
 	subscribeCmd    *WSCmd
 	orderBookLocals map[string]*OrderBookLocal // key: symbol
 	orderLocals     map[string]*swagger.Order  // key: OrderID
 	orderBookLoaded map[string]bool            // key: symbol
+	funding         *FundingTracker
+	instruments     *InstrumentRegistry
+	bookMode        BookMode
+	recorderMutex   sync.RWMutex
+	recorder        *Recorder
+	metricsMutex    sync.RWMutex
+	metrics         Metrics
+	loggerMutex     sync.RWMutex
+	logger          Logger
+	wsConnects      int64
+	orderTracer     *orderTracer
+	timeSync        *TimeSync
+	signerMutex     sync.RWMutex
+	signer          Signer
+	signedKey       atomic.Value // string
+	tableHooksMutex sync.RWMutex
+	tableHooks      map[string][]*tableHook                      // raw rows by table, see AddTableHook
+	emitHook        func(event string, arguments ...interface{}) // every event, set before StartWS
+	streamMutex     sync.RWMutex
+	stream          *muxStream // set by Multiplexer.Open instead of StartWS
+	requestsMutex   sync.Mutex
+	requests        map[string]chan []byte // key: request id
+	requestSeq      int64
+	orderEntryMutex sync.RWMutex
+	orderEntry      OrderEntry // Trader orders, nil for rest
+	connState       connState
+	wsWG            sync.WaitGroup // heartbeat and reader of StartWS
+	heartbeat       *heartbeat
 }
 
 // New allows the use of the public or private and websocket api
@@ -63,66 +96,70 @@ func New(httpClient *http.Client, host string, key string, secret string, debugM
 	b.orderBookLocals = make(map[string]*OrderBookLocal)
 	b.orderLocals = make(map[string]*swagger.Order)
 	b.orderBookLoaded = make(map[string]bool)
+	b.funding = newFundingTracker(b.emit)
+	b.instruments = NewInstrumentRegistry()
+	level := LevelInfo
+	if debugMode {
+		level = LevelDebug
+	}
+	b.logger = NewStdLogger(nil, level)
 	b.ws = recws.RecConn{
-		SubscribeHandler: b.subscribeHandler,
+		SubscribeHandler:  b.subscribeHandler,
+		ConnectionHandler: b.connectionHandler,
+		StateHandler:      b.stateHandler,
+		Logger:            b.log(),
 	}
 	b.host = host
 	b.ctx = MakeContext(key, secret, host, 10)
 	b.timeout = 10 * time.Second
 	b.cfg = GetConfiguration(b.ctx)
+	b.timeSync = &TimeSync{}
+	b.heartbeat = newHeartbeat()
+	b.cfg.Clock = b.now
+	b.cfg.Signer = clientSigner{b}
+	b.orderTracer = newOrderTracer()
+	b.cfg.Tracer = b.orderTracer
 	if httpClient == nil {
 		httpClient = &http.Client{
 			Timeout: b.timeout,
 		}
 	}
-	b.httpClient = httpClient
-	b.cfg.HTTPClient = httpClient
+	b.baseClient = httpClient
+	b.setHTTPClient(httpClient)
 	b.client = swagger.NewAPIClient(b.cfg)
 	return b
 }
 
-// SetHttpProxy proxyURL: http://127.0.0.1:1080
-func (b *BitMEX) SetHttpProxy(proxyURL string) error {
-	proxyURL_, err := url.Parse(proxyURL)
-	if err != nil {
-		return err
-	}
+// SetBasePath changes the rest api base path, e.g. http://127.0.0.1:8080/api/v1 for a local simulator
+func (b *BitMEX) SetBasePath(basePath string) {
+	b.client.ChangeBasePath(basePath)
+}
 
-	//adding the proxy settings to the Transport object
-	transport := &http.Transport{
-		Proxy: http.ProxyURL(proxyURL_),
-	}
+// SetWSURL changes the realtime websocket url used by StartWS, e.g. ws://127.0.0.1:8080/realtime
+func (b *BitMEX) SetWSURL(wsURL string) {
+	b.wsURL = wsURL
+}
 
-	//adding the Transport object to the http Client
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   b.timeout,
-	}
-	b.httpClient = client
-	b.cfg.HTTPClient = client
-	b.proxyURL = proxyURL
-	return nil
+// SetTimeout changes the rest request timeout, 10s by default, 0 for none
+func (b *BitMEX) SetTimeout(timeout time.Duration) {
+	client := *b.baseClient
+	client.Timeout = timeout
+	b.timeout = timeout
+	b.baseClient = &client
+	b.applyTransport() // can't fail, a proxy or dialer was only kept if it applied
 }
 
-// SetProxy proxyURL: 127.0.0.1:1080
-func (b *BitMEX) SetProxy(socks5Proxy string) error {
-	// socks5Proxy := "127.0.0.1:1080"
-	dialer, err := proxy.SOCKS5("tcp", socks5Proxy, nil, proxy.Direct)
-	if err != nil {
-		log.Fatal("Error creating dialer, aborting.")
-	}
+// SetHttpProxy proxyURL: http://127.0.0.1:1080, see SetProxyURL
+func (b *BitMEX) SetHttpProxy(proxyURL string) error {
+	return b.SetProxyURL(proxyURL)
+}
 
-	dialFunc := func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return dialer.Dial(network, addr)
+// SetProxy socks5Proxy: 127.0.0.1:1080, see SetProxyURL
+func (b *BitMEX) SetProxy(socks5Proxy string) error {
+	if !strings.Contains(socks5Proxy, "://") {
+		socks5Proxy = "socks5://" + socks5Proxy
 	}
-
-	tr := &http.Transport{DialContext: dialFunc} // Dial: dialer.Dial,
-	client := &http.Client{Transport: tr, Timeout: b.timeout}
-
-	b.httpClient = client
-	b.cfg.HTTPClient = client
-	b.proxyURL = "http://" + socks5Proxy
-	return nil
+	return b.SetProxyURL(socks5Proxy)
 }
 
 func (b *BitMEX) GetRateLimit() RateLimit {
@@ -1,83 +1,93 @@
 package bitmex
 
 import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
 	"github.com/micro/go-micro/config"
 	"github.com/micro/go-micro/config/source/file"
-	"testing"
 )
 
-var (
-	_proxyURL string
-	_testnet  bool
-	_key      string
-	_secret   string
-	_key2     string
-	_secret2  string
+const (
+	testKey     = "8K2Oi0bnRRZ7GK4UJnY-38oj"
+	testSecret  = "9EmGvk8mKX5nWa11y1KyPPGn78Lv2ZEiLx3TH0YasE_oE06y"
+	testKey2    = "0fyfKgWNejv0konUuqEGA2oU"
+	testSecret2 = "YhIY9ukZyvoRw_pAf0JpY7UgBs7DR7Fh0gUqXmOlNyfXIhwC"
 )
 
-func loadConfig() {
-	err := config.Load(file.NewSource(file.WithPath("./testdata/config.yaml")))
+func TestConfig(t *testing.T) {
+	data, err := ioutil.ReadFile("./testdata/config.yaml.example")
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
-	cfg := config.Map()
-
-	_proxyURL = cfg["proxy_url"].(string)
-	_testnet = cfg["testnet"].(bool)
-	_key = cfg["key"].(string)
-	_secret = cfg["secret"].(string)
-	_key2 = cfg["key2"].(string)
-	_secret2 = cfg["secret2"].(string)
-}
-
-func TestConfig(t *testing.T) {
-	err := config.Load(file.NewSource(file.WithPath("./testdata/config.yaml")))
+	// the file source picks the decoder by extension
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = config.Load(file.NewSource(file.WithPath(path)))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	cfg := config.Map()
 
-	proxy := cfg["proxy_url"].(string)
-	testnet := cfg["testnet"].(bool)
-	key := cfg["key"].(string)
-	secret := cfg["secret"].(string)
-	key2 := cfg["key2"].(string)
-	secret2 := cfg["secret2"].(string)
+	for _, k := range []string{"proxy_url", "key", "secret", "key2", "secret2"} {
+		if v, _ := cfg[k].(string); v == "" {
+			t.Errorf("%v missing", k)
+		}
+	}
+	if _, ok := cfg["testnet"].(bool); !ok {
+		t.Error("testnet missing")
+	}
+}
 
-	t.Log(proxy)
-	t.Log(testnet)
-	t.Log(key)
-	t.Log(secret)
-	t.Log(key2)
-	t.Log(secret2)
+// newTestServer starts a fake server which accepts signatures made with testKey and testSecret
+func newTestServer(t *testing.T) *bitmextest.Server {
+	srv := bitmextest.NewServer()
+	srv.RequireAuth(testKey, testSecret)
+	t.Cleanup(srv.Close)
+	return srv
 }
 
-func newBitmexForTest() *BitMEX {
-	loadConfig()
-	var host string
-	if _testnet {
-		host = HostTestnet
-	} else {
-		host = HostReal
-	}
-	bitmex := New(nil, host, _key, _secret, true)
-	if _proxyURL != "" {
-		bitmex.SetHttpProxy(_proxyURL)
-	}
+func newBitmexForServer(srv *bitmextest.Server, key string, secret string) *BitMEX {
+	bitmex := New(nil, HostTestnet, key, secret, false)
+	bitmex.SetBasePath(srv.BasePath)
+	bitmex.SetWSURL(srv.WSURL)
+	bitmex.ws.HandshakeTimeout = 100 * time.Millisecond
 	return bitmex
 }
 
-func newBitmexForTest2() *BitMEX {
-	loadConfig()
-	var host string
-	if _testnet {
-		host = HostTestnet
-	} else {
-		host = HostReal
+func newBitmexForTest(t *testing.T) (*BitMEX, *bitmextest.Server) {
+	srv := newTestServer(t)
+	return newBitmexForServer(srv, testKey, testSecret), srv
+}
+
+// newBitmexForTest2 signs with the second key pair, which the server does not accept
+func newBitmexForTest2(t *testing.T) (*BitMEX, *bitmextest.Server) {
+	srv := newTestServer(t)
+	return newBitmexForServer(srv, testKey2, testSecret2), srv
+}
+
+// startWS starts the websocket of b, closed and waited for when the test ends
+func startWS(t *testing.T, b *BitMEX) {
+	t.Helper()
+	if err := b.StartWS(context.Background()); err != nil {
+		t.Fatal(err)
 	}
-	bitmex := New(nil, host, _key2, _secret2, true)
-	if _proxyURL != "" {
-		bitmex.SetHttpProxy(_proxyURL)
+	t.Cleanup(func() {
+		b.CloseWS()
+		b.Wait()
+	})
+}
+
+func handleFixture(t testing.TB, srv *bitmextest.Server, method string, path string, filename string) *bitmextest.Route {
+	route, err := srv.HandleFile(method, path, 200, "testdata/"+filename)
+	if err != nil {
+		t.Fatal(err)
 	}
-	return bitmex
+	return route
 }
@@ -0,0 +1,727 @@
+// Package backtest runs a bitmex.Strategy against recorded trades and order
+// books or downloaded TradeBins.
+//
+// The Engine implements bitmex.Trader, so a strategy built on it runs
+// unchanged against the live client. Resting orders keep their queue position
+// at their price level, fills pay the instrument maker or taker fee, open
+// positions pay or receive funding, and order entry takes effect after the
+// configured latency.
+package backtest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+	"github.com/frankrap/bitmex-api/internal/contract"
+	"github.com/frankrap/bitmex-api/paper"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+const (
+	actionPlace = iota
+	actionAmend
+	actionCancel
+)
+
+var (
+	ErrInvalidSymbol    = errors.New("backtest: invalid symbol")
+	ErrInvalidOrdType   = errors.New("backtest: only Limit and Market orders are simulated")
+	ErrInvalidOrderQty  = errors.New("backtest: invalid orderQty")
+	ErrInvalidPrice     = errors.New("backtest: invalid price tickSize")
+	ErrInvalidOrdStatus = errors.New("backtest: invalid ordStatus")
+)
+
+// Config of an Engine
+type Config struct {
+	Instrument    swagger.Instrument // symbol, tick and lot size, multiplier and fees, default XBTUSD
+	Balance       float64            // initial wallet balance in XBt, default 1 XBT
+	Latency       time.Duration      // new, amend and cancel take effect after it
+	TimerInterval time.Duration      // OnTimer interval in simulated time, default 1 minute
+	Funding       []swagger.Funding  // funding payments, recorded funding frames are applied too
+}
+
+type order struct {
+	swagger.Order
+	seq        int64
+	resting    bool    // in the book
+	queueAhead float64 // contracts ahead of us at our price
+}
+
+func (o *order) open() bool {
+	return o.OrdStatus == bitmex.OS_NEW || o.OrdStatus == bitmex.OS_PARTIALLY_FILLED
+}
+
+type action struct {
+	at    time.Time
+	kind  int
+	o     *order
+	price float64
+}
+
+// Engine simulates the exchange for one instrument
+type Engine struct {
+	cfg  Config
+	inst swagger.Instrument
+
+	strategy  bitmex.Strategy
+	now       time.Time
+	nextTimer time.Time
+	book      *bitmex.OrderBookLocal
+	ob        bitmex.OrderBook
+	lastPrice float64
+
+	seq     int64
+	orders  map[string]*order // key: OrderID
+	all     []*order          // in seq order
+	pending []*action         // sorted by at
+	dirty   []*order
+
+	funding        []swagger.Funding
+	fundingIndex   int
+	fundingApplied map[int64]bool // key: funding timestamp
+
+	balance     float64
+	pos         contract.Position
+	realised    float64
+	hasPosition bool
+	peak        float64
+
+	report Report
+}
+
+var _ bitmex.Trader = (*Engine)(nil)
+
+// New creates an engine, create the strategy with it and pass both to Run
+func New(cfg Config) *Engine {
+	if cfg.Instrument.Symbol == "" {
+		cfg.Instrument = paper.DefaultInstrument()
+	}
+	if cfg.Balance == 0 {
+		cfg.Balance = 100000000
+	}
+	if cfg.TimerInterval <= 0 {
+		cfg.TimerInterval = time.Minute
+	}
+	e := &Engine{
+		cfg:            cfg,
+		inst:           cfg.Instrument,
+		book:           bitmex.NewOrderBookLocal(),
+		orders:         make(map[string]*order),
+		fundingApplied: make(map[int64]bool),
+		balance:        cfg.Balance,
+		peak:           cfg.Balance,
+	}
+	e.funding = make([]swagger.Funding, len(cfg.Funding))
+	copy(e.funding, cfg.Funding)
+	sort.Slice(e.funding, func(i, j int) bool {
+		return e.funding[i].Timestamp.Before(e.funding[j].Timestamp)
+	})
+	e.report.InitialBalance = cfg.Balance
+	return e
+}
+
+// Now returns the simulated time
+func (e *Engine) Now() time.Time {
+	return e.now
+}
+
+// Run feeds every event of src to s and returns the report
+func (e *Engine) Run(src Source, s bitmex.Strategy) (*Report, error) {
+	e.strategy = s
+	for {
+		ev, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.report.Start.IsZero() {
+			e.report.Start = ev.Time
+			e.now = ev.Time
+			e.nextTimer = ev.Time.Add(e.cfg.TimerInterval)
+		}
+		e.advance(ev.Time)
+		if ev.Time.After(e.now) {
+			e.now = ev.Time
+		}
+		e.apply(ev)
+	}
+	e.finish()
+	return &e.report, nil
+}
+
+// advance runs pending order actions, funding and timers due up to t in time order
+func (e *Engine) advance(t time.Time) {
+	for {
+		kind := -1
+		var next time.Time
+		consider := func(k int, at time.Time) {
+			if !at.After(t) && (kind == -1 || at.Before(next)) {
+				next, kind = at, k
+			}
+		}
+		if len(e.pending) > 0 {
+			consider(0, e.pending[0].at)
+		}
+		if e.fundingIndex < len(e.funding) {
+			consider(1, e.funding[e.fundingIndex].Timestamp)
+		}
+		consider(2, e.nextTimer)
+		if kind == -1 {
+			return
+		}
+		if next.After(e.now) {
+			e.now = next
+		}
+
+		switch kind {
+		case 0:
+			a := e.pending[0]
+			e.pending = e.pending[1:]
+			e.run(a)
+			e.flush()
+		case 1:
+			e.applyFunding(e.funding[e.fundingIndex])
+			e.fundingIndex++
+		case 2:
+			e.nextTimer = e.nextTimer.Add(e.cfg.TimerInterval)
+			e.strategy.OnTimer(e.now)
+			e.flush()
+			e.recordEquity()
+		}
+	}
+}
+
+func (e *Engine) apply(ev Event) {
+	switch ev.Table {
+	case bitmex.BitmexWSOrderBookL2:
+		var data []*bitmex.OrderBookL2
+		for _, v := range ev.Book {
+			if v.Symbol == e.inst.Symbol {
+				level := *v
+				data = append(data, &level)
+			}
+		}
+		if len(data) == 0 {
+			return
+		}
+		if ev.Action == "partial" {
+			e.book.LoadSnapshot(data)
+		} else {
+			e.book.Update(data, ev.Action)
+		}
+		e.ob = e.book.GetOrderbook()
+		e.ob.Timestamp = e.now
+		e.matchBook()
+		e.flush()
+
+		ob := bitmex.OrderBook{
+			Bids:      append([]bitmex.Item(nil), e.ob.Bids...),
+			Asks:      append([]bitmex.Item(nil), e.ob.Asks...),
+			Timestamp: e.ob.Timestamp,
+		}
+		e.strategy.OnBook(e.inst.Symbol, ob)
+		e.flush()
+	case bitmex.BitmexWSTrade:
+		var trades []*swagger.Trade
+		for _, t := range ev.Trades {
+			if t.Symbol != e.inst.Symbol {
+				continue
+			}
+			trade := *t
+			trades = append(trades, &trade)
+			e.lastPrice = t.Price
+			e.matchTrade(t)
+		}
+		if len(trades) == 0 {
+			return
+		}
+		e.flush()
+		e.strategy.OnTrade(trades)
+		e.flush()
+	case bitmex.BitmexWSFunding:
+		for _, f := range ev.Funding {
+			if f.Symbol == e.inst.Symbol {
+				e.applyFunding(*f)
+			}
+		}
+	}
+}
+
+// PlaceOrder implements bitmex.Trader, the order reaches the book after the latency
+func (e *Engine) PlaceOrder(side string, ordType string, stopPx float64, price float64, orderQty int32, timeInForce string, execInst string, symbol string) (swagger.Order, error) {
+	if symbol != e.inst.Symbol {
+		return swagger.Order{}, ErrInvalidSymbol
+	}
+	if side != bitmex.SIDE_BUY && side != bitmex.SIDE_SELL {
+		return swagger.Order{}, fmt.Errorf("backtest: invalid side %q", side)
+	}
+	if ordType != bitmex.ORD_TYPE_LIMIT && ordType != bitmex.ORD_TYPE_MARKET {
+		return swagger.Order{}, ErrInvalidOrdType
+	}
+	if orderQty <= 0 || (e.inst.LotSize > 0 && math.Mod(float64(orderQty), float64(e.inst.LotSize)) != 0) {
+		return swagger.Order{}, ErrInvalidOrderQty
+	}
+	if ordType == bitmex.ORD_TYPE_LIMIT && !e.validPrice(price) {
+		return swagger.Order{}, ErrInvalidPrice
+	}
+	if ordType == bitmex.ORD_TYPE_MARKET {
+		price = 0
+		if timeInForce == "" {
+			timeInForce = "ImmediateOrCancel"
+		}
+	}
+	if timeInForce == "" {
+		timeInForce = "GoodTillCancel"
+	}
+
+	e.seq++
+	o := &order{
+		Order: swagger.Order{
+			OrderID:      fmt.Sprintf("00000000-0000-4000-8000-%012d", e.seq),
+			Symbol:       symbol,
+			Side:         side,
+			OrderQty:     float32(orderQty),
+			Price:        price,
+			OrdType:      ordType,
+			TimeInForce:  timeInForce,
+			ExecInst:     execInst,
+			OrdStatus:    bitmex.OS_NEW,
+			LeavesQty:    float32(orderQty),
+			Text:         "backtest",
+			TransactTime: e.now,
+			Timestamp:    e.now,
+		},
+		seq: e.seq,
+	}
+	e.orders[o.OrderID] = o
+	e.all = append(e.all, o)
+	e.report.Orders++
+	e.report.OrderedQty += float64(orderQty)
+
+	e.schedule(&action{kind: actionPlace, o: o})
+	return o.Order, nil
+}
+
+// AmendOrder implements bitmex.Trader, a new price loses the queue position
+func (e *Engine) AmendOrder(oid string, price float64) (swagger.Order, error) {
+	o, ok := e.orders[oid]
+	if !ok {
+		return swagger.Order{}, bitmex.NotFound
+	}
+	if !o.open() || o.OrdType != bitmex.ORD_TYPE_LIMIT {
+		return swagger.Order{}, ErrInvalidOrdStatus
+	}
+	if !e.validPrice(price) {
+		return swagger.Order{}, ErrInvalidPrice
+	}
+	e.schedule(&action{kind: actionAmend, o: o, price: price})
+	result := o.Order
+	result.Price = price
+	return result, nil
+}
+
+// CancelOrder implements bitmex.Trader
+func (e *Engine) CancelOrder(oid string) (swagger.Order, error) {
+	o, ok := e.orders[oid]
+	if !ok {
+		return swagger.Order{}, bitmex.NotFound
+	}
+	if !o.open() {
+		return swagger.Order{}, ErrInvalidOrdStatus
+	}
+	e.schedule(&action{kind: actionCancel, o: o})
+	result := o.Order
+	result.OrdStatus = bitmex.OS_CANCELED
+	return result, nil
+}
+
+// CancelAllOrders implements bitmex.Trader
+func (e *Engine) CancelAllOrders(symbol string) ([]swagger.Order, error) {
+	var result []swagger.Order
+	for _, o := range e.all {
+		if !o.open() || (symbol != "" && o.Symbol != symbol) {
+			continue
+		}
+		e.schedule(&action{kind: actionCancel, o: o})
+		canceled := o.Order
+		canceled.OrdStatus = bitmex.OS_CANCELED
+		result = append(result, canceled)
+	}
+	return result, nil
+}
+
+// GetOrders implements bitmex.Trader, it returns open orders including those still in flight
+func (e *Engine) GetOrders(symbol string) ([]swagger.Order, error) {
+	var result []swagger.Order
+	for _, o := range e.all {
+		if o.open() && (symbol == "" || o.Symbol == symbol) {
+			result = append(result, o.Order)
+		}
+	}
+	return result, nil
+}
+
+// GetPosition implements bitmex.Trader, it returns bitmex.NotFound before the first fill
+func (e *Engine) GetPosition(symbol string) (swagger.Position, error) {
+	if symbol != e.inst.Symbol || !e.hasPosition {
+		return swagger.Position{}, bitmex.NotFound
+	}
+	mark := e.markPrice()
+	return swagger.Position{
+		Symbol:           symbol,
+		Currency:         e.inst.SettlCurrency,
+		Underlying:       e.inst.Underlying,
+		QuoteCurrency:    e.inst.QuoteCurrency,
+		Commission:       e.inst.TakerFee,
+		CurrentQty:       float32(e.pos.Qty),
+		AvgEntryPrice:    e.pos.AvgEntryPrice,
+		IsOpen:           e.pos.Qty != 0,
+		MarkPrice:        mark,
+		LastPrice:        e.lastPrice,
+		RealisedPnl:      float32(e.realised),
+		UnrealisedPnl:    float32(contract.PnL(&e.inst, e.pos.Qty, e.pos.AvgEntryPrice, mark)),
+		CurrentTimestamp: e.now,
+	}, nil
+}
+
+// Balance returns the wallet balance in XBt
+func (e *Engine) Balance() float64 {
+	return e.balance
+}
+
+func (e *Engine) validPrice(price float64) bool {
+	if price <= 0 {
+		return false
+	}
+	if e.inst.TickSize <= 0 {
+		return true
+	}
+	ticks := price / e.inst.TickSize
+	return math.Abs(ticks-math.Round(ticks)) < 1e-9
+}
+
+func (e *Engine) schedule(a *action) {
+	if e.cfg.Latency <= 0 {
+		e.run(a)
+		return
+	}
+	a.at = e.now.Add(e.cfg.Latency)
+	e.pending = append(e.pending, a)
+}
+
+func (e *Engine) run(a *action) {
+	o := a.o
+	if !o.open() {
+		return
+	}
+	switch a.kind {
+	case actionPlace:
+		e.execute(o)
+	case actionAmend:
+		o.Price = a.price
+		o.Timestamp = e.now
+		o.resting = false
+		e.markDirty(o)
+		e.execute(o)
+	case actionCancel:
+		e.cancel(o, "Canceled: Canceled via API.")
+	}
+}
+
+// execute takes liquidity if the order crosses the book, then rests the remainder
+func (e *Engine) execute(o *order) {
+	buy := o.Side == bitmex.SIDE_BUY
+	levels := e.ob.Asks
+	if !buy {
+		levels = e.ob.Bids
+	}
+	market := o.OrdType == bitmex.ORD_TYPE_MARKET
+	crosses := func(price float64) bool {
+		if market {
+			return true
+		}
+		if buy {
+			return price <= o.Price
+		}
+		return price >= o.Price
+	}
+
+	if len(levels) > 0 && crosses(levels[0].Price) {
+		if strings.Contains(o.ExecInst, "ParticipateDoNotInitiate") {
+			e.cancel(o, "Canceled: Order had execInst of ParticipateDoNotInitiate")
+			return
+		}
+		if o.TimeInForce == "FillOrKill" {
+			available := 0.0
+			for _, l := range levels {
+				if !crosses(l.Price) {
+					break
+				}
+				available += l.Amount
+			}
+			if available < float64(o.LeavesQty) {
+				e.cancel(o, "Canceled: Order had timeInForce of FillOrKill")
+				return
+			}
+		}
+		for _, l := range levels {
+			if o.LeavesQty <= 0 || !crosses(l.Price) {
+				break
+			}
+			e.fill(o, math.Min(float64(o.LeavesQty), l.Amount), l.Price, false)
+		}
+	}
+
+	if !o.open() {
+		return
+	}
+	if market || o.TimeInForce == "ImmediateOrCancel" || o.TimeInForce == "FillOrKill" {
+		e.cancel(o, "Canceled: Order had timeInForce of "+o.TimeInForce)
+		return
+	}
+	o.resting = true
+	o.WorkingIndicator = true
+	o.queueAhead = e.levelSize(o.Side, o.Price)
+	e.markDirty(o)
+}
+
+func (e *Engine) cancel(o *order, text string) {
+	o.OrdStatus = bitmex.OS_CANCELED
+	o.LeavesQty = 0
+	o.WorkingIndicator = false
+	o.resting = false
+	o.Text = text
+	o.Timestamp = e.now
+	e.report.CanceledOrders++
+	e.markDirty(o)
+}
+
+// levelSize returns the size resting at price on side
+func (e *Engine) levelSize(side string, price float64) float64 {
+	if side == bitmex.SIDE_BUY {
+		i := sort.Search(len(e.ob.Bids), func(i int) bool { return e.ob.Bids[i].Price <= price })
+		if i < len(e.ob.Bids) && e.ob.Bids[i].Price == price {
+			return e.ob.Bids[i].Amount
+		}
+		return 0
+	}
+	i := sort.Search(len(e.ob.Asks), func(i int) bool { return e.ob.Asks[i].Price >= price })
+	if i < len(e.ob.Asks) && e.ob.Asks[i].Price == price {
+		return e.ob.Asks[i].Amount
+	}
+	return 0
+}
+
+// resting returns the resting orders of side in price time priority
+func (e *Engine) resting(side string) []*order {
+	var result []*order
+	for _, o := range e.all {
+		if o.resting && o.open() && o.Side == side {
+			result = append(result, o)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Price != result[j].Price {
+			if side == bitmex.SIDE_BUY {
+				return result[i].Price > result[j].Price
+			}
+			return result[i].Price < result[j].Price
+		}
+		return result[i].seq < result[j].seq
+	})
+	return result
+}
+
+// matchBook shrinks the queue ahead when a level shrinks and fills orders the book moved through
+func (e *Engine) matchBook() {
+	for _, side := range []string{bitmex.SIDE_BUY, bitmex.SIDE_SELL} {
+		for _, o := range e.resting(side) {
+			if size := e.levelSize(o.Side, o.Price); size < o.queueAhead {
+				o.queueAhead = size
+			}
+			if side == bitmex.SIDE_BUY && len(e.ob.Asks) > 0 && e.ob.Ask() <= o.Price ||
+				side == bitmex.SIDE_SELL && len(e.ob.Bids) > 0 && e.ob.Bid() >= o.Price {
+				e.fill(o, float64(o.LeavesQty), o.Price, true)
+			}
+		}
+	}
+}
+
+// matchTrade fills resting orders on the passive side of a trade, orders at
+// the trade price only fill after the queue ahead of them has traded
+func (e *Engine) matchTrade(t *swagger.Trade) {
+	side := bitmex.SIDE_BUY
+	if t.Side == bitmex.SIDE_BUY {
+		side = bitmex.SIDE_SELL
+	}
+	remaining := float64(t.Size)
+	for _, o := range e.resting(side) {
+		through := side == bitmex.SIDE_BUY && o.Price > t.Price || side == bitmex.SIDE_SELL && o.Price < t.Price
+		if through {
+			e.fill(o, float64(o.LeavesQty), o.Price, true)
+			continue
+		}
+		if o.Price != t.Price || remaining <= 0 {
+			continue
+		}
+		ahead := math.Min(remaining, o.queueAhead)
+		o.queueAhead -= ahead
+		remaining -= ahead
+		qty := math.Min(float64(o.LeavesQty), remaining)
+		if qty > 0 {
+			e.fill(o, qty, o.Price, true)
+			remaining -= qty
+		}
+	}
+}
+
+func (e *Engine) fill(o *order, qty float64, price float64, maker bool) {
+	feeRate := e.inst.TakerFee
+	if maker {
+		feeRate = e.inst.MakerFee
+	}
+	value := contract.Value(&e.inst, qty, price)
+	commission := value * feeRate
+
+	cum := float64(o.CumQty)
+	o.AvgPx = (o.AvgPx*cum + price*qty) / (cum + qty)
+	o.CumQty += float32(qty)
+	o.LeavesQty -= float32(qty)
+	if o.LeavesQty <= 0 {
+		o.LeavesQty = 0
+		o.OrdStatus = bitmex.OS_FILLED
+		o.WorkingIndicator = false
+		o.resting = false
+		e.report.FilledOrders++
+	} else {
+		o.OrdStatus = bitmex.OS_PARTIALLY_FILLED
+	}
+	o.Timestamp = e.now
+	e.markDirty(o)
+
+	signed := qty
+	if o.Side == bitmex.SIDE_SELL {
+		signed = -qty
+	}
+	e.applyFill(signed, price)
+	e.balance -= commission
+
+	e.report.Executions++
+	e.report.FilledQty += qty
+	e.report.Volume += qty
+	e.report.Turnover += value
+	e.report.Fees += commission
+	if maker {
+		e.report.MakerQty += qty
+	}
+	e.recordEquity()
+}
+
+// applyFill updates the position and realises pnl of the closed part
+func (e *Engine) applyFill(signedQty float64, price float64) {
+	e.hasPosition = true
+	pnl := e.pos.Fill(&e.inst, signedQty, price)
+	e.realised += pnl
+	e.balance += pnl
+}
+
+func (e *Engine) applyFunding(f swagger.Funding) {
+	key := f.Timestamp.UnixNano()
+	if e.fundingApplied[key] {
+		return
+	}
+	e.fundingApplied[key] = true
+	if e.pos.Qty == 0 {
+		return
+	}
+	info := bitmex.FundingInfo{
+		Symbol:           e.inst.Symbol,
+		FundingRate:      f.FundingRate,
+		FundingTimestamp: f.Timestamp,
+		Multiplier:       float64(e.inst.Multiplier),
+		IsInverse:        e.inst.IsInverse,
+	}
+	p, err := info.ProjectFunding(e.pos.Qty, e.markPrice())
+	if err != nil {
+		return
+	}
+	e.balance += p.Payment
+	e.report.Funding += p.Payment
+	e.report.FundingPayments++
+	e.recordEquity()
+}
+
+func (e *Engine) markDirty(o *order) {
+	for _, v := range e.dirty {
+		if v == o {
+			return
+		}
+	}
+	e.dirty = append(e.dirty, o)
+}
+
+// flush delivers order updates, the strategy may cause more of them
+func (e *Engine) flush() {
+	for len(e.dirty) > 0 {
+		dirty := e.dirty
+		e.dirty = nil
+		updates := make([]*swagger.Order, 0, len(dirty))
+		for _, o := range dirty {
+			update := o.Order
+			updates = append(updates, &update)
+		}
+		e.strategy.OnOrderUpdate(updates)
+	}
+}
+
+func (e *Engine) markPrice() float64 {
+	if e.lastPrice > 0 {
+		return e.lastPrice
+	}
+	if e.ob.Valid() {
+		return (e.ob.Bid() + e.ob.Ask()) / 2
+	}
+	return 0
+}
+
+func (e *Engine) equity() float64 {
+	return e.balance + contract.PnL(&e.inst, e.pos.Qty, e.pos.AvgEntryPrice, e.markPrice())
+}
+
+func (e *Engine) recordEquity() {
+	equity := e.equity()
+	e.report.Equity = append(e.report.Equity, EquityPoint{
+		Time:     e.now,
+		Equity:   equity,
+		Position: e.pos.Qty,
+	})
+	if equity > e.peak {
+		e.peak = equity
+	}
+	if dd := e.peak - equity; dd > e.report.MaxDrawdown {
+		e.report.MaxDrawdown = dd
+		e.report.MaxDrawdownPercent = dd / e.peak * 100
+	}
+}
+
+func (e *Engine) finish() {
+	e.recordEquity()
+	r := &e.report
+	r.End = e.now
+	r.FinalEquity = e.equity()
+	r.PnL = r.FinalEquity - r.InitialBalance
+	r.RealisedPnl = e.realised
+	r.UnrealisedPnl = contract.PnL(&e.inst, e.pos.Qty, e.pos.AvgEntryPrice, e.markPrice())
+	r.Position = e.pos.Qty
+	if r.OrderedQty > 0 {
+		r.FillRatio = r.FilledQty / r.OrderedQty
+	}
+}
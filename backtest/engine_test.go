@@ -0,0 +1,287 @@
+package backtest
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+var t0 = time.Date(2019, 4, 9, 8, 0, 0, 0, time.UTC)
+
+// testStrategy calls the hooks it has
+type testStrategy struct {
+	onBook  func(ob bitmex.OrderBook)
+	onTrade func(trades []*swagger.Trade)
+	onTimer func(now time.Time)
+	updates []swagger.Order
+}
+
+func (s *testStrategy) OnTrade(trades []*swagger.Trade) {
+	if s.onTrade != nil {
+		s.onTrade(trades)
+	}
+}
+
+func (s *testStrategy) OnBook(symbol string, ob bitmex.OrderBook) {
+	if s.onBook != nil {
+		s.onBook(ob)
+	}
+}
+
+func (s *testStrategy) OnOrderUpdate(orders []*swagger.Order) {
+	for _, o := range orders {
+		s.updates = append(s.updates, *o)
+	}
+}
+
+func (s *testStrategy) OnTimer(now time.Time) {
+	if s.onTimer != nil {
+		s.onTimer(now)
+	}
+}
+
+func bookEvent(at time.Duration, bid float64, bidSize int64, ask float64, askSize int64) Event {
+	return Event{
+		Time:   t0.Add(at),
+		Table:  bitmex.BitmexWSOrderBookL2,
+		Action: "partial",
+		Book: []*bitmex.OrderBookL2{
+			{ID: 1, Symbol: "XBTUSD", Side: bitmex.SIDE_BUY, Price: bid, Size: bidSize},
+			{ID: 2, Symbol: "XBTUSD", Side: bitmex.SIDE_SELL, Price: ask, Size: askSize},
+		},
+	}
+}
+
+func tradeEvent(at time.Duration, side string, size float32, price float64) Event {
+	return Event{
+		Time:   t0.Add(at),
+		Table:  bitmex.BitmexWSTrade,
+		Trades: []*swagger.Trade{{Timestamp: t0.Add(at), Symbol: "XBTUSD", Side: side, Size: size, Price: price}},
+	}
+}
+
+func TestEngine_QueuePosition(t *testing.T) {
+	e := New(Config{})
+	s := &testStrategy{}
+	placed := false
+	s.onBook = func(ob bitmex.OrderBook) {
+		if placed {
+			return
+		}
+		placed = true
+		if _, err := e.PlaceOrder(bitmex.SIDE_BUY, bitmex.ORD_TYPE_LIMIT, 0, ob.Bid(), 10, "", "ParticipateDoNotInitiate", "XBTUSD"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := e.Run(NewSliceSource([]Event{
+		bookEvent(0, 9000, 100, 9000.5, 100),
+		tradeEvent(time.Second, bitmex.SIDE_SELL, 50, 9000),
+		// the level shrinks to 40, at most 40 ahead of us
+		bookEvent(2*time.Second, 9000, 40, 9000.5, 100),
+		tradeEvent(3*time.Second, bitmex.SIDE_SELL, 50, 9000),
+	}), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.FilledOrders != 1 || report.MakerQty != 10 || report.Position != 10 {
+		t.Fatalf("fill error %+v", report)
+	}
+	if report.Fees >= 0 {
+		t.Errorf("expect maker rebate, fees %v", report.Fees)
+	}
+	last := s.updates[len(s.updates)-1]
+	if last.OrdStatus != bitmex.OS_FILLED || last.AvgPx != 9000 {
+		t.Errorf("order update error %#v", last)
+	}
+	if report.FillRatio != 1 {
+		t.Errorf("fill ratio %v", report.FillRatio)
+	}
+}
+
+func TestEngine_QueueNotReached(t *testing.T) {
+	e := New(Config{})
+	s := &testStrategy{}
+	s.onBook = func(ob bitmex.OrderBook) {
+		if len(s.updates) == 0 {
+			e.PlaceOrder(bitmex.SIDE_BUY, bitmex.ORD_TYPE_LIMIT, 0, ob.Bid(), 10, "", "", "XBTUSD")
+		}
+	}
+	report, err := e.Run(NewSliceSource([]Event{
+		bookEvent(0, 9000, 100, 9000.5, 100),
+		tradeEvent(time.Second, bitmex.SIDE_SELL, 95, 9000),
+	}), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Executions != 0 {
+		t.Errorf("filled ahead of the queue %+v", report)
+	}
+	orders, _ := e.GetOrders("XBTUSD")
+	if len(orders) != 1 {
+		t.Errorf("open orders %v", orders)
+	}
+	if _, err = e.GetPosition("XBTUSD"); err != bitmex.NotFound {
+		t.Errorf("expect NotFound, got %v", err)
+	}
+}
+
+func TestEngine_TakerAndLatency(t *testing.T) {
+	e := New(Config{Latency: 100 * time.Millisecond})
+	s := &testStrategy{}
+	s.onBook = func(ob bitmex.OrderBook) {
+		if len(s.updates) == 0 && e.Now().Equal(t0) {
+			e.PlaceOrder(bitmex.SIDE_BUY, bitmex.ORD_TYPE_MARKET, 0, 0, 20, "", "", "XBTUSD")
+		}
+	}
+	report, err := e.Run(NewSliceSource([]Event{
+		bookEvent(0, 9000, 100, 9000.5, 10),
+		// the ask moves before the order arrives
+		bookEvent(50*time.Millisecond, 9000, 100, 9001, 15),
+		tradeEvent(time.Second, bitmex.SIDE_BUY, 1, 9001.5),
+	}), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Position != 15 || report.FilledQty != 15 {
+		t.Fatalf("taker fill error %+v", report)
+	}
+	last := s.updates[len(s.updates)-1]
+	if last.OrdStatus != bitmex.OS_CANCELED || last.AvgPx != 9001 || !last.Timestamp.Equal(t0.Add(100*time.Millisecond)) {
+		t.Errorf("market order error %#v", last)
+	}
+	wantFee := 15 * 1e8 / 9001 * 0.00075
+	if math.Abs(report.Fees-wantFee) > 1e-6 {
+		t.Errorf("fees %v want %v", report.Fees, wantFee)
+	}
+	// marked at 9001.5
+	if report.UnrealisedPnl <= 0 || math.Abs(report.PnL-(report.UnrealisedPnl-report.Fees)) > 1e-6 {
+		t.Errorf("pnl error %+v", report)
+	}
+}
+
+func TestEngine_FundingAndTimer(t *testing.T) {
+	e := New(Config{
+		TimerInterval: time.Hour,
+		Funding:       []swagger.Funding{{Timestamp: t0.Add(4 * time.Hour), Symbol: "XBTUSD", FundingRate: 0.0001}},
+	})
+	s := &testStrategy{}
+	timers := 0
+	s.onTimer = func(now time.Time) {
+		timers++
+		if timers == 1 {
+			e.PlaceOrder(bitmex.SIDE_BUY, bitmex.ORD_TYPE_MARKET, 0, 0, 1000, "", "", "XBTUSD")
+		}
+	}
+	report, err := e.Run(NewSliceSource([]Event{
+		bookEvent(0, 10000, 10000, 10000.5, 10000),
+		tradeEvent(5*time.Hour+time.Minute, bitmex.SIDE_SELL, 1, 10000),
+	}), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timers != 5 {
+		t.Errorf("timers %v", timers)
+	}
+	// long pays about 1000 * 1e8 / 10000 * 0.0001, marked at the mid price
+	if report.FundingPayments != 1 || math.Abs(report.Funding+1000) > 0.1 {
+		t.Errorf("funding error %v %v", report.FundingPayments, report.Funding)
+	}
+	if report.MaxDrawdown <= 0 {
+		t.Errorf("drawdown error %+v", report)
+	}
+}
+
+func TestEngine_PostOnlyAndCancel(t *testing.T) {
+	e := New(Config{})
+	s := &testStrategy{}
+	var resting swagger.Order
+	s.onBook = func(ob bitmex.OrderBook) {
+		if len(s.updates) > 0 {
+			return
+		}
+		// crosses the book
+		e.PlaceOrder(bitmex.SIDE_BUY, bitmex.ORD_TYPE_LIMIT, 0, ob.Ask(), 10, "", "ParticipateDoNotInitiate", "XBTUSD")
+		resting, _ = e.PlaceOrder(bitmex.SIDE_SELL, bitmex.ORD_TYPE_LIMIT, 0, ob.Ask()+10, 10, "", "", "XBTUSD")
+	}
+	s.onTrade = func(trades []*swagger.Trade) {
+		if _, err := e.CancelOrder(resting.OrderID); err != nil {
+			t.Error(err)
+		}
+	}
+	report, err := e.Run(NewSliceSource([]Event{
+		bookEvent(0, 9000, 100, 9000.5, 100),
+		tradeEvent(time.Second, bitmex.SIDE_BUY, 5, 9000.5),
+	}), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Executions != 0 || report.CanceledOrders != 2 {
+		t.Errorf("report error %+v", report)
+	}
+	if _, err = e.PlaceOrder(bitmex.SIDE_BUY, bitmex.ORD_TYPE_LIMIT, 0, 9000.3, 10, "", "", "XBTUSD"); err != ErrInvalidPrice {
+		t.Errorf("expect tick size error, got %v", err)
+	}
+}
+
+func TestRecordingSource(t *testing.T) {
+	var buf bytes.Buffer
+	r := bitmex.NewRecorder(&buf)
+	r.Record(t0, []byte(`{"success":true,"subscribe":"trade:XBTUSD"}`))
+	r.Record(t0, []byte(`{"table":"orderBookL2","action":"partial","data":[{"symbol":"XBTUSD","id":1,"side":"Buy","size":100,"price":9000},{"symbol":"XBTUSD","id":2,"side":"Sell","size":100,"price":9000.5}]}`))
+	r.Record(t0.Add(time.Second), []byte(`{"table":"trade","action":"insert","data":[{"symbol":"XBTUSD","side":"Sell","size":200,"price":9000}]}`))
+	r.Record(t0.Add(time.Second), []byte("pong"))
+	r.Close()
+
+	src, err := NewRecordingSource(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	e := New(Config{})
+	s := &testStrategy{}
+	s.onBook = func(ob bitmex.OrderBook) {
+		e.PlaceOrder(bitmex.SIDE_BUY, bitmex.ORD_TYPE_LIMIT, 0, ob.Bid(), 10, "", "", "XBTUSD")
+	}
+	report, err := e.Run(src, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilledQty != 10 || !report.End.Equal(t0.Add(time.Second)) {
+		t.Errorf("report error %+v", report)
+	}
+}
+
+func TestTradeBinSource(t *testing.T) {
+	bins := []swagger.TradeBin{
+		{Timestamp: t0.Add(time.Minute), Symbol: "XBTUSD", Open: 9000, High: 9010, Low: 8990, Close: 9005, Volume: 4000},
+		{Timestamp: t0.Add(2 * time.Minute), Symbol: "XBTUSD", Open: 9005, High: 9006, Low: 8980, Close: 8985, Volume: 4000},
+	}
+	e := New(Config{})
+	s := &testStrategy{}
+	trades := 0
+	s.onTrade = func(m []*swagger.Trade) {
+		trades++
+		if trades == 1 {
+			e.PlaceOrder(bitmex.SIDE_BUY, bitmex.ORD_TYPE_LIMIT, 0, 8995, 10, "", "", "XBTUSD")
+		}
+	}
+	report, err := e.Run(NewTradeBinSource(bins, time.Minute, 0.5), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trades != 8 {
+		t.Errorf("trades %v", trades)
+	}
+	// the first bin trades through 8995 on its way to the low
+	if report.Position != 10 {
+		t.Errorf("position %v", report.Position)
+	}
+	t.Log(report)
+}
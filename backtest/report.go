@@ -0,0 +1,62 @@
+package backtest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EquityPoint is a sample of the equity curve, taken on every timer, fill and funding payment
+type EquityPoint struct {
+	Time     time.Time
+	Equity   float64 // wallet balance plus unrealised pnl in XBt
+	Position float64 // contracts
+}
+
+// Report summarises a backtest, amounts are in XBt
+type Report struct {
+	Start time.Time
+	End   time.Time
+
+	InitialBalance float64
+	FinalEquity    float64
+	PnL            float64 // FinalEquity - InitialBalance
+	RealisedPnl    float64
+	UnrealisedPnl  float64
+	Fees           float64 // paid, negative for net maker rebates
+	Funding        float64 // received, negative when paid
+	Position       float64 // contracts at the end
+
+	MaxDrawdown        float64
+	MaxDrawdownPercent float64
+
+	Orders          int
+	FilledOrders    int
+	CanceledOrders  int
+	Executions      int
+	FundingPayments int
+	OrderedQty      float64
+	FilledQty       float64
+	MakerQty        float64
+	FillRatio       float64 // FilledQty / OrderedQty
+	Volume          float64 // contracts traded
+	Turnover        float64 // value traded
+
+	Equity []EquityPoint
+}
+
+// String formats the summary, without the equity curve
+func (r *Report) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Period:        %v - %v\n", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339))
+	fmt.Fprintf(&sb, "PnL:           %.0f (%.4f%%)\n", r.PnL, r.PnL/r.InitialBalance*100)
+	fmt.Fprintf(&sb, "Realised PnL:  %.0f\n", r.RealisedPnl)
+	fmt.Fprintf(&sb, "Fees:          %.0f\n", r.Fees)
+	fmt.Fprintf(&sb, "Funding:       %.0f (%d payments)\n", r.Funding, r.FundingPayments)
+	fmt.Fprintf(&sb, "Max drawdown:  %.0f (%.4f%%)\n", r.MaxDrawdown, r.MaxDrawdownPercent)
+	fmt.Fprintf(&sb, "Orders:        %d, %d filled, %d canceled\n", r.Orders, r.FilledOrders, r.CanceledOrders)
+	fmt.Fprintf(&sb, "Fill ratio:    %.4f\n", r.FillRatio)
+	fmt.Fprintf(&sb, "Volume:        %.0f contracts, %.0f maker\n", r.Volume, r.MakerQty)
+	fmt.Fprintf(&sb, "Turnover:      %.0f\n", r.Turnover)
+	return sb.String()
+}
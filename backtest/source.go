@@ -0,0 +1,164 @@
+package backtest
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// Event is one market data update
+type Event struct {
+	Time    time.Time
+	Table   string // bitmex.BitmexWSTrade, bitmex.BitmexWSOrderBookL2 or bitmex.BitmexWSFunding
+	Action  string // partial, insert, update or delete for order book events
+	Trades  []*swagger.Trade
+	Book    []*bitmex.OrderBookL2
+	Funding []*swagger.Funding
+}
+
+// Source yields events in time order, Next returns io.EOF at the end
+type Source interface {
+	Next() (Event, error)
+}
+
+// SliceSource replays events from memory
+type SliceSource struct {
+	events []Event
+	i      int
+}
+
+// NewSliceSource sorts events by time
+func NewSliceSource(events []Event) *SliceSource {
+	sorted := make([]Event, len(events))
+	copy(sorted, events)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.Before(sorted[j].Time)
+	})
+	return &SliceSource{events: sorted}
+}
+
+// Next implements Source
+func (s *SliceSource) Next() (Event, error) {
+	if s.i >= len(s.events) {
+		return Event{}, io.EOF
+	}
+	s.i++
+	return s.events[s.i-1], nil
+}
+
+// RecordingSource reads trade, orderBookL2, orderBookL2_25 and funding frames
+// from a recording made with bitmex.Recorder, using the receive time of each frame
+type RecordingSource struct {
+	fr *bitmex.FrameReader
+}
+
+// NewRecordingSource reads a gzip compressed recording from r
+func NewRecordingSource(r io.Reader) (*RecordingSource, error) {
+	fr, err := bitmex.NewFrameReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordingSource{fr: fr}, nil
+}
+
+// Next implements Source
+func (s *RecordingSource) Next() (Event, error) {
+	for {
+		frame, err := s.fr.Next()
+		if err != nil {
+			return Event{}, err
+		}
+		var msg struct {
+			Table  string          `json:"table"`
+			Action string          `json:"action"`
+			Data   json.RawMessage `json:"data"`
+		}
+		if json.Unmarshal([]byte(frame.Message), &msg) != nil {
+			// pong and other non json frames
+			continue
+		}
+
+		ev := Event{Time: frame.Time, Action: msg.Action}
+		switch msg.Table {
+		case bitmex.BitmexWSTrade:
+			ev.Table = bitmex.BitmexWSTrade
+			err = json.Unmarshal(msg.Data, &ev.Trades)
+		case bitmex.BitmexWSOrderBookL2, bitmex.BitmexWSOrderBookL2_25:
+			ev.Table = bitmex.BitmexWSOrderBookL2
+			err = json.Unmarshal(msg.Data, &ev.Book)
+		case bitmex.BitmexWSFunding:
+			ev.Table = bitmex.BitmexWSFunding
+			err = json.Unmarshal(msg.Data, &ev.Funding)
+		default:
+			continue
+		}
+		if err != nil {
+			return Event{}, err
+		}
+		return ev, nil
+	}
+}
+
+// Close releases the recording reader
+func (s *RecordingSource) Close() error {
+	return s.fr.Close()
+}
+
+// NewTradeBinSource turns downloaded TradeBins into events. Each bin becomes four
+// trades walking open, high/low, low/high and close, each preceded by a one
+// level book around the trade price. BitMEX timestamps a bin at its end.
+func NewTradeBinSource(bins []swagger.TradeBin, binSize time.Duration, tickSize float64) *SliceSource {
+	if tickSize <= 0 {
+		tickSize = 0.5
+	}
+	var events []Event
+	for _, bin := range bins {
+		path := []float64{bin.Open, bin.High, bin.Low, bin.Close}
+		if bin.Close < bin.Open {
+			path = []float64{bin.Open, bin.Low, bin.High, bin.Close}
+		}
+		size := float32(math.Max(1, math.Floor(float64(bin.Volume)/4)))
+		start := bin.Timestamp.Add(-binSize)
+		last := bin.Open
+		for i, price := range path {
+			t := start.Add(time.Duration(i+1) * binSize / 4)
+			side := bitmex.SIDE_BUY
+			if price < last || (i == 0 && bin.Close < bin.Open) {
+				side = bitmex.SIDE_SELL
+			}
+			last = price
+
+			bid := math.Floor(price/tickSize) * tickSize
+			if side == bitmex.SIDE_BUY && bid == price {
+				// the buyer lifted the ask at price
+				bid -= tickSize
+			}
+			levelSize := int64(size)
+			events = append(events, Event{
+				Time:   t,
+				Table:  bitmex.BitmexWSOrderBookL2,
+				Action: "partial",
+				Book: []*bitmex.OrderBookL2{
+					{ID: 1, Symbol: bin.Symbol, Side: bitmex.SIDE_BUY, Price: bid, Size: levelSize},
+					{ID: 2, Symbol: bin.Symbol, Side: bitmex.SIDE_SELL, Price: bid + tickSize, Size: levelSize},
+				},
+			}, Event{
+				Time:  t,
+				Table: bitmex.BitmexWSTrade,
+				Trades: []*swagger.Trade{{
+					Timestamp: t,
+					Symbol:    bin.Symbol,
+					Side:      side,
+					Size:      size,
+					Price:     price,
+				}},
+			})
+		}
+	}
+	return NewSliceSource(events)
+}
@@ -0,0 +1,133 @@
+package bitmextest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// /realtimemd envelopes are [type, id, topic, payload]
+const (
+	mdMessage     = 0
+	mdSubscribe   = 1
+	mdUnsubscribe = 2
+)
+
+// mdStream writes to one stream of a multiplexed connection
+type mdStream struct {
+	c     *wsConn
+	id    string
+	topic string
+}
+
+func (s mdStream) write(frame string) error {
+	id, _ := json.Marshal(s.id)
+	topic, _ := json.Marshal(s.topic)
+	return s.c.write(fmt.Sprintf("[%d,%s,%s,%s]", mdMessage, id, topic, frame))
+}
+
+// PushStream sends a frame to the multiplexed streams with id
+func (s *Server) PushStream(id string, frame string) {
+	for _, st := range s.ws.streamSnapshot(id) {
+		st.write(frame)
+	}
+}
+
+// Streams returns the ids of the open multiplexed streams
+func (s *Server) Streams() []string {
+	var ids []string
+	for _, st := range s.ws.streamSnapshot("") {
+		ids = append(ids, st.id)
+	}
+	return ids
+}
+
+// streamSnapshot returns the streams with id, or all of them for ""
+func (ws *wsServer) streamSnapshot(id string) []mdStream {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	var streams []mdStream
+	for c := range ws.conns {
+		for sid, topic := range c.streams {
+			if id == "" || sid == id {
+				streams = append(streams, mdStream{c: c, id: sid, topic: topic})
+			}
+		}
+	}
+	return streams
+}
+
+// serveMD is /realtimemd, every stream behaves like a /realtime connection
+func (ws *wsServer) serveMD(w http.ResponseWriter, r *http.Request) {
+	conn, err := ws.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &wsConn{conn: conn, streams: make(map[string]string)}
+	ws.mu.Lock()
+	ws.conns[c] = struct{}{}
+	ws.dials++
+	ws.mu.Unlock()
+
+	defer func() {
+		ws.mu.Lock()
+		delete(ws.conns, c)
+		ws.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if string(message) == "ping" {
+			ws.ping(c)
+			continue
+		}
+		ws.mu.Lock()
+		ws.received = append(ws.received, string(message))
+		ws.mu.Unlock()
+		select {
+		case ws.notify <- struct{}{}:
+		default:
+		}
+
+		var envelope []json.RawMessage
+		var typ int
+		var st mdStream
+		if json.Unmarshal(message, &envelope) != nil || len(envelope) < 3 ||
+			json.Unmarshal(envelope[0], &typ) != nil ||
+			json.Unmarshal(envelope[1], &st.id) != nil ||
+			json.Unmarshal(envelope[2], &st.topic) != nil {
+			c.write(`{"status":400,"error":"Unable to parse request"}`)
+			continue
+		}
+		st.c = c
+
+		switch typ {
+		case mdSubscribe:
+			ws.mu.Lock()
+			c.streams[st.id] = st.topic
+			ws.mu.Unlock()
+			st.write(`{"info":"Welcome to the BitMEX Realtime API.","version":"bitmextest","limit":{"remaining":39}}`)
+			for _, f := range ws.frames(ScriptOnConnect) {
+				st.write(f)
+			}
+		case mdUnsubscribe:
+			ws.mu.Lock()
+			delete(c.streams, st.id)
+			ws.mu.Unlock()
+		case mdMessage:
+			ws.mu.Lock()
+			_, open := c.streams[st.id]
+			ws.mu.Unlock()
+			if !open || len(envelope) < 4 {
+				c.write(fmt.Sprintf(`{"status":400,"error":"Stream %v is not open"}`, st.id))
+				continue
+			}
+			ws.handle(st, envelope[3])
+		}
+	}
+}
@@ -0,0 +1,367 @@
+// Package bitmextest provides a fake BitMEX rest and realtime server for tests.
+//
+// Responses and websocket frames are scripted with fixtures, authenticated
+// requests are checked against the api-signature headers, and every request
+// is recorded so tests can assert on what the client sent.
+package bitmextest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// Request is a recorded rest request
+type Request struct {
+	Method string
+	Path   string // e.g. /api/v1/order
+	Query  url.Values
+	Header http.Header
+	Body   string
+	Proto  string // e.g. HTTP/1.1
+	Resume bool   // a TLS session was resumed, see NewTLSServer
+}
+
+// Params returns the query merged with the json body the swagger client sends
+func (r Request) Params() map[string]string {
+	params := make(map[string]string)
+	for k, v := range r.Query {
+		if len(v) > 0 {
+			params[k] = v[0]
+		}
+	}
+	var body map[string]interface{}
+	if json.Unmarshal([]byte(r.Body), &body) == nil {
+		for k, v := range body {
+			if s, ok := v.(string); ok {
+				params[k] = s
+			} else {
+				params[k] = fmt.Sprint(v)
+			}
+		}
+	}
+	return params
+}
+
+// ResponderFunc builds the status and body of a scripted route
+type ResponderFunc func(req Request) (status int, body interface{})
+
+// Route is a scripted rest response
+type Route struct {
+	Method  string
+	Path    string // relative to /api/v1, e.g. /order
+	private bool
+	respond ResponderFunc
+	hits    int64 // atomic, read by tests while requests are served
+}
+
+// Private requires a valid api-key signature for the route
+func (r *Route) Private() *Route {
+	r.private = true
+	return r
+}
+
+// Hits returns how many requests the route answered
+func (r *Route) Hits() int {
+	return int(atomic.LoadInt64(&r.hits))
+}
+
+// Server is a fake BitMEX server
+type Server struct {
+	*httptest.Server
+
+	BasePath string // e.g. http://127.0.0.1:1234/api/v1
+	WSURL    string // e.g. ws://127.0.0.1:1234/realtime
+	MDURL    string // e.g. ws://127.0.0.1:1234/realtimemd, the multiplexed endpoint
+
+	mu         sync.Mutex
+	key        string
+	secret     string
+	routes     []*Route
+	requests   []Request
+	authErrors []string
+	rateLimit  [3]int64 // limit, remaining, reset
+	clock      time.Duration
+	conns      int
+
+	ws *wsServer
+}
+
+// NewServer starts a fake server, Close it when done
+func NewServer() *Server {
+	return newServer(false)
+}
+
+// NewTLSServer starts a fake server on https and wss, Client().Transport
+// trusts its certificate
+func NewTLSServer() *Server {
+	return newServer(true)
+}
+
+func newServer(tls bool) *Server {
+	s := &Server{rateLimit: [3]int64{60, 59, 0}}
+	s.ws = newWSServer(s)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realtime", s.ws.serve)
+	mux.HandleFunc("/realtimemd", s.ws.serveMD)
+	mux.HandleFunc("/api/v1", s.serveREST)
+	mux.HandleFunc("/api/v1/", s.serveREST)
+	s.Server = httptest.NewUnstartedServer(mux)
+	s.Server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+		}
+	}
+	ws := "ws://"
+	if tls {
+		s.Server.StartTLS()
+		ws = "wss://"
+	} else {
+		s.Server.Start()
+	}
+
+	host := s.Server.Listener.Addr().String()
+	s.BasePath = s.Server.URL + "/api/v1"
+	s.WSURL = ws + host + "/realtime"
+	s.MDURL = ws + host + "/realtimemd"
+	return s
+}
+
+// Conns returns how many connections were accepted
+func (s *Server) Conns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+// Close disconnects websocket clients and shuts the server down
+func (s *Server) Close() {
+	s.ws.close()
+	s.Server.Close()
+}
+
+// RequireAuth makes private routes and websocket authKey verify signatures made with key and secret
+func (s *Server) RequireAuth(key string, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.key = key
+	s.secret = secret
+}
+
+// SetClockOffset makes the server clock run ahead by offset, or behind when
+// negative. It shows in the version timestamp, the Date header and the expiry checks.
+func (s *Server) SetClockOffset(offset time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clock = offset
+}
+
+func (s *Server) now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Add(s.clock)
+}
+
+// SetRateLimit sets the X-Ratelimit-* headers of every response
+func (s *Server) SetRateLimit(limit int64, remaining int64, reset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rateLimit = [3]int64{limit, remaining, reset}
+}
+
+// HandleFunc scripts a route answered by fn, later routes take precedence
+func (s *Server) HandleFunc(method string, path string, fn ResponderFunc) *Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := &Route{Method: strings.ToUpper(method), Path: path, respond: fn}
+	s.routes = append(s.routes, r)
+	return r
+}
+
+// Handle scripts a fixed response, body is marshalled unless it is a string or []byte
+func (s *Server) Handle(method string, path string, status int, body interface{}) *Route {
+	return s.HandleFunc(method, path, func(Request) (int, interface{}) {
+		return status, body
+	})
+}
+
+// HandleFile scripts a response read from a json fixture file
+func (s *Server) HandleFile(method string, path string, status int, filename string) (*Route, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return s.Handle(method, path, status, data), nil
+}
+
+// HandleError scripts a BitMEX error response
+func (s *Server) HandleError(method string, path string, status int, name string, message string) *Route {
+	return s.Handle(method, path, status, swagger.ModelError{
+		Error_: &swagger.ErrorError{Name: name, Message: message},
+	})
+}
+
+// Requests returns the recorded rest requests
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]Request, len(s.requests))
+	copy(result, s.requests)
+	return result
+}
+
+// LastRequest returns the latest recorded request of method and path
+func (s *Server) LastRequest(method string, path string) (req Request, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.requests) - 1; i >= 0; i-- {
+		r := s.requests[i]
+		if r.Method == strings.ToUpper(method) && r.Path == "/api/v1"+path {
+			return r, true
+		}
+	}
+	return
+}
+
+// AuthErrors returns why signed requests were rejected
+func (s *Server) AuthErrors() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result := make([]string, len(s.authErrors))
+	copy(result, s.authErrors)
+	return result
+}
+
+func (s *Server) addAuthError(format string, a ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.authErrors = append(s.authErrors, fmt.Sprintf(format, a...))
+}
+
+func (s *Server) findRoute(method string, path string) *Route {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.routes) - 1; i >= 0; i-- {
+		r := s.routes[i]
+		if r.Method == method && r.Path == path {
+			atomic.AddInt64(&r.hits, 1)
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *Server) credentials() (key string, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.key, s.secret
+}
+
+// verify checks api-key, api-expires and api-signature like BitMEX does
+func (s *Server) verify(r *http.Request, body string) bool {
+	key, secret := s.credentials()
+	if secret == "" {
+		return true
+	}
+	if r.Header.Get("api-key") != key {
+		s.addAuthError("invalid api-key %q", r.Header.Get("api-key"))
+		return false
+	}
+	switch swagger.VerifyRequest(r, secret, body, s.now()) {
+	case nil:
+	case swagger.ErrRequestExpired:
+		s.addAuthError("request expired, api-expires %q", r.Header.Get("api-expires"))
+		return false
+	default:
+		s.addAuthError("invalid api-signature for %v %v", r.Method, r.URL.RequestURI())
+		return false
+	}
+	return true
+}
+
+func (s *Server) serveREST(w http.ResponseWriter, r *http.Request) {
+	data, _ := ioutil.ReadAll(r.Body)
+	req := Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.Query(),
+		Header: r.Header.Clone(),
+		Body:   string(data),
+		Proto:  r.Proto,
+		Resume: r.TLS != nil && r.TLS.DidResume,
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	rateLimit := s.rateLimit
+	s.mu.Unlock()
+
+	now := s.now()
+	w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Ratelimit-Limit", strconv.FormatInt(rateLimit[0], 10))
+	w.Header().Set("X-Ratelimit-Remaining", strconv.FormatInt(rateLimit[1], 10))
+	w.Header().Set("X-Ratelimit-Reset", strconv.FormatInt(rateLimit[2], 10))
+
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1")
+	route := s.findRoute(r.Method, path)
+	if route == nil {
+		if path == "" || path == "/" {
+			writeBody(w, http.StatusOK, map[string]interface{}{
+				"name":      "BitMEX API",
+				"version":   "1.2.0",
+				"timestamp": now.UnixNano() / int64(time.Millisecond),
+			})
+			return
+		}
+		writeBody(w, http.StatusNotFound, swagger.ModelError{
+			Error_: &swagger.ErrorError{Name: "HTTPError", Message: "Not Found"},
+		})
+		return
+	}
+	if route.private && !s.verify(r, req.Body) {
+		writeBody(w, http.StatusUnauthorized, swagger.ModelError{
+			Error_: &swagger.ErrorError{Name: "HTTPError", Message: "Signature not valid."},
+		})
+		return
+	}
+	status, body := route.respond(req)
+	writeBody(w, status, body)
+}
+
+func writeBody(w http.ResponseWriter, status int, body interface{}) {
+	w.WriteHeader(status)
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		w.Write(b)
+	case string:
+		w.Write([]byte(b))
+	case json.RawMessage:
+		w.Write(b)
+	default:
+		json.NewEncoder(w).Encode(b)
+	}
+}
@@ -0,0 +1,381 @@
+package bitmextest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// ScriptOnConnect frames are sent right after a client connects
+	ScriptOnConnect = "connect"
+	// ScriptOnAuth frames are sent after a successful authKeyExpires
+	ScriptOnAuth = "auth"
+)
+
+// ScriptOnSubscribe returns the script trigger of a subscription topic, e.g. orderBookL2:XBTUSD
+func ScriptOnSubscribe(topic string) string {
+	return "subscribe:" + topic
+}
+
+// frameWriter is a connection, or a stream of a multiplexed one
+type frameWriter interface {
+	write(frame string) error
+}
+
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+
+	streams map[string]string // id: topic, on /realtimemd; guarded by wsServer.mu
+}
+
+func (c *wsConn) write(frame string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(frame))
+}
+
+type wsServer struct {
+	s        *Server
+	upgrader websocket.Upgrader
+
+	mu       sync.Mutex
+	conns    map[*wsConn]struct{}
+	scripts  map[string][]string // key: trigger
+	received []string
+	dials    int
+	commands map[string]CommandFunc // key: op
+	pings    int
+	silent   bool // no pongs
+	notify   chan struct{}
+}
+
+func newWSServer(s *Server) *wsServer {
+	return &wsServer{
+		s: s,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		conns:    make(map[*wsConn]struct{}),
+		scripts:  make(map[string][]string),
+		commands: make(map[string]CommandFunc),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// IgnorePings stops answering "ping", like a half open connection would
+func (s *Server) IgnorePings(ignore bool) {
+	s.ws.mu.Lock()
+	defer s.ws.mu.Unlock()
+
+	s.ws.silent = ignore
+}
+
+// Pings returns the number of "ping" received
+func (s *Server) Pings() int {
+	s.ws.mu.Lock()
+	defer s.ws.mu.Unlock()
+
+	return s.ws.pings
+}
+
+func (ws *wsServer) ping(c frameWriter) {
+	ws.mu.Lock()
+	ws.pings++
+	silent := ws.silent
+	ws.mu.Unlock()
+	if !silent {
+		c.write("pong")
+	}
+}
+
+// CommandFunc answers a realtime command, data is sent back with the request
+type CommandFunc func(args []interface{}) (data interface{}, err error)
+
+// HandleCommand makes the realtime api support op, BitMEX answers any
+// command but auth and (un)subscribe with "Unknown or unsupported command"
+func (s *Server) HandleCommand(op string, fn CommandFunc) {
+	s.ws.mu.Lock()
+	defer s.ws.mu.Unlock()
+
+	s.ws.commands[op] = fn
+}
+
+func (ws *wsServer) command(op string) CommandFunc {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.commands[op]
+}
+
+// Script queues frames to send when trigger happens,
+// trigger is ScriptOnConnect, ScriptOnAuth or ScriptOnSubscribe(topic)
+func (s *Server) Script(trigger string, frames ...string) {
+	s.ws.mu.Lock()
+	defer s.ws.mu.Unlock()
+
+	s.ws.scripts[trigger] = append(s.ws.scripts[trigger], frames...)
+}
+
+// ScriptJSON is like Script but marshals each frame
+func (s *Server) ScriptJSON(trigger string, frames ...interface{}) error {
+	for _, v := range frames {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		s.Script(trigger, string(b))
+	}
+	return nil
+}
+
+// LoadScript reads a JSON Lines script, one {"on": trigger, "frame": ...} per line,
+// a string frame is sent as is, any other json value is sent verbatim
+func (s *Server) LoadScript(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var item struct {
+			On    string          `json:"on"`
+			Frame json.RawMessage `json:"frame"`
+		}
+		if err := json.Unmarshal([]byte(text), &item); err != nil {
+			return fmt.Errorf("bitmextest: script line %d: %v", line, err)
+		}
+		frame := string(item.Frame)
+		var str string
+		if json.Unmarshal(item.Frame, &str) == nil {
+			frame = str
+		}
+		s.Script(item.On, frame)
+	}
+	return scanner.Err()
+}
+
+// Push sends a frame to every connected websocket client, and every stream
+// of the multiplexed ones
+func (s *Server) Push(frame string) {
+	for _, c := range s.ws.snapshot() {
+		if c.streams == nil {
+			c.write(frame)
+		}
+	}
+	for _, st := range s.ws.streamSnapshot("") {
+		st.write(frame)
+	}
+}
+
+// PushJSON marshals v and sends it to every connected websocket client
+func (s *Server) PushJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.Push(string(b))
+	return nil
+}
+
+// WSMessages returns the messages received from websocket clients, "ping" excluded
+func (s *Server) WSMessages() []string {
+	s.ws.mu.Lock()
+	defer s.ws.mu.Unlock()
+
+	result := make([]string, len(s.ws.received))
+	copy(result, s.ws.received)
+	return result
+}
+
+// Dials returns how many websocket connections were accepted
+func (s *Server) Dials() int {
+	s.ws.mu.Lock()
+	defer s.ws.mu.Unlock()
+	return s.ws.dials
+}
+
+// WaitWSMessage waits until a received websocket message contains substr
+func (s *Server) WaitWSMessage(substr string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		for _, m := range s.WSMessages() {
+			if strings.Contains(m, substr) {
+				return true
+			}
+		}
+		select {
+		case <-s.ws.notify:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// DropWS closes all websocket connections without a close frame
+func (s *Server) DropWS() {
+	for _, c := range s.ws.snapshot() {
+		c.conn.Close()
+	}
+}
+
+func (ws *wsServer) snapshot() []*wsConn {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	conns := make([]*wsConn, 0, len(ws.conns))
+	for c := range ws.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (ws *wsServer) frames(trigger string) []string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	frames := ws.scripts[trigger]
+	result := make([]string, len(frames))
+	copy(result, frames)
+	return result
+}
+
+func (ws *wsServer) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := ws.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &wsConn{conn: conn}
+	ws.mu.Lock()
+	ws.conns[c] = struct{}{}
+	ws.dials++
+	ws.mu.Unlock()
+
+	defer func() {
+		ws.mu.Lock()
+		delete(ws.conns, c)
+		ws.mu.Unlock()
+		conn.Close()
+	}()
+
+	c.write(`{"info":"Welcome to the BitMEX Realtime API.","version":"bitmextest","limit":{"remaining":39}}`)
+	for _, f := range ws.frames(ScriptOnConnect) {
+		c.write(f)
+	}
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if string(message) == "ping" {
+			ws.ping(c)
+			continue
+		}
+		ws.mu.Lock()
+		ws.received = append(ws.received, string(message))
+		ws.mu.Unlock()
+		select {
+		case ws.notify <- struct{}{}:
+		default:
+		}
+		ws.handle(c, message)
+	}
+}
+
+func (ws *wsServer) handle(c frameWriter, message []byte) {
+	var req struct {
+		Op   string        `json:"op"`
+		Args []interface{} `json:"args"`
+		ID   interface{}   `json:"id,omitempty"`
+	}
+	if err := json.Unmarshal(message, &req); err != nil {
+		c.write(`{"status":400,"error":"Unable to parse request"}`)
+		return
+	}
+	request, _ := json.Marshal(req)
+
+	switch req.Op {
+	case "authKey", "authKeyExpires":
+		if !ws.verify(req.Args) {
+			c.write(fmt.Sprintf(`{"status":401,"error":"Signature not valid.","request":%s}`, request))
+			return
+		}
+		c.write(fmt.Sprintf(`{"success":true,"request":%s}`, request))
+		for _, f := range ws.frames(ScriptOnAuth) {
+			c.write(f)
+		}
+	case "subscribe":
+		for _, arg := range req.Args {
+			topic := fmt.Sprint(arg)
+			c.write(fmt.Sprintf(`{"success":true,"subscribe":%q,"request":%s}`, topic, request))
+			for _, f := range ws.frames(ScriptOnSubscribe(topic)) {
+				c.write(f)
+			}
+		}
+	case "unsubscribe":
+		for _, arg := range req.Args {
+			c.write(fmt.Sprintf(`{"success":true,"unsubscribe":%q,"request":%s}`, fmt.Sprint(arg), request))
+		}
+	default:
+		fn := ws.command(req.Op)
+		if fn == nil {
+			c.write(fmt.Sprintf(`{"status":400,"error":"Unknown or unsupported command %s","request":%s}`, req.Op, request))
+			return
+		}
+		data, err := fn(req.Args)
+		if err != nil {
+			msg, _ := json.Marshal(err.Error())
+			c.write(fmt.Sprintf(`{"status":400,"error":%s,"request":%s}`, msg, request))
+			return
+		}
+		raw, err := json.Marshal(data)
+		if err != nil {
+			raw = []byte("null")
+		}
+		c.write(fmt.Sprintf(`{"success":true,"request":%s,"data":%s}`, request, raw))
+	}
+}
+
+func (ws *wsServer) verify(args []interface{}) bool {
+	key, secret := ws.s.credentials()
+	if secret == "" {
+		return true
+	}
+	if len(args) != 3 {
+		ws.s.addAuthError("authKeyExpires expects 3 args, got %d", len(args))
+		return false
+	}
+	expires, _ := args[1].(float64)
+	if args[0] != key {
+		ws.s.addAuthError("invalid ws api key %v", args[0])
+		return false
+	}
+	if int64(expires) < ws.s.now().Unix() {
+		ws.s.addAuthError("ws auth expired %v", int64(expires))
+		return false
+	}
+	want := swagger.CalSignature(secret, fmt.Sprintf("GET/realtime%d", int64(expires)))
+	if args[2] != want {
+		ws.s.addAuthError("invalid ws signature")
+		return false
+	}
+	return true
+}
+
+func (ws *wsServer) close() {
+	for _, c := range ws.snapshot() {
+		c.conn.Close()
+	}
+}
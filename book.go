@@ -0,0 +1,110 @@
+package bitmex
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// BitmexBook fires with the book of the BookMode, listener: func(ob OrderBook, symbol string)
+const BitmexBook = "book"
+
+// BookMode selects the subscription the books of BitmexBook and RunStrategy come from
+type BookMode int32
+
+const (
+	BookL2    BookMode = iota // orderBookL2 or orderBookL2_25, the depth kept from deltas
+	Book10                    // orderBook10, snapshots of the top 10 levels
+	BookQuote                 // quote, the top of book
+)
+
+func (m BookMode) String() string {
+	switch m {
+	case BookL2:
+		return "l2"
+	case Book10:
+		return "10"
+	case BookQuote:
+		return "quote"
+	}
+	return "unknown"
+}
+
+// Subscription returns what to subscribe for the books of symbol
+func (m BookMode) Subscription(symbol string) SubscribeInfo {
+	op := BitmexWSOrderBookL2
+	switch m {
+	case Book10:
+		op = BitmexWSOrderBook10
+	case BookQuote:
+		op = BitmexWSQuote
+	}
+	return SubscribeInfo{Op: op, Param: symbol}
+}
+
+// SetBookMode selects where BitmexBook comes from, BookL2 by default. Book10
+// and BookQuote cost less to receive and keep but see less of the book.
+func (b *BitMEX) SetBookMode(mode BookMode) {
+	atomic.StoreInt32((*int32)(&b.bookMode), int32(mode))
+}
+
+// BookMode returns the mode of SetBookMode
+func (b *BitMEX) BookMode() BookMode {
+	return BookMode(atomic.LoadInt32((*int32)(&b.bookMode)))
+}
+
+// emitBook emits BitmexBook when mode is the selected one, book is only
+// called then
+func (b *BitMEX) emitBook(mode BookMode, symbol string, book func() OrderBook) {
+	if b.BookMode() == mode {
+		b.emit(BitmexBook, book(), symbol)
+	}
+}
+
+// OrderBook converts the top 10 levels, best first like the L2 book
+func (o *OrderBook10) OrderBook() (ob OrderBook) {
+	ob.Bids = levelItems(o.Bids)
+	ob.Asks = levelItems(o.Asks)
+	ob.Timestamp = o.Timestamp
+	return
+}
+
+// levelItems converts [price, size] pairs
+func levelItems(levels [][]float64) []Item {
+	if len(levels) == 0 {
+		return nil
+	}
+	items := make([]Item, 0, len(levels))
+	for _, l := range levels {
+		if len(l) >= 2 {
+			items = append(items, Item{Price: l[0], Amount: l[1]})
+		}
+	}
+	return items
+}
+
+// QuoteOrderBook is the book of a quote, a level per side if it has one
+func QuoteOrderBook(q *swagger.Quote) (ob OrderBook) {
+	if q.BidPrice > 0 {
+		ob.Bids = []Item{{Price: q.BidPrice, Amount: float64(q.BidSize)}}
+	}
+	if q.AskPrice > 0 {
+		ob.Asks = []Item{{Price: q.AskPrice, Amount: float64(q.AskSize)}}
+	}
+	ob.Timestamp = q.Timestamp
+	return
+}
+
+func (b *BitMEX) processOrderBook10(msg *Response) (err error) {
+	books, _ := msg.Data.([]*OrderBook10)
+	if len(books) < 1 {
+		return errors.New("ws.go error - no orderBook10 data")
+	}
+
+	for _, v := range books {
+		b.emit(BitmexWSOrderBook10, *v, v.Symbol)
+		b.emitBook(Book10, v.Symbol, v.OrderBook)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package bitmex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+const (
+	book10Frame = `{"table":"orderBook10","action":"update","data":[{"symbol":"XBTUSD","bids":[[8999.5,700],[8999,20]],"asks":[[9000,300],[9000.5,10],[9001]],"timestamp":"2019-04-09T08:15:12.704Z"}]}`
+	quoteFrame  = `{"table":"quote","action":"insert","data":[{"timestamp":"2019-04-09T08:15:12.704Z","symbol":"XBTUSD","bidSize":50,"bidPrice":8999,"askPrice":9000,"askSize":60},{"timestamp":"2019-04-09T08:15:12.804Z","symbol":"XBTUSD","bidSize":700,"bidPrice":8999.5,"askPrice":9000,"askSize":300}]}`
+)
+
+func TestBookConversions(t *testing.T) {
+	res, err := decodeMessage([]byte(book10Frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	books := res.Data.([]*OrderBook10)
+	ob := books[0].OrderBook()
+	// the level without size is skipped
+	if !equalItems(ob.Bids, []Item{{Price: 8999.5, Amount: 700}, {Price: 8999, Amount: 20}}) || !equalItems(ob.Asks, []Item{{Price: 9000, Amount: 300}, {Price: 9000.5, Amount: 10}}) {
+		t.Errorf("book %+v", ob)
+	}
+	if ob.Timestamp.IsZero() || ob.Bid() != 8999.5 || ob.Ask() != 9000 {
+		t.Errorf("book %+v", ob)
+	}
+
+	ob = QuoteOrderBook(&swagger.Quote{Symbol: "XBTUSD", BidPrice: 8999.5, BidSize: 700})
+	if !equalItems(ob.Bids, []Item{{Price: 8999.5, Amount: 700}}) || len(ob.Asks) != 0 {
+		t.Errorf("quote %+v", ob)
+	}
+}
+
+func TestBitMEX_BookMode(t *testing.T) {
+	b := New(nil, HostTestnet, "", "", false)
+	b.SetLogger(NopLogger)
+	var got []OrderBook
+	b.On(BitmexBook, func(ob OrderBook, symbol string) { got = append(got, ob) })
+	frames := loadFrames(t)
+
+	for _, frame := range []string{string(frames[0]), book10Frame, quoteFrame} {
+		b.processMessage([]byte(frame))
+	}
+	if len(got) != 1 || len(got[0].Bids)+len(got[0].Asks) != 100 {
+		t.Fatalf("l2 mode %d books", len(got))
+	}
+
+	got = nil
+	b.SetBookMode(Book10)
+	for _, frame := range []string{string(frames[1]), book10Frame, quoteFrame} {
+		b.processMessage([]byte(frame))
+	}
+	if len(got) != 1 || len(got[0].Bids) != 2 {
+		t.Fatalf("10 mode %+v", got)
+	}
+
+	// a book per symbol of a quote frame, the last quote
+	got = nil
+	b.SetBookMode(BookQuote)
+	for _, frame := range []string{string(frames[1]), book10Frame, quoteFrame} {
+		b.processMessage([]byte(frame))
+	}
+	if len(got) != 1 || got[0].Bid() != 8999.5 || got[0].Ask() != 9000 {
+		t.Fatalf("quote mode %+v", got)
+	}
+
+	if s := BookQuote.Subscription("XBTUSD"); s.Topic() != "quote:XBTUSD" {
+		t.Errorf("topic %v", s.Topic())
+	}
+}
+
+type bookStrategy struct {
+	chanStrategy
+	books chan OrderBook
+}
+
+func (s *bookStrategy) OnBook(symbol string, ob OrderBook) { s.books <- ob }
+
+func TestBitMEX_RunStrategyBook10(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	srv.Script(bitmextest.ScriptOnSubscribe("orderBook10:XBTUSD"), book10Frame)
+	b.SetBookMode(Book10)
+	b.Subscribe([]SubscribeInfo{b.BookMode().Subscription("XBTUSD")})
+
+	s := &bookStrategy{books: make(chan OrderBook, 16)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- b.RunStrategy(ctx, s, 0)
+	}()
+
+	startWS(t, b)
+
+	select {
+	case ob := <-s.books:
+		if ob.Bid() != 8999.5 || ob.Ask() != 9000 {
+			t.Errorf("book %+v", ob)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no book")
+	}
+	cancel()
+	<-done
+}
+
+func TestHub_OrderBookTop(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Script(bitmextest.ScriptOnSubscribe("orderBook10:XBTUSD"), book10Frame)
+	hub := NewHub(func() *BitMEX { return newBitmexForServer(srv, "", "") })
+	defer hub.Close()
+
+	sub, err := hub.Subscribe([]SubscribeInfo{Book10.Subscription("XBTUSD")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "book", func() bool { _, ok := hub.OrderBook("XBTUSD"); return ok })
+	if ob, _ := hub.OrderBook("XBTUSD"); ob.Bid() != 8999.5 || len(ob.Asks) != 2 {
+		t.Errorf("book %+v", ob)
+	}
+	sub.Close()
+	if _, ok := hub.OrderBook("XBTUSD"); ok {
+		t.Error("book kept")
+	}
+}
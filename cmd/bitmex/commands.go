@@ -0,0 +1,413 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+const defaultSymbol = "XBTUSD"
+
+func cmdOrders(a *app, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "list":
+		return cmdOrdersList(a, args[1:])
+	case "place":
+		return cmdOrdersPlace(a, args[1:])
+	case "amend":
+		return cmdOrdersAmend(a, args[1:])
+	case "cancel":
+		return cmdOrdersCancel(a, args[1:])
+	case "cancel-all":
+		return cmdOrdersCancelAll(a, args[1:])
+	}
+	return fmt.Errorf("unknown orders command %q", args[0])
+}
+
+func ordersTable(orders []swagger.Order) *table {
+	t := &table{
+		value:  orders,
+		header: []string{"ORDER_ID", "SYMBOL", "SIDE", "TYPE", "QTY", "PRICE", "STOP_PX", "FILLED", "AVG_PX", "STATUS", "TIME"},
+	}
+	for _, o := range orders {
+		t.add(o.OrderID, o.Symbol, o.Side, o.OrdType, o.OrderQty, o.Price, o.StopPx, o.CumQty, o.AvgPx, o.OrdStatus, o.Timestamp)
+	}
+	return t
+}
+
+func cmdOrdersList(a *app, args []string) error {
+	fs := flag.NewFlagSet("orders list", flag.ContinueOnError)
+	symbol := fs.String("symbol", "", "symbol, all symbols if empty")
+	all := fs.Bool("all", false, "include closed orders")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	var orders []swagger.Order
+	var err error
+	if *all {
+		orders, err = a.client.GetOrdersRaw(*symbol, "")
+	} else {
+		orders, err = a.client.GetOrders(*symbol)
+	}
+	if err != nil {
+		return err
+	}
+	return a.print(ordersTable(orders))
+}
+
+func cmdOrdersPlace(a *app, args []string) error {
+	fs := flag.NewFlagSet("orders place", flag.ContinueOnError)
+	symbol := fs.String("symbol", defaultSymbol, "symbol")
+	side := fs.String("side", "", "Buy or Sell")
+	ordType := fs.String("type", bitmex.ORD_TYPE_LIMIT, "Limit, Market, Stop, StopLimit, ...")
+	qty := fs.Int("qty", 0, "order quantity in contracts")
+	price := fs.Float64("price", 0, "limit price")
+	stopPx := fs.Float64("stop-px", 0, "stop trigger price")
+	tif := fs.String("tif", "", "time in force, e.g. GoodTillCancel, ImmediateOrCancel")
+	execInst := fs.String("exec-inst", "", "e.g. ParticipateDoNotInitiate, ReduceOnly")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	switch strings.ToLower(*side) {
+	case "buy":
+		*side = bitmex.SIDE_BUY
+	case "sell":
+		*side = bitmex.SIDE_SELL
+	default:
+		return fmt.Errorf("orders place: -side must be Buy or Sell")
+	}
+	if *qty <= 0 {
+		return fmt.Errorf("orders place: -qty must be positive")
+	}
+	order, err := a.client.PlaceOrder(*side, *ordType, *stopPx, *price, int32(*qty), *tif, *execInst, *symbol)
+	if err != nil {
+		return err
+	}
+	return a.print(ordersTable([]swagger.Order{order}))
+}
+
+func cmdOrdersAmend(a *app, args []string) error {
+	fs := flag.NewFlagSet("orders amend", flag.ContinueOnError)
+	price := fs.Float64("price", 0, "new price")
+	qty := fs.Int("qty", 0, "new order quantity")
+	ids, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 {
+		return fmt.Errorf("orders amend: need one ORDER_ID")
+	}
+	if *price == 0 && *qty == 0 {
+		return fmt.Errorf("orders amend: nothing to amend, use -price or -qty")
+	}
+	order, err := a.client.AmendOrder2(ids[0], "", "", 0, float32(*qty), 0, 0, *price, 0, 0, "")
+	if err != nil {
+		return err
+	}
+	return a.print(ordersTable([]swagger.Order{order}))
+}
+
+func cmdOrdersCancel(a *app, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("orders cancel: need ORDER_ID")
+	}
+	var orders []swagger.Order
+	for _, id := range args {
+		order, err := a.client.CancelOrder(id)
+		if err != nil {
+			return fmt.Errorf("cancel %v: %v", id, err)
+		}
+		orders = append(orders, order)
+	}
+	return a.print(ordersTable(orders))
+}
+
+func cmdOrdersCancelAll(a *app, args []string) error {
+	fs := flag.NewFlagSet("orders cancel-all", flag.ContinueOnError)
+	symbol := fs.String("symbol", "", "symbol, all symbols if empty")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	orders, err := a.client.CancelAllOrders(*symbol)
+	if err != nil {
+		return err
+	}
+	return a.print(ordersTable(orders))
+}
+
+func cmdPositions(a *app, args []string) error {
+	fs := flag.NewFlagSet("positions", flag.ContinueOnError)
+	symbol := fs.String("symbol", "", "symbol, all symbols if empty")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	positions, err := a.client.GetPositions(*symbol)
+	if err != nil {
+		return err
+	}
+	t := &table{
+		value:  positions,
+		header: []string{"SYMBOL", "QTY", "AVG_ENTRY", "MARK", "LIQ_PRICE", "LEVERAGE", "CROSS", "UNREALISED_PNL", "REALISED_PNL"},
+	}
+	for _, p := range positions {
+		t.add(p.Symbol, p.CurrentQty, p.AvgEntryPrice, p.MarkPrice, p.LiquidationPrice, p.Leverage, p.CrossMargin, p.UnrealisedPnl, p.RealisedPnl)
+	}
+	return a.print(t)
+}
+
+func cmdLeverage(a *app, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("leverage: need SYMBOL LEVERAGE, 0 for cross margin")
+	}
+	leverage, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return fmt.Errorf("leverage: %v", err)
+	}
+	position, err := a.client.PositionUpdateLeverage(leverage, args[0])
+	if err != nil {
+		return err
+	}
+	t := &table{
+		value:  position,
+		header: []string{"SYMBOL", "LEVERAGE", "CROSS", "QTY", "LIQ_PRICE"},
+	}
+	t.add(position.Symbol, position.Leverage, position.CrossMargin, position.CurrentQty, position.LiquidationPrice)
+	return a.print(t)
+}
+
+func cmdWallet(a *app, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	wallet, err := a.client.GetWallet()
+	if err != nil {
+		return err
+	}
+	margin, err := a.client.GetMargin()
+	if err != nil {
+		return err
+	}
+	t := &table{
+		value: map[string]interface{}{
+			"wallet": wallet,
+			"margin": margin,
+		},
+		header: []string{"CURRENCY", "AMOUNT", "WALLET_BALANCE", "MARGIN_BALANCE", "AVAILABLE_MARGIN", "UNREALISED_PNL", "REALISED_PNL"},
+	}
+	t.add(wallet.Currency, wallet.Amount, margin.WalletBalance, margin.MarginBalance, margin.AvailableMargin, margin.UnrealisedPnl, margin.RealisedPnl)
+	return a.print(t)
+}
+
+func cmdBook(a *app, args []string) error {
+	fs := flag.NewFlagSet("book", flag.ContinueOnError)
+	depth := fs.Int("depth", 10, "levels per side, 0 for the full book")
+	symbols, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(symbols) != 1 {
+		return fmt.Errorf("book: need one SYMBOL")
+	}
+	ob, err := a.client.GetOrderBook(*depth, symbols[0])
+	if err != nil {
+		return err
+	}
+	t := &table{
+		value:  ob,
+		header: []string{"SIDE", "PRICE", "SIZE"},
+	}
+	// asks from the top down to the spread, like a ladder
+	for i := len(ob.Asks) - 1; i >= 0; i-- {
+		t.add(bitmex.SIDE_SELL, ob.Asks[i].Price, ob.Asks[i].Amount)
+	}
+	for _, bid := range ob.Bids {
+		t.add(bitmex.SIDE_BUY, bid.Price, bid.Amount)
+	}
+	return a.print(t)
+}
+
+var tradeHeader = []string{"TIME", "SYMBOL", "SIDE", "SIZE", "PRICE", "TICK"}
+
+func cmdTrades(a *app, args []string) error {
+	fs := flag.NewFlagSet("trades", flag.ContinueOnError)
+	count := fs.Int("count", 20, "recent trades")
+	follow := fs.Bool("follow", false, "stream trades until interrupted")
+	limit := fs.Int("n", 0, "with -follow, stop after n trades")
+	symbols, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(symbols) != 1 {
+		return fmt.Errorf("trades: need one SYMBOL")
+	}
+	if *follow {
+		return followTrades(a, symbols[0], *limit)
+	}
+
+	trades, err := a.client.GetTrades(symbols[0], *count, true, time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+	t := &table{value: trades, header: tradeHeader}
+	// oldest first
+	for i := len(trades) - 1; i >= 0; i-- {
+		tr := trades[i]
+		t.add(tr.Timestamp, tr.Symbol, tr.Side, tr.Size, tr.Price, tr.TickDirection)
+	}
+	return a.print(t)
+}
+
+func followTrades(a *app, symbol string, limit int) error {
+	b := a.client
+	ch := make(chan []*swagger.Trade, 64)
+	done := make(chan struct{})
+	defer close(done)
+
+	listener := func(trades []*swagger.Trade, action string) {
+		select {
+		case ch <- trades:
+		case <-done:
+		}
+	}
+	b.On(bitmex.BitmexWSTrade, listener)
+	defer b.Off(bitmex.BitmexWSTrade, listener)
+	if err := b.Subscribe([]bitmex.SubscribeInfo{{Op: bitmex.BitmexWSTrade, Param: symbol}}); err != nil {
+		return err
+	}
+	if err := b.StartWS(a.ctx); err != nil {
+		return err
+	}
+	defer b.CloseWS()
+
+	w := newStreamWriter(a.stdout, a.format, tradeHeader)
+	n := 0
+	for {
+		select {
+		case <-a.ctx.Done():
+			return nil
+		case trades := <-ch:
+			for _, tr := range trades {
+				if tr.Symbol != symbol {
+					continue
+				}
+				if err := w.write(tr, tr.Timestamp, tr.Symbol, tr.Side, tr.Size, tr.Price, tr.TickDirection); err != nil {
+					return err
+				}
+				n++
+				if limit > 0 && n >= limit {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+var binSizes = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+// candlesPageSize is the api maximum count
+const candlesPageSize = 1000
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q, use RFC3339 or 2006-01-02", s)
+}
+
+func cmdCandles(a *app, args []string) error {
+	fs := flag.NewFlagSet("candles", flag.ContinueOnError)
+	bin := fs.String("bin", "1h", "bin size: 1m, 5m, 1h or 1d")
+	fromFlag := fs.String("from", "", "start time, RFC3339 or 2006-01-02")
+	toFlag := fs.String("to", "", "end time, default now")
+	out := fs.String("out", "", "write to file, the format follows a .csv or .json extension")
+	symbols, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(symbols) != 1 {
+		return fmt.Errorf("candles: need one SYMBOL")
+	}
+	binSize, ok := binSizes[*bin]
+	if !ok {
+		return fmt.Errorf("candles: bad bin size %q", *bin)
+	}
+	if *fromFlag == "" {
+		return fmt.Errorf("candles: need -from")
+	}
+	from, err := parseTime(*fromFlag)
+	if err != nil {
+		return err
+	}
+	to := time.Now().UTC()
+	if *toFlag != "" {
+		if to, err = parseTime(*toFlag); err != nil {
+			return err
+		}
+	}
+
+	var bins []swagger.TradeBin
+	for start := from; !start.After(to); {
+		page, err := a.client.GetBucketed(symbols[0], *bin, false, "", "", candlesPageSize, 0, false, start, to)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		bins = append(bins, page...)
+		next := page[len(page)-1].Timestamp.Add(binSize)
+		if len(page) < candlesPageSize || !next.After(start) {
+			break
+		}
+		start = next
+	}
+
+	t := &table{
+		value:  bins,
+		header: []string{"TIME", "OPEN", "HIGH", "LOW", "CLOSE", "VOLUME", "TRADES", "VWAP"},
+	}
+	for _, c := range bins {
+		t.add(c.Timestamp, c.Open, c.High, c.Low, c.Close, c.Volume, c.Trades, c.Vwap)
+	}
+	if *out == "" {
+		return a.print(t)
+	}
+
+	format := a.format
+	switch strings.ToLower(filepath.Ext(*out)) {
+	case ".csv":
+		format = formatCSV
+	case ".json":
+		format = formatJSON
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := writeTable(f, format, t); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(a.stderr, "%d candles written to %v\n", len(bins), *out)
+	return nil
+}
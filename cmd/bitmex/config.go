@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/frankrap/bitmex-api"
+)
+
+// Profile is one account in the config file, see bitmex.Config for the format
+type Profile = bitmex.Profile
+
+func defaultConfigPath() string {
+	if path := os.Getenv("BITMEX_CONFIG"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".bitmex.yaml"
+	}
+	return filepath.Join(home, ".bitmex.yaml")
+}
+
+func loadConfig(path string) (*bitmex.Config, error) {
+	return bitmex.LoadConfig(path)
+}
+
+func newClient(p Profile) (*bitmex.BitMEX, error) {
+	return bitmex.NewClient(
+		bitmex.WithProfile(p),
+		bitmex.WithLogger(bitmex.NewStdLogger(nil, bitmex.LevelWarn)),
+	)
+}
@@ -0,0 +1,161 @@
+// Command bitmex is a command line client for the BitMEX api.
+//
+//	bitmex [-config FILE] [-profile NAME] [-o table|json|csv] COMMAND [ARGS]
+//
+// Profiles are read from $BITMEX_CONFIG or ~/.bitmex.yaml, see bitmex.Config.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+
+	"github.com/frankrap/bitmex-api"
+)
+
+const usage = `usage: bitmex [-config FILE] [-profile NAME] [-o table|json|csv] COMMAND [ARGS]
+
+commands:
+  orders list [-symbol S] [-all]
+  orders place -side Buy|Sell -qty N [-type Limit] [-price P] [-stop-px P] [-tif T] [-exec-inst I] [-symbol S]
+  orders amend ORDER_ID [-price P] [-qty N]
+  orders cancel ORDER_ID...
+  orders cancel-all [-symbol S]
+  positions [-symbol S]
+  leverage SYMBOL LEVERAGE
+  wallet
+  book SYMBOL [-depth N]
+  trades SYMBOL [-count N] [-follow] [-n N]
+  candles SYMBOL [-bin 1m|5m|1h|1d] -from TIME [-to TIME] [-out FILE]
+  watch SYMBOL [-depth N] [-trades N] [-fps N] [-no-color]
+`
+
+var errUsage = errors.New("usage")
+
+// app is the state shared by the commands
+type app struct {
+	ctx     context.Context
+	stdout  io.Writer
+	stderr  io.Writer
+	format  string
+	profile Profile
+	client  *bitmex.BitMEX
+}
+
+type command func(a *app, args []string) error
+
+var commands = map[string]command{
+	"orders":    cmdOrders,
+	"positions": cmdPositions,
+	"leverage":  cmdLeverage,
+	"wallet":    cmdWallet,
+	"book":      cmdBook,
+	"trades":    cmdTrades,
+	"candles":   cmdCandles,
+	"watch":     cmdWatch,
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	if err == errUsage {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "bitmex:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) error {
+	fs := flag.NewFlagSet("bitmex", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	configPath := fs.String("config", "", "config file, default $BITMEX_CONFIG or ~/.bitmex.yaml")
+	profileName := fs.String("profile", os.Getenv("BITMEX_PROFILE"), "config profile")
+	format := fs.String("o", formatTable, "output format: table, json or csv")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return errUsage
+	}
+	if err := checkFormat(*format); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, have: %v", fs.Arg(0), names)
+	}
+
+	profile, err := loadProfile(*configPath, *profileName)
+	if err != nil {
+		return err
+	}
+	client, err := newClient(profile)
+	if err != nil {
+		return err
+	}
+	a := &app{
+		ctx:     ctx,
+		stdout:  stdout,
+		stderr:  stderr,
+		format:  *format,
+		profile: profile,
+		client:  client,
+	}
+	return cmd(a, fs.Args()[1:])
+}
+
+// loadProfile allows running public commands without a config file
+func loadProfile(path string, name string) (Profile, error) {
+	explicit := path != ""
+	if !explicit {
+		path = defaultConfigPath()
+	}
+	cfg, err := loadConfig(path)
+	if os.IsNotExist(err) && !explicit && name == "" {
+		return Profile{}, nil
+	}
+	if err != nil {
+		return Profile{}, err
+	}
+	return cfg.Lookup(name)
+}
+
+func (a *app) print(t *table) error {
+	return writeTable(a.stdout, a.format, t)
+}
+
+// parseArgs parses flags appearing before and after positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, fmt.Errorf("%v: %v", fs.Name(), err)
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
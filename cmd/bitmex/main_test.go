@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+const (
+	testKey    = "8K2Oi0bnRRZ7GK4UJnY-38oj"
+	testSecret = "9EmGvk8mKX5nWa11y1KyPPGn78Lv2ZEiLx3TH0YasE_oE06y"
+)
+
+// setup writes a config with a "local" profile pointing at a fake server
+func setup(t *testing.T) (*bitmextest.Server, string) {
+	srv := bitmextest.NewServer()
+	srv.RequireAuth(testKey, testSecret)
+	t.Cleanup(srv.Close)
+
+	config := fmt.Sprintf(`default: local
+profiles:
+  local:
+    key: %v
+    secret: %v
+    base_path: %v
+    ws_url: %v
+  mainnet:
+    key: other
+`, testKey, testSecret, srv.BasePath, srv.WSURL)
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, path
+}
+
+func runCLI(t *testing.T, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := run(context.Background(), args, &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func handleFixture(t *testing.T, srv *bitmextest.Server, method string, path string, filename string) {
+	if _, err := srv.HandleFile(method, path, 200, "../../testdata/"+filename); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigProfiles(t *testing.T) {
+	_, path := setup(t)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := cfg.Lookup("")
+	if err != nil || p.Key != testKey {
+		t.Errorf("default profile %+v %v", p, err)
+	}
+	if p, _ = cfg.Lookup("mainnet"); p.Key != "other" || p.Testnet || p.Host != "" {
+		t.Errorf("mainnet profile %+v", p)
+	}
+	if _, err = cfg.Lookup("nope"); err == nil {
+		t.Error("expect profile not found")
+	}
+
+	// the flat format of testdata/config.yaml.example
+	cfg, err = loadConfig("../../testdata/config.yaml.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = cfg.Lookup("")
+	if err != nil || p.Key != testKey || !p.Testnet || p.ProxyURL != "http://127.0.0.1:1080" {
+		t.Errorf("flat profile %+v %v", p, err)
+	}
+}
+
+func TestOrders(t *testing.T) {
+	srv, config := setup(t)
+	handleFixture(t, srv, "GET", "/order", "orders.json")
+	handleFixture(t, srv, "POST", "/order", "order.json")
+
+	out, err := runCLI(t, "-config", config, "-o", "json", "orders", "list", "-symbol", "XBTUSD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orders []swagger.Order
+	if err = json.Unmarshal([]byte(out), &orders); err != nil || len(orders) != 2 {
+		t.Fatalf("orders list %v %v", err, out)
+	}
+	req, _ := srv.LastRequest("GET", "/order")
+	if p := req.Params(); p["symbol"] != "XBTUSD" || p["filter"] != `{"open":true}` {
+		t.Errorf("orders list params %v", p)
+	}
+
+	out, err = runCLI(t, "-config", config, "orders", "place", "-side", "buy", "-qty", "10", "-price", "3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "ORDER_ID") || len(strings.Split(strings.TrimSpace(out), "\n")) != 2 {
+		t.Errorf("table output %q", out)
+	}
+	req, _ = srv.LastRequest("POST", "/order")
+	if p := req.Params(); p["side"] != "Buy" || p["orderQty"] != "10" || p["price"] != "3000" || p["symbol"] != "XBTUSD" {
+		t.Errorf("orders place params %v", p)
+	}
+	if len(srv.AuthErrors()) != 0 {
+		t.Errorf("auth errors %v", srv.AuthErrors())
+	}
+
+	if _, err = runCLI(t, "-config", config, "orders", "place", "-side", "up", "-qty", "10"); err == nil {
+		t.Error("expect side error")
+	}
+}
+
+func TestBook(t *testing.T) {
+	srv, config := setup(t)
+	handleFixture(t, srv, "GET", "/orderBook/L2", "orderbook_l2.json")
+
+	out, err := runCLI(t, "-config", config, "-o", "csv", "book", "XBTUSD", "-depth", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 7 || records[0][0] != "SIDE" || records[1][0] != "Sell" || records[6][0] != "Buy" {
+		t.Errorf("book csv %v", records)
+	}
+	req, _ := srv.LastRequest("GET", "/orderBook/L2")
+	if p := req.Params(); p["depth"] != "3" || p["symbol"] != "XBTUSD" {
+		t.Errorf("book params %v", p)
+	}
+}
+
+func TestCandles(t *testing.T) {
+	srv, config := setup(t)
+	from := time.Date(2019, 4, 1, 0, 0, 0, 0, time.UTC)
+	pages := 0
+	srv.HandleFunc("GET", "/trade/bucketed", func(req bitmextest.Request) (int, interface{}) {
+		pages++
+		n := candlesPageSize
+		if pages == 2 {
+			n = 10
+		}
+		start := from.Add(time.Duration((pages-1)*candlesPageSize) * time.Minute)
+		bins := make([]swagger.TradeBin, n)
+		for i := range bins {
+			bins[i] = swagger.TradeBin{Timestamp: start.Add(time.Duration(i) * time.Minute), Symbol: "XBTUSD", Open: 5000, Close: 5000}
+		}
+		return 200, bins
+	})
+
+	out := filepath.Join(t.TempDir(), "candles.csv")
+	if _, err := runCLI(t, "-config", config, "candles", "XBTUSD", "-bin", "1m", "-from", "2019-04-01", "-to", "2019-04-02", "-out", out); err != nil {
+		t.Fatal(err)
+	}
+	if pages != 2 {
+		t.Errorf("pages %v", pages)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != candlesPageSize+10+1 || records[1][0] != "2019-04-01T00:00:00.000Z" {
+		t.Errorf("candles csv %v rows, first %v", len(records), records[1])
+	}
+}
+
+func TestTradesFollow(t *testing.T) {
+	srv, config := setup(t)
+	srv.Script(bitmextest.ScriptOnSubscribe("trade:XBTUSD"),
+		`{"table":"trade","action":"insert","data":[{"timestamp":"2019-04-09T08:15:12.704Z","symbol":"XBTUSD","side":"Buy","size":10,"price":9000}]}`,
+		`{"table":"trade","action":"insert","data":[{"timestamp":"2019-04-09T08:15:13.704Z","symbol":"XBTUSD","side":"Sell","size":5,"price":8999.5}]}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var stdout bytes.Buffer
+	if err := run(ctx, []string{"-config", config, "-o", "json", "trades", "XBTUSD", "-follow", "-n", "2"}, &stdout, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("no trades")
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"price":8999.5`) {
+		t.Errorf("trades output %q", stdout.String())
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	_, config := setup(t)
+	if _, err := runCLI(t, "-config", config, "nope"); err == nil {
+		t.Error("expect unknown command")
+	}
+	if _, err := runCLI(t, "-config", config, "-o", "xml", "wallet"); err == nil {
+		t.Error("expect format error")
+	}
+	if _, err := runCLI(t); err != errUsage {
+		t.Errorf("expect usage, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+)
+
+func checkFormat(format string) error {
+	switch format {
+	case formatTable, formatJSON, formatCSV:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, use table, json or csv", format)
+}
+
+// table is what a command prints: the raw value for json, rows for table and csv
+type table struct {
+	value  interface{}
+	header []string
+	rows   [][]string
+}
+
+func (t *table) add(cells ...interface{}) {
+	row := make([]string, len(cells))
+	for i, c := range cells {
+		row[i] = cell(c)
+	}
+	t.rows = append(t.rows, row)
+}
+
+func cell(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.UTC().Format("2006-01-02T15:04:05.000Z")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeTable(w io.Writer, format string, t *table) error {
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t.value)
+	case formatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(t.header)
+		cw.WriteAll(t.rows)
+		return cw.Error()
+	default:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(t.header, "\t"))
+		for _, row := range t.rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	}
+}
+
+// streamWriter prints rows as they arrive, json is one object per line
+type streamWriter struct {
+	w      io.Writer
+	format string
+	header []string
+	csv    *csv.Writer
+	wrote  bool
+}
+
+func newStreamWriter(w io.Writer, format string, header []string) *streamWriter {
+	return &streamWriter{w: w, format: format, header: header, csv: csv.NewWriter(w)}
+}
+
+func (s *streamWriter) write(value interface{}, cells ...interface{}) error {
+	t := &table{}
+	t.add(cells...)
+	row := t.rows[0]
+	switch s.format {
+	case formatJSON:
+		return json.NewEncoder(s.w).Encode(value)
+	case formatCSV:
+		if !s.wrote {
+			s.csv.Write(s.header)
+			s.wrote = true
+		}
+		s.csv.Write(row)
+		s.csv.Flush()
+		return s.csv.Error()
+	default:
+		// fixed width, a tabwriter can't align rows it hasn't seen
+		if !s.wrote {
+			fmt.Fprintln(s.w, padRow(s.header))
+			s.wrote = true
+		}
+		_, err := fmt.Fprintln(s.w, padRow(row))
+		return err
+	}
+}
+
+func padRow(row []string) string {
+	var sb strings.Builder
+	for i, c := range row {
+		if i == len(row)-1 {
+			sb.WriteString(c)
+		} else {
+			fmt.Fprintf(&sb, "%-26s", c)
+		}
+	}
+	return sb.String()
+}
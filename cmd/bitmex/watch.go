@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+const (
+	ansiClear      = "\x1b[H\x1b[2J"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+	ansiRed        = "\x1b[31m"
+	ansiGreen      = "\x1b[32m"
+	ansiBold       = "\x1b[1m"
+	ansiReset      = "\x1b[0m"
+
+	barWidth = 20
+)
+
+// watchState is everything the screen shows, updated by the ws listeners
+type watchState struct {
+	mu        sync.Mutex
+	symbol    string
+	book      bitmex.OrderBook
+	trades    []swagger.Trade // newest first
+	orders    map[string]swagger.Order
+	position  *swagger.Position
+	rateLimit bitmex.RateLimit
+	connected bool
+	updated   time.Time
+}
+
+func newWatchState(symbol string) *watchState {
+	return &watchState{symbol: symbol, orders: make(map[string]swagger.Order)}
+}
+
+func (s *watchState) onBook(ob bitmex.OrderBook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.book = ob
+	s.updated = ob.Timestamp
+}
+
+func (s *watchState) onTrades(trades []*swagger.Trade, keep int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range trades {
+		if t.Symbol != s.symbol {
+			continue
+		}
+		s.trades = append([]swagger.Trade{*t}, s.trades...)
+		s.updated = t.Timestamp
+	}
+	if len(s.trades) > keep {
+		s.trades = s.trades[:keep]
+	}
+}
+
+// onOrders reports whether any order filled, the position then needs a refresh
+func (s *watchState) onOrders(orders []*swagger.Order) (filled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range orders {
+		if o.Symbol != s.symbol {
+			continue
+		}
+		if old, ok := s.orders[o.OrderID]; o.CumQty > 0 && (!ok || o.CumQty != old.CumQty) {
+			filled = true
+		}
+		switch o.OrdStatus {
+		case bitmex.OS_NEW, bitmex.OS_PARTIALLY_FILLED:
+			s.orders[o.OrderID] = *o
+		default:
+			delete(s.orders, o.OrderID)
+		}
+	}
+	return
+}
+
+// onPositions merges the raw rows of ws updates, which only carry the
+// changed fields
+func (s *watchState) onPositions(action string, data []byte) {
+	var rows []json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, row := range rows {
+		var key struct {
+			Symbol string `json:"symbol"`
+		}
+		if json.Unmarshal(row, &key) != nil || key.Symbol != s.symbol {
+			continue
+		}
+		if s.position == nil || action != "update" {
+			s.position = &swagger.Position{}
+		}
+		json.Unmarshal(row, s.position)
+	}
+}
+
+func (s *watchState) setPosition(p *swagger.Position) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.position = p
+}
+
+func (s *watchState) setStatus(connected bool, rateLimit bitmex.RateLimit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = connected
+	s.rateLimit = rateLimit
+}
+
+// leavesQty from the fields the ws order updates keep current
+func leavesQty(o swagger.Order) float32 {
+	return o.OrderQty - o.CumQty
+}
+
+func colorize(color bool, code string, s string) string {
+	if !color {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+// render draws the screen: status, position, the ladder with our orders and the trade tape
+func (s *watchState) render(depth int, color bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sb strings.Builder
+	status := colorize(color, ansiRed, "disconnected")
+	if s.connected {
+		status = colorize(color, ansiGreen, "connected")
+	}
+	updated := "-"
+	if !s.updated.IsZero() {
+		updated = s.updated.UTC().Format("15:04:05.000")
+	}
+	fmt.Fprintf(&sb, "%v  %v  last %v  rate limit %d/%d\n",
+		colorize(color, ansiBold, s.symbol), status, updated, s.rateLimit.Remaining, s.rateLimit.Limit)
+
+	if p := s.position; p != nil && p.CurrentQty != 0 {
+		fmt.Fprintf(&sb, "Position %v @ %v  mark %v  liq %v  lev %vx  uPnL %v  rPnL %v\n",
+			p.CurrentQty, p.AvgEntryPrice, p.MarkPrice, p.LiquidationPrice, p.Leverage, p.UnrealisedPnl, p.RealisedPnl)
+	} else {
+		sb.WriteString("Position flat\n")
+	}
+	sb.WriteString("\n")
+
+	// our resting quantity per price
+	mine := make(map[float64]float32)
+	var orders []swagger.Order
+	for _, o := range s.orders {
+		mine[o.Price] += leavesQty(o)
+		orders = append(orders, o)
+	}
+
+	asks := s.book.Asks
+	if len(asks) > depth {
+		asks = asks[:depth]
+	}
+	bids := s.book.Bids
+	if len(bids) > depth {
+		bids = bids[:depth]
+	}
+	maxSize := 0.0
+	for _, level := range append(append([]bitmex.Item{}, asks...), bids...) {
+		maxSize = math.Max(maxSize, level.Amount)
+	}
+
+	var ladder []string
+	ladder = append(ladder, fmt.Sprintf("%-*s %10s %10s %8s", barWidth, "", "SIZE", "PRICE", "MINE"))
+	level := func(item bitmex.Item, code string) string {
+		n := 0
+		if maxSize > 0 {
+			n = int(math.Round(item.Amount / maxSize * barWidth))
+		}
+		bar := strings.Repeat(" ", barWidth-n) + colorize(color, code, strings.Repeat("█", n))
+		own := ""
+		if q, ok := mine[item.Price]; ok {
+			own = cell(q)
+		}
+		return fmt.Sprintf("%v %10v %10v %8v", bar, cell(item.Amount), cell(item.Price), own)
+	}
+	for i := len(asks) - 1; i >= 0; i-- {
+		ladder = append(ladder, level(asks[i], ansiRed))
+	}
+	if len(asks) > 0 && len(bids) > 0 {
+		spread := fmt.Sprintf("spread %v", cell(asks[0].Price-bids[0].Price))
+		ladder = append(ladder, fmt.Sprintf("%-*s", barWidth+31, fmt.Sprintf("%*s", barWidth+22, spread)))
+	}
+	for _, item := range bids {
+		ladder = append(ladder, level(item, ansiGreen))
+	}
+
+	tape := []string{"TRADES"}
+	for _, t := range s.trades {
+		code := ansiGreen
+		if t.Side == bitmex.SIDE_SELL {
+			code = ansiRed
+		}
+		tape = append(tape, colorize(color, code, fmt.Sprintf("%v %-4s %8v %10v",
+			t.Timestamp.UTC().Format("15:04:05.000"), t.Side, cell(t.Size), cell(t.Price))))
+	}
+
+	// ladder and tape side by side, the ladder is fixed width apart from color codes
+	for i := 0; i < len(ladder) || i < len(tape); i++ {
+		left := strings.Repeat(" ", barWidth+31)
+		if i < len(ladder) {
+			left = ladder[i]
+		}
+		right := ""
+		if i < len(tape) {
+			right = tape[i]
+		}
+		sb.WriteString(strings.TrimRight(left+"  | "+right, " "))
+		sb.WriteString("\n")
+	}
+
+	if len(orders) > 0 {
+		sort.Slice(orders, func(i, j int) bool {
+			return orders[i].Price > orders[j].Price
+		})
+		sb.WriteString("\nOpen orders\n")
+		for _, o := range orders {
+			fmt.Fprintf(&sb, "%-4s %8v / %-8v @ %-10v %v\n", o.Side, cell(leavesQty(o)), cell(o.OrderQty), cell(o.Price), o.OrderID)
+		}
+	}
+	return sb.String()
+}
+
+func cmdWatch(a *app, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	depth := fs.Int("depth", 10, "ladder levels per side, up to 25")
+	tape := fs.Int("trades", 20, "trades in the tape")
+	fps := fs.Int("fps", 10, "maximum redraws per second")
+	noColor := fs.Bool("no-color", false, "disable colors")
+	symbols, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(symbols) != 1 {
+		return fmt.Errorf("watch: need one SYMBOL")
+	}
+	if *fps <= 0 {
+		*fps = 1
+	}
+	symbol := symbols[0]
+	b := a.client
+	private := a.profile.Key != "" && a.profile.Secret != ""
+	state := newWatchState(symbol)
+
+	dirty := make(chan struct{}, 1)
+	changed := func() {
+		select {
+		case dirty <- struct{}{}:
+		default:
+		}
+	}
+	refreshPosition := func() {
+		position, err := b.GetPosition(symbol)
+		if err == nil {
+			state.setPosition(&position)
+		} else if err == bitmex.NotFound {
+			state.setPosition(nil)
+		}
+		changed()
+	}
+
+	onBook := func(m bitmex.OrderBookDataL2, sym string) {
+		if sym == symbol {
+			state.onBook(m.OrderBook())
+			changed()
+		}
+	}
+	onTrade := func(trades []*swagger.Trade, action string) {
+		state.onTrades(trades, *tape)
+		changed()
+	}
+	onOrder := func(orders []*swagger.Order, action string) {
+		if state.onOrders(orders) {
+			go refreshPosition()
+		}
+		changed()
+	}
+	onPosition := func(action string, data []byte) {
+		state.onPositions(action, data)
+		changed()
+	}
+	b.On(bitmex.BitmexWSOrderBookL2_25, onBook)
+	b.On(bitmex.BitmexWSTrade, onTrade)
+	defer b.Off(bitmex.BitmexWSOrderBookL2_25, onBook)
+	defer b.Off(bitmex.BitmexWSTrade, onTrade)
+
+	subscribes := []bitmex.SubscribeInfo{
+		{Op: bitmex.BitmexWSOrderBookL2_25, Param: symbol},
+		{Op: bitmex.BitmexWSTrade, Param: symbol},
+	}
+	if private {
+		b.On(bitmex.BitmexWSOrder, onOrder)
+		removePosition := b.AddTableHook(bitmex.BitmexWSPosition, onPosition)
+		defer b.Off(bitmex.BitmexWSOrder, onOrder)
+		defer removePosition()
+		subscribes = append(subscribes,
+			bitmex.SubscribeInfo{Op: bitmex.BitmexWSOrder, Param: symbol},
+			bitmex.SubscribeInfo{Op: bitmex.BitmexWSPosition, Param: symbol})
+	}
+	if err := b.Subscribe(subscribes); err != nil {
+		return err
+	}
+	if err := b.StartWS(a.ctx); err != nil {
+		return err
+	}
+	defer b.CloseWS()
+	if private {
+		go refreshPosition()
+	}
+
+	fmt.Fprint(a.stdout, ansiHideCursor)
+	defer fmt.Fprint(a.stdout, ansiShowCursor)
+	interval := time.Second / time.Duration(*fps)
+	var last time.Time
+	for {
+		select {
+		case <-a.ctx.Done():
+			return nil
+		case <-dirty:
+		}
+		if wait := interval - time.Since(last); wait > 0 {
+			select {
+			case <-a.ctx.Done():
+				return nil
+			case <-time.After(wait):
+			}
+		}
+		last = time.Now()
+		state.setStatus(b.IsConnected(), b.GetRateLimit())
+		if _, err := io.WriteString(a.stdout, ansiClear+state.render(*depth, !*noColor)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+	"github.com/frankrap/bitmex-api/bitmextest"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+func TestWatchState_Render(t *testing.T) {
+	s := newWatchState("XBTUSD")
+	s.onBook(bitmex.OrderBook{
+		Asks: []bitmex.Item{{Price: 9000.5, Amount: 100}, {Price: 9001, Amount: 400}},
+		Bids: []bitmex.Item{{Price: 9000, Amount: 200}, {Price: 8999.5, Amount: 50}},
+	})
+	s.onTrades([]*swagger.Trade{
+		{Symbol: "XBTUSD", Side: bitmex.SIDE_BUY, Size: 10, Price: 9000.5},
+		{Symbol: "ETHUSD", Side: bitmex.SIDE_BUY, Size: 1, Price: 170},
+		{Symbol: "XBTUSD", Side: bitmex.SIDE_SELL, Size: 5, Price: 9000},
+	}, 20)
+	filled := s.onOrders([]*swagger.Order{
+		{OrderID: "a", Symbol: "XBTUSD", Side: bitmex.SIDE_BUY, OrderQty: 30, CumQty: 0, Price: 9000, OrdStatus: bitmex.OS_NEW},
+		{OrderID: "b", Symbol: "XBTUSD", Side: bitmex.SIDE_SELL, OrderQty: 10, Price: 9100, OrdStatus: bitmex.OS_CANCELED},
+	})
+	if filled {
+		t.Error("nothing filled yet")
+	}
+	if !s.onOrders([]*swagger.Order{{OrderID: "a", Symbol: "XBTUSD", Side: bitmex.SIDE_BUY, OrderQty: 30, CumQty: 10, Price: 9000, OrdStatus: bitmex.OS_PARTIALLY_FILLED}}) {
+		t.Error("expect filled")
+	}
+	s.onPositions("partial", []byte(`[{"symbol":"XBTUSD","currentQty":10,"avgEntryPrice":9000,"markPrice":9000.2},{"symbol":"ETHUSD","currentQty":3}]`))
+	s.onPositions("update", []byte(`[{"symbol":"XBTUSD","markPrice":9001,"unrealisedPnl":1234}]`))
+	s.setStatus(true, bitmex.RateLimit{Limit: 60, Remaining: 59})
+
+	lines := strings.Split(s.render(10, false), "\n")
+	expect := []string{
+		"XBTUSD  connected  last -  rate limit 59/60",
+		"Position 10 @ 9000  mark 9001  liq 0  lev 0x  uPnL 1234  rPnL 0",
+		"",
+		"                           SIZE      PRICE     MINE  | TRADES",
+		"████████████████████        400       9001           | 00:00:00.000 Sell        5       9000",
+		"               █████        100     9000.5           | 00:00:00.000 Buy        10     9000.5",
+		"                                spread 0.5           |",
+		"          ██████████        200       9000       20  |",
+		"                 ███         50     8999.5           |",
+		"",
+		"Open orders",
+		"Buy        20 / 30       @ 9000       a",
+	}
+	for i, want := range expect {
+		if i >= len(lines) || lines[i] != want {
+			t.Fatalf("line %d\n got %q\nwant %q\n%v", i, lines[i], want, strings.Join(lines, "\n"))
+		}
+	}
+
+	// closed, the update carries currentQty 0
+	s.onPositions("update", []byte(`[{"symbol":"XBTUSD","currentQty":0,"realisedPnl":500}]`))
+	if lines = strings.Split(s.render(10, false), "\n"); lines[1] != "Position flat" || s.position.RealisedPnl != 500 {
+		t.Errorf("position %q %+v", lines[1], s.position)
+	}
+}
+
+// syncBuffer is written by the render loop while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatch(t *testing.T) {
+	srv, config := setup(t)
+	handleFixture(t, srv, "GET", "/position", "position.json")
+	srv.Script(bitmextest.ScriptOnSubscribe("orderBookL2_25:XBTUSD"),
+		`{"table":"orderBookL2_25","action":"partial","data":[{"symbol":"XBTUSD","id":1,"side":"Sell","size":300,"price":9000.5},{"symbol":"XBTUSD","id":2,"side":"Buy","size":700,"price":9000}]}`)
+	srv.Script(bitmextest.ScriptOnSubscribe("trade:XBTUSD"),
+		`{"table":"trade","action":"insert","data":[{"timestamp":"2019-04-09T08:15:12.704Z","symbol":"XBTUSD","side":"Sell","size":25,"price":9000}]}`)
+	srv.Script(bitmextest.ScriptOnSubscribe("order:XBTUSD"),
+		`{"table":"order","action":"partial","data":[{"orderID":"o-1","symbol":"XBTUSD","side":"Buy","orderQty":40,"cumQty":0,"price":9000,"ordStatus":"New"}]}`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := &syncBuffer{}
+	done := make(chan error)
+	go func() {
+		done <- run(ctx, []string{"-config", config, "watch", "XBTUSD", "-no-color", "-fps", "50"}, out, ioutil.Discard)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	var frame string
+	for time.Now().Before(deadline) {
+		frames := strings.Split(out.String(), ansiClear)
+		frame = frames[len(frames)-1]
+		if strings.Contains(frame, "spread 0.5") && strings.Contains(frame, "08:15:12.704 Sell") &&
+			strings.Contains(frame, "Buy        40 / 40") && strings.Contains(frame, "Position 100 @ 8950") {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(frame, "spread 0.5") || !strings.Contains(frame, "Position 100 @ 8950") || !strings.Contains(frame, "Buy        40 / 40") {
+		t.Fatalf("frame\n%v", frame)
+	}
+	if !strings.HasSuffix(out.String(), ansiShowCursor) {
+		t.Error("cursor not restored")
+	}
+}
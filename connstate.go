@@ -0,0 +1,122 @@
+package bitmex
+
+import (
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api/recws"
+)
+
+// BitmexConnState fires on every state change of the realtime connection,
+// listener: func(ev ConnEvent)
+const BitmexConnState = "connState"
+
+// ConnState is a state of the realtime connection
+type ConnState = recws.State
+
+// ConnEvent is a state change, Err is set for Disconnected and Backoff
+type ConnEvent = recws.Event
+
+const (
+	ConnConnecting    = recws.StateConnecting
+	ConnConnected     = recws.StateConnected
+	ConnAuthenticated = recws.StateAuthenticated // authKey accepted
+	ConnSubscribed    = recws.StateSubscribed    // every topic of the connection acknowledged
+	ConnDisconnected  = recws.StateDisconnected
+	ConnBackoff       = recws.StateBackoff
+	ConnClosed        = recws.StateClosed
+)
+
+// ConnStats are the state and counters of the realtime connection
+type ConnStats struct {
+	State       ConnState
+	Since       time.Time // of State
+	Connects    int64
+	Disconnects int64
+	Backoffs    int64 // failed dials and subscribe handlers
+	LastError   error // of a disconnect, a dial or an error response
+	LastErrorAt time.Time
+	LastMessage time.Time     // anything received, pongs included
+	PingRTT     time.Duration // of the last answered ping
+}
+
+// connState tracks the realtime connection for ConnStats
+type connState struct {
+	mu      sync.Mutex
+	stats   ConnStats
+	pending map[string]bool // topics waiting for their subscribe response
+}
+
+// ConnStats returns the state and counters of the realtime connection
+func (b *BitMEX) ConnStats() ConnStats {
+	b.connState.mu.Lock()
+	stats := b.connState.stats
+	b.connState.mu.Unlock()
+	stats.LastMessage = b.LastMessage()
+	stats.PingRTT = b.PingRTT()
+	return stats
+}
+
+// stateHandler is the recws StateHandler, also called for Authenticated and Subscribed
+func (b *BitMEX) stateHandler(ev ConnEvent) {
+	s := &b.connState
+	s.mu.Lock()
+	s.stats.State = ev.State
+	s.stats.Since = ev.Time
+	switch ev.State {
+	case ConnConnected:
+		s.stats.Connects++
+		b.heartbeat.reset()
+	case ConnDisconnected:
+		s.stats.Disconnects++
+	case ConnBackoff:
+		s.stats.Backoffs++
+	}
+	if ev.Err != nil {
+		s.stats.LastError = ev.Err
+		s.stats.LastErrorAt = ev.Time
+	}
+	s.mu.Unlock()
+
+	switch ev.State {
+	case ConnDisconnected, ConnBackoff:
+		b.log().Warn("ws state", "state", ev.State, "err", ev.Err, "delay", ev.Delay)
+	default:
+		b.log().Debug("ws state", "state", ev.State)
+	}
+	b.emit(BitmexConnState, ev)
+}
+
+// connError records an error response, the connection stays up
+func (b *BitMEX) connError(err error) {
+	s := &b.connState
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.LastError = err
+	s.stats.LastErrorAt = time.Now()
+}
+
+// expectSubscribed waits for topics before reporting Subscribed
+func (b *BitMEX) expectSubscribed(topics []interface{}) {
+	s := &b.connState
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		if t, ok := topic.(string); ok {
+			s.pending[t] = true
+		}
+	}
+}
+
+// subscribed acknowledges topic, Subscribed is reported with the last one
+func (b *BitMEX) subscribed(topic string) {
+	s := &b.connState
+	s.mu.Lock()
+	done := s.pending[topic] && len(s.pending) == 1
+	delete(s.pending, topic)
+	s.mu.Unlock()
+	if done {
+		b.ws.SetState(ConnEvent{State: ConnSubscribed})
+	}
+}
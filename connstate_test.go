@@ -0,0 +1,97 @@
+package bitmex
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stateRecorder struct {
+	mu     sync.Mutex
+	events []ConnEvent
+}
+
+func (r *stateRecorder) listener(ev ConnEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *stateRecorder) states() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var states []string
+	for _, ev := range r.events {
+		states = append(states, ev.State.String())
+	}
+	return strings.Join(states, ",")
+}
+
+func (r *stateRecorder) last(state ConnState) (ev ConnEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.events {
+		if e.State == state {
+			ev = e
+		}
+	}
+	return
+}
+
+func TestBitMEX_ConnState(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	b.ws.RecIntvlMin = 50 * time.Millisecond
+	rec := &stateRecorder{}
+	b.On(BitmexConnState, rec.listener)
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrder, Param: "XBTUSD"}, {Op: BitmexWSPosition, Param: "XBTUSD"}})
+
+	startWS(t, b)
+	up := "Connecting,Connected,Authenticated,Subscribed"
+	waitFor(t, "subscribed", func() bool { return rec.states() == up })
+	if st := b.ConnStats(); st.State != ConnSubscribed || st.Connects != 1 || st.LastError != nil {
+		t.Errorf("stats %+v", st)
+	}
+
+	srv.DropWS()
+	waitFor(t, "resubscribed", func() bool { return rec.states() == up+",Disconnected,"+up })
+	if ev := rec.last(ConnDisconnected); ev.Err == nil {
+		t.Error("disconnect without a reason")
+	}
+	st := b.ConnStats()
+	if st.Connects != 2 || st.Disconnects != 1 || st.LastError == nil {
+		t.Errorf("stats %+v", st)
+	}
+
+	// an error response is recorded, the connection stays up
+	b.sendWSMessage(WSCmd{Command: "bogus"})
+	waitFor(t, "error response", func() bool {
+		err, ok := b.ConnStats().LastError.(*WSError)
+		return ok && err.Status == 400
+	})
+
+	b.CloseWS()
+	waitFor(t, "closed", func() bool { return strings.HasSuffix(rec.states(), ",Closed") })
+	if st := b.ConnStats(); st.State != ConnClosed {
+		t.Errorf("state %v", st.State)
+	}
+}
+
+func TestBitMEX_ConnStateBackoff(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	b.ws.RecIntvlMin = 50 * time.Millisecond
+	rec := &stateRecorder{}
+	b.On(BitmexConnState, rec.listener)
+	startWS(t, b)
+	waitFor(t, "connected", func() bool { return b.ConnStats().Connects == 1 })
+
+	srv.Close()
+	waitFor(t, "backoff", func() bool { return b.ConnStats().Backoffs >= 2 })
+	ev := rec.last(ConnBackoff)
+	if ev.Err == nil || ev.Delay <= 0 || !strings.Contains(rec.states(), "Disconnected,Connecting,Backoff,Connecting") {
+		t.Errorf("%v, states %v", ev, rec.states())
+	}
+	if st := b.ConnStats(); st.Connects != 1 || st.LastError == nil {
+		t.Errorf("stats %+v", st)
+	}
+}
@@ -0,0 +1,237 @@
+package bitmex
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+	"gopkg.in/yaml.v2"
+)
+
+// Signer signs rest requests and the ws authKey message. It is
+// consulted for every signature, a rotated key is used by the next request
+// and the next ws (re)connection, the live connection stays up.
+type Signer = swagger.Signer
+
+// Credentials is an api key pair
+type Credentials struct {
+	Key    string `yaml:"key" json:"key"`
+	Secret string `yaml:"secret" json:"secret"`
+}
+
+// CredentialProvider returns the current credentials
+type CredentialProvider interface {
+	Credentials() (Credentials, error)
+}
+
+// StaticCredentials never change
+type StaticCredentials Credentials
+
+// Credentials implements CredentialProvider
+func (c StaticCredentials) Credentials() (Credentials, error) {
+	return Credentials(c), nil
+}
+
+// EnvCredentials reads the key and secret from environment variables, e.g.
+// EnvCredentials("BITMEX_KEY", "BITMEX_SECRET")
+type EnvCredentials struct {
+	KeyVar    string
+	SecretVar string
+}
+
+// Credentials implements CredentialProvider
+func (e EnvCredentials) Credentials() (Credentials, error) {
+	c := Credentials{Key: os.Getenv(e.KeyVar), Secret: os.Getenv(e.SecretVar)}
+	if c.Key == "" || c.Secret == "" {
+		return c, fmt.Errorf("credentials: %v or %v not set", e.KeyVar, e.SecretVar)
+	}
+	return c, nil
+}
+
+// FileCredentials reads "key: ..." and "secret: ..." from a yaml (or json)
+// file, it is read again when it changes, so rotating a key is rewriting the file
+type FileCredentials struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	creds   Credentials
+}
+
+// Credentials implements CredentialProvider
+func (f *FileCredentials) Credentials() (Credentials, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return Credentials{}, err
+	}
+	if fi.ModTime().Equal(f.modTime) && f.creds.Key != "" {
+		return f.creds, nil
+	}
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return Credentials{}, err
+	}
+	var c Credentials
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return Credentials{}, fmt.Errorf("credentials: %v: %v", f.Path, err)
+	}
+	if c.Key == "" || c.Secret == "" {
+		return Credentials{}, fmt.Errorf("credentials: %v: no key or secret", f.Path)
+	}
+	f.creds = c
+	f.modTime = fi.ModTime()
+	return c, nil
+}
+
+// hmacSigner signs with the secret of a CredentialProvider
+type hmacSigner struct {
+	p CredentialProvider
+}
+
+// NewHMACSigner signs in process with the credentials of p
+func NewHMACSigner(p CredentialProvider) Signer {
+	return hmacSigner{p}
+}
+
+func (s hmacSigner) Sign(payload string) (string, string, error) {
+	c, err := s.p.Credentials()
+	if err != nil {
+		return "", "", err
+	}
+	return c.Key, swagger.CalSignature(c.Secret, payload), nil
+}
+
+// signRequest and signResponse are the json lines of the signing socket protocol
+type signRequest struct {
+	Payload string `json:"payload"`
+}
+
+type signResponse struct {
+	Key       string `json:"key"`
+	Signature string `json:"signature"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SocketSigner asks a signing process, e.g. one running ServeSigner, to sign
+// over a local socket, the secret stays out of the trading process.
+// Each Sign sends a {"payload":...} line and reads a {"key":...,"signature":...} line.
+type SocketSigner struct {
+	Network string // "unix" or "tcp"
+	Address string
+	Timeout time.Duration // 0 for 5s
+}
+
+// Sign implements Signer
+func (s *SocketSigner) Sign(payload string) (string, string, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	conn, err := net.DialTimeout(s.Network, s.Address, timeout)
+	if err != nil {
+		return "", "", fmt.Errorf("signer: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(signRequest{Payload: payload}); err != nil {
+		return "", "", fmt.Errorf("signer: %v", err)
+	}
+	var resp signResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return "", "", fmt.Errorf("signer: %v", err)
+	}
+	if resp.Error != "" {
+		return "", "", fmt.Errorf("signer: %v", resp.Error)
+	}
+	return resp.Key, resp.Signature, nil
+}
+
+// ServeSigner answers SocketSigner requests with signer until l is closed
+func ServeSigner(l net.Listener, signer Signer) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSignerConn(conn, signer)
+	}
+}
+
+func serveSignerConn(conn net.Conn, signer Signer) {
+	defer conn.Close()
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	enc := json.NewEncoder(conn)
+	for {
+		var req signRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		var resp signResponse
+		key, signature, err := signer.Sign(req.Payload)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Key, resp.Signature = key, signature
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// SetSigner replaces the api key and secret given to New, nil goes back to them
+func (b *BitMEX) SetSigner(s Signer) {
+	b.signerMutex.Lock()
+	defer b.signerMutex.Unlock()
+	b.signer = s
+}
+
+// SetCredentials signs in process with the credentials of p
+func (b *BitMEX) SetCredentials(p CredentialProvider) {
+	b.SetSigner(NewHMACSigner(p))
+}
+
+func (b *BitMEX) getSigner() Signer {
+	b.signerMutex.RLock()
+	defer b.signerMutex.RUnlock()
+	return b.signer
+}
+
+// clientSigner is the swagger.Signer of the client, it follows SetSigner
+// and remembers the last key for the log redaction
+type clientSigner struct {
+	b *BitMEX
+}
+
+func (s clientSigner) Sign(payload string) (string, string, error) {
+	signer := s.b.getSigner()
+	if signer == nil {
+		return s.b.Key, swagger.CalSignature(s.b.Secret, payload), nil
+	}
+	key, signature, err := signer.Sign(payload)
+	if err == nil {
+		s.b.signedKey.Store(key)
+	}
+	return key, signature, err
+}
+
+// hasCredentials tells whether private requests can be signed
+func (b *BitMEX) hasCredentials() bool {
+	return b.getSigner() != nil || (b.Key != "" && b.Secret != "")
+}
+
+// lastKey is the key of the last signature made by a Signer
+func (b *BitMEX) lastKey() string {
+	key, _ := b.signedKey.Load().(string)
+	return key
+}
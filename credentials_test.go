@@ -0,0 +1,130 @@
+package bitmex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCredentials(t *testing.T, path string, key string, secret string, modTime time.Time) {
+	t.Helper()
+	data := fmt.Sprintf("key: %v\nsecret: %v\n", key, secret)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the mtime resolution of some filesystems is a second
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.yaml")
+	f := &FileCredentials{Path: path}
+	if _, err := f.Credentials(); err == nil {
+		t.Error("expect error for a missing file")
+	}
+
+	writeCredentials(t, path, testKey, testSecret, time.Now().Add(-time.Minute))
+	c, err := f.Credentials()
+	if err != nil || c.Key != testKey || c.Secret != testSecret {
+		t.Fatalf("got %+v, %v", c, err)
+	}
+
+	writeCredentials(t, path, testKey2, testSecret2, time.Now())
+	if c, _ = f.Credentials(); c.Key != testKey2 {
+		t.Errorf("not reloaded %+v", c)
+	}
+}
+
+func TestEnvCredentials(t *testing.T) {
+	t.Setenv("TEST_BITMEX_KEY", testKey)
+	e := EnvCredentials{KeyVar: "TEST_BITMEX_KEY", SecretVar: "TEST_BITMEX_SECRET"}
+	if _, err := e.Credentials(); err == nil {
+		t.Error("expect error without a secret")
+	}
+	t.Setenv("TEST_BITMEX_SECRET", testSecret)
+	if c, err := e.Credentials(); err != nil || c.Key != testKey || c.Secret != testSecret {
+		t.Errorf("got %+v, %v", c, err)
+	}
+}
+
+func TestBitMEX_SocketSigner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go ServeSigner(l, NewHMACSigner(StaticCredentials{Key: testKey, Secret: testSecret}))
+
+	srv := newTestServer(t)
+	b := newBitmexForServer(srv, "", "")
+	b.SetSigner(&SocketSigner{Network: "tcp", Address: l.Addr().String()})
+	handleFixture(t, srv, "GET", "/order", "orders.json").Private()
+
+	if _, err := b.GetOrders("XBTUSD"); err != nil {
+		t.Fatalf("%v, auth errors %v", err, srv.AuthErrors())
+	}
+
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrder, Param: "XBTUSD"}})
+	startWS(t, b)
+	if !srv.WaitWSMessage("subscribe", 5*time.Second) {
+		t.Fatal("not subscribed")
+	}
+	if errs := srv.AuthErrors(); len(errs) != 0 {
+		t.Errorf("auth errors %v", errs)
+	}
+
+	// the signing process is gone
+	l.Close()
+	if _, err := b.GetOrders("XBTUSD"); err == nil {
+		t.Error("expect signer error")
+	}
+}
+
+func TestBitMEX_RotateCredentials(t *testing.T) {
+	srv := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "key.yaml")
+	writeCredentials(t, path, testKey, testSecret, time.Now().Add(-time.Minute))
+	b := newBitmexForServer(srv, "", "")
+	b.ws.RecIntvlMin = 50 * time.Millisecond
+	b.SetCredentials(&FileCredentials{Path: path})
+	handleFixture(t, srv, "GET", "/order", "orders.json").Private()
+
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrder, Param: "XBTUSD"}})
+	startWS(t, b)
+	if !srv.WaitWSMessage("subscribe", 5*time.Second) {
+		t.Fatal("not subscribed")
+	}
+	if _, err := b.GetOrders("XBTUSD"); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate, the connection stays up
+	srv.RequireAuth(testKey2, testSecret2)
+	writeCredentials(t, path, testKey2, testSecret2, time.Now())
+	if _, err := b.GetOrders("XBTUSD"); err != nil {
+		t.Fatalf("%v, auth errors %v", err, srv.AuthErrors())
+	}
+	if srv.Dials() != 1 {
+		t.Errorf("%d dials", srv.Dials())
+	}
+
+	// and authenticates with the new key when it reconnects
+	srv.DropWS()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.Dials() < 2 || !b.IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("not reconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if errs := srv.AuthErrors(); len(errs) != 0 {
+		t.Errorf("auth errors %v", errs)
+	}
+}
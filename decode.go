@@ -0,0 +1,131 @@
+package bitmex
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/frankrap/bitmex-api/swagger"
+	"github.com/tidwall/gjson"
+)
+
+// decodeMessage decodes a frame in one pass: table and action are sniffed
+// and the rows unmarshalled once into the type of the table. Responses to
+// commands are rare and decoded generically.
+func decodeMessage(message []byte) (Response, error) {
+	table := gjson.GetBytes(message, "table")
+	if !table.Exists() {
+		var res Response
+		err := json.Unmarshal(message, &res)
+		return res, err
+	}
+	res := Response{
+		Table:  table.String(),
+		Action: gjson.GetBytes(message, "action").String(),
+	}
+
+	var err error
+	switch res.Table {
+	case BitmexWSInstrument:
+		var instruments []*swagger.Instrument
+		err = decodeData(message, &instruments)
+		res.Data = instruments
+	case BitmexWSFunding:
+		var fundings []*swagger.Funding
+		err = decodeData(message, &fundings)
+		res.Data = fundings
+	case BitmexWSOrderBookL2, BitmexWSOrderBookL2_25:
+		res.rows, err = decodeOrderBookRows(message)
+		if err == nil {
+			res.Data = res.rows.data
+		}
+	case BitmexWSOrderBook10:
+		var books []*OrderBook10
+		err = decodeData(message, &books)
+		res.Data = books
+	case BitmexWSQuote:
+		var quotes []*swagger.Quote
+		err = decodeData(message, &quotes)
+		res.Data = quotes
+	case BitmexWSTradeBin1m, BitmexWSTradeBin5m, BitmexWSTradeBin1h, BitmexWSTradeBin1d:
+		var tradeBins []*swagger.TradeBin
+		err = decodeData(message, &tradeBins)
+		res.Data = tradeBins
+	case BitmexWSTrade:
+		var trades []*swagger.Trade
+		err = decodeData(message, &trades)
+		res.Data = trades
+	case BitmexWSExecution:
+		var executions []*swagger.Execution
+		err = decodeData(message, &executions)
+		res.Data = executions
+	case BitmexWSOrder:
+		var orders []*swagger.Order
+		err = decodeData(message, &orders)
+		res.Data = orders
+	case BitmexWSMargin:
+		var margins []*swagger.Margin
+		err = decodeData(message, &margins)
+		res.Data = margins
+	case BitmexWSPosition:
+		var positions []*swagger.Position
+		err = decodeData(message, &positions)
+		res.Data = positions
+	case BitmexWSWallet:
+		var wallets []*swagger.Wallet
+		err = decodeData(message, &wallets)
+		res.Data = wallets
+	default:
+		var data interface{}
+		err = decodeData(message, &data)
+		res.Data = data
+	}
+	return res, err
+}
+
+// decodeData unmarshals the data field of a frame into data, a pointer
+func decodeData(message []byte, data interface{}) error {
+	return json.Unmarshal(message, &struct {
+		Data interface{} `json:"data"`
+	}{data})
+}
+
+// orderBookRows are the decoded rows of an orderBookL2 frame, the pointers
+// of data point into rows. Both are reused once the frame is processed, the
+// local book copies what it keeps.
+type orderBookRows struct {
+	rows []OrderBookL2
+	data OrderBookData
+}
+
+var orderBookRowsPool = sync.Pool{
+	New: func() interface{} { return new(orderBookRows) },
+}
+
+func decodeOrderBookRows(message []byte) (*orderBookRows, error) {
+	r := orderBookRowsPool.Get().(*orderBookRows)
+	// encoding/json decodes into the old elements within the capacity,
+	// update and delete rows come without price
+	rows := r.rows[:cap(r.rows)]
+	for i := range rows {
+		rows[i] = OrderBookL2{}
+	}
+	r.rows = rows[:0]
+	if err := decodeData(message, &r.rows); err != nil {
+		orderBookRowsPool.Put(r)
+		return nil, err
+	}
+	r.data = r.data[:0]
+	for i := range r.rows {
+		r.data = append(r.data, &r.rows[i])
+	}
+	return r, nil
+}
+
+// release returns the pooled rows, Data must not be used after
+func (r *Response) release() {
+	if r.rows != nil {
+		orderBookRowsPool.Put(r.rows)
+		r.rows = nil
+		r.Data = nil
+	}
+}
@@ -0,0 +1,182 @@
+package bitmex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/frankrap/bitmex-api/swagger"
+	"github.com/tidwall/gjson"
+)
+
+// loadFrames reads testdata/ws_frames.jsonl: partial, update, delete and
+// insert of orderBookL2, then a trade insert
+func loadFrames(t testing.TB) [][]byte {
+	f, err := os.Open("testdata/ws_frames.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var frames [][]byte
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if line := s.Bytes(); len(line) > 0 && line[0] != '#' {
+			frames = append(frames, append([]byte(nil), line...))
+		}
+	}
+	return frames
+}
+
+func TestDecodeMessage(t *testing.T) {
+	frames := loadFrames(t)
+	partial, err := decodeMessage(frames[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, _ := partial.Data.(OrderBookData)
+	if partial.Action != "partial" || len(rows) != 100 || rows[0].Price == 0 {
+		t.Fatalf("partial %v %d rows", partial.Action, len(rows))
+	}
+	partial.release()
+
+	// the pooled rows of the partial don't leak their prices into the update
+	update, err := decodeMessage(frames[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer update.release()
+	rows, _ = update.Data.(OrderBookData)
+	if update.Table != BitmexWSOrderBookL2 || update.Action != "update" || len(rows) != 8 {
+		t.Fatalf("update %v %v %d rows", update.Table, update.Action, len(rows))
+	}
+	for _, row := range rows {
+		if row.Price != 0 || row.Size == 0 || row.Symbol != "XBTUSD" {
+			t.Errorf("row %+v", *row)
+		}
+	}
+
+	trade, err := decodeMessage(frames[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	trades, _ := trade.Data.([]*swagger.Trade)
+	if len(trades) != 5 || trades[0].Timestamp.IsZero() || trades[0].TrdMatchID == "" {
+		t.Errorf("trades %+v", trades)
+	}
+
+	// responses and unknown tables stay generic
+	res, err := decodeMessage([]byte(`{"success":true,"subscribe":"trade:XBTUSD","request":{"op":"subscribe","args":["trade:XBTUSD"]}}`))
+	if err != nil || !res.Success || res.Subscribe != "trade:XBTUSD" || res.Request == nil {
+		t.Errorf("response %+v %v", res, err)
+	}
+	res, err = decodeMessage([]byte(`{"table":"chat","action":"insert","data":[{"user":"a"}]}`))
+	if rows, ok := res.Data.([]interface{}); err != nil || !ok || len(rows) != 1 {
+		t.Errorf("chat %+v %v", res, err)
+	}
+	if _, err = decodeMessage([]byte(`{"table":"orderBookL2","action":"update","data":[{"id":"x"}]}`)); err == nil {
+		t.Error("expect decode error")
+	}
+}
+
+func TestBitMEX_ProcessMessageReusesRows(t *testing.T) {
+	b := New(nil, HostTestnet, "", "", false)
+	b.SetLogger(NopLogger)
+	frames := loadFrames(t)
+	for _, frame := range frames[:4] {
+		if err := b.processMessage(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the partial and insert rows were copied before their slices were reused
+	for i := 0; i < 10; i++ {
+		b.processMessage(frames[1])
+	}
+	ob := b.orderBookLocals["XBTUSD"].GetOrderbook()
+	if len(ob.Bids)+len(ob.Asks) != 99 {
+		t.Errorf("%d bids %d asks", len(ob.Bids), len(ob.Asks))
+	}
+	for _, level := range append(ob.Bids, ob.Asks...) {
+		if level.Price < 8975 || level.Price > 9025.5 || level.Amount == 0 {
+			t.Errorf("level %+v", level)
+		}
+	}
+}
+
+// decodeMessageTwoPass is the decoder before the single pass one, kept to
+// compare: the whole frame into Response, gjson for data and the typed rows
+func decodeMessageTwoPass(message []byte) (Response, error) {
+	var res Response
+	if err := json.Unmarshal(message, &res); err != nil {
+		return res, err
+	}
+	raw := gjson.ParseBytes(message).Get("data").Raw
+	var err error
+	switch res.Table {
+	case BitmexWSOrderBookL2:
+		var orderbooks OrderBookData
+		err = json.Unmarshal([]byte(raw), &orderbooks)
+		res.Data = orderbooks
+	case BitmexWSTrade:
+		var trades []*swagger.Trade
+		err = json.Unmarshal([]byte(raw), &trades)
+		res.Data = trades
+	}
+	return res, err
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+	frames := loadFrames(b)
+	for _, bc := range []struct {
+		name  string
+		frame []byte
+	}{
+		{"orderBookL2 partial", frames[0]},
+		{"orderBookL2 update", frames[1]},
+		{"trade", frames[4]},
+	} {
+		b.Run(bc.name+"/two pass", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bc.frame)))
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeMessageTwoPass(bc.frame); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(bc.name+"/single pass", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(bc.frame)))
+			for i := 0; i < b.N; i++ {
+				res, err := decodeMessage(bc.frame)
+				if err != nil {
+					b.Fatal(err)
+				}
+				res.release()
+			}
+		})
+	}
+}
+
+// BenchmarkProcessMessage is the hot path of the reader, an orderBookL2
+// update applied to the local book and emitted
+func BenchmarkProcessMessage(b *testing.B) {
+	client := New(nil, HostTestnet, "", "", false)
+	client.SetLogger(NopLogger)
+	frames := loadFrames(b)
+	if err := client.processMessage(frames[0]); err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		buf.Write(frames[1])
+		if err := client.processMessage(buf.Bytes()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/frankrap/bitmex-api"
 	"github.com/frankrap/bitmex-api/swagger"
@@ -35,7 +36,9 @@ func main() {
 		fmt.Printf("Wallet action=%v margins=%#v\n", action, m)
 	})
 
-	b.StartWS()
+	if err := b.StartWS(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 
 	// Get orderbook by rest api
 	b.GetOrderBook(10, "XBTUSD")
@@ -0,0 +1,473 @@
+package bitmex
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chuckpreslar/emission"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+const (
+	// BitmexFundingAlert fires AlertBefore ahead of each funding time,
+	// listener: func(info FundingInfo, left time.Duration)
+	BitmexFundingAlert = "fundingAlert"
+
+	// 资金费率区间在 BitMEX 中以 2000-01-01 为原点的时间表示, 如 08:00 代表 8 小时
+	fundingIntervalEpochYear = 2000
+
+	fundingHistoryMax = 1000
+)
+
+var (
+	ErrNoFundingInfo = errors.New("no funding info")
+	ErrNoMarkPrice   = errors.New("no mark price")
+)
+
+// FundingInfo is the latest funding state of a perpetual swap
+type FundingInfo struct {
+	Symbol                string
+	FundingRate           float64       // 下一次结算的资金费率
+	IndicativeFundingRate float64       // 预测的再下一次资金费率
+	FundingTimestamp      time.Time     // 下一次结算时间
+	FundingInterval       time.Duration // 结算间隔, 通常 8 小时
+	MarkPrice             float64
+	Multiplier            float64
+	IsInverse             bool
+	Timestamp             time.Time
+}
+
+// FundingAfter returns the first funding time strictly after t
+func (f FundingInfo) FundingAfter(t time.Time) time.Time {
+	next := f.FundingTimestamp
+	if next.IsZero() || f.FundingInterval <= 0 || next.After(t) {
+		return next
+	}
+	n := t.Sub(next)/f.FundingInterval + 1
+	return next.Add(n * f.FundingInterval)
+}
+
+// FundingProjection is the expected funding payment of a position at the next funding time
+type FundingProjection struct {
+	Symbol           string
+	CurrentQty       float64
+	MarkPrice        float64
+	FundingRate      float64
+	FundingTimestamp time.Time
+	// Payment is in the settlement currency (XBt for XBTUSD),
+	// positive means the position receives funding, negative means it pays
+	Payment float64
+	// IndicativePayment uses IndicativeFundingRate, i.e. the funding after next
+	IndicativePayment float64
+}
+
+// ProjectFunding calculates the funding payment for a position size at markPrice.
+// Longs pay shorts when the rate is positive.
+func (f FundingInfo) ProjectFunding(currentQty float64, markPrice float64) (p FundingProjection, err error) {
+	if markPrice <= 0 {
+		markPrice = f.MarkPrice
+	}
+	if markPrice <= 0 {
+		err = ErrNoMarkPrice
+		return
+	}
+	multiplier := math.Abs(f.Multiplier)
+	if multiplier == 0 {
+		multiplier = 1
+	}
+	var value float64
+	if f.IsInverse {
+		value = currentQty * multiplier / markPrice
+	} else {
+		value = currentQty * multiplier * markPrice
+	}
+
+	p.Symbol = f.Symbol
+	p.CurrentQty = currentQty
+	p.MarkPrice = markPrice
+	p.FundingRate = f.FundingRate
+	p.FundingTimestamp = f.FundingTimestamp
+	p.Payment = -value * f.FundingRate
+	p.IndicativePayment = -value * f.IndicativeFundingRate
+	return
+}
+
+func parseFundingInterval(t time.Time) time.Duration {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Sub(time.Date(fundingIntervalEpochYear, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// FundingTracker keeps funding info from instrument updates and funding history,
+// and raises BitmexFundingAlert before each funding time.
+type FundingTracker struct {
+	mu          sync.RWMutex
+	infos       map[string]*FundingInfo      // key: symbol
+	history     map[string][]swagger.Funding // key: symbol
+	timers      map[string]*time.Timer       // key: symbol
+	scheduled   map[string]time.Time         // key: symbol, funding time of the pending alert
+	alertBefore time.Duration
+
+	emit func(event string, arguments ...interface{})
+	now  func() time.Time
+}
+
+func NewFundingTracker(emitter *emission.Emitter) *FundingTracker {
+	t := newFundingTracker(nil)
+	if emitter != nil {
+		t.emit = func(event string, arguments ...interface{}) {
+			emitter.Emit(event, arguments...)
+		}
+	}
+	return t
+}
+
+// newFundingTracker raises the alerts through emit, BitMEX passes its own emit
+// so that the alerts reach the emit hook, the Hub and the metrics
+func newFundingTracker(emit func(event string, arguments ...interface{})) *FundingTracker {
+	return &FundingTracker{
+		infos:     make(map[string]*FundingInfo),
+		history:   make(map[string][]swagger.Funding),
+		timers:    make(map[string]*time.Timer),
+		scheduled: make(map[string]time.Time),
+		emit:      emit,
+		now:       time.Now,
+	}
+}
+
+// SetAlertBefore sets how long before each funding time BitmexFundingAlert fires, 0 disables it
+func (t *FundingTracker) SetAlertBefore(d time.Duration) {
+	t.mu.Lock()
+	t.alertBefore = d
+	for symbol, timer := range t.timers {
+		timer.Stop()
+		delete(t.timers, symbol)
+		delete(t.scheduled, symbol)
+	}
+	symbols := make([]string, 0, len(t.infos))
+	for symbol := range t.infos {
+		symbols = append(symbols, symbol)
+	}
+	t.mu.Unlock()
+
+	for _, symbol := range symbols {
+		t.schedule(symbol)
+	}
+}
+
+// Get returns the funding info of symbol
+func (t *FundingTracker) Get(symbol string) (info FundingInfo, ok bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	v, ok := t.infos[symbol]
+	if ok {
+		info = *v
+	}
+	return
+}
+
+// Symbols returns all tracked perpetual symbols
+func (t *FundingTracker) Symbols() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	symbols := make([]string, 0, len(t.infos))
+	for symbol := range t.infos {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// History returns the funding history of symbol, oldest first
+func (t *FundingTracker) History(symbol string) []swagger.Funding {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	h := t.history[symbol]
+	result := make([]swagger.Funding, len(h))
+	copy(result, h)
+	return result
+}
+
+// fundingRow holds the funding keys of an instrument row, nil when the row doesn't carry the key
+type fundingRow struct {
+	Symbol                string     `json:"symbol"`
+	FundingTimestamp      *time.Time `json:"fundingTimestamp"`
+	FundingInterval       *time.Time `json:"fundingInterval"`
+	FundingRate           *float64   `json:"fundingRate"`
+	IndicativeFundingRate *float64   `json:"indicativeFundingRate"`
+	MarkPrice             *float64   `json:"markPrice"`
+	Multiplier            *float64   `json:"multiplier"`
+	IsInverse             *bool      `json:"isInverse"`
+	Timestamp             *time.Time `json:"timestamp"`
+}
+
+// UpdateInstruments merges instrument partial/insert/update data.
+// Only perpetuals (instruments with a funding timestamp) are tracked.
+// Zero fields are taken as absent, use apply with the raw rows to merge a rate of 0.
+func (t *FundingTracker) UpdateInstruments(instruments []*swagger.Instrument, action string) {
+	rows := make([]fundingRow, 0, len(instruments))
+	for _, v := range instruments {
+		row := fundingRow{Symbol: v.Symbol}
+		if !v.FundingTimestamp.IsZero() {
+			row.FundingTimestamp = &v.FundingTimestamp
+		}
+		if !v.FundingInterval.IsZero() {
+			row.FundingInterval = &v.FundingInterval
+		}
+		if v.FundingRate != 0 {
+			row.FundingRate = &v.FundingRate
+		}
+		if v.IndicativeFundingRate != 0 {
+			row.IndicativeFundingRate = &v.IndicativeFundingRate
+		}
+		if v.MarkPrice > 0 {
+			row.MarkPrice = &v.MarkPrice
+		}
+		if v.Multiplier != 0 {
+			multiplier := float64(v.Multiplier)
+			row.Multiplier = &multiplier
+		}
+		if v.IsInverse || action == bitmexActionInitialData || action == bitmexActionInsertData {
+			isInverse := v.IsInverse
+			row.IsInverse = &isInverse
+		}
+		if !v.Timestamp.IsZero() {
+			row.Timestamp = &v.Timestamp
+		}
+		rows = append(rows, row)
+	}
+	t.merge(rows)
+}
+
+// apply merges the raw instrument rows, data, of a ws frame.
+// Only the keys present in a row are merged, so an update can set a rate to 0.
+func (t *FundingTracker) apply(data []byte) error {
+	var rows []fundingRow
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return err
+	}
+	t.merge(rows)
+	return nil
+}
+
+func (t *FundingTracker) merge(rows []fundingRow) {
+	var changed []string
+
+	t.mu.Lock()
+	for _, v := range rows {
+		info, ok := t.infos[v.Symbol]
+		if !ok {
+			if v.FundingTimestamp == nil || v.FundingTimestamp.IsZero() {
+				continue
+			}
+			info = &FundingInfo{Symbol: v.Symbol}
+			t.infos[v.Symbol] = info
+		}
+		if v.FundingTimestamp != nil && !v.FundingTimestamp.IsZero() {
+			if !info.FundingTimestamp.Equal(*v.FundingTimestamp) {
+				changed = append(changed, v.Symbol)
+			}
+			info.FundingTimestamp = *v.FundingTimestamp
+		}
+		if v.FundingInterval != nil {
+			if d := parseFundingInterval(*v.FundingInterval); d > 0 {
+				info.FundingInterval = d
+			}
+		}
+		if v.FundingRate != nil {
+			info.FundingRate = *v.FundingRate
+		}
+		if v.IndicativeFundingRate != nil {
+			info.IndicativeFundingRate = *v.IndicativeFundingRate
+		}
+		if v.MarkPrice != nil {
+			info.MarkPrice = *v.MarkPrice
+		}
+		if v.Multiplier != nil {
+			info.Multiplier = *v.Multiplier
+		}
+		if v.IsInverse != nil {
+			info.IsInverse = *v.IsInverse
+		}
+		if v.Timestamp != nil {
+			info.Timestamp = *v.Timestamp
+		}
+	}
+	t.mu.Unlock()
+
+	for _, symbol := range changed {
+		t.schedule(symbol)
+	}
+}
+
+// AddHistory appends settled funding records, duplicates are ignored
+func (t *FundingTracker) AddHistory(fundings []swagger.Funding) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, v := range fundings {
+		h := t.history[v.Symbol]
+		dup := false
+		for i := len(h) - 1; i >= 0; i-- {
+			if h[i].Timestamp.Equal(v.Timestamp) {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		h = append(h, v)
+		sort.Slice(h, func(i, j int) bool {
+			return h[i].Timestamp.Before(h[j].Timestamp)
+		})
+		if len(h) > fundingHistoryMax {
+			h = h[len(h)-fundingHistoryMax:]
+		}
+		t.history[v.Symbol] = h
+	}
+}
+
+// Stop cancels all pending alerts
+func (t *FundingTracker) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for symbol, timer := range t.timers {
+		timer.Stop()
+		delete(t.timers, symbol)
+		delete(t.scheduled, symbol)
+	}
+}
+
+func (t *FundingTracker) schedule(symbol string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	info, ok := t.infos[symbol]
+	if !ok || t.alertBefore <= 0 || info.FundingTimestamp.IsZero() {
+		return
+	}
+	fundingTime := info.FundingTimestamp
+	if at, ok := t.scheduled[symbol]; ok && at.Equal(fundingTime) {
+		return
+	}
+	if timer, ok := t.timers[symbol]; ok {
+		timer.Stop()
+		delete(t.timers, symbol)
+	}
+
+	now := t.now()
+	if !fundingTime.After(now) {
+		return
+	}
+	delay := fundingTime.Add(-t.alertBefore).Sub(now)
+	if delay < 0 {
+		delay = 0
+	}
+	t.scheduled[symbol] = fundingTime
+	t.timers[symbol] = time.AfterFunc(delay, func() {
+		t.fire(symbol, fundingTime)
+	})
+}
+
+func (t *FundingTracker) fire(symbol string, fundingTime time.Time) {
+	t.mu.Lock()
+	info, ok := t.infos[symbol]
+	if !ok || !t.scheduled[symbol].Equal(fundingTime) {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.timers, symbol)
+	snapshot := *info
+	left := fundingTime.Sub(t.now())
+	t.mu.Unlock()
+
+	if t.emit != nil {
+		t.emit(BitmexFundingAlert, snapshot, left)
+	}
+}
+
+// SetFundingAlert sets how long before each funding time BitmexFundingAlert fires.
+// Subscribe BitmexWSInstrument so the funding times are known.
+func (b *BitMEX) SetFundingAlert(before time.Duration) {
+	b.funding.SetAlertBefore(before)
+}
+
+// GetFundingInfo returns the tracked funding info of a perpetual
+func (b *BitMEX) GetFundingInfo(symbol string) (FundingInfo, bool) {
+	return b.funding.Get(symbol)
+}
+
+// GetFundingTracker returns the funding tracker fed by the websocket
+func (b *BitMEX) GetFundingTracker() *FundingTracker {
+	return b.funding
+}
+
+// LoadFunding loads the current funding state and the latest funding history of symbol by rest api
+func (b *BitMEX) LoadFunding(symbol string, historyCount int) (info FundingInfo, err error) {
+	var instruments []swagger.Instrument
+	instruments, err = b.GetInstrument(symbol, 1, true)
+	if err != nil {
+		return
+	}
+	data := make([]*swagger.Instrument, 0, len(instruments))
+	for i := range instruments {
+		data = append(data, &instruments[i])
+	}
+	b.funding.UpdateInstruments(data, bitmexActionInitialData)
+
+	if historyCount > 0 {
+		var fundings []swagger.Funding
+		fundings, err = b.GetFundingHistory(symbol, historyCount, true, time.Time{}, time.Time{})
+		if err != nil {
+			return
+		}
+		b.funding.AddHistory(fundings)
+	}
+
+	var ok bool
+	info, ok = b.funding.Get(symbol)
+	if !ok {
+		err = ErrNoFundingInfo
+	}
+	return
+}
+
+// ProjectFunding projects the next funding payment of a position
+func (b *BitMEX) ProjectFunding(position swagger.Position) (p FundingProjection, err error) {
+	info, ok := b.funding.Get(position.Symbol)
+	if !ok {
+		err = ErrNoFundingInfo
+		return
+	}
+	return info.ProjectFunding(float64(position.CurrentQty), position.MarkPrice)
+}
+
+// ProjectFundingCurrent gets the current positions by rest api and projects their next funding payments
+func (b *BitMEX) ProjectFundingCurrent(symbol string) (result []FundingProjection, err error) {
+	var positions []swagger.Position
+	positions, err = b.GetPositions(symbol)
+	if err != nil {
+		return
+	}
+	for _, v := range positions {
+		if v.CurrentQty == 0 {
+			continue
+		}
+		p, e := b.ProjectFunding(v)
+		if e != nil {
+			continue
+		}
+		result = append(result, p)
+	}
+	return
+}
@@ -0,0 +1,169 @@
+package bitmex
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/chuckpreslar/emission"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+func TestFundingTracker_UpdateInstruments(t *testing.T) {
+	tracker := NewFundingTracker(nil)
+	fundingTime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	tracker.UpdateInstruments([]*swagger.Instrument{
+		{
+			Symbol:                "XBTUSD",
+			IsInverse:             true,
+			Multiplier:            -100000000,
+			FundingTimestamp:      fundingTime,
+			FundingInterval:       time.Date(2000, 1, 1, 8, 0, 0, 0, time.UTC),
+			FundingRate:           0.0001,
+			IndicativeFundingRate: 0.0002,
+			MarkPrice:             8000,
+		},
+		{
+			Symbol: "XBTM20", // futures have no funding
+		},
+	}, bitmexActionInitialData)
+
+	if symbols := tracker.Symbols(); len(symbols) != 1 || symbols[0] != "XBTUSD" {
+		t.Fatalf("symbols error %v", symbols)
+	}
+
+	tracker.UpdateInstruments([]*swagger.Instrument{
+		{Symbol: "XBTUSD", IndicativeFundingRate: -0.0003},
+	}, bitmexActionUpdateData)
+
+	info, ok := tracker.Get("XBTUSD")
+	if !ok {
+		t.Fatal("no funding info")
+	}
+	if info.FundingInterval != 8*time.Hour {
+		t.Errorf("funding interval error %v", info.FundingInterval)
+	}
+	if info.FundingRate != 0.0001 || info.IndicativeFundingRate != -0.0003 {
+		t.Errorf("funding rate error %#v", info)
+	}
+	if got := info.FundingAfter(fundingTime.Add(time.Hour)); !got.Equal(fundingTime.Add(8 * time.Hour)) {
+		t.Errorf("funding after error %v", got)
+	}
+}
+
+func TestFundingInfo_ProjectFunding(t *testing.T) {
+	info := FundingInfo{
+		Symbol:      "XBTUSD",
+		FundingRate: 0.0001,
+		MarkPrice:   10000,
+		Multiplier:  -100000000,
+		IsInverse:   true,
+	}
+
+	// 10000 contracts long at 10000 = 1 XBT, pays 0.0001 XBT
+	p, err := info.ProjectFunding(10000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(p.Payment+10000) > 1e-6 {
+		t.Errorf("payment error %v", p.Payment)
+	}
+
+	p, _ = info.ProjectFunding(-10000, 0)
+	if math.Abs(p.Payment-10000) > 1e-6 {
+		t.Errorf("payment error %v", p.Payment)
+	}
+
+	info.MarkPrice = 0
+	if _, err = info.ProjectFunding(1, 0); err != ErrNoMarkPrice {
+		t.Errorf("expect ErrNoMarkPrice, got %v", err)
+	}
+}
+
+func TestFundingTracker_AddHistory(t *testing.T) {
+	tracker := NewFundingTracker(nil)
+	t1 := time.Date(2020, 5, 1, 4, 0, 0, 0, time.UTC)
+	t2 := t1.Add(8 * time.Hour)
+	tracker.AddHistory([]swagger.Funding{
+		{Symbol: "XBTUSD", Timestamp: t2, FundingRate: 0.0002},
+		{Symbol: "XBTUSD", Timestamp: t1, FundingRate: 0.0001},
+	})
+	tracker.AddHistory([]swagger.Funding{
+		{Symbol: "XBTUSD", Timestamp: t2, FundingRate: 0.0002},
+	})
+
+	h := tracker.History("XBTUSD")
+	if len(h) != 2 {
+		t.Fatalf("history length error %v", len(h))
+	}
+	if !h[0].Timestamp.Equal(t1) {
+		t.Errorf("history order error %v", h)
+	}
+}
+
+func TestFundingTracker_Alert(t *testing.T) {
+	emitter := emission.NewEmitter()
+	tracker := NewFundingTracker(emitter)
+	defer tracker.Stop()
+
+	alerts := make(chan FundingInfo, 1)
+	emitter.On(BitmexFundingAlert, func(info FundingInfo, left time.Duration) {
+		alerts <- info
+	})
+
+	tracker.SetAlertBefore(time.Minute)
+	tracker.UpdateInstruments([]*swagger.Instrument{
+		{
+			Symbol:           "XBTUSD",
+			FundingTimestamp: time.Now().Add(time.Minute + 50*time.Millisecond),
+			FundingRate:      0.0001,
+		},
+	}, bitmexActionInitialData)
+
+	select {
+	case info := <-alerts:
+		if info.Symbol != "XBTUSD" {
+			t.Errorf("symbol error %v", info.Symbol)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("no funding alert")
+	}
+}
+
+func TestBitMEX_FundingRawUpdate(t *testing.T) {
+	b := New(nil, HostTestnet, "", "", false)
+	alerts := make(chan FundingInfo, 1)
+	b.emitHook = func(event string, arguments ...interface{}) {
+		if event == BitmexFundingAlert {
+			alerts <- arguments[0].(FundingInfo)
+		}
+	}
+	b.SetFundingAlert(time.Minute)
+	defer b.funding.Stop()
+
+	fundingTime := time.Now().Add(time.Minute + 50*time.Millisecond).UTC().Format(time.RFC3339Nano)
+	b.processMessage([]byte(`{"table":"instrument","action":"partial","data":[{"symbol":"XBTUSD",` +
+		`"isInverse":true,"multiplier":-100000000,"fundingTimestamp":"` + fundingTime + `",` +
+		`"fundingInterval":"2000-01-01T08:00:00.000Z","fundingRate":0.0001,"indicativeFundingRate":0.0002,"markPrice":8000}]}`))
+	b.processMessage([]byte(`{"table":"instrument","action":"update","data":[{"symbol":"XBTUSD","fundingRate":0,"indicativeFundingRate":0}]}`))
+
+	info, ok := b.GetFundingInfo("XBTUSD")
+	if !ok {
+		t.Fatal("no funding info")
+	}
+	if info.FundingRate != 0 || info.IndicativeFundingRate != 0 {
+		t.Errorf("funding rate not updated to 0 %#v", info)
+	}
+	if info.MarkPrice != 8000 || !info.IsInverse || info.FundingInterval != 8*time.Hour {
+		t.Errorf("absent keys overwritten %#v", info)
+	}
+
+	select {
+	case info := <-alerts:
+		if info.Symbol != "XBTUSD" {
+			t.Errorf("symbol error %v", info.Symbol)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("funding alert skipped the emit hook")
+	}
+}
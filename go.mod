@@ -12,6 +12,7 @@ require (
 	github.com/tidwall/gjson v1.6.0
 	golang.org/x/net v0.0.0-20200421231249-e086a090c8fd
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 require (
@@ -27,5 +28,4 @@ require (
 	github.com/tidwall/pretty v1.0.0 // indirect
 	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd // indirect
 	google.golang.org/appengine v1.5.0 // indirect
-	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -0,0 +1,151 @@
+package bitmex
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api/recws"
+	"github.com/gorilla/websocket"
+)
+
+// ErrHeartbeatTimeout is the reason of a reconnect when nothing arrived in time
+var ErrHeartbeatTimeout = errors.New("ws heartbeat timeout")
+
+// heartbeat watches a realtime connection. BitMEX wants a "ping" when nothing
+// arrived for a while, and the connection is half open if no "pong" or data
+// follows. With the recws KeepAliveTimeout the control frames probe instead
+// and recws enforces its own timeout, the watchdog only measures.
+type heartbeat struct {
+	mu       sync.Mutex
+	interval time.Duration // quiet time before a ping
+	timeout  time.Duration // quiet time before a reconnect
+	pingSent time.Time     // of the unanswered ping
+	rtt      time.Duration
+	changed  chan struct{} // set tells watch to re-arm its ticker
+}
+
+func newHeartbeat() *heartbeat {
+	return &heartbeat{interval: 5 * time.Second, timeout: 15 * time.Second, changed: make(chan struct{}, 1)}
+}
+
+// SetHeartbeat changes how long the websocket may be quiet before a ping is
+// sent, 5s by default, and before it reconnects, 15s by default. Both must
+// be positive, the settings are kept otherwise.
+func (b *BitMEX) SetHeartbeat(interval time.Duration, timeout time.Duration) error {
+	return b.heartbeat.set(interval, timeout)
+}
+
+// PingRTT returns the round trip of the last answered ping
+func (b *BitMEX) PingRTT() time.Duration {
+	if rtt := b.ws.PingRTT(); rtt > 0 {
+		return rtt
+	}
+	h := b.heartbeat
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rtt
+}
+
+// LastMessage returns when the websocket last received anything, pongs included
+func (b *BitMEX) LastMessage() time.Time {
+	return b.ws.LastActivity()
+}
+
+func (h *heartbeat) set(interval time.Duration, timeout time.Duration) error {
+	if interval <= 0 || timeout <= 0 {
+		return fmt.Errorf("heartbeat interval %v and timeout %v must be positive", interval, timeout)
+	}
+	h.mu.Lock()
+	h.interval = interval
+	h.timeout = timeout
+	h.mu.Unlock()
+
+	select {
+	case h.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// tick is how often watch checks, a quarter of the shorter setting
+func (h *heartbeat) tick() time.Duration {
+	interval, timeout := h.config()
+	if timeout < interval {
+		interval = timeout
+	}
+	return interval / 4
+}
+
+func (h *heartbeat) config() (interval time.Duration, timeout time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.interval, h.timeout
+}
+
+// reset forgets the ping of a previous connection
+func (h *heartbeat) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pingSent = time.Time{}
+}
+
+// pong measures the answered ping
+func (h *heartbeat) pong(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.pingSent.IsZero() {
+		h.rtt = now.Sub(h.pingSent)
+		h.pingSent = time.Time{}
+	}
+}
+
+// check runs at every tick of the watchdog of ws
+func (h *heartbeat) check(ws *recws.RecConn, log Logger, now time.Time) {
+	if !ws.IsConnected() || ws.KeepAliveTimeout != 0 {
+		return
+	}
+	interval, timeout := h.config()
+	idle := now.Sub(ws.LastActivity())
+	if idle > timeout {
+		log.Warn("ws heartbeat timeout", "idle", idle)
+		h.reset()
+		ws.Reconnect(ErrHeartbeatTimeout)
+		return
+	}
+	if idle < interval {
+		return
+	}
+
+	h.mu.Lock()
+	pending := !h.pingSent.IsZero()
+	if !pending {
+		h.pingSent = now
+	}
+	h.mu.Unlock()
+	if pending {
+		return
+	}
+	if err := ws.WriteMessage(websocket.TextMessage, []byte("ping")); err != nil {
+		// The connection has disconnected if ping errors
+		// and everything will automatically tear down.
+		log.Warn("ws ping", "err", err)
+	}
+}
+
+// watch is the watchdog goroutine of ws, /realtime or /realtimemd
+func (h *heartbeat) watch(ws *recws.RecConn, log Logger, done <-chan struct{}) {
+	t := time.NewTicker(h.tick())
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-h.changed:
+			t.Reset(h.tick())
+		case now := <-t.C:
+			h.check(ws, log, now)
+		}
+	}
+}
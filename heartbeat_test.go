@@ -0,0 +1,86 @@
+package bitmex
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBitMEX_Heartbeat(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	b.ws.RecIntvlMin = 50 * time.Millisecond
+	b.SetHeartbeat(50*time.Millisecond, 300*time.Millisecond)
+	rec := &stateRecorder{}
+	b.On(BitmexConnState, rec.listener)
+	startWS(t, b)
+
+	waitFor(t, "pong", func() bool { return srv.Pings() >= 2 && b.PingRTT() > 0 })
+	if srv.Dials() != 1 {
+		t.Errorf("%d dials", srv.Dials())
+	}
+	if st := b.ConnStats(); st.PingRTT <= 0 || time.Since(st.LastMessage) > time.Second {
+		t.Errorf("stats %+v", st)
+	}
+
+	// half open: the pings go out, nothing comes back
+	srv.IgnorePings(true)
+	waitFor(t, "reconnect", func() bool { return srv.Dials() == 2 })
+	if ev := rec.last(ConnDisconnected); ev.Err != ErrHeartbeatTimeout {
+		t.Errorf("disconnected for %v", ev.Err)
+	}
+}
+
+func TestBitMEX_HeartbeatKeepAlive(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	b.ws.KeepAliveTimeout = 100 * time.Millisecond
+	b.SetHeartbeat(20*time.Millisecond, time.Second)
+	startWS(t, b)
+
+	// control frames probe, no "ping" on top of them
+	waitFor(t, "control pong", func() bool { return b.PingRTT() > 0 })
+	time.Sleep(100 * time.Millisecond)
+	if n := srv.Pings(); n != 0 {
+		t.Errorf("%d pings", n)
+	}
+	if srv.Dials() != 1 {
+		t.Errorf("%d dials", srv.Dials())
+	}
+}
+
+func TestBitMEX_HeartbeatKeepAliveNoTimeout(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	b.ws.KeepAliveTimeout = time.Second
+	b.SetHeartbeat(10*time.Millisecond, 50*time.Millisecond)
+	startWS(t, b)
+
+	// recws enforces its own timeout, a quiet connection isn't the watchdog's to drop
+	time.Sleep(300 * time.Millisecond)
+	if srv.Dials() != 1 {
+		t.Errorf("%d dials", srv.Dials())
+	}
+}
+
+func TestBitMEX_SetHeartbeatConnected(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	b.SetHeartbeat(time.Hour, time.Hour)
+	startWS(t, b)
+	time.Sleep(50 * time.Millisecond) // the watchdog is running with the hour
+
+	// the watchdog picks up the new settings without a reconnect
+	b.SetHeartbeat(20*time.Millisecond, time.Second)
+	waitFor(t, "ping", func() bool { return srv.Pings() > 0 })
+	if srv.Dials() != 1 {
+		t.Errorf("%d dials", srv.Dials())
+	}
+}
+
+func TestBitMEX_SetHeartbeatInvalid(t *testing.T) {
+	b := New(nil, HostTestnet, "", "", false)
+	for _, d := range [][2]time.Duration{{time.Second, 0}, {0, time.Second}, {-time.Second, time.Second}} {
+		if err := b.SetHeartbeat(d[0], d[1]); err == nil {
+			t.Errorf("%v accepted", d)
+		}
+	}
+	if interval, timeout := b.heartbeat.config(); interval != 5*time.Second || timeout != 15*time.Second {
+		t.Errorf("%v %v", interval, timeout)
+	}
+}
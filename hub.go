@@ -0,0 +1,492 @@
+package bitmex
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/chuckpreslar/emission"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// Hub shares public websockets between any number of consumers in a process.
+// Topics are reference counted, a topic wanted by ten strategies is subscribed
+// once, and the order book of a symbol is kept once.
+//
+// Topics go to the connection with the fewest, a new connection is opened
+// when all have TopicsPerConn, up to MaxConns as BitMEX limits the
+// connections per IP. Past that the least loaded connection takes more.
+type Hub struct {
+	MaxConns      int // 0 for 3
+	TopicsPerConn int // 0 for 20
+
+	newClient func() *BitMEX
+
+	subsMutex sync.RWMutex
+	subs      map[*HubSubscription]struct{}
+
+	mu     sync.Mutex
+	ctx    context.Context // of Start, the connections are dialed with it
+	conns  []*hubConn
+	topics map[string]*hubTopic
+	closed bool
+	done   chan struct{}
+	wg     sync.WaitGroup // connections until they have stopped, and Start
+
+	booksMutex sync.RWMutex
+	books      map[string]OrderBookDataL2 // key: symbol
+	tops       map[string]OrderBook       // key: topic of orderBook10 or quote
+}
+
+type hubConn struct {
+	b       *BitMEX
+	topics  int
+	started bool          // a consumer dials it
+	ready   chan struct{} // closed once dialed, err set
+	err     error
+}
+
+type hubTopic struct {
+	info SubscribeInfo
+	conn *hubConn
+	refs int
+}
+
+// ErrHubClosed is returned by Subscribe after Close
+var ErrHubClosed = errors.New("hub closed")
+
+// NewHub creates a hub, newClient returns the unauthenticated client of each
+// connection, e.g. func() *BitMEX { return New(nil, HostReal, "", "", false) }
+func NewHub(newClient func() *BitMEX) *Hub {
+	return &Hub{
+		newClient: newClient,
+		ctx:       context.Background(),
+		done:      make(chan struct{}),
+		subs:      make(map[*HubSubscription]struct{}),
+		topics:    make(map[string]*hubTopic),
+		books:     make(map[string]OrderBookDataL2),
+		tops:      make(map[string]OrderBook),
+	}
+}
+
+// HubSubscription is what a consumer holds, Close releases its topics and listeners
+type HubSubscription struct {
+	hub     *Hub
+	emitter *emission.Emitter // listeners of this consumer only
+
+	mu     sync.Mutex
+	closed bool
+
+	topicsMutex sync.RWMutex // read by dispatch, which mustn't wait for a Subscribe
+	topics      []SubscribeInfo
+}
+
+// NewSubscription returns an empty subscription, add listeners with On
+// before Subscribe not to miss the first partials
+func (h *Hub) NewSubscription() *HubSubscription {
+	s := &HubSubscription{hub: h, emitter: emission.NewEmitter()}
+	h.subsMutex.Lock()
+	h.subs[s] = struct{}{}
+	h.subsMutex.Unlock()
+	return s
+}
+
+// Subscribe is NewSubscription and Subscribe
+func (h *Hub) Subscribe(topics []SubscribeInfo) (*HubSubscription, error) {
+	s := h.NewSubscription()
+	if err := s.Subscribe(topics); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// acquire adds a reference to topics. Connections are dialed after h.mu is
+// released, the other consumers aren't held up by a slow dial.
+func (h *Hub) acquire(topics []SubscribeInfo) error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return ErrHubClosed
+	}
+	ctx := h.ctx
+	adds := make(map[*hubConn][]SubscribeInfo)
+	for _, info := range topics {
+		t, ok := h.topics[info.Topic()]
+		if !ok {
+			t = &hubTopic{info: info, conn: h.pickConn()}
+			t.conn.topics++
+			h.topics[info.Topic()] = t
+			adds[t.conn] = append(adds[t.conn], info)
+		}
+		t.refs++
+	}
+	var dials []*hubConn
+	for conn, infos := range adds {
+		if conn.started {
+			continue
+		}
+		// this consumer dials, the others wait for ready
+		conn.started = true
+		conn.ready = make(chan struct{})
+		conn.b.Subscribe(infos)
+		dials = append(dials, conn)
+		h.wg.Add(1)
+	}
+	h.mu.Unlock()
+
+	var err error
+	for _, conn := range dials {
+		delete(adds, conn)
+		if err != nil {
+			conn.err = err
+			close(conn.ready)
+			h.wg.Done()
+			continue
+		}
+		if conn.err = conn.b.StartWS(ctx); conn.err != nil {
+			err = conn.err
+			close(conn.ready)
+			h.wg.Done()
+			continue
+		}
+		close(conn.ready)
+		go func(b *BitMEX) {
+			defer h.wg.Done()
+			<-b.Done()
+			b.Wait()
+		}(conn.b)
+
+		// closed while dialing
+		h.mu.Lock()
+		closed := h.closed
+		h.mu.Unlock()
+		if closed {
+			conn.b.CloseWS()
+		}
+	}
+	for conn, infos := range adds {
+		<-conn.ready
+		if conn.err != nil {
+			err = conn.err
+			continue
+		}
+		conn.b.AddSubscriptions(infos)
+	}
+	if err != nil {
+		// all or nothing, the consumer didn't get its topics
+		h.release(topics)
+		return err
+	}
+	return nil
+}
+
+// pickConn returns the connection for a new topic
+func (h *Hub) pickConn() *hubConn {
+	maxConns, perConn := h.MaxConns, h.TopicsPerConn
+	if maxConns <= 0 {
+		maxConns = 3
+	}
+	if perConn <= 0 {
+		perConn = 20
+	}
+	var least *hubConn
+	for _, c := range h.conns {
+		if least == nil || c.topics < least.topics {
+			least = c
+		}
+	}
+	if least != nil && (least.topics < perConn || len(h.conns) >= maxConns) {
+		return least
+	}
+	b := h.newClient()
+	b.emitHook = h.dispatch
+	c := &hubConn{b: b}
+	h.conns = append(h.conns, c)
+	return c
+}
+
+func (h *Hub) release(topics []SubscribeInfo) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.releaseLocked(topics)
+}
+
+func (h *Hub) releaseLocked(topics []SubscribeInfo) {
+	removes := make(map[*hubConn][]SubscribeInfo)
+	for _, info := range topics {
+		t, ok := h.topics[info.Topic()]
+		if !ok {
+			continue
+		}
+		if t.refs--; t.refs > 0 {
+			continue
+		}
+		delete(h.topics, info.Topic())
+		t.conn.topics--
+		removes[t.conn] = append(removes[t.conn], info)
+		switch info.Op {
+		case BitmexWSOrderBookL2, BitmexWSOrderBookL2_25:
+			h.booksMutex.Lock()
+			delete(h.books, info.Param)
+			h.booksMutex.Unlock()
+		case BitmexWSOrderBook10, BitmexWSQuote:
+			h.booksMutex.Lock()
+			delete(h.tops, info.Topic())
+			h.booksMutex.Unlock()
+		}
+	}
+	for conn, infos := range removes {
+		if conn.topics > 0 {
+			if conn.started {
+				conn.b.RemoveSubscriptions(infos)
+			}
+			continue
+		}
+		// the last topic, close the connection
+		conn.b.CloseWS()
+		for i, c := range h.conns {
+			if c == conn {
+				h.conns = append(h.conns[:i], h.conns[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// dispatch is the emit hook of every connection
+func (h *Hub) dispatch(event string, arguments ...interface{}) {
+	switch event {
+	case BitmexWSOrderBookL2, BitmexWSOrderBookL2_25:
+		if len(arguments) == 2 {
+			ob, _ := arguments[0].(OrderBookDataL2)
+			symbol, _ := arguments[1].(string)
+			h.booksMutex.Lock()
+			h.books[symbol] = ob
+			h.booksMutex.Unlock()
+		}
+	case BitmexWSOrderBook10:
+		if len(arguments) == 2 {
+			ob, _ := arguments[0].(OrderBook10)
+			h.setTop(SubscribeInfo{Op: event, Param: ob.Symbol}, ob.OrderBook())
+		}
+	case BitmexWSQuote:
+		if len(arguments) == 2 {
+			quotes, _ := arguments[0].([]*swagger.Quote)
+			for _, q := range quotes {
+				h.setTop(SubscribeInfo{Op: event, Param: q.Symbol}, QuoteOrderBook(q))
+			}
+		}
+	}
+	// each subscription has its own emitter, emission removes listeners by
+	// the function pointer shared by every closure of a function literal
+	symbols, ok := eventSymbols(event, arguments)
+	h.subsMutex.RLock()
+	subs := make([]*HubSubscription, 0, len(h.subs))
+	for s := range h.subs {
+		if !ok || s.wants(event, symbols) {
+			subs = append(subs, s)
+		}
+	}
+	h.subsMutex.RUnlock()
+	for _, s := range subs {
+		s.emitter.Emit(event, arguments...)
+	}
+}
+
+// eventSymbols returns the symbols of a table event, ok is false for the
+// events of no topic, e.g. BitmexConnState
+func eventSymbols(event string, arguments []interface{}) (symbols []string, ok bool) {
+	if len(arguments) == 0 {
+		return nil, false
+	}
+	switch event {
+	case BitmexWSOrderBookL2, BitmexWSOrderBookL2_25, BitmexWSOrderBook10, BitmexBook:
+		if len(arguments) == 2 {
+			symbol, _ := arguments[1].(string)
+			return []string{symbol}, true
+		}
+		return nil, false
+	}
+	switch data := arguments[0].(type) {
+	case []*swagger.Trade:
+		for _, v := range data {
+			symbols = append(symbols, v.Symbol)
+		}
+	case []*swagger.TradeBin:
+		for _, v := range data {
+			symbols = append(symbols, v.Symbol)
+		}
+	case []*swagger.Quote:
+		for _, v := range data {
+			symbols = append(symbols, v.Symbol)
+		}
+	case []*swagger.Instrument:
+		for _, v := range data {
+			symbols = append(symbols, v.Symbol)
+		}
+	case []*swagger.Funding:
+		for _, v := range data {
+			symbols = append(symbols, v.Symbol)
+		}
+	default:
+		return nil, false
+	}
+	return symbols, true
+}
+
+// wants tells whether s subscribed to event for any of symbols, a topic
+// without a symbol takes all of them. BitmexBook goes with every book topic.
+func (s *HubSubscription) wants(event string, symbols []string) bool {
+	s.topicsMutex.RLock()
+	defer s.topicsMutex.RUnlock()
+	for _, t := range s.topics {
+		if t.Op != event && (event != BitmexBook || !isBookOp(t.Op)) {
+			continue
+		}
+		if t.Param == "" {
+			return true
+		}
+		for _, symbol := range symbols {
+			if symbol == t.Param {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isBookOp(op string) bool {
+	switch op {
+	case BitmexWSOrderBookL2, BitmexWSOrderBookL2_25, BitmexWSOrderBook10, BitmexWSQuote:
+		return true
+	}
+	return false
+}
+
+func (h *Hub) setTop(info SubscribeInfo, ob OrderBook) {
+	h.booksMutex.Lock()
+	h.tops[info.Topic()] = ob
+	h.booksMutex.Unlock()
+}
+
+// OrderBook returns the latest book of symbol, from orderBookL2 or
+// orderBookL2_25, else orderBook10, else quote
+func (h *Hub) OrderBook(symbol string) (ob OrderBook, ok bool) {
+	h.booksMutex.RLock()
+	defer h.booksMutex.RUnlock()
+	if data, ok := h.books[symbol]; ok {
+		return data.OrderBook(), true
+	}
+	for _, mode := range []BookMode{Book10, BookQuote} {
+		if ob, ok = h.tops[mode.Subscription(symbol).Topic()]; ok {
+			return
+		}
+	}
+	return
+}
+
+// Conns returns the number of open connections
+func (h *Hub) Conns() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.conns)
+}
+
+// Start ties the hub to ctx: connections are dialed with it and the hub is
+// closed when it's done. Without Start the hub runs until Close.
+func (h *Hub) Start(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ErrHubClosed
+	}
+	h.ctx = ctx
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		select {
+		case <-ctx.Done():
+			h.Close()
+		case <-h.done:
+		}
+	}()
+	return nil
+}
+
+// Done is closed by Close, or when the context of Start is done
+func (h *Hub) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait waits for the goroutines of every connection to exit after Done
+func (h *Hub) Wait() {
+	h.wg.Wait()
+}
+
+// Close closes every connection, subscriptions stop receiving events
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	close(h.done)
+	for _, c := range h.conns {
+		c.b.CloseWS()
+	}
+	h.conns = nil
+	h.topics = make(map[string]*hubTopic)
+}
+
+// Subscribe adds topics, the events of every connection reach listeners added with On
+func (s *HubSubscription) Subscribe(topics []SubscribeInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrHubClosed
+	}
+	// the topics are wanted before the partials arrive
+	s.topicsMutex.Lock()
+	n := len(s.topics)
+	s.topics = append(s.topics, topics...)
+	s.topicsMutex.Unlock()
+	if err := s.hub.acquire(topics); err != nil {
+		s.topicsMutex.Lock()
+		s.topics = s.topics[:n]
+		s.topicsMutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// On adds a listener, with the same arguments as BitMEX.On. Only the events
+// of the topics of s arrive, and those of no topic, e.g. BitmexConnState.
+func (s *HubSubscription) On(event string, listener interface{}) *HubSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return s
+	}
+	s.emitter.On(event, listener)
+	return s
+}
+
+// Close removes the listeners and releases the topics
+func (s *HubSubscription) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.mu.Unlock()
+	s.hub.subsMutex.Lock()
+	delete(s.hub.subs, s)
+	s.hub.subsMutex.Unlock()
+	s.topicsMutex.RLock()
+	topics := s.topics
+	s.topicsMutex.RUnlock()
+	s.hub.release(topics)
+}
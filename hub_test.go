@@ -0,0 +1,226 @@
+package bitmex
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+func countWSMessages(srv *bitmextest.Server, substrs ...string) int {
+	n := 0
+	for _, msg := range srv.WSMessages() {
+		found := true
+		for _, s := range substrs {
+			found = found && strings.Contains(msg, s)
+		}
+		if found {
+			n++
+		}
+	}
+	return n
+}
+
+func TestHub(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Script(bitmextest.ScriptOnSubscribe("orderBookL2_25:XBTUSD"),
+		`{"table":"orderBookL2_25","action":"partial","data":[{"symbol":"XBTUSD","id":1,"side":"Sell","size":300,"price":9000.5},{"symbol":"XBTUSD","id":2,"side":"Buy","size":700,"price":9000}]}`)
+	hub := NewHub(func() *BitMEX { return newBitmexForServer(srv, "", "") })
+	hub.MaxConns = 2
+	hub.TopicsPerConn = 2
+	defer hub.Close()
+
+	book := SubscribeInfo{Op: BitmexWSOrderBookL2_25, Param: "XBTUSD"}
+	trade := SubscribeInfo{Op: BitmexWSTrade, Param: "XBTUSD"}
+
+	var books int32
+	sub1 := hub.NewSubscription()
+	sub1.On(BitmexWSOrderBookL2_25, func(ob OrderBookDataL2, symbol string) { atomic.AddInt32(&books, 1) })
+	if err := sub1.Subscribe([]SubscribeInfo{book}); err != nil {
+		t.Fatal(err)
+	}
+	sub2, err := hub.Subscribe([]SubscribeInfo{book, trade})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "book", func() bool { _, ok := hub.OrderBook("XBTUSD"); return ok })
+	ob, _ := hub.OrderBook("XBTUSD")
+	if ob.Bid() != 9000 || ob.Ask() != 9000.5 {
+		t.Errorf("book %+v", ob)
+	}
+	waitFor(t, "book event", func() bool { return atomic.LoadInt32(&books) == 1 })
+	waitFor(t, "trade subscription", func() bool { return countWSMessages(srv, `"subscribe"`, "trade:XBTUSD") == 1 })
+	if n := countWSMessages(srv, `"subscribe"`, "orderBookL2_25:XBTUSD"); n != 1 {
+		t.Errorf("book subscribed %d times", n)
+	}
+	if srv.Dials() != 1 {
+		t.Errorf("%d dials", srv.Dials())
+	}
+
+	// the first connection is full
+	sub3, err := hub.Subscribe([]SubscribeInfo{{Op: BitmexWSQuote, Param: "XBTUSD"}, {Op: BitmexWSInstrument, Param: "XBTUSD"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hub.Conns() != 2 || srv.Dials() != 2 {
+		t.Errorf("%d conns, %d dials", hub.Conns(), srv.Dials())
+	}
+
+	sub1.Close()
+	if n := countWSMessages(srv, `"unsubscribe"`); n != 0 {
+		t.Errorf("unsubscribed while referenced")
+	}
+	sub2.Close()
+	if hub.Conns() != 1 {
+		t.Errorf("%d conns, the first should be closed", hub.Conns())
+	}
+	if _, ok := hub.OrderBook("XBTUSD"); ok {
+		t.Error("book kept")
+	}
+
+	quote, err := hub.Subscribe([]SubscribeInfo{{Op: BitmexWSQuote, Param: "XBTUSD"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub3.Close()
+	waitFor(t, "unsubscribe", func() bool { return countWSMessages(srv, `"unsubscribe"`, "instrument:XBTUSD") == 1 })
+	if n := countWSMessages(srv, `"unsubscribe"`, "quote:XBTUSD"); n != 0 {
+		t.Error("quote unsubscribed while referenced")
+	}
+	quote.Close()
+	if hub.Conns() != 0 {
+		t.Errorf("%d conns", hub.Conns())
+	}
+
+	hub.Close()
+	if _, err := hub.Subscribe([]SubscribeInfo{trade}); err != ErrHubClosed {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestHub_SubscriptionListeners(t *testing.T) {
+	srv := newTestServer(t)
+	hub := NewHub(func() *BitMEX { return newBitmexForServer(srv, "", "") })
+	defer hub.Close()
+
+	// the listeners of both are closures of the same function literal
+	consumer := func(n *int32) *HubSubscription {
+		sub := hub.NewSubscription()
+		sub.On(BitmexWSTrade, func(trades []*swagger.Trade, action string) { atomic.AddInt32(n, 1) })
+		if err := sub.Subscribe([]SubscribeInfo{{Op: BitmexWSTrade, Param: "XBTUSD"}}); err != nil {
+			t.Fatal(err)
+		}
+		return sub
+	}
+	var na, nb int32
+	a := consumer(&na)
+	b := consumer(&nb)
+	waitFor(t, "subscribe", func() bool { return countWSMessages(srv, `"subscribe"`, "trade:XBTUSD") == 1 })
+
+	trade := `{"table":"trade","action":"insert","data":[{"timestamp":"2019-04-09T08:15:12.704Z","symbol":"XBTUSD","side":"Buy","size":10,"price":9000}]}`
+	srv.Push(trade)
+	waitFor(t, "trades", func() bool { return atomic.LoadInt32(&na) == 1 && atomic.LoadInt32(&nb) == 1 })
+
+	a.Close()
+	srv.Push(trade)
+	waitFor(t, "trade after close", func() bool { return atomic.LoadInt32(&nb) == 2 })
+	if n := atomic.LoadInt32(&na); n != 1 {
+		t.Errorf("closed subscription got %d trades", n)
+	}
+	b.Close()
+}
+
+func TestHub_TopicFilter(t *testing.T) {
+	srv := newTestServer(t)
+	hub := NewHub(func() *BitMEX { return newBitmexForServer(srv, "", "") })
+	defer hub.Close()
+
+	consumer := func(symbol string, n *int32) *HubSubscription {
+		sub := hub.NewSubscription()
+		sub.On(BitmexWSTrade, func(trades []*swagger.Trade, action string) { atomic.AddInt32(n, 1) })
+		if err := sub.Subscribe([]SubscribeInfo{{Op: BitmexWSTrade, Param: symbol}}); err != nil {
+			t.Fatal(err)
+		}
+		return sub
+	}
+	var nx, ne, nall int32
+	defer consumer("XBTUSD", &nx).Close()
+	defer consumer("ETHUSD", &ne).Close()
+	defer consumer("", &nall).Close()
+	waitFor(t, "subscribe", func() bool { return countWSMessages(srv, `"subscribe"`, "trade:ETHUSD") == 1 })
+
+	srv.Push(`{"table":"trade","action":"insert","data":[{"timestamp":"2019-04-09T08:15:12.704Z","symbol":"XBTUSD","side":"Buy","size":10,"price":9000}]}`)
+	waitFor(t, "trades", func() bool { return atomic.LoadInt32(&nx) == 1 && atomic.LoadInt32(&nall) == 1 })
+	srv.Push(`{"table":"trade","action":"insert","data":[{"timestamp":"2019-04-09T08:15:12.704Z","symbol":"ETHUSD","side":"Buy","size":10,"price":200}]}`)
+	waitFor(t, "trades", func() bool { return atomic.LoadInt32(&ne) == 1 && atomic.LoadInt32(&nall) == 2 })
+	if n := atomic.LoadInt32(&nx); n != 1 {
+		t.Errorf("XBTUSD consumer got %d trades", n)
+	}
+}
+
+func TestHub_DialOutsideLock(t *testing.T) {
+	srv := newTestServer(t)
+	dialing := make(chan struct{})
+	unblock := make(chan struct{})
+	var clients int32
+	hub := NewHub(func() *BitMEX {
+		b := newBitmexForServer(srv, "", "")
+		if atomic.AddInt32(&clients, 1) == 2 {
+			var d net.Dialer
+			b.SetDialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				close(dialing)
+				<-unblock
+				return d.DialContext(ctx, network, addr)
+			})
+		}
+		return b
+	})
+	hub.TopicsPerConn = 1
+	defer hub.Close()
+
+	trade := SubscribeInfo{Op: BitmexWSTrade, Param: "XBTUSD"}
+	sub1, err := hub.Subscribe([]SubscribeInfo{trade})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub1.Close()
+
+	// the second connection hangs in its dial
+	errs := make(chan error, 1)
+	go func() {
+		sub, err := hub.Subscribe([]SubscribeInfo{{Op: BitmexWSQuote, Param: "XBTUSD"}})
+		if err == nil {
+			defer sub.Close()
+		}
+		errs <- err
+	}()
+	<-dialing
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sub3, err := hub.Subscribe([]SubscribeInfo{trade})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sub3.Close()
+		hub.Conns()
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("hub held while a connection dials")
+	}
+	close(unblock)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
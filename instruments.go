@@ -0,0 +1,263 @@
+package bitmex
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+var (
+	// ErrUnknownLevel is an orderBookL2 delta without price of a level the book hasn't seen
+	ErrUnknownLevel = errors.New("orderBookL2 level unknown")
+	// ErrLevelPrice is an orderBookL2 price its level id doesn't encode
+	ErrLevelPrice = errors.New("orderBookL2 price doesn't match the level id")
+)
+
+// levelsPerIndex is how many ids each instrument index spans
+const levelsPerIndex = 100000000
+
+// LevelCodec converts the orderBookL2 level ids of one instrument and their
+// prices, price = (100000000*Index - id) * TickSize. TickSize is the one of
+// the ids, 0.01 for XBTUSD although it trades in 0.5.
+type LevelCodec struct {
+	Index    int64
+	TickSize float64
+}
+
+// Valid reports whether the codec is set
+func (c LevelCodec) Valid() bool {
+	return c.Index > 0 && c.TickSize > 0
+}
+
+// Price returns the price of level id
+func (c LevelCodec) Price(id int64) float64 {
+	price := float64(levelsPerIndex*c.Index-id) * c.TickSize
+	// 899910 * 0.01 is 8999.1 as parsed from json, not 8999.100000000001
+	p := decimals(c.TickSize)
+	return math.Round(price*p) / p
+}
+
+// ID returns the level id of price
+func (c LevelCodec) ID(price float64) int64 {
+	return levelsPerIndex*c.Index - int64(math.Round(price/c.TickSize))
+}
+
+// Match reports whether id encodes price
+func (c LevelCodec) Match(id int64, price float64) bool {
+	return math.Abs(c.Price(id)-price) < c.TickSize/2
+}
+
+// decimals returns 10^n for the n decimals of tick
+func decimals(tick float64) float64 {
+	p := 1.0
+	for i := 0; i < 10 && math.Abs(tick*p-math.Round(tick*p)) > 1e-9*tick*p; i++ {
+		p *= 10
+	}
+	return p
+}
+
+// NewLevelCodec derives the codec from the rows of a partial, trying
+// tickSize, the one of the instrument or 0 if unknown, and then the tick
+// the rows themselves span
+func NewLevelCodec(rows []*OrderBookL2, tickSize float64) (LevelCodec, error) {
+	var priced []*OrderBookL2
+	for _, row := range rows {
+		if row.Price > 0 {
+			priced = append(priced, row)
+		}
+	}
+	if len(priced) == 0 {
+		return LevelCodec{}, errors.New("level codec: no prices")
+	}
+	var ticks []float64
+	if tickSize > 0 {
+		ticks = append(ticks, tickSize)
+	}
+	first, last := priced[0], priced[len(priced)-1]
+	for _, row := range priced[1:] {
+		if math.Abs(float64(first.ID-row.ID)) > math.Abs(float64(first.ID-last.ID)) {
+			last = row
+		}
+	}
+	if first.ID != last.ID {
+		tick := (last.Price - first.Price) / float64(first.ID-last.ID)
+		ticks = append(ticks, math.Round(tick*1e10)/1e10)
+	}
+
+	for _, tick := range ticks {
+		if tick <= 0 {
+			continue
+		}
+		index := int64(math.Round((float64(first.ID) + first.Price/tick) / levelsPerIndex))
+		c := LevelCodec{Index: index, TickSize: tick}
+		if !c.Valid() {
+			continue
+		}
+		ok := true
+		for _, row := range priced {
+			if !c.Match(row.ID, row.Price) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return c, nil
+		}
+	}
+	return LevelCodec{}, fmt.Errorf("level codec: the ids of %v don't encode their prices", first.Symbol)
+}
+
+// InstrumentRegistry keeps the instruments of the instrument table, or loaded
+// by rest, and the orderBookL2 level codecs derived from them
+type InstrumentRegistry struct {
+	mu          sync.RWMutex
+	instruments map[string]swagger.Instrument // key: symbol
+	codecs      map[string]LevelCodec         // key: symbol
+	fixed       map[string]bool               // codecs set by SetLevelCodec
+}
+
+func NewInstrumentRegistry() *InstrumentRegistry {
+	return &InstrumentRegistry{
+		instruments: make(map[string]swagger.Instrument),
+		codecs:      make(map[string]LevelCodec),
+		fixed:       make(map[string]bool),
+	}
+}
+
+// Update merges decoded instrument partial/insert/update data. A decoded
+// update can't tell a field it doesn't carry from one set to zero, only its
+// TickSize and State are merged. The client merges the raw rows instead.
+func (r *InstrumentRegistry) Update(instruments []*swagger.Instrument, action string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, v := range instruments {
+		old, ok := r.instruments[v.Symbol]
+		if action == bitmexActionUpdateData && ok {
+			if v.TickSize > 0 {
+				old.TickSize = v.TickSize
+			}
+			if v.State != "" {
+				old.State = v.State
+			}
+			r.instruments[v.Symbol] = old
+			continue
+		}
+		r.instruments[v.Symbol] = *v
+	}
+}
+
+// apply merges the raw rows of an instrument message, the fields an update
+// carries are set over the known ones, like the table caches of AccountManager
+func (r *InstrumentRegistry) apply(action string, data []byte) error {
+	var rows []json.RawMessage
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, row := range rows {
+		var inst swagger.Instrument
+		if action == bitmexActionUpdateData {
+			var key struct {
+				Symbol string `json:"symbol"`
+			}
+			if err := json.Unmarshal(row, &key); err != nil {
+				return err
+			}
+			inst = r.instruments[key.Symbol]
+		}
+		if err := json.Unmarshal(row, &inst); err != nil {
+			return err
+		}
+		r.instruments[inst.Symbol] = inst
+	}
+	return nil
+}
+
+// Load adds instruments of the rest api
+func (r *InstrumentRegistry) Load(instruments []swagger.Instrument) {
+	data := make([]*swagger.Instrument, 0, len(instruments))
+	for i := range instruments {
+		data = append(data, &instruments[i])
+	}
+	r.Update(data, bitmexActionInitialData)
+}
+
+// Get returns the instrument of symbol
+func (r *InstrumentRegistry) Get(symbol string) (swagger.Instrument, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	inst, ok := r.instruments[symbol]
+	return inst, ok
+}
+
+// SetLevelCodec fixes the codec of symbol instead of deriving it from partials
+func (r *InstrumentRegistry) SetLevelCodec(symbol string, c LevelCodec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.codecs[symbol] = c
+	r.fixed[symbol] = true
+}
+
+// LevelCodec returns the codec of symbol, known once set or derived from a partial
+func (r *InstrumentRegistry) LevelCodec(symbol string) (LevelCodec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	c, ok := r.codecs[symbol]
+	return c, ok
+}
+
+// resolveLevelCodec returns the codec of symbol for the rows of a partial,
+// derived again if the known one doesn't fit them
+func (r *InstrumentRegistry) resolveLevelCodec(symbol string, rows []*OrderBookL2) (LevelCodec, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.codecs[symbol]
+	if r.fixed[symbol] {
+		return c, nil
+	}
+	if ok {
+		fits := true
+		for _, row := range rows {
+			if row.Price > 0 && !c.Match(row.ID, row.Price) {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return c, nil
+		}
+	}
+	c, err := NewLevelCodec(rows, r.instruments[symbol].TickSize)
+	if err != nil {
+		delete(r.codecs, symbol)
+		return c, err
+	}
+	r.codecs[symbol] = c
+	return c, nil
+}
+
+// GetInstrumentRegistry returns the instruments fed by the websocket and LoadInstruments
+func (b *BitMEX) GetInstrumentRegistry() *InstrumentRegistry {
+	return b.instruments
+}
+
+// LoadInstruments loads the active instruments by rest api
+func (b *BitMEX) LoadInstruments() error {
+	instruments, err := b.GetActiveInstruments()
+	if err != nil {
+		return err
+	}
+	b.instruments.Load(instruments)
+	return nil
+}
@@ -0,0 +1,161 @@
+package bitmex
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+var xbtusdCodec = LevelCodec{Index: 88, TickSize: 0.01}
+
+func TestLevelCodec(t *testing.T) {
+	if p := xbtusdCodec.Price(8799100090); p != 8999.1 {
+		t.Errorf("price %v", p)
+	}
+	if id := xbtusdCodec.ID(8999.5); id != 8799100050 {
+		t.Errorf("id %v", id)
+	}
+	if !xbtusdCodec.Match(8799100050, 8999.5) || xbtusdCodec.Match(8799100050, 9000) {
+		t.Error("match")
+	}
+	ethusd := LevelCodec{Index: 297, TickSize: 0.05}
+	if id := ethusd.ID(201.35); ethusd.Price(id) != 201.35 {
+		t.Errorf("round trip %v", ethusd.Price(id))
+	}
+}
+
+func TestNewLevelCodec(t *testing.T) {
+	partial, err := decodeMessage(loadFrames(t)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partial.release()
+	rows := partial.Data.(OrderBookData)
+
+	// XBTUSD trades in 0.5 but its ids count 0.01
+	for _, tick := range []float64{0, 0.5, 0.01} {
+		if c, err := NewLevelCodec(rows, tick); err != nil || c != xbtusdCodec {
+			t.Errorf("tick %v: %+v %v", tick, c, err)
+		}
+	}
+
+	bad := []*OrderBookL2{
+		{ID: 8799100000, Price: 9000},
+		{ID: 8799100050, Price: 8999.5},
+		{ID: 8799100100, Price: 8000},
+	}
+	if _, err := NewLevelCodec(bad, 0.01); err == nil {
+		t.Error("expect error")
+	}
+	if _, err := NewLevelCodec([]*OrderBookL2{{ID: 1}}, 0.5); err == nil {
+		t.Error("expect no prices")
+	}
+}
+
+func TestOrderBookLocal_Levels(t *testing.T) {
+	snapshot := []*OrderBookL2{
+		{ID: 8799100000, Side: SIDE_SELL, Size: 100, Price: 9000},
+		{ID: 8799100150, Side: SIDE_BUY, Size: 200, Price: 8998.5},
+	}
+	book := NewOrderBookLocal()
+	if err := book.LoadSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	update := []*OrderBookL2{{ID: 8799100050, Side: SIDE_SELL, Size: 300}}
+
+	// without a codec the unseen level is skipped
+	if err := book.Update(update, "update"); !errors.Is(err, ErrUnknownLevel) {
+		t.Errorf("got %v", err)
+	}
+	if ob := book.GetOrderbook(); len(ob.Asks) != 1 {
+		t.Errorf("asks %v", ob.Asks)
+	}
+
+	book.SetLevelCodec(xbtusdCodec)
+	if err := book.Update(update, "update"); err != nil {
+		t.Fatal(err)
+	}
+	if err := book.Update([]*OrderBookL2{{ID: 8799100200, Side: SIDE_BUY, Size: 50, Price: 8998}}, "insert"); err != nil {
+		t.Fatal(err)
+	}
+	ob := book.GetOrderbook()
+	wantAsks := []Item{{Price: 8999.5, Amount: 300}, {Price: 9000, Amount: 100}}
+	wantBids := []Item{{Price: 8998.5, Amount: 200}, {Price: 8998, Amount: 50}}
+	if !equalItems(ob.Asks, wantAsks) || !equalItems(ob.Bids, wantBids) {
+		t.Errorf("book %+v", ob)
+	}
+
+	// a level crossing sides and a delete keep the sides sorted
+	book.Update([]*OrderBookL2{{ID: 8799100050, Side: SIDE_BUY, Size: 10}}, "update")
+	book.Update([]*OrderBookL2{{ID: 8799100200, Side: SIDE_BUY}}, "delete")
+	ob = book.GetOrderbook()
+	if !equalItems(ob.Asks, wantAsks[1:]) || !equalItems(ob.Bids, []Item{{Price: 8999.5, Amount: 10}, {Price: 8998.5, Amount: 200}}) {
+		t.Errorf("book %+v", ob)
+	}
+
+	if err := book.Update([]*OrderBookL2{{ID: 8799100250, Side: SIDE_BUY, Size: 1, Price: 9500}}, "insert"); !errors.Is(err, ErrLevelPrice) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func equalItems(a []Item, b []Item) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBitMEX_OrderBookLevelCodec(t *testing.T) {
+	b := New(nil, HostTestnet, "", "", false)
+	b.SetLogger(NopLogger)
+	b.instruments.Load([]swagger.Instrument{{Symbol: "XBTUSD", TickSize: 0.5}})
+	frames := loadFrames(t)
+	if err := b.processMessage(frames[0]); err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := b.GetInstrumentRegistry().LevelCodec("XBTUSD"); !ok || c != xbtusdCodec {
+		t.Errorf("codec %+v", c)
+	}
+
+	// an update of a level the partial didn't have
+	id := xbtusdCodec.ID(8990)
+	b.processMessage([]byte(`{"table":"orderBookL2","action":"update","data":[{"symbol":"XBTUSD","id":` +
+		strconv.FormatInt(id, 10) + `,"side":"Buy","size":4200}]}`))
+	ob := b.orderBookLocals["XBTUSD"].GetOrderbook()
+	found := false
+	for _, bid := range ob.Bids {
+		found = found || bid == Item{Price: 8990, Amount: 4200}
+	}
+	if !found {
+		t.Errorf("bids %v", ob.Bids)
+	}
+
+	// a fixed codec isn't derived again
+	b.instruments.SetLevelCodec("XBTUSD", LevelCodec{Index: 88, TickSize: 0.5})
+	b.processMessage(frames[0])
+	if c := b.orderBookLocals["XBTUSD"].LevelCodec(); c.TickSize != 0.5 {
+		t.Errorf("codec %+v", c)
+	}
+}
+
+func TestBitMEX_InstrumentUpdates(t *testing.T) {
+	b := New(nil, HostTestnet, "", "", false)
+	b.SetLogger(NopLogger)
+	b.processMessage([]byte(`{"table":"instrument","action":"partial","data":[{"symbol":"XBTUSD","state":"Open","tickSize":0.5,"lotSize":100,"markPrice":9000,"openInterest":500}]}`))
+	b.processMessage([]byte(`{"table":"instrument","action":"update","data":[{"symbol":"XBTUSD","markPrice":9001.5,"openInterest":0}]}`))
+
+	inst, ok := b.GetInstrumentRegistry().Get("XBTUSD")
+	if !ok || inst.MarkPrice != 9001.5 || inst.OpenInterest != 0 {
+		t.Errorf("changed fields %+v", inst)
+	}
+	if inst.TickSize != 0.5 || inst.LotSize != 100 || inst.State != "Open" {
+		t.Errorf("kept fields %+v", inst)
+	}
+}
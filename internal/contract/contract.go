@@ -0,0 +1,83 @@
+// Package contract is the position math of BitMEX inverse and linear
+// contracts, shared by the paper exchange and the backtest engine.
+package contract
+
+import (
+	"math"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// Position is a signed quantity of contracts and its average entry price
+type Position struct {
+	Qty           float64
+	AvgEntryPrice float64
+}
+
+// Fill adds signedQty contracts bought (> 0) or sold (< 0) at price and
+// returns the pnl realised by the part it closes, in XBt
+func (p *Position) Fill(inst *swagger.Instrument, signedQty float64, price float64) (realised float64) {
+	if p.Qty == 0 || sameSign(p.Qty, signedQty) {
+		total := math.Abs(p.Qty) + math.Abs(signedQty)
+		if inst.IsInverse {
+			// 反向合约的平均开仓价为调和平均
+			p.AvgEntryPrice = total / (math.Abs(p.Qty)/nonZero(p.AvgEntryPrice) + math.Abs(signedQty)/price)
+		} else {
+			p.AvgEntryPrice = (math.Abs(p.Qty)*p.AvgEntryPrice + math.Abs(signedQty)*price) / total
+		}
+		p.Qty += signedQty
+		return 0
+	}
+
+	closed := math.Min(math.Abs(p.Qty), math.Abs(signedQty))
+	realised = PnL(inst, math.Copysign(closed, p.Qty), p.AvgEntryPrice, price)
+
+	p.Qty += signedQty
+	if p.Qty == 0 {
+		p.AvgEntryPrice = 0
+	} else if !sameSign(p.Qty, -signedQty) {
+		// reversed
+		p.AvgEntryPrice = price
+	}
+	return realised
+}
+
+// Value returns the absolute value of qty contracts at price in XBt
+func Value(inst *swagger.Instrument, qty float64, price float64) float64 {
+	if price <= 0 {
+		return 0
+	}
+	if inst.IsInverse {
+		return math.Abs(qty) * multiplier(inst) / price
+	}
+	return math.Abs(qty) * multiplier(inst) * price
+}
+
+// PnL of a signed position qty entered at entry and marked at exit, in XBt
+func PnL(inst *swagger.Instrument, qty float64, entry float64, exit float64) float64 {
+	if entry <= 0 || exit <= 0 {
+		return 0
+	}
+	if inst.IsInverse {
+		return qty * multiplier(inst) * (1/entry - 1/exit)
+	}
+	return qty * multiplier(inst) * (exit - entry)
+}
+
+func multiplier(inst *swagger.Instrument) float64 {
+	if m := math.Abs(float64(inst.Multiplier)); m != 0 {
+		return m
+	}
+	return 1
+}
+
+func sameSign(a, b float64) bool {
+	return (a > 0 && b > 0) || (a < 0 && b < 0)
+}
+
+func nonZero(v float64) float64 {
+	if v == 0 {
+		return 1
+	}
+	return v
+}
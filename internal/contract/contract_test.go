@@ -0,0 +1,36 @@
+package contract
+
+import (
+	"math"
+	"testing"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+func TestPosition_Fill(t *testing.T) {
+	inverse := &swagger.Instrument{Symbol: "XBTUSD", IsInverse: true, Multiplier: -100000000}
+	var p Position
+	p.Fill(inverse, 100, 10000)
+	p.Fill(inverse, 100, 5000)
+	// harmonic mean of the entries
+	if p.Qty != 200 || math.Abs(p.AvgEntryPrice-20000.0/3) > 1e-6 {
+		t.Fatalf("position %+v", p)
+	}
+
+	// closes 200 and reverses into 50 short
+	realised := p.Fill(inverse, -250, 10000)
+	if want := 200 * 1e8 * (3.0/20000 - 1.0/10000); math.Abs(realised-want) > 1e-3 {
+		t.Errorf("realised %v, want %v", realised, want)
+	}
+	if p.Qty != -50 || p.AvgEntryPrice != 10000 {
+		t.Errorf("reversed %+v", p)
+	}
+
+	linear := &swagger.Instrument{Symbol: "ETHUSDT", Multiplier: 10}
+	if v := Value(linear, -3, 2000); v != 60000 {
+		t.Errorf("value %v", v)
+	}
+	if pnl := PnL(linear, -3, 2000, 1900); pnl != 3000 {
+		t.Errorf("pnl %v", pnl)
+	}
+}
@@ -0,0 +1,228 @@
+package bitmex
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/frankrap/bitmex-api/recws"
+	"github.com/tidwall/gjson"
+)
+
+// Logger is a leveled, structured logger, keyvals are alternating keys and
+// values. *slog.Logger satisfies it, as does recws.Logger.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Level has the same values as slog.Level
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l >= LevelError:
+		return "ERROR"
+	case l >= LevelWarn:
+		return "WARN"
+	case l >= LevelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
+// StdLogger writes "LEVEL msg key=value ..." lines to a *log.Logger
+type StdLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+// NewStdLogger logs messages at level and above, l nil for the standard logger
+func NewStdLogger(l *log.Logger, level Level) *StdLogger {
+	if l == nil {
+		l = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &StdLogger{l: l, level: level}
+}
+
+func (s *StdLogger) log(level Level, msg string, keyvals []interface{}) {
+	if level < s.level {
+		return
+	}
+	var sb strings.Builder
+	sb.WriteString(level.String())
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var v interface{} = "!MISSING"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		value := fmt.Sprint(v)
+		if strings.ContainsAny(value, " \"=") || value == "" {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&sb, " %v=%v", keyvals[i], value)
+	}
+	s.l.Output(3, sb.String())
+}
+
+// Debug implements Logger
+func (s *StdLogger) Debug(msg string, keyvals ...interface{}) { s.log(LevelDebug, msg, keyvals) }
+
+// Info implements Logger
+func (s *StdLogger) Info(msg string, keyvals ...interface{}) { s.log(LevelInfo, msg, keyvals) }
+
+// Warn implements Logger
+func (s *StdLogger) Warn(msg string, keyvals ...interface{}) { s.log(LevelWarn, msg, keyvals) }
+
+// Error implements Logger
+func (s *StdLogger) Error(msg string, keyvals ...interface{}) { s.log(LevelError, msg, keyvals) }
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// NopLogger discards everything
+var NopLogger Logger = nopLogger{}
+
+var _ recws.Logger = Logger(nil)
+
+// SetLogger replaces the logger of the client and its websocket, nil for NopLogger
+func (b *BitMEX) SetLogger(l Logger) {
+	if l == nil {
+		l = NopLogger
+	}
+	b.loggerMutex.Lock()
+	defer b.loggerMutex.Unlock()
+	b.logger = l
+}
+
+// log returns the redacting logger all client messages go through
+func (b *BitMEX) log() Logger {
+	return redactLogger{b}
+}
+
+func (b *BitMEX) getLogger() Logger {
+	b.loggerMutex.RLock()
+	defer b.loggerMutex.RUnlock()
+	return b.logger
+}
+
+const redacted = "[REDACTED]"
+
+// sensitive keys are redacted whatever their value
+var sensitiveKeys = map[string]bool{
+	"secret":        true,
+	"signature":     true,
+	"api-signature": true,
+	"otpToken":      true,
+	"password":      true,
+}
+
+// redactLogger is what the client logs through, it masks the api secret and key
+type redactLogger struct {
+	b *BitMEX
+}
+
+func (r redactLogger) Debug(msg string, keyvals ...interface{}) {
+	r.b.getLogger().Debug(r.redact(msg), r.redactKeyvals(keyvals)...)
+}
+
+func (r redactLogger) Info(msg string, keyvals ...interface{}) {
+	r.b.getLogger().Info(r.redact(msg), r.redactKeyvals(keyvals)...)
+}
+
+func (r redactLogger) Warn(msg string, keyvals ...interface{}) {
+	r.b.getLogger().Warn(r.redact(msg), r.redactKeyvals(keyvals)...)
+}
+
+func (r redactLogger) Error(msg string, keyvals ...interface{}) {
+	r.b.getLogger().Error(r.redact(msg), r.redactKeyvals(keyvals)...)
+}
+
+func (r redactLogger) redact(s string) string {
+	if secret := r.b.Secret; secret != "" {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	for _, key := range []string{r.b.Key, r.b.lastKey()} {
+		if key != "" {
+			s = strings.Replace(s, key, maskKey(key), -1)
+		}
+	}
+	return s
+}
+
+func (r redactLogger) redactKeyvals(keyvals []interface{}) []interface{} {
+	out := make([]interface{}, len(keyvals))
+	for i, v := range keyvals {
+		if i%2 == 1 {
+			if k, ok := keyvals[i-1].(string); ok && sensitiveKeys[k] {
+				out[i] = redacted
+				continue
+			}
+		}
+		switch v := v.(type) {
+		case string:
+			out[i] = r.redact(v)
+		case []byte:
+			out[i] = r.redact(string(v))
+		case error:
+			if s := v.Error(); r.redact(s) != s {
+				out[i] = r.redact(s)
+			} else {
+				out[i] = v
+			}
+		default:
+			out[i] = v
+		}
+	}
+	return out
+}
+
+// redactWSCmd hides the signature of auth commands
+func redactWSCmd(msg interface{}) interface{} {
+	cmd, ok := msg.(WSCmd)
+	if !ok || !strings.HasPrefix(cmd.Command, "authKey") || len(cmd.Args) < 3 {
+		return msg
+	}
+	args := append([]interface{}(nil), cmd.Args...)
+	args[2] = redacted
+	return WSCmd{Command: cmd.Command, Args: args, ID: cmd.ID}
+}
+
+// redactWSReply masks the signature of an authKey request BitMEX echoes in
+// its success and error replies
+func redactWSReply(message []byte) []byte {
+	if !strings.HasPrefix(gjson.GetBytes(message, "request.op").String(), "authKey") {
+		return message
+	}
+	signature := gjson.GetBytes(message, "request.args.2")
+	if signature.Type != gjson.String || signature.Str == "" {
+		return message
+	}
+	return bytes.Replace(message, []byte(signature.Raw), []byte(strconv.Quote(redacted)), -1)
+}
+
+// maskKey keeps the first 4 characters of an api key id
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return key[:4] + "****"
+}
@@ -0,0 +1,117 @@
+package bitmex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// captureLogger keeps every line, at all levels
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (c *captureLogger) add(level string, msg string, keyvals []interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines = append(c.lines, fmt.Sprint(level, " ", msg, " ", keyvals))
+}
+
+func (c *captureLogger) Debug(msg string, keyvals ...interface{}) { c.add("DEBUG", msg, keyvals) }
+func (c *captureLogger) Info(msg string, keyvals ...interface{})  { c.add("INFO", msg, keyvals) }
+func (c *captureLogger) Warn(msg string, keyvals ...interface{})  { c.add("WARN", msg, keyvals) }
+func (c *captureLogger) Error(msg string, keyvals ...interface{}) { c.add("ERROR", msg, keyvals) }
+
+func (c *captureLogger) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Join(c.lines, "\n")
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), LevelInfo)
+	l.Debug("hidden")
+	l.Info("ws subscribe", "args", []interface{}{"trade:XBTUSD"}, "n", 2)
+	l.Error("ws read", "err", errors.New("use of closed connection"), "odd")
+	want := "INFO ws subscribe args=[trade:XBTUSD] n=2\n" +
+		"ERROR ws read err=\"use of closed connection\" odd=!MISSING\n"
+	if buf.String() != want {
+		t.Errorf("got\n%v\nwant\n%v", buf.String(), want)
+	}
+}
+
+func TestBitMEX_LoggerRedacts(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	logs := &captureLogger{}
+	b.SetLogger(logs)
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrder, Param: "XBTUSD"}})
+
+	startWS(t, b)
+	if !srv.WaitWSMessage("subscribe", 5*time.Second) {
+		t.Fatal("not subscribed")
+	}
+
+	b.log().Error("oops", "err", fmt.Errorf("bad secret %v", testSecret), "signature", "abc", "msg", []byte(testKey))
+
+	out := logs.String()
+	if !strings.Contains(out, `ws send [msg {"op":"authKey","args":["8K2O****"`) {
+		t.Errorf("auth message not logged\n%v", out)
+	}
+	if strings.Contains(out, testSecret) || strings.Contains(out, testKey) {
+		t.Errorf("secret logged\n%v", out)
+	}
+	if regexp.MustCompile(`[0-9a-f]{64}`).MatchString(out) {
+		t.Errorf("signature logged\n%v", out)
+	}
+	if !strings.Contains(out, "ERROR oops [err bad secret [REDACTED] signature [REDACTED] msg 8K2O****]") {
+		t.Errorf("values not redacted\n%v", out)
+	}
+}
+
+func TestBitMEX_LoggerRedactsAuthReplies(t *testing.T) {
+	b := New(nil, HostTestnet, testKey, testSecret, false)
+	logs := &captureLogger{}
+	b.SetLogger(logs)
+	signature := swagger.CalSignature(testSecret, "GET/realtime1600000000")
+	request := `{"op":"authKeyExpires","args":["` + testKey + `",1600000000,"` + signature + `"]}`
+
+	b.processMessage([]byte(`{"success":true,"request":` + request + `}`))
+	b.processMessage([]byte(`{"status":401,"error":"Signature not valid.","meta":{},"request":` + request + `}`))
+
+	out := logs.String()
+	if !strings.Contains(out, "ws success") || !strings.Contains(out, "ws error response") {
+		t.Fatalf("replies not logged\n%v", out)
+	}
+	if strings.Contains(out, signature) || strings.Contains(out, testKey) {
+		t.Errorf("signature logged\n%v", out)
+	}
+	if strings.Count(out, redacted) != 2 {
+		t.Errorf("signature not redacted\n%v", out)
+	}
+}
+
+func TestBitMEX_StartWSBadURL(t *testing.T) {
+	b, _ := newBitmexForTest(t)
+	logs := &captureLogger{}
+	b.SetLogger(logs)
+	b.SetWSURL("http://127.0.0.1:1/realtime")
+
+	// used to log.Fatal
+	if err := b.StartWS(context.Background()); err == nil {
+		t.Error("expect dial error")
+	}
+	if !strings.Contains(logs.String(), "ERROR ws dial") {
+		t.Errorf("dial error not logged\n%v", logs)
+	}
+}
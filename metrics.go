@@ -0,0 +1,128 @@
+package bitmex
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+	"github.com/tidwall/gjson"
+)
+
+// Metrics receives instrumentation from the client, package metrics has a
+// Prometheus exporter. Methods are called from the rest and websocket
+// goroutines and must be safe for concurrent use.
+type Metrics interface {
+	// ObserveRequest is called for every rest request, status is 0 when no response was received
+	ObserveRequest(endpoint string, method string, status int, d time.Duration)
+	// SetRateLimit is called with the X-Ratelimit headers, api is "public" or "private"
+	SetRateLimit(api string, rateLimit RateLimit)
+	SetWSConnected(connected bool)
+	IncWSReconnects()
+	IncWSMessages(table string, action string)
+	IncDecodeErrors()
+	// ObserveListener is the time the listeners of an event took
+	ObserveListener(event string, d time.Duration)
+	// ObserveBookLatency is the receive time minus the exchange timestamp of a book update
+	ObserveBookLatency(table string, symbol string, d time.Duration)
+}
+
+// SetMetrics enables instrumentation, nil disables it
+func (b *BitMEX) SetMetrics(m Metrics) {
+	b.metricsMutex.Lock()
+	defer b.metricsMutex.Unlock()
+	b.metrics = m
+}
+
+func (b *BitMEX) getMetrics() Metrics {
+	b.metricsMutex.RLock()
+	defer b.metricsMutex.RUnlock()
+	return b.metrics
+}
+
+// setHTTPClient installs the rest client, with a copy of its transport instrumented
+func (b *BitMEX) setHTTPClient(client *http.Client) {
+	instrumented := *client
+	instrumented.Transport = &metricsTransport{base: client.Transport, b: b}
+	b.httpClient = &instrumented
+	b.cfg.HTTPClient = &instrumented
+}
+
+type metricsTransport struct {
+	base http.RoundTripper
+	b    *BitMEX
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+		t.b.timeSync.observeDate(start, time.Now(), resp.Header.Get("Date"))
+	}
+	m := t.b.getMetrics()
+	if m == nil {
+		return resp, err
+	}
+	m.ObserveRequest(swagger.Endpoint(req.URL.Path), req.Method, status, time.Since(start))
+	return resp, err
+}
+
+// connectionHandler is the recws ConnectionHandler
+func (b *BitMEX) connectionHandler(connected bool) {
+	var reconnect bool
+	if connected {
+		reconnect = atomic.AddInt64(&b.wsConnects, 1) > 1
+	}
+	if m := b.getMetrics(); m != nil {
+		m.SetWSConnected(connected)
+		if reconnect {
+			m.IncWSReconnects()
+		}
+	}
+}
+
+// emit runs the listeners of a ws event, timing them for the metrics
+func (b *BitMEX) emit(event string, arguments ...interface{}) {
+	if b.emitHook != nil {
+		b.emitHook(event, arguments...)
+	}
+	m := b.getMetrics()
+	if m == nil {
+		b.emitter.Emit(event, arguments...)
+		return
+	}
+	start := time.Now()
+	b.emitter.Emit(event, arguments...)
+	m.ObserveListener(event, time.Since(start))
+}
+
+// observeMessage counts a decoded frame, and the book latency for tables carrying timestamps
+func (b *BitMEX) observeMessage(m Metrics, resp *Response, message []byte, receivedAt time.Time) {
+	if resp.Table == "" {
+		return
+	}
+	m.IncWSMessages(resp.Table, resp.Action)
+
+	switch resp.Table {
+	case BitmexWSOrderBookL2, BitmexWSOrderBookL2_25, BitmexWSOrderBook10, BitmexWSQuote:
+	default:
+		return
+	}
+	data := gjson.GetBytes(message, "data")
+	var latest time.Time
+	for _, ts := range data.Get("#.timestamp").Array() {
+		if t, err := time.Parse(time.RFC3339Nano, ts.String()); err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	if latest.IsZero() {
+		return
+	}
+	m.ObserveBookLatency(resp.Table, data.Get("0.symbol").String(), receivedAt.Sub(latest))
+}
@@ -0,0 +1,164 @@
+// Package metrics exports BitMEX client instrumentation in the Prometheus
+// text format:
+//
+//	c := metrics.New(map[string]string{"bot": "mm-1"})
+//	b.SetMetrics(c)
+//	http.Handle("/metrics", c.Handler())
+//
+// Several clients can share a Collector, or use one each with different
+// constant labels and be served together by Handler.
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+)
+
+var (
+	requestBuckets  = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	listenerBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1}
+	latencyBuckets  = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+)
+
+// Collector implements bitmex.Metrics
+type Collector struct {
+	constLabels []string // name, value pairs sorted by name
+
+	requests         *vec
+	requestDuration  *vec
+	rateLimit        *vec
+	rateLimitRemain  *vec
+	wsConnected      *vec
+	wsReconnects     *vec
+	wsMessages       *vec
+	decodeErrors     *vec
+	listenerDuration *vec
+	bookLatency      *vec
+
+	vecs []*vec // in output order
+}
+
+var _ bitmex.Metrics = (*Collector)(nil)
+
+// New creates a Collector, constLabels are added to every sample
+func New(constLabels map[string]string) *Collector {
+	c := &Collector{
+		requests: newVec("bitmex_rest_requests_total",
+			"REST requests by endpoint, method and status, status 0 when no response was received.",
+			typeCounter, nil, "endpoint", "method", "status"),
+		requestDuration: newVec("bitmex_rest_request_duration_seconds",
+			"REST request latency.",
+			typeHistogram, requestBuckets, "endpoint", "method"),
+		rateLimit: newVec("bitmex_rate_limit_limit",
+			"X-Ratelimit-Limit of the last response.",
+			typeGauge, nil, "api"),
+		rateLimitRemain: newVec("bitmex_rate_limit_remaining",
+			"X-Ratelimit-Remaining of the last response.",
+			typeGauge, nil, "api"),
+		wsConnected: newVec("bitmex_ws_connected",
+			"1 while the websocket is connected.",
+			typeGauge, nil),
+		wsReconnects: newVec("bitmex_ws_reconnects_total",
+			"Websocket connections established after the first one.",
+			typeCounter, nil),
+		wsMessages: newVec("bitmex_ws_messages_total",
+			"Websocket data messages by table and action.",
+			typeCounter, nil, "table", "action"),
+		decodeErrors: newVec("bitmex_ws_decode_errors_total",
+			"Websocket messages that failed to decode.",
+			typeCounter, nil),
+		listenerDuration: newVec("bitmex_listener_duration_seconds",
+			"Time the listeners of an event took.",
+			typeHistogram, listenerBuckets, "event"),
+		bookLatency: newVec("bitmex_orderbook_latency_seconds",
+			"Receive time minus exchange timestamp of order book updates.",
+			typeHistogram, latencyBuckets, "table", "symbol"),
+	}
+	c.vecs = []*vec{
+		c.requests, c.requestDuration, c.rateLimit, c.rateLimitRemain, c.wsConnected,
+		c.wsReconnects, c.wsMessages, c.decodeErrors, c.listenerDuration, c.bookLatency,
+	}
+
+	names := make([]string, 0, len(constLabels))
+	for name := range constLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c.constLabels = append(c.constLabels, name, constLabels[name])
+	}
+	return c
+}
+
+// ObserveRequest implements bitmex.Metrics
+func (c *Collector) ObserveRequest(endpoint string, method string, status int, d time.Duration) {
+	c.requests.add(1, endpoint, method, strconv.Itoa(status))
+	c.requestDuration.observe(d.Seconds(), endpoint, method)
+}
+
+// SetRateLimit implements bitmex.Metrics
+func (c *Collector) SetRateLimit(api string, rateLimit bitmex.RateLimit) {
+	c.rateLimit.set(float64(rateLimit.Limit), api)
+	c.rateLimitRemain.set(float64(rateLimit.Remaining), api)
+}
+
+// SetWSConnected implements bitmex.Metrics
+func (c *Collector) SetWSConnected(connected bool) {
+	v := 0.0
+	if connected {
+		v = 1
+	}
+	c.wsConnected.set(v)
+}
+
+// IncWSReconnects implements bitmex.Metrics
+func (c *Collector) IncWSReconnects() {
+	c.wsReconnects.add(1)
+}
+
+// IncWSMessages implements bitmex.Metrics
+func (c *Collector) IncWSMessages(table string, action string) {
+	c.wsMessages.add(1, table, action)
+}
+
+// IncDecodeErrors implements bitmex.Metrics
+func (c *Collector) IncDecodeErrors() {
+	c.decodeErrors.add(1)
+}
+
+// ObserveListener implements bitmex.Metrics
+func (c *Collector) ObserveListener(event string, d time.Duration) {
+	c.listenerDuration.observe(d.Seconds(), event)
+}
+
+// ObserveBookLatency implements bitmex.Metrics
+func (c *Collector) ObserveBookLatency(table string, symbol string, d time.Duration) {
+	c.bookLatency.observe(d.Seconds(), table, symbol)
+}
+
+// Handler serves the metrics of c
+func (c *Collector) Handler() http.Handler {
+	return Handler(c)
+}
+
+// Handler serves the metrics of several collectors, which should have different constant labels
+func Handler(collectors ...*Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if len(collectors) > 0 {
+			for i, v := range collectors[0].vecs {
+				v.writeHeader(&buf)
+				for _, c := range collectors {
+					c.vecs[i].writeSamples(&buf, c.constLabels)
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+)
+
+func scrape(t *testing.T, c ...*Collector) string {
+	rec := httptest.NewRecorder()
+	Handler(c...).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type %v", ct)
+	}
+	body, _ := ioutil.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestCollector(t *testing.T) {
+	c := New(map[string]string{"bot": "mm-1"})
+	c.ObserveRequest("/order", "POST", 200, 30*time.Millisecond)
+	c.ObserveRequest("/order", "POST", 200, 300*time.Millisecond)
+	c.ObserveRequest("/order", "POST", 0, 10*time.Second)
+	c.SetRateLimit("private", bitmex.RateLimit{Limit: 60, Remaining: 42})
+	c.SetWSConnected(true)
+	c.IncWSReconnects()
+	c.IncWSMessages("trade", "insert")
+	c.IncWSMessages("trade", "insert")
+	c.IncDecodeErrors()
+	c.ObserveListener("trade", 200*time.Microsecond)
+	c.ObserveBookLatency("orderBookL2", "XBT\"USD", 20*time.Millisecond)
+
+	out := scrape(t, c)
+	for _, want := range []string{
+		"# TYPE bitmex_rest_requests_total counter\n",
+		`bitmex_rest_requests_total{bot="mm-1",endpoint="/order",method="POST",status="0"} 1` + "\n",
+		`bitmex_rest_requests_total{bot="mm-1",endpoint="/order",method="POST",status="200"} 2` + "\n",
+		"# TYPE bitmex_rest_request_duration_seconds histogram\n",
+		`bitmex_rest_request_duration_seconds_bucket{bot="mm-1",endpoint="/order",method="POST",le="0.025"} 0` + "\n",
+		`bitmex_rest_request_duration_seconds_bucket{bot="mm-1",endpoint="/order",method="POST",le="0.05"} 1` + "\n",
+		`bitmex_rest_request_duration_seconds_bucket{bot="mm-1",endpoint="/order",method="POST",le="0.5"} 2` + "\n",
+		`bitmex_rest_request_duration_seconds_bucket{bot="mm-1",endpoint="/order",method="POST",le="10"} 3` + "\n",
+		`bitmex_rest_request_duration_seconds_bucket{bot="mm-1",endpoint="/order",method="POST",le="+Inf"} 3` + "\n",
+		`bitmex_rest_request_duration_seconds_sum{bot="mm-1",endpoint="/order",method="POST"} 10.33` + "\n",
+		`bitmex_rest_request_duration_seconds_count{bot="mm-1",endpoint="/order",method="POST"} 3` + "\n",
+		`bitmex_rate_limit_remaining{bot="mm-1",api="private"} 42` + "\n",
+		`bitmex_rate_limit_limit{bot="mm-1",api="private"} 60` + "\n",
+		`bitmex_ws_connected{bot="mm-1"} 1` + "\n",
+		`bitmex_ws_reconnects_total{bot="mm-1"} 1` + "\n",
+		`bitmex_ws_messages_total{bot="mm-1",table="trade",action="insert"} 2` + "\n",
+		`bitmex_ws_decode_errors_total{bot="mm-1"} 1` + "\n",
+		`bitmex_listener_duration_seconds_count{bot="mm-1",event="trade"} 1` + "\n",
+		`bitmex_orderbook_latency_seconds_bucket{bot="mm-1",table="orderBookL2",symbol="XBT\"USD",le="0.025"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%v", want, out)
+		}
+	}
+}
+
+func TestHandler_Collectors(t *testing.T) {
+	a := New(map[string]string{"bot": "a"})
+	b := New(map[string]string{"bot": "b"})
+	a.IncDecodeErrors()
+	b.IncDecodeErrors()
+	b.IncDecodeErrors()
+
+	out := scrape(t, a, b)
+	if strings.Count(out, "# TYPE bitmex_ws_decode_errors_total counter") != 1 {
+		t.Errorf("family header repeated\n%v", out)
+	}
+	if !strings.Contains(out, `bitmex_ws_decode_errors_total{bot="a"} 1`+"\n"+`bitmex_ws_decode_errors_total{bot="b"} 2`) {
+		t.Errorf("samples not grouped\n%v", out)
+	}
+}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// series is one combination of label values
+type series struct {
+	labels []string
+	value  float64  // counter and gauge
+	counts []uint64 // histogram, per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// vec is a metric family with variable labels
+type vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name string, help string, typ string, buckets []float64, labelNames ...string) *vec {
+	return &vec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+}
+
+// get must be called with the lock held
+func (v *vec) get(values []string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		if v.typ == typeHistogram {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) add(delta float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(values).value += delta
+}
+
+func (v *vec) set(value float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(values).value = value
+}
+
+func (v *vec) observe(x float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.get(values)
+	s.sum += x
+	s.count++
+	for i, upper := range v.buckets {
+		if x <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+}
+
+func (v *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+// writeSamples writes the series sorted by labels, constLabels are name, value pairs
+func (v *vec) writeSamples(w io.Writer, constLabels []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := v.series[k]
+		pairs := append([]string(nil), constLabels...)
+		for i, name := range v.labelNames {
+			pairs = append(pairs, name, s.labels[i])
+		}
+		if v.typ != typeHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(pairs), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, upper := range v.buckets {
+			cumulative += s.counts[i]
+			le := append(pairs[:len(pairs):len(pairs)], "le", formatValue(upper))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(le), cumulative)
+		}
+		le := append(pairs[:len(pairs):len(pairs)], "le", "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(le), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(pairs), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(pairs), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,137 @@
+package bitmex
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
+)
+
+// fakeMetrics records the calls as strings
+type fakeMetrics struct {
+	mu    sync.Mutex
+	calls []string
+	seen  map[string]int
+}
+
+func (m *fakeMetrics) record(format string, a ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := fmt.Sprintf(format, a...)
+	m.calls = append(m.calls, s)
+	if m.seen == nil {
+		m.seen = make(map[string]int)
+	}
+	m.seen[s]++
+}
+
+func (m *fakeMetrics) count(call string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.seen[call]
+}
+
+func (m *fakeMetrics) ObserveRequest(endpoint string, method string, status int, d time.Duration) {
+	m.record("request %v %v %v", endpoint, method, status)
+}
+
+func (m *fakeMetrics) SetRateLimit(api string, rateLimit RateLimit) {
+	m.record("ratelimit %v %v/%v", api, rateLimit.Remaining, rateLimit.Limit)
+}
+
+func (m *fakeMetrics) SetWSConnected(connected bool) { m.record("connected %v", connected) }
+func (m *fakeMetrics) IncWSReconnects()              { m.record("reconnect") }
+func (m *fakeMetrics) IncDecodeErrors()              { m.record("decode error") }
+
+func (m *fakeMetrics) IncWSMessages(table string, action string) {
+	m.record("message %v %v", table, action)
+}
+
+func (m *fakeMetrics) ObserveListener(event string, d time.Duration) {
+	m.record("listener %v", event)
+}
+
+func (m *fakeMetrics) ObserveBookLatency(table string, symbol string, d time.Duration) {
+	if d > 0 {
+		m.record("latency %v %v", table, symbol)
+	}
+}
+
+func waitCall(t *testing.T, m *fakeMetrics, call string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for m.count(call) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%q called %d times, want %d, calls %q", call, m.count(call), n, m.calls)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBitMEX_MetricsREST(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	m := &fakeMetrics{}
+	b.SetMetrics(m)
+	srv.SetRateLimit(60, 58, 1554800000)
+	handleFixture(t, srv, "GET", "/orderBook/L2", "orderbook_l2.json")
+	handleFixture(t, srv, "GET", "/order", "orders.json")
+
+	if _, err := b.GetOrderBook(10, "XBTUSD"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetOrders("XBTUSD"); err != nil {
+		t.Fatal(err)
+	}
+	srv.HandleError("GET", "/position", 503, "HTTPError", "overloaded")
+	if _, err := b.GetPosition("XBTUSD"); err == nil {
+		t.Fatal("expect error")
+	}
+
+	for _, call := range []string{
+		"request /orderBook/L2 GET 200",
+		"ratelimit public 58/60",
+		"request /order GET 200",
+		"ratelimit private 58/60",
+		"request /position GET 503",
+	} {
+		if m.count(call) != 1 {
+			t.Errorf("%q not recorded, calls %q", call, m.calls)
+		}
+	}
+
+	// disabled
+	b.SetMetrics(nil)
+	b.GetOrders("XBTUSD")
+	if m.count("request /order GET 200") != 1 {
+		t.Error("recorded after SetMetrics(nil)")
+	}
+}
+
+func TestBitMEX_MetricsWS(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	b.ws.RecIntvlMin = 50 * time.Millisecond
+	m := &fakeMetrics{}
+	b.SetMetrics(m)
+
+	ts := time.Now().Add(-50 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	srv.Script(bitmextest.ScriptOnSubscribe("orderBookL2_25:XBTUSD"),
+		`{"table":"orderBookL2_25","action":"partial","data":[{"symbol":"XBTUSD","id":1,"side":"Sell","size":300,"price":9000.5,"timestamp":"`+ts+`"},{"symbol":"XBTUSD","id":2,"side":"Buy","size":700,"price":9000,"timestamp":"`+ts+`"}]}`,
+		`{"table":"trade","action":"insert","data":"not trades"}`)
+	b.On(BitmexWSOrderBookL2_25, func(ob OrderBookDataL2, symbol string) {})
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrderBookL2_25, Param: "XBTUSD"}})
+
+	startWS(t, b)
+
+	waitCall(t, m, "connected true", 1)
+	waitCall(t, m, "message orderBookL2_25 partial", 1)
+	waitCall(t, m, "listener orderBookL2_25", 1)
+	waitCall(t, m, "latency orderBookL2_25 XBTUSD", 1)
+	waitCall(t, m, "decode error", 1)
+
+	srv.DropWS()
+	waitCall(t, m, "connected false", 1)
+	waitCall(t, m, "connected true", 2)
+	waitCall(t, m, "reconnect", 1)
+}
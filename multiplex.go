@@ -0,0 +1,393 @@
+package bitmex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api/recws"
+	"github.com/gorilla/websocket"
+)
+
+// /realtimemd envelopes are [type, id, topic, payload]
+const (
+	muxMessage     = 0
+	muxSubscribe   = 1
+	muxUnsubscribe = 2
+)
+
+var (
+	// ErrStreamClosed is returned when sending on a closed stream
+	ErrStreamClosed = errors.New("stream closed")
+	// ErrStreamClient is returned by StartWS of a client opened on a Multiplexer
+	ErrStreamClient = errors.New("client is a multiplexer stream, see Multiplexer.Start")
+)
+
+// Multiplexer carries several streams over one /realtimemd connection, public
+// ones or each authenticated with its own key. A stream is a BitMEX client
+// which doesn't StartWS itself: its Subscribe, On and caches work as usual.
+// Streams are opened again, authenticated and subscribed after a reconnect.
+type Multiplexer struct {
+	ws        recws.RecConn
+	host      string
+	wsURL     string
+	logger    Logger
+	heartbeat *heartbeat
+
+	mu        sync.RWMutex
+	streams   map[string]*BitMEX // key: stream id
+	proxy     *url.URL           // see SetProxyURL
+	dial      DialContextFunc    // see SetDialContext
+	dialerSet bool               // SetProxyURL or SetDialContext was called, nothing is inherited
+	wg        sync.WaitGroup     // heartbeat and reader of Start
+}
+
+// muxStream is what a stream client sends through
+type muxStream struct {
+	m  *Multiplexer
+	id string
+}
+
+// NewMultiplexer creates a multiplexer for host, HostReal or HostTestnet
+func NewMultiplexer(host string) *Multiplexer {
+	m := &Multiplexer{
+		host:      host,
+		logger:    NewStdLogger(nil, LevelInfo),
+		heartbeat: newHeartbeat(),
+		streams:   make(map[string]*BitMEX),
+	}
+	m.ws = recws.RecConn{
+		SubscribeHandler: m.restore,
+		StateHandler:     m.stateHandler,
+		Logger:           m.getLogger(),
+	}
+	return m
+}
+
+// stateHandler is the recws StateHandler, every stream reports the state of
+// the connection as BitmexConnState
+func (m *Multiplexer) stateHandler(ev ConnEvent) {
+	m.mu.RLock()
+	streams := make([]*BitMEX, 0, len(m.streams))
+	for _, b := range m.streams {
+		streams = append(streams, b)
+	}
+	m.mu.RUnlock()
+	for _, b := range streams {
+		b.stateHandler(ev)
+	}
+}
+
+// SetWSURL changes the url, e.g. ws://127.0.0.1:8080/realtimemd
+func (m *Multiplexer) SetWSURL(wsURL string) {
+	m.wsURL = wsURL
+}
+
+// SetProxyURL is BitMEX.SetProxyURL for the /realtimemd connection, call it before Start.
+// Without SetProxyURL or SetDialContext the connection takes the proxy and dialer
+// of the first stream which has any.
+func (m *Multiplexer) SetProxyURL(proxyURL string) error {
+	u, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.proxy = u
+	m.dialerSet = true
+	return nil
+}
+
+// SetDialContext is BitMEX.SetDialContext for the /realtimemd connection, call it before Start
+func (m *Multiplexer) SetDialContext(dial DialContextFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dial = dial
+	m.dialerSet = true
+}
+
+// applyDialer gives the connection its proxy and dialer, or those of the
+// first stream, by id, having any
+func (m *Multiplexer) applyDialer() {
+	m.mu.RLock()
+	proxy, dial := m.proxy, m.dial
+	if !m.dialerSet {
+		ids := make([]string, 0, len(m.streams))
+		for id := range m.streams {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if b := m.streams[id]; b.proxy != nil || b.dial != nil {
+				proxy, dial = b.proxy, b.dial
+				break
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	m.ws.Proxy = nil
+	if proxy != nil {
+		m.ws.Proxy = http.ProxyURL(proxy)
+	}
+	m.ws.NetDialContext = dial
+}
+
+// SetHeartbeat is BitMEX.SetHeartbeat for the /realtimemd connection
+func (m *Multiplexer) SetHeartbeat(interval time.Duration, timeout time.Duration) error {
+	return m.heartbeat.set(interval, timeout)
+}
+
+// PingRTT returns the round trip of the last answered ping
+func (m *Multiplexer) PingRTT() time.Duration {
+	if rtt := m.ws.PingRTT(); rtt > 0 {
+		return rtt
+	}
+	h := m.heartbeat
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rtt
+}
+
+// SetLogger replaces the logger of the connection, streams log through their client
+func (m *Multiplexer) SetLogger(l Logger) {
+	if l == nil {
+		l = NopLogger
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.logger = l
+}
+
+func (m *Multiplexer) getLogger() Logger {
+	return loggerFunc(func() Logger {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		return m.logger
+	})
+}
+
+// Open adds a stream, b's key, if any, authenticates it
+func (m *Multiplexer) Open(id string, b *BitMEX) error {
+	m.mu.Lock()
+	if _, ok := m.streams[id]; ok {
+		m.mu.Unlock()
+		return fmt.Errorf("stream %q already open", id)
+	}
+	m.streams[id] = b
+	m.mu.Unlock()
+
+	b.setStream(&muxStream{m: m, id: id})
+	if !m.ws.IsConnected() {
+		return nil
+	}
+	// the connection is up already, the stream missed its Connected
+	b.stateHandler(ConnEvent{State: ConnConnected, Time: time.Now()})
+	if err := m.send(muxSubscribe, id, nil); err != nil {
+		return err
+	}
+	return b.subscribeHandler()
+}
+
+// CloseStream removes a stream
+func (m *Multiplexer) CloseStream(id string) error {
+	m.mu.Lock()
+	_, ok := m.streams[id]
+	delete(m.streams, id)
+	m.mu.Unlock()
+	if !ok || !m.ws.IsConnected() {
+		return nil
+	}
+	return m.send(muxUnsubscribe, id, nil)
+}
+
+// len returns the number of open streams
+func (m *Multiplexer) len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.streams)
+}
+
+func (m *Multiplexer) stream(id string) *BitMEX {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.streams[id]
+}
+
+// send writes an envelope, payload nil for subscribe and unsubscribe
+func (m *Multiplexer) send(typ int, id string, payload []byte) error {
+	envelope := []interface{}{typ, id, id}
+	if payload != nil {
+		envelope = append(envelope, json.RawMessage(payload))
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return m.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+func (b *BitMEX) setStream(s *muxStream) {
+	b.streamMutex.Lock()
+	defer b.streamMutex.Unlock()
+
+	b.stream = s
+}
+
+func (b *BitMEX) getStream() *muxStream {
+	b.streamMutex.RLock()
+	defer b.streamMutex.RUnlock()
+
+	return b.stream
+}
+
+func (s *muxStream) send(payload []byte) error {
+	if s.m.stream(s.id) == nil {
+		return ErrStreamClosed
+	}
+	return s.m.send(muxMessage, s.id, payload)
+}
+
+func (s *muxStream) isConnected() bool {
+	return s.m.stream(s.id) != nil && s.m.ws.IsConnected()
+}
+
+// restore opens, authenticates and subscribes every stream on (re)connect
+func (m *Multiplexer) restore() error {
+	m.mu.RLock()
+	ids := make([]string, 0, len(m.streams))
+	for id := range m.streams {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		b := m.stream(id)
+		if b == nil {
+			continue
+		}
+		if err := m.send(muxSubscribe, id, nil); err != nil {
+			return err
+		}
+		// a stream failing to sign doesn't hold up the others
+		if err := b.subscribeHandler(); err != nil {
+			m.getLogger().Error("ws stream subscribe", "stream", id, "err", err)
+		}
+	}
+	return nil
+}
+
+// Start connects and routes the messages of every stream to its client until
+// ctx is done or Close, like StartWS. The first connection attempt's error is
+// returned, later disconnects are retried. Done and Wait tell when everything
+// has stopped.
+func (m *Multiplexer) Start(ctx context.Context) error {
+	wsURL := m.wsURL
+	if wsURL == "" {
+		u := url.URL{Scheme: "wss", Host: m.host, Path: "/realtimemd"}
+		wsURL = u.String()
+	}
+	m.applyDialer()
+	if err := m.ws.DialContext(ctx, wsURL, nil); err != nil {
+		m.getLogger().Error("ws dial", "err", err)
+		return err
+	}
+
+	done := m.ws.Done()
+	m.wg.Add(2)
+	go func() {
+		defer m.wg.Done()
+		// the same watchdog as /realtime, a half open connection is reconnected
+		m.heartbeat.watch(&m.ws, m.getLogger(), done)
+	}()
+
+	go func() {
+		defer m.wg.Done()
+		for m.ws.WaitConnected() {
+			_, message, err := m.ws.ReadMessage()
+			if err != nil {
+				if !m.ws.IsClosed() {
+					m.getLogger().Warn("ws read", "err", err)
+				}
+				continue
+			}
+			m.route(message)
+		}
+		m.getLogger().Info("ws closed")
+	}()
+	return nil
+}
+
+// route hands the payload of an envelope to its stream
+func (m *Multiplexer) route(message []byte) {
+	if string(message) == "pong" {
+		m.heartbeat.pong(time.Now())
+		return
+	}
+	var envelope []json.RawMessage
+	var typ int
+	var id string
+	if err := json.Unmarshal(message, &envelope); err != nil || len(envelope) < 3 ||
+		json.Unmarshal(envelope[0], &typ) != nil || json.Unmarshal(envelope[1], &id) != nil {
+		m.getLogger().Warn("ws mux message", "msg", message)
+		return
+	}
+	b := m.stream(id)
+	if b == nil {
+		m.getLogger().Debug("ws mux unknown stream", "stream", id)
+		return
+	}
+	switch typ {
+	case muxMessage:
+		if len(envelope) < 4 {
+			return
+		}
+		if recorder := b.getRecorder(); recorder != nil {
+			if err := recorder.Record(time.Now(), envelope[3]); err != nil {
+				b.log().Error("ws record", "err", err)
+			}
+		}
+		if err := b.processMessage(envelope[3]); err != nil {
+			b.log().Warn("ws decode", "err", err)
+		}
+	case muxUnsubscribe:
+		// closed by the server, e.g. a failed auth
+		m.getLogger().Warn("ws stream closed by server", "stream", id)
+	}
+}
+
+// IsConnected tells whether the connection is up
+func (m *Multiplexer) IsConnected() bool {
+	return m.ws.IsConnected()
+}
+
+// Close closes the connection
+func (m *Multiplexer) Close() {
+	m.ws.CloseWS()
+}
+
+// Done is closed when the connection is closed, by Close or the context of Start
+func (m *Multiplexer) Done() <-chan struct{} {
+	return m.ws.Done()
+}
+
+// Wait waits for the goroutines of Start to exit after Done
+func (m *Multiplexer) Wait() {
+	m.wg.Wait()
+	m.ws.Wait()
+}
+
+// loggerFunc resolves the logger on every call, so SetLogger applies to recws too
+type loggerFunc func() Logger
+
+func (f loggerFunc) Debug(msg string, keyvals ...interface{}) { f().Debug(msg, keyvals...) }
+func (f loggerFunc) Info(msg string, keyvals ...interface{})  { f().Info(msg, keyvals...) }
+func (f loggerFunc) Warn(msg string, keyvals ...interface{})  { f().Warn(msg, keyvals...) }
+func (f loggerFunc) Error(msg string, keyvals ...interface{}) { f().Error(msg, keyvals...) }
@@ -0,0 +1,183 @@
+package bitmex
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+func TestMultiplexer(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Script(bitmextest.ScriptOnSubscribe("trade:XBTUSD"),
+		`{"table":"trade","action":"insert","data":[{"symbol":"XBTUSD","side":"Buy","size":5,"price":9001}]}`)
+
+	m := NewMultiplexer(HostTestnet)
+	m.SetWSURL(srv.MDURL)
+	m.ws.HandshakeTimeout = 100 * time.Millisecond
+	m.ws.RecIntvlMin = 50 * time.Millisecond
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, s)
+	}
+	has := func(s string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range events {
+			if e == s {
+				return true
+			}
+		}
+		return false
+	}
+
+	pub := New(nil, HostTestnet, "", "", false)
+	pub.Subscribe([]SubscribeInfo{{Op: BitmexWSTrade, Param: "XBTUSD"}})
+	pub.On(BitmexWSTrade, func(trades []*swagger.Trade, action string) { record("pub trade") })
+	if err := m.Open("pub", pub); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		name := name
+		b := New(nil, HostTestnet, "", "", false)
+		b.SetCredentials(StaticCredentials{Key: testKey, Secret: testSecret})
+		b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrder}})
+		b.On(BitmexWSOrder, func(orders []*swagger.Order, action string) { record(name + " " + orders[0].OrderID) })
+		if err := m.Open(name, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Open("a", pub); err == nil {
+		t.Error("expect duplicate error")
+	}
+
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	streams := func() string {
+		ids := srv.Streams()
+		sort.Strings(ids)
+		return strings.Join(ids, ",")
+	}
+	waitFor(t, "streams", func() bool { return streams() == "a,b,pub" && countWSMessages(srv, `"authKey"`) == 2 })
+	waitFor(t, "trade", func() bool { return has("pub trade") })
+	if errs := srv.AuthErrors(); len(errs) != 0 {
+		t.Errorf("auth errors %v", errs)
+	}
+
+	srv.PushStream("a", `{"table":"order","action":"insert","data":[{"orderID":"o-a","symbol":"XBTUSD"}]}`)
+	srv.PushStream("b", `{"table":"order","action":"insert","data":[{"orderID":"o-b","symbol":"XBTUSD"}]}`)
+	waitFor(t, "orders", func() bool { return has("a o-a") && has("b o-b") })
+	if has("a o-b") || has("b o-a") {
+		t.Errorf("misrouted %q", events)
+	}
+
+	// all streams come back
+	srv.DropWS()
+	waitFor(t, "reconnect", func() bool {
+		return srv.Dials() == 2 && streams() == "a,b,pub" && countWSMessages(srv, `"authKey"`) == 4
+	})
+	if n := countWSMessages(srv, `"subscribe"`, "trade:XBTUSD"); n != 2 {
+		t.Errorf("trade subscribed %d times", n)
+	}
+
+	if err := m.CloseStream("b"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "closed stream", func() bool { return streams() == "a,pub" })
+	if m.stream("b") != nil {
+		t.Error("stream kept")
+	}
+}
+
+func TestMultiplexer_Heartbeat(t *testing.T) {
+	srv := newTestServer(t)
+	m := NewMultiplexer(HostTestnet)
+	m.SetLogger(NopLogger)
+	m.SetWSURL(srv.MDURL)
+	m.ws.RecIntvlMin = 50 * time.Millisecond
+	if err := m.SetHeartbeat(50*time.Millisecond, 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	waitFor(t, "pong", func() bool { return srv.Pings() >= 2 && m.PingRTT() > 0 })
+	if srv.Dials() != 1 {
+		t.Errorf("%d dials", srv.Dials())
+	}
+
+	// half open: the pings go out, nothing comes back
+	srv.IgnorePings(true)
+	waitFor(t, "reconnect", func() bool { return srv.Dials() == 2 })
+}
+
+func TestMultiplexer_ConnState(t *testing.T) {
+	srv := newTestServer(t)
+	m := NewMultiplexer(HostTestnet)
+	m.SetLogger(NopLogger)
+	m.SetWSURL(srv.MDURL)
+	m.ws.RecIntvlMin = 50 * time.Millisecond
+
+	pub := New(nil, HostTestnet, "", "", false)
+	pub.SetLogger(NopLogger)
+	pub.Subscribe([]SubscribeInfo{{Op: BitmexWSTrade, Param: "XBTUSD"}})
+	rec := &stateRecorder{}
+	pub.On(BitmexConnState, rec.listener)
+	if err := m.Open("pub", pub); err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.StartWS(context.Background()); err != ErrStreamClient {
+		t.Errorf("StartWS of a stream: %v", err)
+	}
+	if err := m.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscribed", func() bool { return rec.states() == "Connecting,Connected,Subscribed" })
+
+	// opened while IsConnected is read, on a connection already up
+	late := New(nil, HostTestnet, "", "", false)
+	lateRec := &stateRecorder{}
+	late.On(BitmexConnState, lateRec.listener)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for !late.IsConnected() {
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if err := m.Open("late", late); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if st := late.ConnStats(); st.State != ConnConnected || st.Connects != 1 {
+		t.Errorf("late stream stats %+v", st)
+	}
+
+	srv.DropWS()
+	waitFor(t, "reconnect", func() bool { return pub.ConnStats().Connects == 2 && late.ConnStats().Connects == 2 })
+	if rec.last(ConnDisconnected).State != ConnDisconnected || lateRec.last(ConnDisconnected).State != ConnDisconnected {
+		t.Errorf("disconnect not forwarded %v, %v", rec.states(), lateRec.states())
+	}
+
+	m.Close()
+	waitStopped(t, m.Done(), m.Wait)
+	if pub.ConnStats().State != ConnClosed || late.ConnStats().State != ConnClosed {
+		t.Errorf("states %v, %v", rec.states(), lateRec.states())
+	}
+}
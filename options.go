@@ -0,0 +1,345 @@
+package bitmex
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Option configures NewClient
+type Option func(o *clientOptions) error
+
+type clientOptions struct {
+	host       string
+	key        string
+	secret     string
+	httpClient *http.Client
+	transport  *TransportConfig
+	debug      bool
+	timeout    time.Duration // 0 keeps the default, see noTimeout
+	noTimeout  bool
+	userAgent  string
+	expireTime time.Duration
+	recMin     time.Duration
+	recMax     time.Duration
+	recFactor  float64
+	proxyURL   string
+	dial       DialContextFunc
+	logger     Logger
+	basePath   string
+	wsURL      string
+}
+
+func defaultClientOptions() clientOptions {
+	return clientOptions{host: HostReal}
+}
+
+// NewClient is New with options, validated before the client is created:
+//
+//	b, err := bitmex.NewClient(
+//		bitmex.WithConfigFile("bitmex.yaml", "testnet"),
+//		bitmex.WithEnv("BITMEX"),
+//		bitmex.WithTimeout(5*time.Second),
+//	)
+//
+// Later options override earlier ones, for a profile only its set fields.
+func NewClient(opts ...Option) (*BitMEX, error) {
+	o := defaultClientOptions()
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+
+	b := New(o.httpClient, o.host, o.key, o.secret, o.debug)
+	if o.logger != nil {
+		b.SetLogger(o.logger)
+	}
+	if o.transport != nil {
+		b.SetTransport(*o.transport)
+	}
+	if o.timeout > 0 || o.noTimeout {
+		b.SetTimeout(o.timeout)
+	}
+	if o.userAgent != "" {
+		b.cfg.UserAgent = o.userAgent
+	}
+	if o.expireTime > 0 {
+		b.cfg.ExpireTime = int64(o.expireTime / time.Second)
+	}
+	b.ws.RecIntvlMin = o.recMin
+	b.ws.RecIntvlMax = o.recMax
+	b.ws.RecIntvlFactor = o.recFactor
+	if o.dial != nil {
+		b.dial = o.dial
+	}
+	if o.proxyURL != "" || o.dial != nil {
+		if err := b.SetProxyURL(o.proxyURL); err != nil {
+			return nil, err
+		}
+	}
+	if o.basePath != "" {
+		b.SetBasePath(o.basePath)
+	}
+	if o.wsURL != "" {
+		b.SetWSURL(o.wsURL)
+	}
+	return b, nil
+}
+
+func (o *clientOptions) validate() error {
+	if o.host == "" || strings.Contains(o.host, "/") {
+		return fmt.Errorf("host %q: want a host name like %v", o.host, HostTestnet)
+	}
+	if (o.key == "") != (o.secret == "") {
+		return errors.New("key and secret go together")
+	}
+	if o.timeout < 0 {
+		return fmt.Errorf("timeout %v: negative", o.timeout)
+	}
+	if o.expireTime != 0 && o.expireTime < time.Second {
+		return fmt.Errorf("expire time %v: at least 1s", o.expireTime)
+	}
+	if o.recMin < 0 || o.recMax < 0 || (o.recMax != 0 && o.recMin > o.recMax) {
+		return fmt.Errorf("reconnect interval %v..%v: want 0 <= min <= max", o.recMin, o.recMax)
+	}
+	if o.recFactor != 0 && o.recFactor < 1 {
+		return fmt.Errorf("reconnect factor %v: at least 1", o.recFactor)
+	}
+	if _, err := parseProxyURL(o.proxyURL); err != nil {
+		return err
+	}
+	if err := checkURL("base path", o.basePath, "http", "https"); err != nil {
+		return err
+	}
+	return checkURL("ws url", o.wsURL, "ws", "wss")
+}
+
+func checkURL(name string, s string, schemes ...string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("%v %v: %v", name, s, err)
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme && u.Host != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("%v %v: want %v://host/...", name, s, strings.Join(schemes, " or "))
+}
+
+// WithHost selects the venue, HostReal by default
+func WithHost(host string) Option {
+	return func(o *clientOptions) error {
+		o.host = host
+		return nil
+	}
+}
+
+// WithTestnet selects HostTestnet
+func WithTestnet() Option {
+	return WithHost(HostTestnet)
+}
+
+// WithCredentials sets the api key, without one only public endpoints work
+func WithCredentials(key string, secret string) Option {
+	return func(o *clientOptions) error {
+		o.key = key
+		o.secret = secret
+		return nil
+	}
+}
+
+// WithHTTPClient makes rest use client, the proxy and dialer go into a copy
+// of it, see SetProxyURL
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *clientOptions) error {
+		o.httpClient = client
+		return nil
+	}
+}
+
+// WithTransport replaces the http client by a tuned one, see SetTransport,
+// WithTimeout still overrides its RequestTimeout
+func WithTransport(cfg TransportConfig) Option {
+	return func(o *clientOptions) error {
+		o.transport = &cfg
+		return nil
+	}
+}
+
+// WithDebug logs at the debug level
+func WithDebug(debug bool) Option {
+	return func(o *clientOptions) error {
+		o.debug = debug
+		return nil
+	}
+}
+
+// WithTimeout sets the rest request timeout, 10s by default, 0 for none
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *clientOptions) error {
+		o.timeout = timeout
+		o.noTimeout = timeout == 0
+		return nil
+	}
+}
+
+// WithUserAgent sets the User-Agent of rest requests
+func WithUserAgent(userAgent string) Option {
+	return func(o *clientOptions) error {
+		o.userAgent = userAgent
+		return nil
+	}
+}
+
+// WithExpireTime sets how far ahead api-expires of signed rest requests is,
+// 5s by default, whole seconds
+func WithExpireTime(expire time.Duration) Option {
+	return func(o *clientOptions) error {
+		o.expireTime = expire
+		return nil
+	}
+}
+
+// WithReconnect sets the websocket reconnect backoff, the first delay min
+// grows by factor up to max, 0 keeps the recws default
+func WithReconnect(min time.Duration, max time.Duration, factor float64) Option {
+	return func(o *clientOptions) error {
+		o.recMin = min
+		o.recMax = max
+		o.recFactor = factor
+		return nil
+	}
+}
+
+// WithProxy routes rest and the websocket through proxyURL, see SetProxyURL
+func WithProxy(proxyURL string) Option {
+	return func(o *clientOptions) error {
+		o.proxyURL = proxyURL
+		return nil
+	}
+}
+
+// WithDialContext makes rest and the websocket connect with dial, see SetDialContext
+func WithDialContext(dial DialContextFunc) Option {
+	return func(o *clientOptions) error {
+		o.dial = dial
+		return nil
+	}
+}
+
+// WithLogger replaces the default logger, see SetLogger
+func WithLogger(l Logger) Option {
+	return func(o *clientOptions) error {
+		o.logger = l
+		return nil
+	}
+}
+
+// WithBasePath changes the rest api base path, see SetBasePath
+func WithBasePath(basePath string) Option {
+	return func(o *clientOptions) error {
+		o.basePath = basePath
+		return nil
+	}
+}
+
+// WithWSURL changes the realtime websocket url, see SetWSURL
+func WithWSURL(wsURL string) Option {
+	return func(o *clientOptions) error {
+		o.wsURL = wsURL
+		return nil
+	}
+}
+
+// WithProfile applies the set fields of p
+func WithProfile(p Profile) Option {
+	return p.apply
+}
+
+// WithConfigFile applies the profile name of a config file, see Config.Lookup
+func WithConfigFile(path string, name string) Option {
+	return func(o *clientOptions) error {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			return err
+		}
+		p, err := cfg.Lookup(name)
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		return p.apply(o)
+	}
+}
+
+// WithEnv applies the profile fields set in the environment, see ProfileFromEnv
+func WithEnv(prefix string) Option {
+	return func(o *clientOptions) error {
+		p, err := ProfileFromEnv(prefix)
+		if err != nil {
+			return err
+		}
+		return p.apply(o)
+	}
+}
+
+func (p Profile) apply(o *clientOptions) error {
+	if p.Host != "" {
+		o.host = p.Host
+	} else if p.Testnet {
+		o.host = HostTestnet
+	}
+	if p.Key != "" || p.Secret != "" {
+		o.key = p.Key
+		o.secret = p.Secret
+	}
+	if p.Debug {
+		o.debug = true
+	}
+	for _, s := range []struct {
+		to  *string
+		val string
+	}{
+		{&o.proxyURL, p.ProxyURL},
+		{&o.basePath, p.BasePath},
+		{&o.wsURL, p.WSURL},
+		{&o.userAgent, p.UserAgent},
+	} {
+		if s.val != "" {
+			*s.to = s.val
+		}
+	}
+	for _, d := range []struct {
+		name string
+		to   *time.Duration
+		val  string
+	}{
+		{"timeout", &o.timeout, p.Timeout},
+		{"expire_time", &o.expireTime, p.ExpireTime},
+		{"reconnect_min", &o.recMin, p.ReconnectMin},
+		{"reconnect_max", &o.recMax, p.ReconnectMax},
+	} {
+		if d.val == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.val)
+		if err != nil {
+			return fmt.Errorf("%v: %v", d.name, err)
+		}
+		*d.to = v
+	}
+	if p.Timeout != "" {
+		o.noTimeout = o.timeout == 0
+	}
+	return nil
+}
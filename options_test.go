@@ -0,0 +1,130 @@
+package bitmex
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewClient(t *testing.T) {
+	srv := newTestServer(t)
+	handleFixture(t, srv, "GET", "/order", "orders.json").Private()
+	b, err := NewClient(
+		WithCredentials(testKey, testSecret),
+		WithBasePath(srv.BasePath),
+		WithWSURL(srv.WSURL),
+		WithUserAgent("bot/1.0"),
+		WithExpireTime(30*time.Second),
+		WithTimeout(3*time.Second),
+		WithReconnect(100*time.Millisecond, time.Second, 2),
+		WithTransport(LowLatencyTransport()),
+		WithLogger(NopLogger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.GetOrders("XBTUSD"); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := srv.LastRequest("GET", "/order")
+	if ua := req.Header.Get("User-Agent"); ua != "bot/1.0" {
+		t.Errorf("user agent %q", ua)
+	}
+	expires, _ := strconv.ParseInt(req.Header.Get("api-expires"), 10, 64)
+	if d := expires - time.Now().Unix(); d < 29 || d > 30 {
+		t.Errorf("expires in %vs", d)
+	}
+	if b.httpClient.Timeout != 3*time.Second || b.ws.RecIntvlMin != 100*time.Millisecond || b.ws.RecIntvlFactor != 2 {
+		t.Errorf("timeout %v reconnect %v %v", b.httpClient.Timeout, b.ws.RecIntvlMin, b.ws.RecIntvlFactor)
+	}
+	if b.transport.WarmConns != LowLatencyTransport().WarmConns {
+		t.Error("transport not set")
+	}
+	if b.getLogger() != NopLogger {
+		t.Error("logger not set")
+	}
+	startWS(t, b)
+}
+
+func TestNewClientProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitmex.json")
+	config := `{
+	"default": "local",
+	"profiles": {
+		"local": {"testnet": true, "key": "k", "secret": "s", "timeout": "2s", "reconnect_max": "1m"},
+		"mainnet": {"key": "other", "secret": "other"}
+	}
+}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("BITMEX_TEST_KEY", testKey)
+	t.Setenv("BITMEX_TEST_SECRET", testSecret)
+	t.Setenv("BITMEX_TEST_USER_AGENT", "env")
+
+	b, err := NewClient(WithConfigFile(path, ""), WithEnv("BITMEX_TEST"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.host != HostTestnet || b.Key != testKey || b.cfg.UserAgent != "env" {
+		t.Errorf("host %v key %v user agent %v", b.host, b.Key, b.cfg.UserAgent)
+	}
+	if b.httpClient.Timeout != 2*time.Second || b.ws.RecIntvlMax != time.Minute {
+		t.Errorf("timeout %v reconnect max %v", b.httpClient.Timeout, b.ws.RecIntvlMax)
+	}
+
+	if b, err = NewClient(WithConfigFile(path, "mainnet")); err != nil || b.host != HostReal || b.Key != "other" {
+		t.Errorf("mainnet %v", err)
+	}
+	if _, err = NewClient(WithConfigFile(path, "nope")); err == nil || !strings.Contains(err.Error(), "local, mainnet") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	// the flat format
+	cfg, err := LoadConfig("testdata/config.yaml.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := cfg.Lookup("")
+	if err != nil || p.Key != testKey || !p.Testnet || p.ProxyURL != "http://127.0.0.1:1080" {
+		t.Errorf("flat profile %+v %v", p, err)
+	}
+	if err := p.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	t.Setenv("BITMEX_TEST_TESTNET", "maybe")
+	if _, err := ProfileFromEnv("BITMEX_TEST"); err == nil || !strings.Contains(err.Error(), "BITMEX_TEST_TESTNET") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestNewClientInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opt  Option
+	}{
+		{"host", WithHost("https://www.bitmex.com")},
+		{"key", WithCredentials(testKey, "")},
+		{"timeout", WithTimeout(-time.Second)},
+		{"expire", WithExpireTime(time.Millisecond)},
+		{"reconnect", WithReconnect(time.Minute, time.Second, 1.5)},
+		{"factor", WithReconnect(0, 0, 0.5)},
+		{"proxy", WithProxy("ftp://127.0.0.1")},
+		{"base path", WithBasePath("127.0.0.1:8080/api/v1")},
+		{"ws url", WithWSURL("http://127.0.0.1:8080/realtime")},
+		{"profile", WithProfile(Profile{Timeout: "10"})},
+	} {
+		if _, err := NewClient(tc.opt); err == nil {
+			t.Errorf("%v: expect error", tc.name)
+		}
+	}
+	if err := (Profile{ReconnectMin: "1m", ReconnectMax: "1s"}).Validate(); err == nil {
+		t.Error("expect reconnect error")
+	}
+}
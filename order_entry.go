@@ -0,0 +1,331 @@
+package bitmex
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+	"github.com/tidwall/gjson"
+)
+
+// realtime order commands, named after the OrderApiService calls
+const (
+	WSCmdOrderNew       = "orderNew"
+	WSCmdOrderAmend     = "orderAmend"
+	WSCmdOrderCancel    = "orderCancel"
+	WSCmdOrderCancelAll = "orderCancelAll"
+)
+
+// ErrOrderTimeout is returned when a websocket order got no response in time.
+// The order may have been placed, look it up by ClOrdID before placing again.
+var ErrOrderTimeout = errors.New("order request timed out")
+
+// OrderEntry places, amends and cancels orders. RESTOrderEntry and
+// WSOrderEntry implement it so strategies don't care about the transport.
+type OrderEntry interface {
+	PlaceOrder(req OrderRequest) (swagger.Order, error)
+	AmendOrder(req AmendRequest) (swagger.Order, error)
+	CancelOrder(req CancelRequest) ([]swagger.Order, error)
+	CancelAll(req CancelAllRequest) ([]swagger.Order, error)
+}
+
+// OrderRequest is a new order, zero fields are left out
+type OrderRequest struct {
+	Symbol      string
+	Side        string
+	OrdType     string
+	OrderQty    float32
+	Price       float64
+	StopPx      float64
+	DisplayQty  *float32 // nil to display all, 0 for hidden
+	TimeInForce string
+	ExecInst    string
+	ClOrdID     string
+	Text        string
+}
+
+func (r OrderRequest) params() map[string]interface{} {
+	params := map[string]interface{}{
+		"symbol":   r.Symbol,
+		"side":     r.Side,
+		"ordType":  r.OrdType,
+		"orderQty": r.OrderQty,
+	}
+	setFloat(params, "price", r.Price)
+	setFloat(params, "stopPx", r.StopPx)
+	if r.DisplayQty != nil {
+		params["displayQty"] = *r.DisplayQty
+	}
+	setString(params, "timeInForce", r.TimeInForce)
+	setString(params, "execInst", r.ExecInst)
+	setString(params, "clOrdID", r.ClOrdID)
+	setString(params, "text", r.Text)
+	return params
+}
+
+// AmendRequest changes an order by OrderID or OrigClOrdID, zero fields are kept
+type AmendRequest struct {
+	OrderID         string
+	OrigClOrdID     string
+	ClOrdID         string // new id
+	OrderQty        float32
+	LeavesQty       float32
+	SimpleOrderQty  float64
+	SimpleLeavesQty float64
+	Price           float64
+	StopPx          float64
+	PegOffsetValue  float64
+	Text            string
+}
+
+func (r AmendRequest) params() map[string]interface{} {
+	params := map[string]interface{}{}
+	setString(params, "orderID", r.OrderID)
+	setString(params, "origClOrdID", r.OrigClOrdID)
+	setString(params, "clOrdID", r.ClOrdID)
+	// OrderApiService checks the quantities are float32
+	setFloat32(params, "orderQty", r.OrderQty)
+	setFloat32(params, "leavesQty", r.LeavesQty)
+	setFloat(params, "simpleOrderQty", r.SimpleOrderQty)
+	setFloat(params, "simpleLeavesQty", r.SimpleLeavesQty)
+	setFloat(params, "price", r.Price)
+	setFloat(params, "stopPx", r.StopPx)
+	setFloat(params, "pegOffsetValue", r.PegOffsetValue)
+	setString(params, "text", r.Text)
+	return params
+}
+
+// CancelRequest cancels orders by OrderID or ClOrdID, comma separated for several
+type CancelRequest struct {
+	OrderID string
+	ClOrdID string
+	Text    string
+}
+
+func (r CancelRequest) params() map[string]interface{} {
+	params := map[string]interface{}{}
+	setString(params, "orderID", r.OrderID)
+	setString(params, "clOrdID", r.ClOrdID)
+	setString(params, "text", r.Text)
+	return params
+}
+
+// CancelAllRequest cancels every order, or those of Symbol matching Filter
+type CancelAllRequest struct {
+	Symbol string
+	Filter string // e.g. `{"side":"Buy"}`
+	Text   string
+}
+
+func (r CancelAllRequest) params() map[string]interface{} {
+	params := map[string]interface{}{}
+	setString(params, "symbol", r.Symbol)
+	setString(params, "filter", r.Filter)
+	setString(params, "text", r.Text)
+	return params
+}
+
+func setString(params map[string]interface{}, key string, v string) {
+	if v != "" {
+		params[key] = v
+	}
+}
+
+func setFloat(params map[string]interface{}, key string, v float64) {
+	if v != 0 {
+		params[key] = v
+	}
+}
+
+func setFloat32(params map[string]interface{}, key string, v float32) {
+	if v != 0 {
+		params[key] = v
+	}
+}
+
+// RESTOrderEntry sends orders through OrderApiService
+type RESTOrderEntry struct {
+	b *BitMEX
+}
+
+// NewRESTOrderEntry returns the rest order entry of b
+func NewRESTOrderEntry(b *BitMEX) *RESTOrderEntry {
+	return &RESTOrderEntry{b: b}
+}
+
+// PlaceOrder is POST /order
+func (e *RESTOrderEntry) PlaceOrder(req OrderRequest) (order swagger.Order, err error) {
+	var response *http.Response
+	order, response, err = e.b.client.OrderApi.OrderNew(e.b.ctx, req.Symbol, req.params())
+	if err != nil {
+		return
+	}
+	e.b.onResponse(response)
+	return
+}
+
+// AmendOrder is PUT /order
+func (e *RESTOrderEntry) AmendOrder(req AmendRequest) (order swagger.Order, err error) {
+	var response *http.Response
+	order, response, err = e.b.client.OrderApi.OrderAmend(e.b.ctx, req.params())
+	if err != nil {
+		return
+	}
+	e.b.onResponse(response)
+	return
+}
+
+// CancelOrder is DELETE /order
+func (e *RESTOrderEntry) CancelOrder(req CancelRequest) (orders []swagger.Order, err error) {
+	var response *http.Response
+	orders, response, err = e.b.client.OrderApi.OrderCancel(e.b.ctx, req.params())
+	if err != nil {
+		return
+	}
+	e.b.onResponse(response)
+	return
+}
+
+// CancelAll is DELETE /order/all
+func (e *RESTOrderEntry) CancelAll(req CancelAllRequest) (orders []swagger.Order, err error) {
+	var response *http.Response
+	orders, response, err = e.b.client.OrderApi.OrderCancelAll(e.b.ctx, req.params())
+	if err != nil {
+		return
+	}
+	e.b.onResponse(response)
+	return
+}
+
+// SetOrderEntry sends every order of b through e, nil for rest: NewOrder,
+// PlaceOrder, PlaceOrder2, CloseOrder, AmendOrder, AmendOrder2, CancelOrder
+// and CancelAllOrders. Queries such as GetOrders stay on rest.
+func (b *BitMEX) SetOrderEntry(e OrderEntry) {
+	b.orderEntryMutex.Lock()
+	defer b.orderEntryMutex.Unlock()
+	b.orderEntry = e
+}
+
+func (b *BitMEX) getOrderEntry() OrderEntry {
+	b.orderEntryMutex.RLock()
+	defer b.orderEntryMutex.RUnlock()
+	return b.orderEntry
+}
+
+// orders returns the order entry of SetOrderEntry, or rest
+func (b *BitMEX) orders() OrderEntry {
+	if e := b.getOrderEntry(); e != nil {
+		return e
+	}
+	return NewRESTOrderEntry(b)
+}
+
+// WSOrderEntry sends orders over the authenticated realtime connection and
+// falls back to rest when the connection is down, the command couldn't be
+// sent, or the venue doesn't support it. BitMEX answers order commands with
+// "Unknown or unsupported command", after the first such answer every order
+// goes through rest without trying the websocket again.
+//
+// A placement with no response within Timeout returns ErrOrderTimeout rather
+// than being sent again through rest, which could double it. Amends and
+// cancels set absolute values and fall back.
+type WSOrderEntry struct {
+	Timeout time.Duration // 0 for 5s
+
+	b           *BitMEX
+	rest        *RESTOrderEntry
+	unsupported int32
+}
+
+// NewWSOrderEntry returns the websocket order entry of b, b must StartWS
+// with credentials for orders to go over the websocket
+func NewWSOrderEntry(b *BitMEX) *WSOrderEntry {
+	return &WSOrderEntry{b: b, rest: NewRESTOrderEntry(b)}
+}
+
+// Supported tells whether the venue may take orders over the websocket,
+// false once it answered that it doesn't
+func (e *WSOrderEntry) Supported() bool {
+	return atomic.LoadInt32(&e.unsupported) == 0
+}
+
+// PlaceOrder places over the websocket, or rest
+func (e *WSOrderEntry) PlaceOrder(req OrderRequest) (order swagger.Order, err error) {
+	ok, err := e.send(WSCmdOrderNew, req.params(), &order, false)
+	if !ok {
+		return e.rest.PlaceOrder(req)
+	}
+	return
+}
+
+// AmendOrder amends over the websocket, or rest
+func (e *WSOrderEntry) AmendOrder(req AmendRequest) (order swagger.Order, err error) {
+	ok, err := e.send(WSCmdOrderAmend, req.params(), &order, true)
+	if !ok {
+		return e.rest.AmendOrder(req)
+	}
+	return
+}
+
+// CancelOrder cancels over the websocket, or rest
+func (e *WSOrderEntry) CancelOrder(req CancelRequest) (orders []swagger.Order, err error) {
+	ok, err := e.send(WSCmdOrderCancel, req.params(), &orders, true)
+	if !ok {
+		return e.rest.CancelOrder(req)
+	}
+	return
+}
+
+// CancelAll cancels over the websocket, or rest
+func (e *WSOrderEntry) CancelAll(req CancelAllRequest) (orders []swagger.Order, err error) {
+	ok, err := e.send(WSCmdOrderCancelAll, req.params(), &orders, true)
+	if !ok {
+		return e.rest.CancelAll(req)
+	}
+	return
+}
+
+// send runs a command and decodes its data into out, ok is false when the
+// caller should go through rest instead
+func (e *WSOrderEntry) send(op string, params map[string]interface{}, out interface{}, retryOnTimeout bool) (ok bool, err error) {
+	b := e.b
+	if !e.Supported() || !b.IsConnected() || !b.hasCredentials() {
+		return false, nil
+	}
+	timeout := e.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	response, sent, err := b.request(WSCmd{Command: op, Args: []interface{}{params}}, timeout)
+	if !sent {
+		b.log().Warn("ws order not sent, using rest", "op", op, "err", err)
+		return false, nil
+	}
+	if err == errRequestTimeout {
+		if retryOnTimeout {
+			b.log().Warn("ws order timed out, using rest", "op", op)
+			return false, nil
+		}
+		return true, ErrOrderTimeout
+	}
+
+	if status := gjson.GetBytes(response, "status"); status.Exists() {
+		msg := gjson.GetBytes(response, "error").String()
+		if strings.Contains(msg, "Unknown or unsupported command") {
+			atomic.StoreInt32(&e.unsupported, 1)
+			b.log().Info("ws orders unsupported, using rest", "op", op)
+			return false, nil
+		}
+		return true, &WSError{Status: int(status.Int()), Message: msg}
+	}
+	data := gjson.GetBytes(response, "data")
+	if !data.Exists() {
+		return true, nil
+	}
+	return true, json.Unmarshal([]byte(data.Raw), out)
+}
@@ -0,0 +1,229 @@
+package bitmex
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+func countRequests(srv *bitmextest.Server, method string, path string) int {
+	n := 0
+	for _, r := range srv.Requests() {
+		if r.Method == method && r.Path == "/api/v1"+path {
+			n++
+		}
+	}
+	return n
+}
+
+func startOrderEntry(t *testing.T) (*WSOrderEntry, *bitmextest.Server) {
+	b, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "POST", "/order", "order.json").Private()
+	handleFixture(t, srv, "DELETE", "/order", "orders.json").Private()
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrder, Param: "XBTUSD"}})
+	startWS(t, b)
+	if !srv.WaitWSMessage("subscribe", 5*time.Second) {
+		t.Fatal("not subscribed")
+	}
+	return NewWSOrderEntry(b), srv
+}
+
+var limitOrder = OrderRequest{Symbol: "XBTUSD", Side: SIDE_BUY, OrdType: ORD_TYPE_LIMIT, OrderQty: 20, Price: 3000, ClOrdID: "c1"}
+
+func TestWSOrderEntry(t *testing.T) {
+	e, srv := startOrderEntry(t)
+	var _ OrderEntry = e
+	srv.HandleCommand(WSCmdOrderNew, func(args []interface{}) (interface{}, error) {
+		params := args[0].(map[string]interface{})
+		return map[string]interface{}{"orderID": "ws-1", "clOrdID": params["clOrdID"], "price": params["price"]}, nil
+	})
+	srv.HandleCommand(WSCmdOrderAmend, func(args []interface{}) (interface{}, error) {
+		return nil, errors.New("Invalid ordStatus")
+	})
+
+	order, err := e.PlaceOrder(limitOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.OrderID != "ws-1" || order.ClOrdID != "c1" || order.Price != 3000 {
+		t.Errorf("order %+v", order)
+	}
+	if n := countRequests(srv, "POST", "/order"); n != 0 {
+		t.Errorf("%d rest requests", n)
+	}
+
+	// a rejection is returned, not retried through rest
+	_, err = e.AmendOrder(AmendRequest{OrderID: "ws-1", Price: 3001})
+	if wsErr, ok := err.(*WSError); !ok || wsErr.Status != 400 || wsErr.Message != "Invalid ordStatus" {
+		t.Errorf("got %v", err)
+	}
+	if n := countRequests(srv, "PUT", "/order"); n != 0 {
+		t.Errorf("%d rest requests", n)
+	}
+
+	// no response: a placement is left to the caller, a cancel falls back
+	e.Timeout = 50 * time.Millisecond
+	slow := func(args []interface{}) (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return nil, nil
+	}
+	srv.HandleCommand(WSCmdOrderNew, slow)
+	srv.HandleCommand(WSCmdOrderCancel, slow)
+	if _, err := e.PlaceOrder(limitOrder); err != ErrOrderTimeout {
+		t.Errorf("got %v", err)
+	}
+	orders, err := e.CancelOrder(CancelRequest{OrderID: "ws-1"})
+	if err != nil || len(orders) == 0 {
+		t.Fatalf("%v %v", orders, err)
+	}
+	if n := countRequests(srv, "DELETE", "/order"); n != 1 {
+		t.Errorf("%d rest cancels", n)
+	}
+}
+
+func TestWSOrderEntry_Unsupported(t *testing.T) {
+	e, srv := startOrderEntry(t)
+
+	order, err := e.PlaceOrder(limitOrder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.OrderID == "" || e.Supported() {
+		t.Errorf("order %+v, supported %v", order, e.Supported())
+	}
+	req, _ := srv.LastRequest("POST", "/order")
+	if p := req.Params(); p["clOrdID"] != "c1" || p["price"] != "3000" || p["orderQty"] != "20" {
+		t.Errorf("params %v", p)
+	}
+
+	// the websocket isn't tried again
+	if _, err := e.PlaceOrder(limitOrder); err != nil {
+		t.Fatal(err)
+	}
+	if n := countWSMessages(srv, WSCmdOrderNew); n != 1 {
+		t.Errorf("%d ws orders", n)
+	}
+	if n := countRequests(srv, "POST", "/order"); n != 2 {
+		t.Errorf("%d rest orders", n)
+	}
+}
+
+func TestWSOrderEntry_NotConnected(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "POST", "/order", "order.json").Private()
+	srv.HandleCommand(WSCmdOrderNew, func(args []interface{}) (interface{}, error) {
+		t.Error("sent over the websocket")
+		return nil, nil
+	})
+
+	e := NewWSOrderEntry(b)
+	if _, err := e.PlaceOrder(limitOrder); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Supported() {
+		t.Error("unsupported without trying")
+	}
+	if n := countRequests(srv, "POST", "/order"); n != 1 {
+		t.Errorf("%d rest orders", n)
+	}
+}
+
+func TestBitMEX_SetOrderEntry(t *testing.T) {
+	e, srv := startOrderEntry(t)
+	srv.HandleCommand(WSCmdOrderNew, func(args []interface{}) (interface{}, error) {
+		return map[string]interface{}{"orderID": "ws-1"}, nil
+	})
+	var trader Trader = e.b
+	e.b.SetOrderEntry(e)
+
+	order, err := trader.PlaceOrder(SIDE_BUY, ORD_TYPE_LIMIT, 0, 3000, 20, "", "", "XBTUSD")
+	if err != nil || order.OrderID != "ws-1" {
+		t.Fatalf("%+v %v", order, err)
+	}
+	if _, err := trader.CancelOrder("ws-1"); err == nil {
+		t.Error("expect one order error, the fixture has several")
+	}
+	if countRequests(srv, "POST", "/order") != 0 || countRequests(srv, "DELETE", "/order") != 1 {
+		t.Errorf("requests %v", srv.Requests())
+	}
+}
+
+func TestRESTOrderEntry_AmendOrder(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "PUT", "/order", "order.json").Private()
+
+	e := NewRESTOrderEntry(b)
+	if _, err := e.AmendOrder(AmendRequest{OrderID: "o-1", OrderQty: 30, Price: 3001}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := srv.LastRequest("PUT", "/order")
+	if p := req.Params(); p["orderID"] != "o-1" || p["orderQty"] != "30" || p["price"] != "3001" {
+		t.Errorf("params %v", p)
+	}
+	if _, err := e.AmendOrder(AmendRequest{OrderID: "o-1", LeavesQty: 10}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = srv.LastRequest("PUT", "/order")
+	if p := req.Params(); p["leavesQty"] != "10" {
+		t.Errorf("params %v", p)
+	}
+}
+
+// recordingEntry records the requests of every call
+type recordingEntry struct {
+	calls []interface{}
+}
+
+func (e *recordingEntry) PlaceOrder(req OrderRequest) (swagger.Order, error) {
+	e.calls = append(e.calls, req)
+	return swagger.Order{OrderID: "o-1"}, nil
+}
+
+func (e *recordingEntry) AmendOrder(req AmendRequest) (swagger.Order, error) {
+	e.calls = append(e.calls, req)
+	return swagger.Order{OrderID: "o-1"}, nil
+}
+
+func (e *recordingEntry) CancelOrder(req CancelRequest) ([]swagger.Order, error) {
+	e.calls = append(e.calls, req)
+	return []swagger.Order{{OrderID: "o-1"}}, nil
+}
+
+func (e *recordingEntry) CancelAll(req CancelAllRequest) ([]swagger.Order, error) {
+	e.calls = append(e.calls, req)
+	return nil, nil
+}
+
+func TestBitMEX_SetOrderEntryRoutesAll(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	e := &recordingEntry{}
+	b.SetOrderEntry(e)
+
+	b.NewOrder(SIDE_BUY, ORD_TYPE_LIMIT, 3000, 20, true, "", "XBTUSD")
+	b.PlaceOrder(SIDE_BUY, ORD_TYPE_LIMIT, 0, 3000, 20, "", "", "XBTUSD")
+	b.PlaceOrder2(SIDE_BUY, ORD_TYPE_LIMIT, 0, 3000, 20, 0, "", "", "XBTUSD", "c1", "")
+	b.CloseOrder(SIDE_SELL, ORD_TYPE_LIMIT, 3100, 20, false, "", "XBTUSD")
+	b.AmendOrder("o-1", 3001)
+	b.AmendOrder2("o-1", "", "", 0, 30, 0, 0, 0, 0, 0, "")
+	b.CancelOrder("o-1")
+	b.CancelAllOrders("XBTUSD")
+
+	if len(e.calls) != 8 || len(srv.Requests()) != 0 {
+		t.Fatalf("%d calls, %d rest requests", len(e.calls), len(srv.Requests()))
+	}
+	if req := e.calls[2].(OrderRequest); req.DisplayQty == nil || *req.DisplayQty != 0 || req.ClOrdID != "c1" {
+		t.Errorf("PlaceOrder2 %+v", req)
+	}
+	if req := e.calls[3].(OrderRequest); req.ExecInst != "Close" {
+		t.Errorf("CloseOrder %+v", req)
+	}
+	if req := e.calls[5].(AmendRequest); req.OrderQty != 30 {
+		t.Errorf("AmendOrder2 %+v", req)
+	}
+	if req := e.calls[7].(CancelAllRequest); req.Symbol != "XBTUSD" {
+		t.Errorf("CancelAllOrders %+v", req)
+	}
+}
@@ -1,6 +1,7 @@
 package bitmex
 
 import (
+	"fmt"
 	"sort"
 	"strconv"
 	"sync"
@@ -94,21 +95,47 @@ func (ob *OrderBook) Ask() float64 {
 	return ob.Asks[0].Price
 }
 
+// OrderBookLocal is an orderBookL2 book kept from a partial and its deltas,
+// sorted by price. With a LevelCodec the deltas of levels it hasn't seen are
+// resolved and the prices validated.
 type OrderBookLocal struct {
-	ob map[string]*OrderBookL2
-	m  sync.Mutex
+	levels map[int64]*OrderBookL2 // key: ID
+	bids   []*OrderBookL2         // best first
+	asks   []*OrderBookL2         // best first
+	codec  LevelCodec
+	m      sync.Mutex
 }
 
 func NewOrderBookLocal() *OrderBookLocal {
 	o := &OrderBookLocal{
-		ob: make(map[string]*OrderBookL2),
+		levels: make(map[int64]*OrderBookL2),
 	}
 	return o
 }
 
+// SetLevelCodec makes the book resolve and validate prices with c
+func (o *OrderBookLocal) SetLevelCodec(c LevelCodec) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.codec = c
+}
+
+// LevelCodec returns the codec of the book, zero if none
+func (o *OrderBookLocal) LevelCodec() LevelCodec {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return o.codec
+}
+
 func (o *OrderBookLocal) GetOrderbookL2() (ob OrderBookDataL2) {
-	ob.RawData = make([]OrderBookL2, 0, len(o.ob))
-	for _, v := range o.ob {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	ob.RawData = make([]OrderBookL2, 0, len(o.levels))
+	for _, v := range o.bids {
+		ob.RawData = append(ob.RawData, *v)
+	}
+	for _, v := range o.asks {
 		ob.RawData = append(ob.RawData, *v)
 	}
 	ob.Timestamp = time.Now()
@@ -116,69 +143,179 @@ func (o *OrderBookLocal) GetOrderbookL2() (ob OrderBookDataL2) {
 }
 
 func (o *OrderBookLocal) GetOrderbook() (ob OrderBook) {
+	o.m.Lock()
+	defer o.m.Unlock()
+
 	//ob.Symbol = "XBTUSD"
-	for _, v := range o.ob {
-		switch v.Side {
-		case "Buy":
-			ob.Bids = append(ob.Bids, Item{
-				Price:  v.Price,
-				Amount: float64(v.Size),
-			})
-		case "Sell":
-			ob.Asks = append(ob.Asks, Item{
-				Price:  v.Price,
-				Amount: float64(v.Size),
-			})
-		}
+	if len(o.bids) > 0 {
+		ob.Bids = make([]Item, 0, len(o.bids))
+	}
+	for _, v := range o.bids {
+		ob.Bids = append(ob.Bids, Item{Price: v.Price, Amount: float64(v.Size)})
+	}
+	if len(o.asks) > 0 {
+		ob.Asks = make([]Item, 0, len(o.asks))
+	}
+	for _, v := range o.asks {
+		ob.Asks = append(ob.Asks, Item{Price: v.Price, Amount: float64(v.Size)})
 	}
-
-	sort.Slice(ob.Bids, func(i, j int) bool {
-		return ob.Bids[i].Price > ob.Bids[j].Price
-	})
-
-	sort.Slice(ob.Asks, func(i, j int) bool {
-		return ob.Asks[i].Price < ob.Asks[j].Price
-	})
-
 	ob.Timestamp = time.Now()
 
 	return
 }
 
+// LoadSnapshot replaces the book by a partial, it's loaded even if a price
+// doesn't match the codec
 func (o *OrderBookLocal) LoadSnapshot(newOrderbook []*OrderBookL2) error {
 	o.m.Lock()
 	defer o.m.Unlock()
 
-	o.ob = make(map[string]*OrderBookL2)
+	o.levels = make(map[int64]*OrderBookL2, len(newOrderbook))
+	o.bids = o.bids[:0]
+	o.asks = o.asks[:0]
 
+	var err error
+	// copied, the decoder reuses the rows
 	for _, v := range newOrderbook {
-		o.ob[v.Key()] = v
+		row := *v
+		if e := o.resolve(&row); e != nil {
+			if err == nil {
+				err = e
+			}
+			if row.Price == 0 {
+				continue
+			}
+		}
+		o.levels[row.ID] = &row
+		switch row.Side {
+		case SIDE_BUY:
+			o.bids = append(o.bids, &row)
+		case SIDE_SELL:
+			o.asks = append(o.asks, &row)
+		}
 	}
-
-	return nil
+	sort.Slice(o.bids, func(i, j int) bool { return o.bids[i].Price > o.bids[j].Price })
+	sort.Slice(o.asks, func(i, j int) bool { return o.asks[i].Price < o.asks[j].Price })
+	return err
 }
 
-func (o *OrderBookLocal) Update(orderbook []*OrderBookL2, action string) {
+// Update applies an insert, update or delete. Updates of unseen levels are
+// inserted when the codec resolves their price and skipped otherwise, the
+// first ErrUnknownLevel or ErrLevelPrice is returned after applying the rest.
+func (o *OrderBookLocal) Update(orderbook []*OrderBookL2, action string) error {
 	o.m.Lock()
 	defer o.m.Unlock()
 
+	var err error
+	fail := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
 	switch action {
 	case bitmexActionUpdateData:
 		for _, elem := range orderbook {
-			if v, ok := o.ob[elem.Key()]; ok {
+			if v, ok := o.levels[elem.ID]; ok {
 				// price is same while id is same
-				// v.Price = elem.Price
+				if v.Side != elem.Side {
+					o.remove(v)
+					v.Side = elem.Side
+					o.insert(v)
+				}
 				v.Size = elem.Size
-				v.Side = elem.Side
+				continue
+			}
+			row := *elem
+			if e := o.resolve(&row); e != nil {
+				fail(e)
+				if row.Price == 0 {
+					continue
+				}
 			}
+			o.insert(&row)
 		}
 	case bitmexActionDeleteData:
 		for _, v := range orderbook {
-			delete(o.ob, v.Key())
+			if old, ok := o.levels[v.ID]; ok {
+				o.remove(old)
+			}
 		}
 	case bitmexActionInsertData:
 		for _, v := range orderbook {
-			o.ob[v.Key()] = v
+			row := *v
+			if e := o.resolve(&row); e != nil {
+				fail(e)
+				if row.Price == 0 {
+					continue
+				}
+			}
+			if old, ok := o.levels[row.ID]; ok {
+				o.remove(old)
+			}
+			o.insert(&row)
+		}
+	}
+	return err
+}
+
+// resolve fills in the price of a row from the codec and checks a given one
+func (o *OrderBookLocal) resolve(row *OrderBookL2) error {
+	if !o.codec.Valid() {
+		if row.Price == 0 {
+			return fmt.Errorf("%w: %v %d", ErrUnknownLevel, row.Symbol, row.ID)
+		}
+		return nil
+	}
+	if row.Price == 0 {
+		row.Price = o.codec.Price(row.ID)
+		return nil
+	}
+	if !o.codec.Match(row.ID, row.Price) {
+		return fmt.Errorf("%w: %v %d at %v, the id says %v", ErrLevelPrice, row.Symbol, row.ID, row.Price, o.codec.Price(row.ID))
+	}
+	return nil
+}
+
+func (o *OrderBookLocal) sideOf(level *OrderBookL2) *[]*OrderBookL2 {
+	switch level.Side {
+	case SIDE_BUY:
+		return &o.bids
+	case SIDE_SELL:
+		return &o.asks
+	}
+	return nil
+}
+
+// search returns where level goes in levels, best first
+func search(levels []*OrderBookL2, level *OrderBookL2) int {
+	if level.Side == SIDE_BUY {
+		return sort.Search(len(levels), func(i int) bool { return levels[i].Price <= level.Price })
+	}
+	return sort.Search(len(levels), func(i int) bool { return levels[i].Price >= level.Price })
+}
+
+func (o *OrderBookLocal) insert(level *OrderBookL2) {
+	o.levels[level.ID] = level
+	side := o.sideOf(level)
+	if side == nil {
+		return
+	}
+	i := search(*side, level)
+	*side = append(*side, nil)
+	copy((*side)[i+1:], (*side)[i:])
+	(*side)[i] = level
+}
+
+func (o *OrderBookLocal) remove(level *OrderBookL2) {
+	delete(o.levels, level.ID)
+	side := o.sideOf(level)
+	if side == nil {
+		return
+	}
+	for i := search(*side, level); i < len(*side); i++ {
+		if (*side)[i] == level {
+			*side = append((*side)[:i], (*side)[i+1:]...)
+			return
 		}
 	}
 }
@@ -0,0 +1,166 @@
+package paper
+
+import (
+	"sort"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+)
+
+// depth25 is the levels per side of orderBookL2_25
+const depth25 = 25
+
+// book is the simulated market order book, keyed by orderBookL2 level id
+type book struct {
+	levels   map[int64]*bitmex.OrderBookL2
+	top      map[int64]bitmex.OrderBookL2 // sent to orderBookL2_25 subscribers
+	consumed map[int64]bitmex.OrderBookL2 // changed by fills, not yet sent, size 0 if deleted
+}
+
+func newBook() *book {
+	return &book{
+		levels:   make(map[int64]*bitmex.OrderBookL2),
+		top:      make(map[int64]bitmex.OrderBookL2),
+		consumed: make(map[int64]bitmex.OrderBookL2),
+	}
+}
+
+func (b *book) apply(action string, data []*bitmex.OrderBookL2) {
+	switch action {
+	case "partial":
+		b.levels = make(map[int64]*bitmex.OrderBookL2)
+		fallthrough
+	case "insert":
+		for _, v := range data {
+			level := *v
+			b.levels[v.ID] = &level
+		}
+	case "update":
+		for _, v := range data {
+			if level, ok := b.levels[v.ID]; ok {
+				level.Size = v.Size
+				if v.Side != "" {
+					level.Side = v.Side
+				}
+			}
+		}
+	case "delete":
+		for _, v := range data {
+			delete(b.levels, v.ID)
+		}
+	}
+}
+
+// consume removes size taken by a simulated fill until the next feed update of the level
+func (b *book) consume(id int64, size int64) {
+	level, ok := b.levels[id]
+	if !ok {
+		return
+	}
+	level.Size -= size
+	if level.Size <= 0 {
+		delete(b.levels, id)
+		level.Size = 0
+	}
+	b.consumed[id] = *level
+}
+
+// takeConsumed returns the levels changed by fills since the last call,
+// as orderBookL2 updates and deletes
+func (b *book) takeConsumed() (updates, deletes []*bitmex.OrderBookL2) {
+	for id, level := range b.consumed {
+		if level.Size > 0 {
+			updates = append(updates, &bitmex.OrderBookL2{ID: id, Symbol: level.Symbol, Side: level.Side, Size: level.Size})
+		} else {
+			deletes = append(deletes, &bitmex.OrderBookL2{ID: id, Symbol: level.Symbol, Side: level.Side})
+		}
+		delete(b.consumed, id)
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].ID < updates[j].ID })
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].ID < deletes[j].ID })
+	return
+}
+
+func (b *book) side(side string) []bitmex.OrderBookL2 {
+	var result []bitmex.OrderBookL2
+	for _, v := range b.levels {
+		if v.Side == side && v.Size > 0 {
+			result = append(result, *v)
+		}
+	}
+	if side == bitmex.SIDE_BUY {
+		sort.Slice(result, func(i, j int) bool { return result[i].Price > result[j].Price })
+	} else {
+		sort.Slice(result, func(i, j int) bool { return result[i].Price < result[j].Price })
+	}
+	return result
+}
+
+// opposite returns the levels an order of side trades against, best first
+func (b *book) opposite(side string) []bitmex.OrderBookL2 {
+	if side == bitmex.SIDE_BUY {
+		return b.side(bitmex.SIDE_SELL)
+	}
+	return b.side(bitmex.SIDE_BUY)
+}
+
+// crosses reports whether a limit order at price would take liquidity
+func (b *book) crosses(side string, price float64) bool {
+	levels := b.opposite(side)
+	if len(levels) == 0 {
+		return false
+	}
+	if side == bitmex.SIDE_BUY {
+		return price >= levels[0].Price
+	}
+	return price <= levels[0].Price
+}
+
+func (b *book) snapshot(depth int) []*bitmex.OrderBookL2 {
+	var result []*bitmex.OrderBookL2
+	for _, side := range []string{bitmex.SIDE_SELL, bitmex.SIDE_BUY} {
+		levels := b.side(side)
+		if depth > 0 && len(levels) > depth {
+			levels = levels[:depth]
+		}
+		for i := range levels {
+			result = append(result, &levels[i])
+		}
+	}
+	return result
+}
+
+// topDeltas moves the levels sent to orderBookL2_25 subscribers to the
+// depth best of each side, levels leaving them are deleted and levels
+// entering them inserted like BitMEX does
+func (b *book) topDeltas(depth int) (deletes, inserts, updates []*bitmex.OrderBookL2) {
+	next := make(map[int64]bitmex.OrderBookL2)
+	for _, level := range b.snapshot(depth) {
+		next[level.ID] = *level
+		old, ok := b.top[level.ID]
+		if !ok {
+			inserts = append(inserts, level)
+		} else if old.Size != level.Size || old.Side != level.Side {
+			updates = append(updates, &bitmex.OrderBookL2{ID: level.ID, Symbol: level.Symbol, Side: level.Side, Size: level.Size})
+		}
+	}
+	for id, old := range b.top {
+		if _, ok := next[id]; !ok {
+			deletes = append(deletes, &bitmex.OrderBookL2{ID: id, Symbol: old.Symbol, Side: old.Side})
+		}
+	}
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].ID < deletes[j].ID })
+	b.top = next
+	return
+}
+
+func (b *book) orderBook(now time.Time) (ob bitmex.OrderBook) {
+	for _, v := range b.side(bitmex.SIDE_BUY) {
+		ob.Bids = append(ob.Bids, bitmex.Item{Price: v.Price, Amount: float64(v.Size)})
+	}
+	for _, v := range b.side(bitmex.SIDE_SELL) {
+		ob.Asks = append(ob.Asks, bitmex.Item{Price: v.Price, Amount: float64(v.Size)})
+	}
+	ob.Timestamp = now
+	return
+}
@@ -0,0 +1,938 @@
+// Package paper provides an in-process simulated BitMEX exchange.
+//
+// It serves the BitMEX rest api and the realtime websocket, so a BitMEX
+// client can trade against it after SetBasePath/SetWSURL. Orders are matched
+// against a replayed or synthetic orderBookL2 feed.
+package paper
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+	"github.com/frankrap/bitmex-api/internal/contract"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+const (
+	defaultAccount  = 100000
+	defaultBalance  = 100000000 // 1 XBT in XBt
+	defaultLeverage = 10.0
+	currencyXBt     = "XBt"
+)
+
+// Error is returned by the rest api with the BitMEX error body
+type Error struct {
+	Status  int
+	Name    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func validationError(format string, a ...interface{}) *Error {
+	return &Error{Status: 400, Name: "ValidationError", Message: fmt.Sprintf(format, a...)}
+}
+
+var errNotFound = &Error{Status: 404, Name: "NotFound", Message: "Not Found"}
+
+// Config of the simulated exchange
+type Config struct {
+	Account     float32
+	Balance     float64 // initial wallet balance in XBt
+	Leverage    float64 // default leverage of new positions
+	Instruments []swagger.Instrument
+}
+
+// DefaultInstrument returns an XBTUSD-like inverse perpetual
+func DefaultInstrument() swagger.Instrument {
+	return swagger.Instrument{
+		Symbol:        "XBTUSD",
+		RootSymbol:    "XBT",
+		State:         "Open",
+		Typ:           "FFWCSX",
+		QuoteCurrency: "USD",
+		SettlCurrency: currencyXBt,
+		Underlying:    "XBT",
+		MaxOrderQty:   10000000,
+		MaxPrice:      1000000,
+		LotSize:       1,
+		TickSize:      0.5,
+		Multiplier:    -100000000,
+		IsInverse:     true,
+		InitMargin:    0.01,
+		MaintMargin:   0.005,
+		MakerFee:      -0.00025,
+		TakerFee:      0.00075,
+	}
+}
+
+type position struct {
+	contract.Position
+	realisedPnl float64
+	leverage    float64
+}
+
+// Exchange is a simulated single account BitMEX exchange
+type Exchange struct {
+	mu          sync.Mutex
+	account     float32
+	balance     float64
+	leverage    float64
+	instruments map[string]*swagger.Instrument // key: symbol
+	books       map[string]*book               // key: symbol
+	orders      map[string]*swagger.Order      // key: OrderID
+	positions   map[string]*position           // key: symbol
+	lastPrice   map[string]float64             // key: symbol
+
+	hub   *hub
+	creds *credentials
+	now   func() time.Time
+}
+
+// New creates an exchange, XBTUSD is listed when cfg has no instruments
+func New(cfg Config) *Exchange {
+	e := &Exchange{
+		account:     cfg.Account,
+		balance:     cfg.Balance,
+		leverage:    cfg.Leverage,
+		instruments: make(map[string]*swagger.Instrument),
+		books:       make(map[string]*book),
+		orders:      make(map[string]*swagger.Order),
+		positions:   make(map[string]*position),
+		lastPrice:   make(map[string]float64),
+		now:         time.Now,
+	}
+	if e.account == 0 {
+		e.account = defaultAccount
+	}
+	if e.balance == 0 {
+		e.balance = defaultBalance
+	}
+	if e.leverage == 0 {
+		e.leverage = defaultLeverage
+	}
+	instruments := cfg.Instruments
+	if len(instruments) == 0 {
+		instruments = []swagger.Instrument{DefaultInstrument()}
+	}
+	for i := range instruments {
+		inst := instruments[i]
+		e.instruments[inst.Symbol] = &inst
+		e.books[inst.Symbol] = newBook()
+	}
+	e.hub = newHub(e)
+	return e
+}
+
+// Balance returns the wallet balance in XBt
+func (e *Exchange) Balance() float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.balance
+}
+
+// OrderBook returns the current simulated market book of symbol
+func (e *Exchange) OrderBook(symbol string) bitmex.OrderBook {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b, ok := e.books[symbol]
+	if !ok {
+		return bitmex.OrderBook{}
+	}
+	return b.orderBook(e.now())
+}
+
+// FeedOrderBookL2 applies an orderBookL2 message to the market book,
+// publishes it to subscribers and fills resting orders crossed by the new book.
+// orderBookL2_25 subscribers get the changes of the 25 best levels of each side.
+func (e *Exchange) FeedOrderBookL2(action string, data []*bitmex.OrderBookL2) error {
+	if len(data) == 0 {
+		return nil
+	}
+	symbol := data[0].Symbol
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	b, ok := e.books[symbol]
+	if !ok {
+		return fmt.Errorf("paper: unknown symbol %v", symbol)
+	}
+	b.apply(action, data)
+	e.matchResting(symbol)
+	e.hub.publishPublic(bitmex.BitmexWSOrderBookL2, symbol, action, data)
+	e.publishBook(symbol)
+	return nil
+}
+
+// publishBook publishes the levels consumed by fills to orderBookL2
+// subscribers, and the changes of the 25 best levels to orderBookL2_25 ones
+func (e *Exchange) publishBook(symbol string) {
+	b := e.books[symbol]
+	updates, deletes := b.takeConsumed()
+	for _, d := range []struct {
+		action string
+		data   []*bitmex.OrderBookL2
+	}{{"update", updates}, {"delete", deletes}} {
+		if len(d.data) > 0 {
+			e.hub.publishPublic(bitmex.BitmexWSOrderBookL2, symbol, d.action, d.data)
+		}
+	}
+
+	deletes, inserts, updates := b.topDeltas(depth25)
+	for _, d := range []struct {
+		action string
+		data   []*bitmex.OrderBookL2
+	}{{"delete", deletes}, {"insert", inserts}, {"update", updates}} {
+		if len(d.data) > 0 {
+			e.hub.publishPublic(bitmex.BitmexWSOrderBookL2_25, symbol, d.action, d.data)
+		}
+	}
+}
+
+// FeedTrades publishes market trades and fills resting orders the trades went through
+func (e *Exchange) FeedTrades(trades []*swagger.Trade) error {
+	if len(trades) == 0 {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, t := range trades {
+		if _, ok := e.instruments[t.Symbol]; !ok {
+			return fmt.Errorf("paper: unknown symbol %v", t.Symbol)
+		}
+		e.lastPrice[t.Symbol] = t.Price
+		e.matchTrade(t)
+	}
+	e.hub.publishPublic(bitmex.BitmexWSTrade, trades[0].Symbol, "insert", trades)
+	return nil
+}
+
+// OrderRequest is a new order as sent to POST /order
+type OrderRequest struct {
+	Symbol      string
+	Side        string
+	OrderQty    float64
+	Price       float64
+	OrdType     string
+	TimeInForce string
+	ExecInst    string
+	ClOrdID     string
+	Text        string
+}
+
+// PlaceOrder validates, matches and rests an order like POST /order
+func (e *Exchange) PlaceOrder(req OrderRequest) (order swagger.Order, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	inst, ok := e.instruments[req.Symbol]
+	if !ok {
+		return order, validationError("Invalid symbol %v", req.Symbol)
+	}
+	if req.OrdType == "" {
+		if req.Price > 0 {
+			req.OrdType = bitmex.ORD_TYPE_LIMIT
+		} else {
+			req.OrdType = bitmex.ORD_TYPE_MARKET
+		}
+	}
+	if err = e.validate(inst, req); err != nil {
+		return
+	}
+	if req.ClOrdID != "" {
+		for _, v := range e.orders {
+			if v.ClOrdID == req.ClOrdID && isOpen(v) {
+				return order, validationError("Duplicate clOrdID")
+			}
+		}
+	}
+
+	now := e.now()
+	o := &swagger.Order{
+		OrderID:               newID(),
+		ClOrdID:               req.ClOrdID,
+		Account:               e.account,
+		Symbol:                req.Symbol,
+		Side:                  req.Side,
+		OrderQty:              float32(req.OrderQty),
+		Price:                 req.Price,
+		Currency:              inst.QuoteCurrency,
+		SettlCurrency:         inst.SettlCurrency,
+		OrdType:               req.OrdType,
+		TimeInForce:           req.TimeInForce,
+		ExecInst:              req.ExecInst,
+		OrdStatus:             bitmex.OS_NEW,
+		WorkingIndicator:      true,
+		LeavesQty:             float32(req.OrderQty),
+		MultiLegReportingType: "SingleSecurity",
+		Text:                  req.Text,
+		TransactTime:          now,
+		Timestamp:             now,
+	}
+	if o.TimeInForce == "" {
+		if o.OrdType == bitmex.ORD_TYPE_MARKET {
+			o.TimeInForce = "ImmediateOrCancel"
+		} else {
+			o.TimeInForce = "GoodTillCancel"
+		}
+	}
+
+	b := e.books[req.Symbol]
+	if strings.Contains(o.ExecInst, "ParticipateDoNotInitiate") && b.crosses(o.Side, o.Price) {
+		o.OrdStatus = bitmex.OS_CANCELED
+		o.WorkingIndicator = false
+		o.LeavesQty = 0
+		o.Text = "Canceled: Order had execInst of ParticipateDoNotInitiate"
+		e.orders[o.OrderID] = o
+		e.publishOrder("insert", o)
+		e.publishExecution(o, "New", 0, 0, 0, "")
+		return *o, nil
+	}
+
+	if need := e.orderMargin(inst, o.Side, req.OrderQty, e.referencePrice(req.Symbol, o.Price)); need > e.availableMargin() {
+		return order, validationError("Account has insufficient Available Balance, %d XBt required", int64(math.Ceil(need)))
+	}
+
+	e.orders[o.OrderID] = o
+	e.publishOrder("insert", o)
+	e.publishExecution(o, "New", 0, 0, 0, "")
+
+	e.matchAggressive(o)
+	e.publishBook(o.Symbol)
+
+	if isOpen(o) && (o.OrdType == bitmex.ORD_TYPE_MARKET ||
+		o.TimeInForce == "ImmediateOrCancel" || o.TimeInForce == "FillOrKill") {
+		e.cancel(o, "Canceled: Cancel from Exchange")
+	}
+	e.publishAccount()
+	return *o, nil
+}
+
+// AmendOrder changes price or quantity of an open order like PUT /order
+func (e *Exchange) AmendOrder(orderID string, origClOrdID string, orderQty float64, leavesQty float64, price float64) (order swagger.Order, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	o := e.findOrder(orderID, origClOrdID)
+	if o == nil {
+		return order, errNotFound
+	}
+	if !isOpen(o) {
+		return order, validationError("Invalid ordStatus")
+	}
+	inst := e.instruments[o.Symbol]
+	if price > 0 {
+		if !onStep(price, inst.TickSize) {
+			return order, validationError("Invalid price tickSize")
+		}
+		o.Price = price
+	}
+	if leavesQty > 0 {
+		orderQty = float64(o.CumQty) + leavesQty
+	}
+	if orderQty > 0 {
+		if !onStep(orderQty, float64(inst.LotSize)) {
+			return order, validationError("Invalid orderQty lotSize")
+		}
+		if orderQty <= float64(o.CumQty) {
+			return order, validationError("Invalid orderQty")
+		}
+		o.OrderQty = float32(orderQty)
+		o.LeavesQty = o.OrderQty - o.CumQty
+	}
+	o.Timestamp = e.now()
+	e.publishOrder("update", o)
+	e.publishExecution(o, "Replaced", 0, 0, 0, "")
+
+	e.matchAggressive(o)
+	e.publishBook(o.Symbol)
+	e.publishAccount()
+	return *o, nil
+}
+
+// CancelOrders cancels orders by orderID or clOrdID like DELETE /order
+func (e *Exchange) CancelOrders(orderIDs []string, clOrdIDs []string, text string) (orders []swagger.Order, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var targets []*swagger.Order
+	for _, id := range orderIDs {
+		if o := e.findOrder(id, ""); o != nil {
+			targets = append(targets, o)
+		}
+	}
+	for _, id := range clOrdIDs {
+		if o := e.findOrder("", id); o != nil {
+			targets = append(targets, o)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, errNotFound
+	}
+	for _, o := range targets {
+		if isOpen(o) {
+			e.cancel(o, text)
+		} else {
+			o.Text = "Unable to cancel order due to existing state: " + o.OrdStatus
+		}
+		orders = append(orders, *o)
+	}
+	e.publishAccount()
+	return
+}
+
+// CancelAllOrders cancels all open orders, or those of symbol, like DELETE /order/all
+func (e *Exchange) CancelAllOrders(symbol string, text string) (orders []swagger.Order) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, o := range e.sortedOrders() {
+		if !isOpen(o) || (symbol != "" && o.Symbol != symbol) {
+			continue
+		}
+		e.cancel(o, text)
+		orders = append(orders, *o)
+	}
+	e.publishAccount()
+	return
+}
+
+// Orders returns orders, optionally only open ones and those of symbol, oldest first
+func (e *Exchange) Orders(symbol string, open bool) []swagger.Order {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.ordersData(symbol, open)
+}
+
+func (e *Exchange) ordersData(symbol string, open bool) (orders []swagger.Order) {
+	for _, o := range e.sortedOrders() {
+		if symbol != "" && o.Symbol != symbol {
+			continue
+		}
+		if open && !isOpen(o) {
+			continue
+		}
+		orders = append(orders, *o)
+	}
+	return
+}
+
+// UpdateLeverage sets the leverage of symbol like POST /position/leverage
+func (e *Exchange) UpdateLeverage(symbol string, leverage float64) (p swagger.Position, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.instruments[symbol]; !ok {
+		return p, validationError("Invalid symbol %v", symbol)
+	}
+	if leverage < 0 || leverage > 100 {
+		return p, validationError("Invalid leverage")
+	}
+	pos := e.position(symbol)
+	pos.leverage = leverage
+	e.publishAccount()
+	return e.positionData(symbol), nil
+}
+
+// Positions returns all positions
+func (e *Exchange) Positions() []swagger.Position {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.positionsData()
+}
+
+func (e *Exchange) positionsData() (positions []swagger.Position) {
+	symbols := make([]string, 0, len(e.positions))
+	for symbol := range e.positions {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	for _, symbol := range symbols {
+		positions = append(positions, e.positionData(symbol))
+	}
+	return
+}
+
+// Margin returns the account margin in XBt
+func (e *Exchange) Margin() swagger.Margin {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.marginData()
+}
+
+// Wallet returns the account wallet in XBt
+func (e *Exchange) Wallet() swagger.Wallet {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.walletData()
+}
+
+// Instruments returns the listed instruments with the simulated prices
+func (e *Exchange) Instruments() []swagger.Instrument {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.instrumentsData()
+}
+
+func (e *Exchange) instrumentsData() (result []swagger.Instrument) {
+	symbols := make([]string, 0, len(e.instruments))
+	for symbol := range e.instruments {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	for _, symbol := range symbols {
+		result = append(result, e.instrumentData(symbol))
+	}
+	return
+}
+
+func (e *Exchange) instrumentData(symbol string) swagger.Instrument {
+	inst := *e.instruments[symbol]
+	ob := e.books[symbol].orderBook(e.now())
+	inst.BidPrice = ob.Bid()
+	inst.AskPrice = ob.Ask()
+	if ob.Valid() {
+		inst.MidPrice = (ob.Bid() + ob.Ask()) / 2
+	}
+	inst.LastPrice = e.lastPrice[symbol]
+	inst.MarkPrice = e.markPrice(symbol)
+	inst.Timestamp = e.now()
+	return inst
+}
+
+func (e *Exchange) validate(inst *swagger.Instrument, req OrderRequest) error {
+	if req.Side != bitmex.SIDE_BUY && req.Side != bitmex.SIDE_SELL {
+		return validationError("Invalid side")
+	}
+	switch req.OrdType {
+	case bitmex.ORD_TYPE_LIMIT:
+		if req.Price <= 0 {
+			return validationError("Invalid price")
+		}
+	case bitmex.ORD_TYPE_MARKET:
+		if req.Price > 0 {
+			return validationError("Invalid price, Market orders cannot have a price")
+		}
+	default:
+		return validationError("Invalid ordType %v, the paper exchange supports Market and Limit", req.OrdType)
+	}
+	if req.OrderQty <= 0 {
+		return validationError("Invalid orderQty")
+	}
+	if inst.MaxOrderQty > 0 && req.OrderQty > float64(inst.MaxOrderQty) {
+		return validationError("Invalid orderQty, maxOrderQty is %v", inst.MaxOrderQty)
+	}
+	if !onStep(req.OrderQty, float64(inst.LotSize)) {
+		return validationError("Invalid orderQty lotSize, lotSize is %v", inst.LotSize)
+	}
+	if req.Price > 0 && !onStep(req.Price, inst.TickSize) {
+		return validationError("Invalid price tickSize, tickSize is %v", inst.TickSize)
+	}
+	if inst.MaxPrice > 0 && req.Price > inst.MaxPrice {
+		return validationError("Invalid price, maxPrice is %v", inst.MaxPrice)
+	}
+	return nil
+}
+
+func onStep(v float64, step float64) bool {
+	if step <= 0 {
+		return true
+	}
+	n := v / step
+	return math.Abs(n-math.Round(n)) < 1e-8
+}
+
+func isOpen(o *swagger.Order) bool {
+	return o.OrdStatus == bitmex.OS_NEW || o.OrdStatus == bitmex.OS_PARTIALLY_FILLED
+}
+
+func (e *Exchange) findOrder(orderID string, clOrdID string) *swagger.Order {
+	if orderID != "" {
+		return e.orders[orderID]
+	}
+	if clOrdID != "" {
+		var found *swagger.Order
+		for _, o := range e.orders {
+			if o.ClOrdID == clOrdID && (found == nil || o.TransactTime.After(found.TransactTime)) {
+				found = o
+			}
+		}
+		return found
+	}
+	return nil
+}
+
+func (e *Exchange) sortedOrders() []*swagger.Order {
+	orders := make([]*swagger.Order, 0, len(e.orders))
+	for _, o := range e.orders {
+		orders = append(orders, o)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].TransactTime.Before(orders[j].TransactTime)
+	})
+	return orders
+}
+
+func (e *Exchange) cancel(o *swagger.Order, text string) {
+	o.OrdStatus = bitmex.OS_CANCELED
+	o.WorkingIndicator = false
+	o.LeavesQty = 0
+	if text != "" {
+		o.Text = text
+	}
+	o.Timestamp = e.now()
+	e.publishOrder("update", o)
+	e.publishExecution(o, "Canceled", 0, 0, 0, "")
+}
+
+// matchAggressive fills o against the opposite side of the market book as taker
+func (e *Exchange) matchAggressive(o *swagger.Order) {
+	b := e.books[o.Symbol]
+	for _, level := range b.opposite(o.Side) {
+		if !isOpen(o) {
+			return
+		}
+		if o.OrdType == bitmex.ORD_TYPE_LIMIT {
+			if o.Side == bitmex.SIDE_BUY && level.Price > o.Price {
+				return
+			}
+			if o.Side == bitmex.SIDE_SELL && level.Price < o.Price {
+				return
+			}
+		}
+		qty := math.Min(float64(o.LeavesQty), float64(level.Size))
+		if qty <= 0 {
+			continue
+		}
+		b.consume(level.ID, int64(qty))
+		e.fill(o, qty, level.Price, "RemovedLiquidity")
+	}
+}
+
+// matchResting fills resting limit orders as maker when the market book crosses them
+func (e *Exchange) matchResting(symbol string) {
+	b := e.books[symbol]
+	for _, o := range e.sortedOrders() {
+		if o.Symbol != symbol || !isOpen(o) || o.OrdType != bitmex.ORD_TYPE_LIMIT {
+			continue
+		}
+		for _, level := range b.opposite(o.Side) {
+			if !isOpen(o) {
+				break
+			}
+			if (o.Side == bitmex.SIDE_BUY && level.Price > o.Price) ||
+				(o.Side == bitmex.SIDE_SELL && level.Price < o.Price) {
+				break
+			}
+			qty := math.Min(float64(o.LeavesQty), float64(level.Size))
+			if qty <= 0 {
+				continue
+			}
+			b.consume(level.ID, int64(qty))
+			e.fill(o, qty, o.Price, "AddedLiquidity")
+		}
+	}
+}
+
+// matchTrade fills resting limit orders a market trade traded through
+func (e *Exchange) matchTrade(t *swagger.Trade) {
+	remaining := float64(t.Size)
+	for _, o := range e.sortedOrders() {
+		if remaining <= 0 {
+			return
+		}
+		if o.Symbol != t.Symbol || !isOpen(o) || o.OrdType != bitmex.ORD_TYPE_LIMIT {
+			continue
+		}
+		// a sell aggressor trades down through resting bids, a buy aggressor up through resting asks
+		if o.Side == bitmex.SIDE_BUY && (t.Side != bitmex.SIDE_SELL || t.Price > o.Price) {
+			continue
+		}
+		if o.Side == bitmex.SIDE_SELL && (t.Side != bitmex.SIDE_BUY || t.Price < o.Price) {
+			continue
+		}
+		qty := math.Min(float64(o.LeavesQty), remaining)
+		remaining -= qty
+		e.fill(o, qty, o.Price, "AddedLiquidity")
+	}
+}
+
+func (e *Exchange) fill(o *swagger.Order, qty float64, price float64, liquidity string) {
+	inst := e.instruments[o.Symbol]
+	feeRate := inst.TakerFee
+	if liquidity == "AddedLiquidity" {
+		feeRate = inst.MakerFee
+	}
+	value := contract.Value(inst, qty, price)
+	commission := value * feeRate
+
+	cum := float64(o.CumQty)
+	o.AvgPx = (o.AvgPx*cum + price*qty) / (cum + qty)
+	o.CumQty += float32(qty)
+	o.LeavesQty -= float32(qty)
+	if o.LeavesQty <= 0 {
+		o.LeavesQty = 0
+		o.OrdStatus = bitmex.OS_FILLED
+		o.WorkingIndicator = false
+	} else {
+		o.OrdStatus = bitmex.OS_PARTIALLY_FILLED
+	}
+	o.Timestamp = e.now()
+	e.lastPrice[o.Symbol] = price
+
+	signed := qty
+	if o.Side == bitmex.SIDE_SELL {
+		signed = -qty
+	}
+	e.applyFill(inst, signed, price)
+	e.balance -= commission
+
+	e.publishOrder("update", o)
+	e.publishExecution(o, "Trade", qty, price, feeRate, liquidity)
+}
+
+// applyFill updates the position and realises pnl of the closed part
+func (e *Exchange) applyFill(inst *swagger.Instrument, signedQty float64, price float64) {
+	pos := e.position(inst.Symbol)
+	pnl := pos.Fill(inst, signedQty, price)
+	pos.realisedPnl += pnl
+	e.balance += pnl
+}
+
+func (e *Exchange) position(symbol string) *position {
+	pos, ok := e.positions[symbol]
+	if !ok {
+		pos = &position{leverage: e.leverage}
+		e.positions[symbol] = pos
+	}
+	return pos
+}
+
+func (e *Exchange) effectiveLeverage(symbol string) float64 {
+	lev := e.leverage
+	if pos, ok := e.positions[symbol]; ok && pos.leverage > 0 {
+		lev = pos.leverage
+	}
+	if inst, ok := e.instruments[symbol]; ok && lev == 0 && inst.InitMargin > 0 {
+		// cross margin uses the maximum leverage
+		lev = 1 / inst.InitMargin
+	}
+	return lev
+}
+
+// markPrice is the mid of the market book, or the last trade price
+func (e *Exchange) markPrice(symbol string) float64 {
+	if b, ok := e.books[symbol]; ok {
+		ob := b.orderBook(e.now())
+		if ob.Valid() {
+			return (ob.Bid() + ob.Ask()) / 2
+		}
+	}
+	return e.lastPrice[symbol]
+}
+
+// referencePrice is the price used for margin checks of an order
+func (e *Exchange) referencePrice(symbol string, price float64) float64 {
+	if price > 0 {
+		return price
+	}
+	return e.markPrice(symbol)
+}
+
+func (e *Exchange) orderMargin(inst *swagger.Instrument, side string, qty float64, price float64) float64 {
+	// orders reducing the current position need no margin
+	pos := e.position(inst.Symbol)
+	if (side == bitmex.SIDE_BUY && pos.Qty < 0) || (side == bitmex.SIDE_SELL && pos.Qty > 0) {
+		qty = math.Max(0, qty-math.Abs(pos.Qty))
+	}
+	value := contract.Value(inst, qty, price)
+	return value/e.effectiveLeverage(inst.Symbol) + value*math.Max(inst.TakerFee, 0)
+}
+
+func (e *Exchange) unrealisedPnl() (total float64) {
+	for symbol, pos := range e.positions {
+		if pos.Qty == 0 {
+			continue
+		}
+		total += contract.PnL(e.instruments[symbol], pos.Qty, pos.AvgEntryPrice, e.markPrice(symbol))
+	}
+	return
+}
+
+func (e *Exchange) usedMargin() (posMargin float64, orderMargin float64) {
+	for symbol, pos := range e.positions {
+		if pos.Qty == 0 {
+			continue
+		}
+		inst := e.instruments[symbol]
+		posMargin += contract.Value(inst, pos.Qty, pos.AvgEntryPrice) / e.effectiveLeverage(symbol)
+	}
+	for _, o := range e.orders {
+		if !isOpen(o) {
+			continue
+		}
+		inst := e.instruments[o.Symbol]
+		orderMargin += contract.Value(inst, float64(o.LeavesQty), e.referencePrice(o.Symbol, o.Price)) / e.effectiveLeverage(o.Symbol)
+	}
+	return
+}
+
+func (e *Exchange) availableMargin() float64 {
+	posMargin, orderMargin := e.usedMargin()
+	return e.balance + math.Min(e.unrealisedPnl(), 0) - posMargin - orderMargin
+}
+
+func (e *Exchange) positionData(symbol string) swagger.Position {
+	inst := e.instruments[symbol]
+	pos := e.position(symbol)
+	mark := e.markPrice(symbol)
+	p := swagger.Position{
+		Account:          e.account,
+		Symbol:           symbol,
+		Currency:         inst.SettlCurrency,
+		Underlying:       inst.Underlying,
+		QuoteCurrency:    inst.QuoteCurrency,
+		Leverage:         pos.leverage,
+		CrossMargin:      pos.leverage == 0,
+		CurrentQty:       float32(pos.Qty),
+		IsOpen:           pos.Qty != 0,
+		MarkPrice:        mark,
+		AvgEntryPrice:    pos.AvgEntryPrice,
+		AvgCostPrice:     pos.AvgEntryPrice,
+		RealisedPnl:      float32(pos.realisedPnl),
+		CurrentTimestamp: e.now(),
+		Timestamp:        e.now(),
+	}
+	if pos.Qty != 0 {
+		p.UnrealisedPnl = float32(contract.PnL(inst, pos.Qty, pos.AvgEntryPrice, mark))
+		p.PosMargin = float32(contract.Value(inst, pos.Qty, pos.AvgEntryPrice) / e.effectiveLeverage(symbol))
+		p.MarkValue = float32(math.Copysign(contract.Value(inst, pos.Qty, mark), pos.Qty))
+		if inst.IsInverse {
+			p.HomeNotional = math.Copysign(contract.Value(inst, pos.Qty, mark), pos.Qty) / math.Abs(float64(inst.Multiplier))
+			p.ForeignNotional = -pos.Qty
+		}
+	}
+	return p
+}
+
+func (e *Exchange) marginData() swagger.Margin {
+	unrealised := e.unrealisedPnl()
+	posMargin, orderMargin := e.usedMargin()
+	var realised float64
+	for _, pos := range e.positions {
+		realised += pos.realisedPnl
+	}
+	m := swagger.Margin{
+		Account:         e.account,
+		Currency:        currencyXBt,
+		WalletBalance:   float32(e.balance),
+		MarginBalance:   float32(e.balance + unrealised),
+		UnrealisedPnl:   float32(unrealised),
+		RealisedPnl:     float32(realised),
+		InitMargin:      float32(orderMargin),
+		MaintMargin:     float32(posMargin),
+		AvailableMargin: float32(e.availableMargin()),
+		Amount:          float32(e.balance),
+		Timestamp:       e.now(),
+	}
+	m.ExcessMargin = m.AvailableMargin
+	m.WithdrawableMargin = m.AvailableMargin
+	if m.MarginBalance > 0 {
+		m.MarginUsedPcnt = float64(m.InitMargin+m.MaintMargin) / float64(m.MarginBalance)
+	}
+	return m
+}
+
+func (e *Exchange) walletData() swagger.Wallet {
+	return swagger.Wallet{
+		Account:   e.account,
+		Currency:  currencyXBt,
+		Amount:    float32(e.balance),
+		Timestamp: e.now(),
+	}
+}
+
+func (e *Exchange) publishOrder(action string, o *swagger.Order) {
+	e.hub.publishPrivate(bitmex.BitmexWSOrder, action, []*swagger.Order{cloneOrder(o)})
+}
+
+func (e *Exchange) publishExecution(o *swagger.Order, execType string, lastQty float64, lastPx float64, feeRate float64, liquidity string) {
+	inst := e.instruments[o.Symbol]
+	exec := &swagger.Execution{
+		ExecID:           newID(),
+		OrderID:          o.OrderID,
+		ClOrdID:          o.ClOrdID,
+		Account:          o.Account,
+		Symbol:           o.Symbol,
+		Side:             o.Side,
+		LastQty:          float32(lastQty),
+		LastPx:           lastPx,
+		LastLiquidityInd: liquidity,
+		OrderQty:         o.OrderQty,
+		Price:            o.Price,
+		Currency:         o.Currency,
+		SettlCurrency:    o.SettlCurrency,
+		ExecType:         execType,
+		OrdType:          o.OrdType,
+		TimeInForce:      o.TimeInForce,
+		ExecInst:         o.ExecInst,
+		OrdStatus:        o.OrdStatus,
+		WorkingIndicator: o.WorkingIndicator,
+		LeavesQty:        o.LeavesQty,
+		CumQty:           o.CumQty,
+		AvgPx:            o.AvgPx,
+		Text:             o.Text,
+		TransactTime:     o.Timestamp,
+		Timestamp:        o.Timestamp,
+	}
+	if execType == "Trade" {
+		value := contract.Value(inst, lastQty, lastPx)
+		exec.Commission = feeRate
+		exec.ExecCost = float32(value)
+		exec.ExecComm = float32(value * feeRate)
+		exec.TrdMatchID = newID()
+	}
+	e.hub.publishPrivate(bitmex.BitmexWSExecution, "insert", []*swagger.Execution{exec})
+}
+
+// publishAccount publishes position, margin and wallet after order activity
+func (e *Exchange) publishAccount() {
+	var positions []*swagger.Position
+	for symbol := range e.positions {
+		p := e.positionData(symbol)
+		positions = append(positions, &p)
+	}
+	if len(positions) > 0 {
+		e.hub.publishPrivate(bitmex.BitmexWSPosition, "update", positions)
+	}
+	m := e.marginData()
+	e.hub.publishPrivate(bitmex.BitmexWSMargin, "update", []*swagger.Margin{&m})
+	w := e.walletData()
+	e.hub.publishPrivate(bitmex.BitmexWSWallet, "update", []*swagger.Wallet{&w})
+}
+
+func cloneOrder(o *swagger.Order) *swagger.Order {
+	c := *o
+	return &c
+}
+
+func newID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(errors.New("paper: no random source"))
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,325 @@
+package paper
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+func newTestExchange(t *testing.T) *Exchange {
+	e := New(Config{})
+	f := NewSyntheticFeed(e, "XBTUSD", 10000, 1)
+	if err := f.Step(); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestExchange_PlaceOrder(t *testing.T) {
+	e := newTestExchange(t)
+	ob := e.OrderBook("XBTUSD")
+	if !ob.Valid() {
+		t.Fatal("order book error")
+	}
+
+	_, err := e.PlaceOrder(OrderRequest{Symbol: "XBTUSD", Side: bitmex.SIDE_BUY, OrderQty: 10, Price: 9000.3})
+	if err == nil {
+		t.Error("expect tick size error")
+	}
+	_, err = e.PlaceOrder(OrderRequest{Symbol: "XBTUSD", Side: bitmex.SIDE_BUY, OrderQty: 100000000, Price: 9000})
+	if err == nil {
+		t.Error("expect insufficient balance error")
+	}
+
+	resting, err := e.PlaceOrder(OrderRequest{Symbol: "XBTUSD", Side: bitmex.SIDE_BUY, OrderQty: 100, Price: 9000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resting.OrdStatus != bitmex.OS_NEW {
+		t.Errorf("ordStatus error %v", resting.OrdStatus)
+	}
+
+	market, err := e.PlaceOrder(OrderRequest{Symbol: "XBTUSD", Side: bitmex.SIDE_BUY, OrderQty: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if market.OrdStatus != bitmex.OS_FILLED || market.AvgPx < ob.Ask() {
+		t.Errorf("market order error %#v", market)
+	}
+
+	positions := e.Positions()
+	if len(positions) != 1 || positions[0].CurrentQty != 100 {
+		t.Fatalf("position error %#v", positions)
+	}
+	if e.Balance() >= defaultBalance {
+		t.Error("taker fee not charged")
+	}
+
+	if len(e.Orders("XBTUSD", true)) != 1 {
+		t.Error("open orders error")
+	}
+	canceled := e.CancelAllOrders("XBTUSD", "")
+	if len(canceled) != 1 || canceled[0].OrderID != resting.OrderID {
+		t.Errorf("cancel all error %#v", canceled)
+	}
+}
+
+func TestExchange_PostOnly(t *testing.T) {
+	e := newTestExchange(t)
+	ob := e.OrderBook("XBTUSD")
+	ask := ob.Ask()
+	o, err := e.PlaceOrder(OrderRequest{
+		Symbol:   "XBTUSD",
+		Side:     bitmex.SIDE_BUY,
+		OrderQty: 10,
+		Price:    ask,
+		ExecInst: "ParticipateDoNotInitiate",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.OrdStatus != bitmex.OS_CANCELED {
+		t.Errorf("ordStatus error %v", o.OrdStatus)
+	}
+}
+
+func TestExchange_RestingFill(t *testing.T) {
+	e := newTestExchange(t)
+	ob := e.OrderBook("XBTUSD")
+	bid := ob.Bid()
+	o, err := e.PlaceOrder(OrderRequest{Symbol: "XBTUSD", Side: bitmex.SIDE_BUY, OrderQty: 10, Price: bid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.FeedTrades([]*swagger.Trade{{Symbol: "XBTUSD", Side: bitmex.SIDE_SELL, Size: 50, Price: bid}})
+
+	orders := e.Orders("XBTUSD", false)
+	if len(orders) != 1 || orders[0].OrderID != o.OrderID || orders[0].OrdStatus != bitmex.OS_FILLED {
+		t.Fatalf("resting fill error %#v", orders)
+	}
+	// maker rebate
+	if e.Balance() <= defaultBalance {
+		t.Error("maker rebate not paid")
+	}
+}
+
+func TestServer_Client(t *testing.T) {
+	e := newTestExchange(t)
+	e.SetCredentials("key", "secret")
+	srv, err := e.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	b := bitmex.New(nil, "paper", "key", "secret", false)
+	b.SetBasePath(srv.BasePath)
+	b.SetWSURL(srv.WSURL)
+
+	orders := make(chan []*swagger.Order, 16)
+	b.On(bitmex.BitmexWSOrder, func(m []*swagger.Order, action string) {
+		orders <- m
+	})
+	b.Subscribe([]bitmex.SubscribeInfo{
+		{Op: bitmex.BitmexWSOrderBookL2, Param: "XBTUSD"},
+		{Op: bitmex.BitmexWSOrder},
+	})
+	if err := b.StartWS(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer b.CloseWS()
+
+	ob, err := b.GetOrderBook(10, "XBTUSD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ob.Valid() {
+		t.Fatal("rest order book error")
+	}
+
+	order, err := b.PlaceOrder(bitmex.SIDE_BUY, bitmex.ORD_TYPE_LIMIT, 0, ob.Bid()-100, 10, "", "", "XBTUSD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-orders:
+		if len(m) != 1 || m[0].OrderID != order.OrderID {
+			t.Errorf("ws order error %#v", m)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("no ws order message")
+	}
+
+	amended, err := b.AmendOrder(order.OrderID, ob.Bid()-50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if amended.Price != ob.Bid()-50 {
+		t.Errorf("amend error %v", amended.Price)
+	}
+	if _, err = b.CancelOrder(order.OrderID); err != nil {
+		t.Fatal(err)
+	}
+	open, err := b.GetOrders("XBTUSD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(open) != 0 {
+		t.Errorf("open orders error %#v", open)
+	}
+
+	bad := bitmex.New(nil, "paper", "key", "wrong", false)
+	bad.SetBasePath(srv.BasePath)
+	if _, err = bad.GetOrders("XBTUSD"); err == nil {
+		t.Error("expect signature error")
+	}
+}
+
+// newTestClient is a websocket client of e without a connection, its messages
+// stay in send
+func newTestClient(e *Exchange) *client {
+	c := &client{send: make(chan []byte, clientSendBuffer), subs: make(map[string]map[string]bool)}
+	e.hub.mu.Lock()
+	e.hub.clients[c] = struct{}{}
+	e.hub.mu.Unlock()
+	return c
+}
+
+// received decodes the table messages queued for c
+func received(t *testing.T, c *client) (messages []tableMessage) {
+	for {
+		select {
+		case msg := <-c.send:
+			var m struct {
+				tableMessage
+				Data []map[string]interface{} `json:"data"`
+			}
+			if err := json.Unmarshal(msg, &m); err != nil {
+				t.Fatal(err)
+			}
+			if m.Table != "" {
+				m.tableMessage.Data = m.Data
+				messages = append(messages, m.tableMessage)
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestHub_SubscribeSymbols(t *testing.T) {
+	eth := DefaultInstrument()
+	eth.Symbol = "ETHUSD"
+	e := New(Config{Instruments: []swagger.Instrument{DefaultInstrument(), eth}})
+	c := newTestClient(e)
+	for _, topic := range []string{"trade:XBTUSD", "trade:ETHUSD"} {
+		e.hub.subscribe(c, wsRequest{Op: "subscribe"}, topic)
+	}
+	received(t, c)
+
+	trades := func() (symbols []string) {
+		for _, symbol := range []string{"XBTUSD", "ETHUSD"} {
+			if err := e.FeedTrades([]*swagger.Trade{{Symbol: symbol, Side: bitmex.SIDE_BUY, Size: 1, Price: 100}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, m := range received(t, c) {
+			symbols = append(symbols, m.Data.([]map[string]interface{})[0]["symbol"].(string))
+		}
+		return
+	}
+	if got := strings.Join(trades(), ","); got != "XBTUSD,ETHUSD" {
+		t.Errorf("trades of %v", got)
+	}
+	c.unsubscribe(splitTopic("trade:XBTUSD"))
+	if got := strings.Join(trades(), ","); got != "ETHUSD" {
+		t.Errorf("trades of %v after unsubscribe", got)
+	}
+}
+
+func TestHub_OrderBookL2_25(t *testing.T) {
+	e := New(Config{})
+	f := NewSyntheticFeed(e, "XBTUSD", 10000, 1)
+	f.Levels = 40
+	if err := f.Step(); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(e)
+	e.hub.subscribe(c, wsRequest{Op: "subscribe"}, "orderBookL2_25:XBTUSD")
+
+	local := make(map[int64]string) // id: side
+	apply := func() {
+		for _, m := range received(t, c) {
+			for _, level := range m.Data.([]map[string]interface{}) {
+				id := int64(level["id"].(float64))
+				switch m.Action {
+				case "partial", "insert", "update":
+					local[id] = level["side"].(string)
+				case "delete":
+					delete(local, id)
+				}
+			}
+		}
+	}
+	for i := 0; i < 50; i++ {
+		apply()
+		if err := f.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	apply()
+
+	want := make(map[int64]string)
+	for _, level := range e.bookSnapshot("XBTUSD", depth25) {
+		want[level.ID] = level.Side
+	}
+	if len(want) != 2*depth25 || !reflect.DeepEqual(local, want) {
+		t.Errorf("%d levels, want the %d best", len(local), len(want))
+	}
+}
+
+func TestHub_OrderBookL2Fills(t *testing.T) {
+	e := newTestExchange(t)
+	c := newTestClient(e)
+	for _, topic := range []string{"orderBookL2:XBTUSD", "orderBookL2_25:XBTUSD"} {
+		e.hub.subscribe(c, wsRequest{Op: "subscribe"}, topic)
+	}
+
+	local := map[string]map[int64]float64{bitmex.BitmexWSOrderBookL2: {}, bitmex.BitmexWSOrderBookL2_25: {}}
+	apply := func() {
+		for _, m := range received(t, c) {
+			for _, level := range m.Data.([]map[string]interface{}) {
+				id := int64(level["id"].(float64))
+				switch m.Action {
+				case "partial", "insert", "update":
+					local[m.Table][id] = level["size"].(float64)
+				case "delete":
+					delete(local[m.Table], id)
+				}
+			}
+		}
+	}
+	apply()
+
+	// takes the best ask and part of the next
+	if _, err := e.PlaceOrder(OrderRequest{Symbol: "XBTUSD", Side: bitmex.SIDE_BUY, OrderQty: 15000}); err != nil {
+		t.Fatal(err)
+	}
+	apply()
+
+	for table, depth := range map[string]int{bitmex.BitmexWSOrderBookL2: 0, bitmex.BitmexWSOrderBookL2_25: depth25} {
+		want := make(map[int64]float64)
+		for _, level := range e.bookSnapshot("XBTUSD", depth) {
+			want[level.ID] = float64(level.Size)
+		}
+		if !reflect.DeepEqual(local[table], want) {
+			t.Errorf("%v not updated by the fill", table)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package paper
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// SyntheticFeed drives the exchange with a random walk order book and trades
+type SyntheticFeed struct {
+	Symbol   string
+	Levels   int     // levels per side, default 25
+	Size     int64   // average level size, default 10000
+	TickSize float64 // default the instrument tick size
+	Index    int64   // instrument index used for level ids, default 88 like XBTUSD
+
+	e      *Exchange
+	rnd    *rand.Rand
+	mid    float64
+	levels map[int64]bitmex.OrderBookL2
+}
+
+// NewSyntheticFeed creates a feed of symbol around mid, seed makes it deterministic
+func NewSyntheticFeed(e *Exchange, symbol string, mid float64, seed int64) *SyntheticFeed {
+	f := &SyntheticFeed{
+		Symbol: symbol,
+		Levels: 25,
+		Size:   10000,
+		Index:  88,
+		e:      e,
+		rnd:    rand.New(rand.NewSource(seed)),
+		mid:    mid,
+	}
+	e.mu.Lock()
+	if inst, ok := e.instruments[symbol]; ok {
+		f.TickSize = inst.TickSize
+	}
+	e.mu.Unlock()
+	if f.TickSize == 0 {
+		f.TickSize = 0.5
+	}
+	return f
+}
+
+// levelID encodes price like BitMEX orderBookL2 ids
+func (f *SyntheticFeed) levelID(price float64) int64 {
+	return 100000000*f.Index - int64(math.Round(price/f.TickSize))
+}
+
+func (f *SyntheticFeed) generate() map[int64]bitmex.OrderBookL2 {
+	levels := make(map[int64]bitmex.OrderBookL2)
+	bestBid := math.Floor(f.mid/f.TickSize) * f.TickSize
+	bestAsk := bestBid + f.TickSize
+	for i := 0; i < f.Levels; i++ {
+		bid := bestBid - float64(i)*f.TickSize
+		ask := bestAsk + float64(i)*f.TickSize
+		for _, v := range []bitmex.OrderBookL2{
+			{Price: bid, Side: bitmex.SIDE_BUY},
+			{Price: ask, Side: bitmex.SIDE_SELL},
+		} {
+			v.Symbol = f.Symbol
+			v.ID = f.levelID(v.Price)
+			v.Size = 1 + f.rnd.Int63n(2*f.Size)
+			levels[v.ID] = v
+		}
+	}
+	return levels
+}
+
+// Step moves the mid price by at most one tick, publishes the book delta and a trade
+func (f *SyntheticFeed) Step() error {
+	if f.levels == nil {
+		f.levels = f.generate()
+		data := make([]*bitmex.OrderBookL2, 0, len(f.levels))
+		for _, v := range f.levels {
+			level := v
+			data = append(data, &level)
+		}
+		return f.e.FeedOrderBookL2("partial", data)
+	}
+
+	move := float64(f.rnd.Intn(3)-1) * f.TickSize
+	f.mid += move
+	next := f.generate()
+
+	var inserts, updates, deletes []*bitmex.OrderBookL2
+	for id, v := range next {
+		level := v
+		if old, ok := f.levels[id]; !ok {
+			inserts = append(inserts, &level)
+		} else if old.Size != v.Size || old.Side != v.Side {
+			updates = append(updates, &bitmex.OrderBookL2{ID: id, Symbol: f.Symbol, Side: v.Side, Size: v.Size})
+		}
+	}
+	for id, v := range f.levels {
+		if _, ok := next[id]; !ok {
+			deletes = append(deletes, &bitmex.OrderBookL2{ID: id, Symbol: f.Symbol, Side: v.Side})
+		}
+	}
+	f.levels = next
+
+	for _, d := range []struct {
+		action string
+		data   []*bitmex.OrderBookL2
+	}{{"delete", deletes}, {"insert", inserts}, {"update", updates}} {
+		if err := f.e.FeedOrderBookL2(d.action, d.data); err != nil {
+			return err
+		}
+	}
+
+	if move == 0 {
+		return nil
+	}
+	side := bitmex.SIDE_BUY
+	price := math.Floor(f.mid/f.TickSize)*f.TickSize + f.TickSize
+	if move < 0 {
+		side = bitmex.SIDE_SELL
+		price -= f.TickSize
+	}
+	return f.e.FeedTrades([]*swagger.Trade{{
+		Timestamp:  f.e.now(),
+		Symbol:     f.Symbol,
+		Side:       side,
+		Size:       float32(1 + f.rnd.Int63n(f.Size)),
+		Price:      price,
+		TrdMatchID: newID(),
+	}})
+}
+
+// Run steps the feed every interval until ctx is done
+func (f *SyntheticFeed) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	if err := f.Step(); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if err := f.Step(); err != nil {
+				return err
+			}
+		}
+	}
+}
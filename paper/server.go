@@ -0,0 +1,415 @@
+package paper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// Server serves the rest api under /api/v1 and the websocket at /realtime
+type Server struct {
+	BasePath string // e.g. http://127.0.0.1:8080/api/v1, for BitMEX.SetBasePath
+	WSURL    string // e.g. ws://127.0.0.1:8080/realtime, for BitMEX.SetWSURL
+
+	e   *Exchange
+	srv *http.Server
+	ln  net.Listener
+}
+
+// Listen starts serving the exchange on addr, use 127.0.0.1:0 for a random port
+func (e *Exchange) Listen(addr string) (*Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		BasePath: "http://" + ln.Addr().String() + "/api/v1",
+		WSURL:    "ws://" + ln.Addr().String() + "/realtime",
+		e:        e,
+		srv:      &http.Server{Handler: e.Handler()},
+		ln:       ln,
+	}
+	go s.srv.Serve(ln)
+	return s, nil
+}
+
+// Close stops the server and disconnects all websocket clients
+func (s *Server) Close() error {
+	s.e.hub.close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+type credentials struct {
+	mu   sync.RWMutex
+	keys map[string]string // key: api key, value: secret
+}
+
+// SetCredentials enables signature verification, requests signed by other keys are rejected.
+// Without credentials every request is accepted.
+func (e *Exchange) SetCredentials(key string, secret string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.creds == nil {
+		e.creds = &credentials{keys: make(map[string]string)}
+	}
+	e.creds.mu.Lock()
+	e.creds.keys[key] = secret
+	e.creds.mu.Unlock()
+}
+
+func (e *Exchange) secret(key string) (secret string, enabled bool, ok bool) {
+	e.mu.Lock()
+	creds := e.creds
+	e.mu.Unlock()
+	if creds == nil {
+		return "", false, false
+	}
+	creds.mu.RLock()
+	defer creds.mu.RUnlock()
+	secret, ok = creds.keys[key]
+	return secret, true, ok
+}
+
+func (e *Exchange) verifyWS(key string, expires int64, signature string) bool {
+	secret, enabled, ok := e.secret(key)
+	if !enabled {
+		return true
+	}
+	if !ok || expires < e.now().Unix() {
+		return false
+	}
+	return swagger.CalSignature(secret, fmt.Sprintf("GET/realtime%d", expires)) == signature
+}
+
+func (e *Exchange) verifyREST(r *http.Request, body string) *Error {
+	key := r.Header.Get("api-key")
+	secret, enabled, ok := e.secret(key)
+	if !enabled {
+		return nil
+	}
+	if !ok {
+		return &Error{Status: 401, Name: "HTTPError", Message: "Invalid API Key."}
+	}
+	switch swagger.VerifyRequest(r, secret, body, e.now()) {
+	case nil:
+	case swagger.ErrRequestExpired:
+		return &Error{Status: 401, Name: "HTTPError", Message: "This request has expired."}
+	default:
+		return &Error{Status: 401, Name: "HTTPError", Message: "Signature not valid."}
+	}
+	return nil
+}
+
+// Handler returns the http handler of the rest api and the websocket
+func (e *Exchange) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realtime", e.hub.serveWS)
+	mux.HandleFunc("/api/v1", e.handleVersion)
+	mux.HandleFunc("/api/v1/instrument", e.public(e.handleInstrument))
+	mux.HandleFunc("/api/v1/orderBook/L2", e.public(e.handleOrderBookL2))
+	mux.HandleFunc("/api/v1/order", e.private(e.handleOrder))
+	mux.HandleFunc("/api/v1/order/all", e.private(e.handleOrderAll))
+	mux.HandleFunc("/api/v1/position", e.private(e.handlePosition))
+	mux.HandleFunc("/api/v1/position/leverage", e.private(e.handleLeverage))
+	mux.HandleFunc("/api/v1/user/margin", e.private(e.handleMargin))
+	mux.HandleFunc("/api/v1/user/wallet", e.private(e.handleWallet))
+	return mux
+}
+
+type handlerFunc func(r *http.Request, params map[string]string) (interface{}, error)
+
+func (e *Exchange) public(fn handlerFunc) http.HandlerFunc {
+	return e.wrap(fn, false)
+}
+
+func (e *Exchange) private(fn handlerFunc) http.HandlerFunc {
+	return e.wrap(fn, true)
+}
+
+func (e *Exchange) wrap(fn handlerFunc, private bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, validationError("Unable to read body"))
+			return
+		}
+		if private {
+			if err := e.verifyREST(r, string(body)); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		params, perr := parseParams(r, body)
+		if perr != nil {
+			writeError(w, perr)
+			return
+		}
+		result, err := fn(r, params)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Ratelimit-Limit", "60")
+		w.Header().Set("X-Ratelimit-Remaining", "59")
+		w.Header().Set("X-Ratelimit-Reset", strconv.FormatInt(e.now().Unix()+1, 10))
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	pe, ok := err.(*Error)
+	if !ok {
+		pe = &Error{Status: 500, Name: "HTTPError", Message: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(pe.Status)
+	json.NewEncoder(w).Encode(swagger.ModelError{Error_: &swagger.ErrorError{Message: pe.Message, Name: pe.Name}})
+}
+
+// parseParams merges query parameters with a json or form encoded body
+func parseParams(r *http.Request, body []byte) (map[string]string, *Error) {
+	params := make(map[string]string)
+	for k, v := range r.URL.Query() {
+		if len(v) > 0 {
+			params[k] = v[0]
+		}
+	}
+	if len(body) == 0 {
+		return params, nil
+	}
+	if strings.Contains(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		values, err := parseForm(string(body))
+		if err != nil {
+			return nil, validationError("Unable to parse body")
+		}
+		for k, v := range values {
+			params[k] = v
+		}
+		return params, nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, validationError("Unable to parse body")
+	}
+	for k, v := range m {
+		switch t := v.(type) {
+		case string:
+			params[k] = t
+		case nil:
+		default:
+			b, _ := json.Marshal(t)
+			params[k] = string(b)
+		}
+	}
+	return params, nil
+}
+
+func parseForm(body string) (map[string]string, error) {
+	r, err := http.NewRequest("POST", "/", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	for k, v := range r.PostForm {
+		if len(v) > 0 {
+			result[k] = v[0]
+		}
+	}
+	return result, nil
+}
+
+func floatParam(params map[string]string, name string) (float64, error) {
+	s, ok := params[name]
+	if !ok || s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, validationError("Invalid %v", name)
+	}
+	return v, nil
+}
+
+// listParam accepts a single value, a comma separated list or a json array
+func listParam(params map[string]string, name string) []string {
+	s := params[name]
+	if s == "" {
+		return nil
+	}
+	var list []string
+	if strings.HasPrefix(s, "[") && json.Unmarshal([]byte(s), &list) == nil {
+		return list
+	}
+	return strings.Split(s, ",")
+}
+
+func (e *Exchange) handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":      "BitMEX API",
+		"version":   "paper",
+		"timestamp": e.now().UnixNano() / int64(time.Millisecond),
+	})
+}
+
+func (e *Exchange) handleInstrument(r *http.Request, params map[string]string) (interface{}, error) {
+	result := []swagger.Instrument{}
+	for _, v := range e.Instruments() {
+		if params["symbol"] == "" || params["symbol"] == v.Symbol {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+func (e *Exchange) handleOrderBookL2(r *http.Request, params map[string]string) (interface{}, error) {
+	depth, err := floatParam(params, "depth")
+	if err != nil {
+		return nil, err
+	}
+	if depth == 0 {
+		depth = 25
+	}
+	result := []swagger.OrderBookL2{}
+	for _, v := range e.bookSnapshot(params["symbol"], int(depth)) {
+		result = append(result, swagger.OrderBookL2{
+			Symbol: v.Symbol,
+			Id:     float32(v.ID),
+			Side:   v.Side,
+			Size:   float32(v.Size),
+			Price:  v.Price,
+		})
+	}
+	return result, nil
+}
+
+func (e *Exchange) handleOrder(r *http.Request, params map[string]string) (interface{}, error) {
+	switch r.Method {
+	case http.MethodGet:
+		return e.getOrders(params)
+	case http.MethodPost:
+		req := OrderRequest{
+			Symbol:      params["symbol"],
+			Side:        params["side"],
+			OrdType:     params["ordType"],
+			TimeInForce: params["timeInForce"],
+			ExecInst:    params["execInst"],
+			ClOrdID:     params["clOrdID"],
+			Text:        params["text"],
+		}
+		var err error
+		if req.OrderQty, err = floatParam(params, "orderQty"); err != nil {
+			return nil, err
+		}
+		if req.Price, err = floatParam(params, "price"); err != nil {
+			return nil, err
+		}
+		return e.PlaceOrder(req)
+	case http.MethodPut:
+		orderQty, err := floatParam(params, "orderQty")
+		if err != nil {
+			return nil, err
+		}
+		leavesQty, err := floatParam(params, "leavesQty")
+		if err != nil {
+			return nil, err
+		}
+		price, err := floatParam(params, "price")
+		if err != nil {
+			return nil, err
+		}
+		return e.AmendOrder(params["orderID"], params["origClOrdID"], orderQty, leavesQty, price)
+	case http.MethodDelete:
+		return e.CancelOrders(listParam(params, "orderID"), listParam(params, "clOrdID"), params["text"])
+	}
+	return nil, &Error{Status: 405, Name: "HTTPError", Message: "Method Not Allowed"}
+}
+
+func (e *Exchange) getOrders(params map[string]string) (interface{}, error) {
+	filter := make(map[string]interface{})
+	if s := params["filter"]; s != "" {
+		if err := json.Unmarshal([]byte(s), &filter); err != nil {
+			return nil, validationError("Invalid filter")
+		}
+	}
+	open, _ := filter["open"].(bool)
+	orderID, _ := filter["orderID"].(string)
+	clOrdID, _ := filter["clOrdID"].(string)
+	symbol := params["symbol"]
+	if s, ok := filter["symbol"].(string); ok {
+		symbol = s
+	}
+
+	result := []swagger.Order{}
+	for _, o := range e.Orders(symbol, open) {
+		if orderID != "" && o.OrderID != orderID {
+			continue
+		}
+		if clOrdID != "" && o.ClOrdID != clOrdID {
+			continue
+		}
+		result = append(result, o)
+	}
+	return result, nil
+}
+
+func (e *Exchange) handleOrderAll(r *http.Request, params map[string]string) (interface{}, error) {
+	if r.Method != http.MethodDelete {
+		return nil, &Error{Status: 405, Name: "HTTPError", Message: "Method Not Allowed"}
+	}
+	result := e.CancelAllOrders(params["symbol"], params["text"])
+	if result == nil {
+		result = []swagger.Order{}
+	}
+	return result, nil
+}
+
+func (e *Exchange) handlePosition(r *http.Request, params map[string]string) (interface{}, error) {
+	filter := make(map[string]interface{})
+	if s := params["filter"]; s != "" {
+		if err := json.Unmarshal([]byte(s), &filter); err != nil {
+			return nil, validationError("Invalid filter")
+		}
+	}
+	symbol, _ := filter["symbol"].(string)
+	result := []swagger.Position{}
+	for _, p := range e.Positions() {
+		if symbol == "" || p.Symbol == symbol {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+func (e *Exchange) handleLeverage(r *http.Request, params map[string]string) (interface{}, error) {
+	leverage, err := floatParam(params, "leverage")
+	if err != nil {
+		return nil, err
+	}
+	return e.UpdateLeverage(params["symbol"], leverage)
+}
+
+func (e *Exchange) handleMargin(r *http.Request, params map[string]string) (interface{}, error) {
+	return e.Margin(), nil
+}
+
+func (e *Exchange) handleWallet(r *http.Request, params map[string]string) (interface{}, error) {
+	return e.Wallet(), nil
+}
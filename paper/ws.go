@@ -0,0 +1,370 @@
+package paper
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api"
+	"github.com/frankrap/bitmex-api/swagger"
+	"github.com/gorilla/websocket"
+)
+
+const clientSendBuffer = 4096
+
+var privateTables = map[string]bool{
+	bitmex.BitmexWSOrder:     true,
+	bitmex.BitmexWSExecution: true,
+	bitmex.BitmexWSPosition:  true,
+	bitmex.BitmexWSMargin:    true,
+	bitmex.BitmexWSWallet:    true,
+}
+
+var publicTables = map[string]bool{
+	bitmex.BitmexWSInstrument:     true,
+	bitmex.BitmexWSOrderBookL2:    true,
+	bitmex.BitmexWSOrderBookL2_25: true,
+	bitmex.BitmexWSTrade:          true,
+}
+
+type tableMessage struct {
+	Table  string            `json:"table"`
+	Action string            `json:"action"`
+	Keys   []string          `json:"keys,omitempty"`
+	Filter map[string]string `json:"filter,omitempty"`
+	Data   interface{}       `json:"data"`
+}
+
+type wsRequest struct {
+	Op   string        `json:"op"`
+	Args []interface{} `json:"args"`
+}
+
+type client struct {
+	conn   *websocket.Conn
+	send   chan []byte
+	mu     sync.Mutex
+	authed bool
+	subs   map[string]map[string]bool // key: table, then symbol filter, "" for all
+}
+
+func (c *client) subscribed(table string, symbol string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	symbols, ok := c.subs[table]
+	return ok && (symbols[""] || symbol == "" || symbols[symbol])
+}
+
+func (c *client) subscribe(table string, symbol string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.subs[table] == nil {
+		c.subs[table] = make(map[string]bool)
+	}
+	c.subs[table][symbol] = true
+}
+
+func (c *client) unsubscribe(table string, symbol string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.subs[table], symbol)
+	if len(c.subs[table]) == 0 {
+		delete(c.subs, table)
+	}
+}
+
+func (c *client) isAuthed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.authed
+}
+
+// hub fans table messages out to websocket clients
+type hub struct {
+	e        *Exchange
+	upgrader websocket.Upgrader
+	mu       sync.Mutex
+	clients  map[*client]struct{}
+}
+
+func newHub(e *Exchange) *hub {
+	return &hub{
+		e: e,
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		clients: make(map[*client]struct{}),
+	}
+}
+
+func (h *hub) serveWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	c := &client{
+		conn: conn,
+		send: make(chan []byte, clientSendBuffer),
+		subs: make(map[string]map[string]bool),
+	}
+	h.mu.Lock()
+	h.clients[c] = struct{}{}
+	h.mu.Unlock()
+
+	go h.writeLoop(c)
+	h.sendJSON(c, map[string]interface{}{
+		"info":      "Welcome to the BitMEX Realtime API.",
+		"version":   "paper",
+		"timestamp": h.e.now().UTC().Format(time.RFC3339Nano),
+	})
+	h.readLoop(c)
+}
+
+func (h *hub) writeLoop(c *client) {
+	for msg := range c.send {
+		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			h.remove(c)
+		}
+	}
+	c.conn.Close()
+}
+
+func (h *hub) readLoop(c *client) {
+	defer h.remove(c)
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if string(message) == "ping" {
+			h.send(c, []byte("pong"))
+			continue
+		}
+		var req wsRequest
+		if err := json.Unmarshal(message, &req); err != nil {
+			h.sendJSON(c, map[string]interface{}{"status": 400, "error": "Unable to parse request"})
+			continue
+		}
+		switch req.Op {
+		case "authKey", "authKeyExpires":
+			h.auth(c, req)
+		case "subscribe":
+			for _, arg := range req.Args {
+				topic, _ := arg.(string)
+				h.subscribe(c, req, topic)
+			}
+		case "unsubscribe":
+			for _, arg := range req.Args {
+				topic, _ := arg.(string)
+				c.unsubscribe(splitTopic(topic))
+				h.sendJSON(c, map[string]interface{}{"success": true, "unsubscribe": topic, "request": req})
+			}
+		default:
+			h.sendJSON(c, map[string]interface{}{"status": 400, "error": "Unknown or unsupported command " + req.Op, "request": req})
+		}
+	}
+}
+
+func (h *hub) auth(c *client, req wsRequest) {
+	if len(req.Args) != 3 {
+		h.sendJSON(c, map[string]interface{}{"status": 400, "error": "Invalid authKey arguments", "request": req})
+		return
+	}
+	key, _ := req.Args[0].(string)
+	expires, _ := req.Args[1].(float64)
+	signature, _ := req.Args[2].(string)
+	if !h.e.verifyWS(key, int64(expires), signature) {
+		h.sendJSON(c, map[string]interface{}{"status": 401, "error": "Signature not valid.", "request": req})
+		return
+	}
+	c.mu.Lock()
+	c.authed = true
+	c.mu.Unlock()
+	h.sendJSON(c, map[string]interface{}{"success": true, "request": req})
+}
+
+func splitTopic(topic string) (table string, symbol string) {
+	i := strings.Index(topic, ":")
+	if i < 0 {
+		return topic, ""
+	}
+	return topic[:i], topic[i+1:]
+}
+
+func (h *hub) subscribe(c *client, req wsRequest, topic string) {
+	table, symbol := splitTopic(topic)
+	if !publicTables[table] && !privateTables[table] {
+		h.sendJSON(c, map[string]interface{}{"status": 400, "error": "Unknown table: " + table, "request": req})
+		return
+	}
+	if privateTables[table] && !c.isAuthed() {
+		h.sendJSON(c, map[string]interface{}{
+			"status":  401,
+			"error":   "User requested an account-locked subscription but no authorization is provided.",
+			"request": req,
+		})
+		return
+	}
+
+	// the exchange publishes under its lock, no update can precede the partial
+	h.e.mu.Lock()
+	defer h.e.mu.Unlock()
+
+	c.subscribe(table, symbol)
+	h.sendJSON(c, map[string]interface{}{"success": true, "subscribe": topic, "request": req})
+
+	msg := tableMessage{Table: table, Action: "partial"}
+	if symbol != "" {
+		msg.Filter = map[string]string{"symbol": symbol}
+	}
+	msg.Data = h.e.partial(table, symbol)
+	h.sendJSON(c, msg)
+}
+
+func (h *hub) remove(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[c]; ok {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// send queues msg for c, a client too slow to keep up is disconnected
+func (h *hub) send(c *client, msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.clients[c]; !ok {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+func (h *hub) sendJSON(c *client, v interface{}) {
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	h.send(c, msg)
+}
+
+func (h *hub) snapshotClients() []*client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	clients := make([]*client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+func (h *hub) publishPublic(table string, symbol string, action string, data interface{}) {
+	msg, err := json.Marshal(tableMessage{Table: table, Action: action, Data: data})
+	if err != nil {
+		return
+	}
+	for _, c := range h.snapshotClients() {
+		if c.subscribed(table, symbol) {
+			h.send(c, msg)
+		}
+	}
+}
+
+func (h *hub) publishPrivate(table string, action string, data interface{}) {
+	msg, err := json.Marshal(tableMessage{Table: table, Action: action, Data: data})
+	if err != nil {
+		return
+	}
+	for _, c := range h.snapshotClients() {
+		if c.isAuthed() && c.subscribed(table, "") {
+			h.send(c, msg)
+		}
+	}
+}
+
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for c := range h.clients {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// partial returns the data of a partial message for a new subscription, e.mu held
+func (e *Exchange) partial(table string, symbol string) interface{} {
+	switch table {
+	case bitmex.BitmexWSOrder:
+		orders := e.ordersData(symbol, true)
+		result := make([]*swagger.Order, 0, len(orders))
+		for i := range orders {
+			result = append(result, &orders[i])
+		}
+		return result
+	case bitmex.BitmexWSPosition:
+		positions := e.positionsData()
+		result := make([]*swagger.Position, 0, len(positions))
+		for i := range positions {
+			if symbol == "" || positions[i].Symbol == symbol {
+				result = append(result, &positions[i])
+			}
+		}
+		return result
+	case bitmex.BitmexWSMargin:
+		m := e.marginData()
+		return []*swagger.Margin{&m}
+	case bitmex.BitmexWSWallet:
+		w := e.walletData()
+		return []*swagger.Wallet{&w}
+	case bitmex.BitmexWSInstrument:
+		instruments := e.instrumentsData()
+		result := make([]*swagger.Instrument, 0, len(instruments))
+		for i := range instruments {
+			if symbol == "" || instruments[i].Symbol == symbol {
+				result = append(result, &instruments[i])
+			}
+		}
+		return result
+	case bitmex.BitmexWSOrderBookL2, bitmex.BitmexWSOrderBookL2_25:
+		depth := 0
+		if table == bitmex.BitmexWSOrderBookL2_25 {
+			depth = depth25
+		}
+		return e.bookData(symbol, depth)
+	}
+	return []interface{}{}
+}
+
+func (e *Exchange) bookSnapshot(symbol string, depth int) []*bitmex.OrderBookL2 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.bookData(symbol, depth)
+}
+
+func (e *Exchange) bookData(symbol string, depth int) []*bitmex.OrderBookL2 {
+	var result []*bitmex.OrderBookL2
+	for s, b := range e.books {
+		if symbol == "" || s == symbol {
+			result = append(result, b.snapshot(depth)...)
+		}
+	}
+	if result == nil {
+		result = []*bitmex.OrderBookL2{}
+	}
+	return result
+}
@@ -0,0 +1,199 @@
+package bitmex
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ReplayMaxSpeed replays frames as fast as they can be processed
+const ReplayMaxSpeed = 0
+
+// RecordedFrame is one line of a recording
+type RecordedFrame struct {
+	Time    time.Time `json:"ts"`  // receive time
+	Message string    `json:"msg"` // raw websocket frame
+}
+
+// Recorder writes raw websocket frames with their receive time to a gzip compressed JSON Lines stream
+type Recorder struct {
+	mu     sync.Mutex
+	closer io.Closer
+	gz     *gzip.Writer
+	w      *bufio.Writer
+	enc    *json.Encoder
+	count  int64
+}
+
+// NewRecorder records to w, Close flushes the gzip stream but does not close w
+func NewRecorder(w io.Writer) *Recorder {
+	r := &Recorder{}
+	r.gz = gzip.NewWriter(w)
+	r.w = bufio.NewWriter(r.gz)
+	r.enc = json.NewEncoder(r.w)
+	r.enc.SetEscapeHTML(false)
+	return r
+}
+
+// CreateRecorder records to filename, e.g. xbtusd-20190409.jsonl.gz
+func CreateRecorder(filename string) (*Recorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRecorder(f)
+	r.closer = f
+	return r, nil
+}
+
+// Record writes a frame received at t
+func (r *Recorder) Record(t time.Time, message []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.count++
+	return r.enc.Encode(RecordedFrame{Time: t, Message: string(message)})
+}
+
+// Count returns the number of recorded frames
+func (r *Recorder) Count() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.count
+}
+
+// Flush writes buffered frames so the recording is readable up to here
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.w.Flush(); err != nil {
+		return err
+	}
+	return r.gz.Flush()
+}
+
+// Close flushes and finishes the recording
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.w.Flush(); err != nil {
+		return err
+	}
+	if err := r.gz.Close(); err != nil {
+		return err
+	}
+	if r.closer != nil {
+		return r.closer.Close()
+	}
+	return nil
+}
+
+// FrameReader reads a recording written by Recorder
+type FrameReader struct {
+	gz  *gzip.Reader
+	dec *json.Decoder
+}
+
+// NewFrameReader reads a gzip compressed recording from r
+func NewFrameReader(r io.Reader) (*FrameReader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &FrameReader{gz: gz, dec: json.NewDecoder(gz)}, nil
+}
+
+// Next returns the next frame, or io.EOF at the end of the recording
+func (fr *FrameReader) Next() (frame RecordedFrame, err error) {
+	err = fr.dec.Decode(&frame)
+	return
+}
+
+// Close releases the gzip reader
+func (fr *FrameReader) Close() error {
+	return fr.gz.Close()
+}
+
+// SetRecorder records every frame StartWS receives, nil stops recording
+func (b *BitMEX) SetRecorder(r *Recorder) {
+	b.recorderMutex.Lock()
+	defer b.recorderMutex.Unlock()
+
+	b.recorder = r
+}
+
+func (b *BitMEX) getRecorder() *Recorder {
+	b.recorderMutex.RLock()
+	defer b.recorderMutex.RUnlock()
+
+	return b.recorder
+}
+
+// Replay feeds a recording through the same handlers as StartWS, so listeners
+// receive the same events as live. speed 1 keeps the recorded timing, 10 plays
+// ten times faster and ReplayMaxSpeed does not wait at all.
+// It returns the number of frames replayed.
+func (b *BitMEX) Replay(ctx context.Context, r io.Reader, speed float64) (n int, err error) {
+	var fr *FrameReader
+	fr, err = NewFrameReader(r)
+	if err != nil {
+		return
+	}
+	defer fr.Close()
+
+	var first time.Time
+	start := time.Now()
+	for {
+		var frame RecordedFrame
+		frame, err = fr.Next()
+		if err == io.EOF {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		if speed > 0 {
+			if first.IsZero() {
+				first = frame.Time
+			}
+			offset := time.Duration(float64(frame.Time.Sub(first)) / speed)
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					err = ctx.Err()
+					return
+				case <-t.C:
+				}
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		if e := b.processMessage([]byte(frame.Message)); e != nil {
+			b.log().Warn("replay decode", "err", e)
+		}
+		n++
+	}
+}
+
+// ReplayFile replays a recording file, see Replay
+func (b *BitMEX) ReplayFile(ctx context.Context, filename string, speed float64) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return b.Replay(ctx, f, speed)
+}
@@ -0,0 +1,103 @@
+package bitmex
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+func TestRecorder_Replay(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	loadScript(t, srv, "ws_orderbook.jsonl")
+
+	filename := filepath.Join(t.TempDir(), "xbtusd.jsonl.gz")
+	recorder, err := CreateRecorder(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetRecorder(recorder)
+
+	var mu sync.Mutex
+	var live []OrderBook
+	c := make(chan OrderBook, 16)
+	b.On(BitmexWSOrderBookL2, func(ob OrderBookDataL2, symbol string) {
+		mu.Lock()
+		live = append(live, ob.OrderBook())
+		mu.Unlock()
+		c <- ob.OrderBook()
+	})
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrderBookL2, Param: "XBTUSD"}})
+	startWS(t, b)
+	waitOrderBook(t, c, func(ob OrderBook) bool { return len(ob.Asks) == 2 && ob.Ask() == 8999 })
+	b.CloseWS()
+	b.SetRecorder(nil)
+	if err = recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := New(nil, HostTestnet, "", "", false)
+	var replayed []OrderBook
+	replay.On(BitmexWSOrderBookL2, func(ob OrderBookDataL2, symbol string) {
+		replayed = append(replayed, ob.OrderBook())
+	})
+	n, err := replay.ReplayFile(context.Background(), filename, ReplayMaxSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(n) != recorder.Count() {
+		t.Errorf("replayed %v of %v frames", n, recorder.Count())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(replayed) != len(live) {
+		t.Fatalf("replayed %v events, live %v", len(replayed), len(live))
+	}
+	for i := range live {
+		if !reflect.DeepEqual(live[i].Asks, replayed[i].Asks) || !reflect.DeepEqual(live[i].Bids, replayed[i].Bids) {
+			t.Errorf("event %v differs: live %v replayed %v", i, live[i], replayed[i])
+		}
+	}
+}
+
+func TestRecorder_ReplaySpeed(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRecorder(&buf)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		r.Record(start.Add(time.Duration(i)*time.Second), []byte(`{"table":"trade","action":"insert","data":[{"symbol":"XBTUSD","side":"Buy","size":10,"price":9000}]}`))
+	}
+	r.Close()
+
+	b := New(nil, HostTestnet, "", "", false)
+	trades := 0
+	b.On(BitmexWSTrade, func(m []*swagger.Trade, action string) {
+		trades++
+	})
+
+	// 2s recorded at 20x
+	begin := time.Now()
+	n, err := b.Replay(context.Background(), bytes.NewReader(buf.Bytes()), 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(begin)
+	if n != 3 || trades != 3 {
+		t.Errorf("replayed %v frames %v trades", n, trades)
+	}
+	if elapsed < 90*time.Millisecond || elapsed > time.Second {
+		t.Errorf("elapsed %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = b.Replay(ctx, bytes.NewReader(buf.Bytes()), 1); err != context.DeadlineExceeded {
+		t.Errorf("expect deadline exceeded, got %v", err)
+	}
+}
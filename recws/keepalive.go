@@ -5,8 +5,12 @@ import (
 	"time"
 )
 
+// keepAliveResponse is when the connection last showed it is alive,
+// by any frame, and the round trip of the last control ping
 type keepAliveResponse struct {
 	lastResponse time.Time
+	pingSent     time.Time
+	rtt          time.Duration
 	sync.RWMutex
 }
 
@@ -23,3 +27,39 @@ func (k *keepAliveResponse) getLastResponse() time.Time {
 
 	return k.lastResponse
 }
+
+func (k *keepAliveResponse) setPingSent() {
+	k.Lock()
+	defer k.Unlock()
+
+	k.pingSent = time.Now()
+}
+
+// setPong is a pong received, measuring the ping it answers
+func (k *keepAliveResponse) setPong() {
+	k.Lock()
+	defer k.Unlock()
+
+	k.lastResponse = time.Now()
+	if !k.pingSent.IsZero() {
+		k.rtt = k.lastResponse.Sub(k.pingSent)
+		k.pingSent = time.Time{}
+	}
+}
+
+func (k *keepAliveResponse) getRTT() time.Duration {
+	k.RLock()
+	defer k.RUnlock()
+
+	return k.rtt
+}
+
+// LastActivity returns when the last frame, data or pong, arrived
+func (rc *RecConn) LastActivity() time.Time {
+	return rc.activity.getLastResponse()
+}
+
+// PingRTT returns the round trip of the last answered control ping, 0 without KeepAliveTimeout
+func (rc *RecConn) PingRTT() time.Duration {
+	return rc.activity.getRTT()
+}
@@ -3,9 +3,14 @@
 package recws
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"sync"
@@ -19,6 +24,32 @@ import (
 // a message and the connection is closed
 var ErrNotConnected = errors.New("websocket: not connected")
 
+// ErrKeepAlive is the reason of a disconnect for a missing pong
+var ErrKeepAlive = errors.New("websocket: keepalive timeout")
+
+// Logger is a leveled logger, keyvals are alternating keys and values.
+// *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// stdLogger prints to the standard log package
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, keyvals ...interface{}) {}
+func (stdLogger) Info(msg string, keyvals ...interface{}) {
+	log.Println(append([]interface{}{msg}, keyvals...)...)
+}
+func (stdLogger) Warn(msg string, keyvals ...interface{}) {
+	log.Println(append([]interface{}{msg}, keyvals...)...)
+}
+func (stdLogger) Error(msg string, keyvals ...interface{}) {
+	log.Println(append([]interface{}{msg}, keyvals...)...)
+}
+
 // The RecConn type represents a Reconnecting WebSocket connection.
 type RecConn struct {
 	// RecIntvlMin specifies the initial reconnecting interval,
@@ -37,9 +68,22 @@ type RecConn struct {
 	NonVerbose bool
 	// SubscribeHandler fires after the connection successfully establish.
 	SubscribeHandler func() error
-	// KeepAliveTimeout is an interval for sending ping/pong messages
+	// ConnectionHandler fires when the connection is established or lost.
+	ConnectionHandler func(connected bool)
+	// StateHandler fires on every state change, see State.
+	StateHandler func(Event)
+	// KeepAliveTimeout is an interval for sending ping/pong messages,
+	// the connection is dropped after that long without any frame,
 	// disabled if 0
 	KeepAliveTimeout time.Duration
+	// Logger receives connection messages, default to the log package
+	Logger Logger
+	// Proxy returns the proxy of a handshake, http:// for HTTP CONNECT or
+	// socks5://, with user:password@ for auth, see SetProxyURL
+	Proxy func(*http.Request) (*url.URL, error)
+	// NetDialContext creates the TCP connections, to the proxy if any,
+	// net.Dialer if nil
+	NetDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
 
 	mu          sync.RWMutex
 	url         string
@@ -50,25 +94,145 @@ type RecConn struct {
 	isConnected bool
 	isClosed    bool
 	dialer      *websocket.Dialer
+	up          chan struct{} // closed while connected
+	activity    keepAliveResponse
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup // connect, keepalive and the context watcher
 
 	*websocket.Conn
 }
 
-// CloseAndReconnect will try to reconnect.
-func (rc *RecConn) closeAndReconnect() {
-	rc.Close()
-	if rc.IsClosed() {
+// Reconnect drops the connection for reason, e.g. a heartbeat timeout,
+// and dials again. Nothing happens if it isn't connected.
+func (rc *RecConn) Reconnect(reason error) {
+	rc.closeAndReconnect(reason)
+}
+
+// CloseAndReconnect will try to reconnect, once however many
+// readers and writers fail on the same connection.
+func (rc *RecConn) closeAndReconnect(reason error) {
+	wasConnected := rc.closeConn()
+	if rc.IsClosed() || !wasConnected {
 		return
 	}
-	go rc.connect()
+	rc.SetState(Event{State: StateDisconnected, Err: reason})
+	rc.goFunc(func(ctx context.Context) { rc.connect(ctx, nil, false) })
 }
 
-// setIsConnected sets state for isConnected
-func (rc *RecConn) setIsConnected(state bool) {
+// setIsConnected sets state for isConnected, and tells whether it changed
+func (rc *RecConn) setIsConnected(state bool) bool {
 	rc.mu.Lock()
-	defer rc.mu.Unlock()
+	changed := rc.setConnectedLocked(state)
+	rc.mu.Unlock()
+
+	if changed {
+		rc.onConnection(state)
+	}
+	return changed
+}
 
+// setConnectedLocked sets isConnected and up, rc.mu held
+func (rc *RecConn) setConnectedLocked(state bool) bool {
+	changed := rc.isConnected != state
 	rc.isConnected = state
+	if changed {
+		if state {
+			close(rc.upLocked())
+		} else {
+			rc.up = make(chan struct{})
+		}
+	}
+	return changed
+}
+
+func (rc *RecConn) upLocked() chan struct{} {
+	if rc.up == nil {
+		rc.up = make(chan struct{})
+	}
+	return rc.up
+}
+
+// contextLocked returns the context of the connection, canceled by CloseWS, rc.mu held
+func (rc *RecConn) contextLocked() context.Context {
+	if rc.ctx == nil {
+		rc.ctx, rc.cancel = context.WithCancel(context.Background())
+	}
+	return rc.ctx
+}
+
+// renew gives a connection closed by CloseWS, or by the context of its
+// DialContext, a fresh context once its goroutines have exited, so that it
+// can be dialed again
+func (rc *RecConn) renew() {
+	rc.mu.Lock()
+	stale := rc.ctx != nil && rc.ctx.Err() != nil
+	rc.mu.Unlock()
+	if !stale {
+		return
+	}
+
+	rc.wg.Wait()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.ctx, rc.cancel = context.WithCancel(context.Background())
+	rc.isClosed = false
+}
+
+// goFunc runs fn in a goroutine Wait waits for, unless the connection is closed
+func (rc *RecConn) goFunc(fn func(ctx context.Context)) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	ctx := rc.contextLocked()
+	if ctx.Err() != nil {
+		return false
+	}
+	rc.wg.Add(1)
+	go func() {
+		defer rc.wg.Done()
+		fn(ctx)
+	}()
+	return true
+}
+
+// Done is closed after CloseWS, or when the context given to DialContext is done
+func (rc *RecConn) Done() <-chan struct{} {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return rc.contextLocked().Done()
+}
+
+// Wait waits for the goroutines of the connection to exit after Done
+func (rc *RecConn) Wait() {
+	rc.wg.Wait()
+}
+
+// WaitConnected waits for the connection to be up, false once closed
+func (rc *RecConn) WaitConnected() bool {
+	rc.mu.Lock()
+	up := rc.upLocked()
+	done := rc.contextLocked().Done()
+	rc.mu.Unlock()
+
+	select {
+	case <-up:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// onConnection calls ConnectionHandler, outside of the lock
+func (rc *RecConn) onConnection(connected bool) {
+	rc.mu.RLock()
+	handler := rc.ConnectionHandler
+	rc.mu.RUnlock()
+
+	if handler != nil {
+		handler(connected)
+	}
 }
 
 // setIsClosed sets state for isClosed
@@ -86,7 +250,7 @@ func (rc *RecConn) getConn() *websocket.Conn {
 	return rc.Conn
 }
 
-// SetProxyURL set connect proxy url
+// SetProxyURL set connect proxy url, it takes precedence over Proxy
 func (rc *RecConn) SetProxyURL(proxyURL string) {
 	rc.proxyURL = proxyURL
 }
@@ -94,19 +258,29 @@ func (rc *RecConn) SetProxyURL(proxyURL string) {
 // Close closes the underlying network connection without
 // sending or waiting for a close frame.
 func (rc *RecConn) Close() {
+	rc.closeConn()
+}
+
+// closeConn closes the connection, true if it was connected
+func (rc *RecConn) closeConn() bool {
 	if rc.getConn() != nil {
 		rc.mu.Lock()
 		rc.Conn.Close()
 		rc.mu.Unlock()
 	}
 
-	rc.setIsConnected(false)
+	return rc.setIsConnected(false)
 }
 
 // CloseWS closes the underlying network connection without
 // sending or waiting for a close frame.
 func (rc *RecConn) CloseWS() {
+	wasClosed := rc.IsClosed()
 	rc.setIsClosed(true)
+	rc.mu.Lock()
+	rc.contextLocked()
+	rc.cancel()
+	rc.mu.Unlock()
 
 	if rc.getConn() != nil {
 		rc.mu.Lock()
@@ -115,6 +289,9 @@ func (rc *RecConn) CloseWS() {
 	}
 
 	rc.setIsConnected(false)
+	if !wasClosed {
+		rc.SetState(Event{State: StateClosed})
+	}
 }
 
 // ReadMessage is a helper method for getting a reader
@@ -126,7 +303,29 @@ func (rc *RecConn) ReadMessage() (messageType int, message []byte, err error) {
 	if rc.IsConnected() {
 		messageType, message, err = rc.Conn.ReadMessage()
 		if err != nil {
-			rc.closeAndReconnect()
+			rc.closeAndReconnect(err)
+		} else {
+			rc.activity.setLastResponse()
+		}
+	}
+
+	return
+}
+
+// ReadMessageTo is ReadMessage into buf, reset first, so that a reader can
+// reuse one buffer instead of allocating one per message
+func (rc *RecConn) ReadMessageTo(buf *bytes.Buffer) (messageType int, err error) {
+	err = ErrNotConnected
+	if rc.IsConnected() {
+		var r io.Reader
+		buf.Reset()
+		if messageType, r, err = rc.Conn.NextReader(); err == nil {
+			_, err = buf.ReadFrom(r)
+		}
+		if err != nil {
+			rc.closeAndReconnect(err)
+		} else {
+			rc.activity.setLastResponse()
 		}
 	}
 
@@ -144,7 +343,7 @@ func (rc *RecConn) WriteMessage(messageType int, data []byte) error {
 		err = rc.Conn.WriteMessage(messageType, data)
 		rc.mu.Unlock()
 		if err != nil {
-			rc.closeAndReconnect()
+			rc.closeAndReconnect(err)
 		}
 	}
 
@@ -164,7 +363,7 @@ func (rc *RecConn) WriteJSON(v interface{}) error {
 		err = rc.Conn.WriteJSON(v)
 		rc.mu.Unlock()
 		if err != nil {
-			rc.closeAndReconnect()
+			rc.closeAndReconnect(err)
 		}
 	}
 
@@ -183,7 +382,9 @@ func (rc *RecConn) ReadJSON(v interface{}) error {
 	if rc.IsConnected() {
 		err = rc.Conn.ReadJSON(v)
 		if err != nil {
-			rc.closeAndReconnect()
+			rc.closeAndReconnect(err)
+		} else {
+			rc.activity.setLastResponse()
 		}
 	}
 
@@ -269,6 +470,8 @@ func (rc *RecConn) setDefaultDialer(handshakeTimeout time.Duration) {
 
 	rc.dialer = &websocket.Dialer{
 		HandshakeTimeout: handshakeTimeout,
+		Proxy:            rc.Proxy,
+		NetDialContext:   rc.NetDialContext,
 	}
 	if rc.proxyURL != "" {
 		proxyURL_, err := url.Parse(rc.proxyURL)
@@ -291,11 +494,26 @@ func (rc *RecConn) getHandshakeTimeout() time.Duration {
 // the origin (Origin), subprotocols (Sec-WebSocket-Protocol) and cookies
 // (Cookie). Use GetHTTPResponse() method for the response.Header to get
 // the selected subprotocol (Sec-WebSocket-Protocol) and cookies (Set-Cookie).
-func (rc *RecConn) Dial(urlStr string, reqHeader http.Header) {
+//
+// An invalid url is returned as an error, connection failures are retried.
+// Dial returns after the first attempt. A connection closed by CloseWS can
+// be dialed again.
+func (rc *RecConn) Dial(urlStr string, reqHeader http.Header) error {
+	return rc.dial(context.Background(), urlStr, reqHeader, false)
+}
+
+// DialContext is Dial, but returns the error of the first attempt instead of
+// retrying it. Every goroutine of the connection exits once ctx is done or
+// after CloseWS, see Done and Wait.
+func (rc *RecConn) DialContext(ctx context.Context, urlStr string, reqHeader http.Header) error {
+	return rc.dial(ctx, urlStr, reqHeader, true)
+}
+
+func (rc *RecConn) dial(parent context.Context, urlStr string, reqHeader http.Header, strict bool) error {
 	urlStr, err := rc.parseURL(urlStr)
 
 	if err != nil {
-		log.Fatalf("Dial: %v", err)
+		return fmt.Errorf("Dial: %v", err)
 	}
 
 	// Config
@@ -306,12 +524,29 @@ func (rc *RecConn) Dial(urlStr string, reqHeader http.Header) {
 	rc.setDefaultRecIntvlFactor()
 	rc.setDefaultHandshakeTimeout()
 	rc.setDefaultDialer(rc.getHandshakeTimeout())
+	rc.renew()
 
-	// Connect
-	go rc.connect()
+	// the connection closes with parent
+	rc.goFunc(func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+		case <-parent.Done():
+		}
+		rc.CloseWS()
+	})
 
-	// wait on first attempt
-	time.Sleep(rc.getHandshakeTimeout())
+	// Connect, and wait on first attempt
+	first := make(chan error, 1)
+	if !rc.goFunc(func(ctx context.Context) { rc.connect(ctx, first, strict) }) {
+		return ErrNotConnected
+	}
+	err = <-first
+	if err != nil && strict {
+		rc.CloseWS()
+		rc.Wait()
+		return err
+	}
+	return nil
 }
 
 // GetURL returns current connection url
@@ -341,6 +576,16 @@ func (rc *RecConn) getBackoff() *backoff.Backoff {
 	}
 }
 
+func (rc *RecConn) getLogger() Logger {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+
+	if rc.Logger == nil {
+		return stdLogger{}
+	}
+	return rc.Logger
+}
+
 func (rc *RecConn) hasSubscribeHandler() bool {
 	rc.mu.RLock()
 	defer rc.mu.RUnlock()
@@ -363,85 +608,147 @@ func (rc *RecConn) writeControlPingMessage() error {
 }
 
 func (rc *RecConn) keepAlive() {
-	var (
-		keepAliveResponse = new(keepAliveResponse)
-		ticker            = time.NewTicker(rc.getKeepAliveTimeout())
-	)
+	timeout := rc.getKeepAliveTimeout()
 
 	rc.mu.Lock()
+	conn := rc.Conn
 	rc.Conn.SetPongHandler(func(msg string) error {
-		keepAliveResponse.setLastResponse()
+		rc.activity.setPong()
 		return nil
 	})
 	rc.mu.Unlock()
 
-	go func() {
+	rc.goFunc(func(ctx context.Context) {
+		// twice per timeout, a pong has time to come back
+		ticker := time.NewTicker(timeout / 2)
 		defer ticker.Stop()
 
 		for {
+			rc.activity.setPingSent()
 			rc.writeControlPingMessage()
-			<-ticker.C
-			if rc.IsClosed() {
+			select {
+			case <-ctx.Done():
 				return
+			case <-ticker.C:
 			}
-			if time.Now().Sub(keepAliveResponse.getLastResponse()) > rc.getKeepAliveTimeout() {
-				rc.closeAndReconnect()
+			if rc.getConn() != conn {
+				// reconnected, the new connection has its own
+				return
+			}
+			// any frame shows the connection is alive, not only pongs
+			if time.Now().Sub(rc.activity.getLastResponse()) > timeout {
+				rc.closeAndReconnect(ErrKeepAlive)
 				return
 			}
 		}
-	}()
+	})
 }
 
-func (rc *RecConn) connect() {
+// sleep waits d, false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// connect dials until connected, or until ctx is done. The result of the
+// first attempt goes to first if not nil, with giveUp connect stops if it failed.
+func (rc *RecConn) connect(ctx context.Context, first chan<- error, giveUp bool) {
 	b := rc.getBackoff()
 	rand.Seed(time.Now().UTC().UnixNano())
 
+	report := func(err error) (stop bool) {
+		if first == nil {
+			return false
+		}
+		first <- err
+		first = nil
+		return err != nil && giveUp
+	}
+
 	for {
 		if rc.IsClosed() {
+			report(ErrNotConnected)
 			return
 		}
 		nextItvl := b.Duration()
-		wsConn, httpResp, err := rc.dialer.Dial(rc.url, rc.reqHeader)
+		rc.SetState(Event{State: StateConnecting})
+		wsConn, httpResp, err := rc.dialer.DialContext(ctx, rc.url, rc.reqHeader)
 
 		rc.mu.Lock()
-		rc.Conn = wsConn
-		rc.dialErr = err
-		rc.isConnected = err == nil
-		rc.httpResp = httpResp
+		closed := rc.isClosed
+		if closed && wsConn != nil {
+			// CloseWS ran during the dial
+			wsConn.Close()
+		}
+		var changed bool
+		if !closed {
+			rc.Conn = wsConn
+			rc.dialErr = err
+			changed = rc.setConnectedLocked(err == nil)
+			rc.httpResp = httpResp
+		}
 		rc.mu.Unlock()
 
-		if rc.IsClosed() {
+		if changed {
+			rc.onConnection(err == nil)
+		}
+
+		if closed {
+			report(ErrNotConnected)
 			return
 		}
 
 		if err == nil {
 			if !rc.getNonVerbose() {
-				log.Printf("Dial: connection was successfully established with %s\n", rc.url)
-
-				if !rc.hasSubscribeHandler() {
-					return
-				}
+				rc.getLogger().Info("Dial: connection was successfully established", "url", rc.url)
+			}
+			rc.activity.setLastResponse()
+			rc.SetState(Event{State: StateConnected})
 
+			if rc.hasSubscribeHandler() {
 				if err := rc.SubscribeHandler(); err != nil {
-					log.Fatalf("Dial: connect handler failed with %s", err.Error())
+					// the connection is of no use without its subscriptions, start over
+					rc.getLogger().Error("Dial: connect handler failed", "url", rc.url, "err", err, "retry in", nextItvl)
+					rc.Close()
+					rc.SetState(Event{State: StateDisconnected, Err: err})
+					if report(err) {
+						return
+					}
+					rc.SetState(Event{State: StateBackoff, Err: err, Delay: nextItvl})
+					if !sleep(ctx, nextItvl) {
+						return
+					}
+					continue
 				}
-
-				log.Printf("Dial: connect handler was successfully established with %s\n", rc.url)
-
-				if rc.getKeepAliveTimeout() != 0 {
-					rc.keepAlive()
+				if !rc.getNonVerbose() {
+					rc.getLogger().Info("Dial: connect handler was successfully established", "url", rc.url)
 				}
 			}
 
+			if rc.getKeepAliveTimeout() != 0 {
+				rc.keepAlive()
+			}
+			report(nil)
 			return
 		}
 
 		if !rc.getNonVerbose() {
-			log.Println(err)
-			log.Println("Dial: will try again in", nextItvl, "seconds.")
+			rc.getLogger().Warn("Dial: will try again", "url", rc.url, "err", err, "in", nextItvl)
+		}
+		if report(err) {
+			return
 		}
 
-		time.Sleep(nextItvl)
+		rc.SetState(Event{State: StateBackoff, Err: err, Delay: nextItvl})
+		if !sleep(ctx, nextItvl) {
+			return
+		}
 	}
 }
 
@@ -0,0 +1,67 @@
+package recws
+
+import (
+	"fmt"
+	"time"
+)
+
+// State is a state of the connection
+type State int
+
+const (
+	// StateConnecting is a dial in progress
+	StateConnecting State = iota
+	// StateConnected is an open connection
+	StateConnected
+	// StateAuthenticated and StateSubscribed are reported by the application
+	// through SetState, RecConn doesn't know the protocol
+	StateAuthenticated
+	StateSubscribed
+	// StateDisconnected is a lost connection, Event.Err tells why
+	StateDisconnected
+	// StateBackoff waits Event.Delay before dialing again, Event.Err is the failure
+	StateBackoff
+	// StateClosed is after CloseWS, no more reconnects
+	StateClosed
+)
+
+var stateNames = [...]string{"Connecting", "Connected", "Authenticated", "Subscribed", "Disconnected", "Backoff", "Closed"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+// Event is a state change
+type Event struct {
+	State State
+	Err   error         // Disconnected and Backoff
+	Delay time.Duration // Backoff
+	Time  time.Time
+}
+
+func (e Event) String() string {
+	switch {
+	case e.State == StateBackoff:
+		return fmt.Sprintf("%v(%v): %v", e.State, e.Delay, e.Err)
+	case e.Err != nil:
+		return fmt.Sprintf("%v: %v", e.State, e.Err)
+	}
+	return e.State.String()
+}
+
+// SetState reports a state change to StateHandler, Time defaults to now
+func (rc *RecConn) SetState(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	rc.mu.RLock()
+	handler := rc.StateHandler
+	rc.mu.RUnlock()
+
+	if handler != nil {
+		handler(e)
+	}
+}
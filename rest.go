@@ -45,20 +45,26 @@ type Version struct {
 	Timestamp int64  `json:"timestamp"`
 }
 
-func (b *BitMEX) GetVersion() (version Version, time time.Duration, err error) {
-	url := "https://" + b.host + "/api/v1"
+// GetVersion also measures the clock skew, rtt is the round trip time
+func (b *BitMEX) GetVersion() (version Version, rtt time.Duration, err error) {
+	url := b.cfg.BasePath
 	var resp *http.Response
+	sent := time.Now()
 	resp, err = b.httpClient.Get(url)
 	if err != nil {
 		return
 	}
+	received := time.Now()
+	rtt = received.Sub(sent)
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return
 	}
-	//time = resp.Time()
 	err = json.Unmarshal(body, &version)
+	if err == nil && version.Timestamp > 0 {
+		b.timeSync.observe(sent, received, time.Unix(0, version.Timestamp*int64(time.Millisecond)))
+	}
 	return
 }
 
@@ -277,76 +283,42 @@ func (b *BitMEX) GetOrdersRaw(symbol string, filter string) (orders []swagger.Or
 }
 
 func (b *BitMEX) NewOrder(side string, ordType string, price float64, orderQty int32, postOnly bool, timeInForce string, symbol string) (order swagger.Order, err error) {
-	var response *http.Response
-
-	params := map[string]interface{}{}
-	params["symbol"] = symbol
-	// params["clOrdID"] = ""	// 客户端委托ID
-	params["side"] = side
-	params["ordType"] = ordType
-	params["orderQty"] = float32(orderQty)
-	if price > 0.0 {
-		params["price"] = price // Limit order only
+	req := OrderRequest{
+		Symbol:      symbol,
+		Side:        side,
+		OrdType:     ordType,
+		OrderQty:    float32(orderQty),
+		TimeInForce: timeInForce, // "FillOrKill"	// 全数执行或立刻取消
+		Text:        `open with bitmex api`,
 	}
-	params["text"] = `open with bitmex api`
-
-	if timeInForce != "" { // "FillOrKill"	// 全数执行或立刻取消
-		params["timeInForce"] = timeInForce
+	if price > 0.0 {
+		req.Price = price // Limit order only
 	}
-
 	if postOnly {
-		params["execInst"] = "ParticipateDoNotInitiate"
+		req.ExecInst = "ParticipateDoNotInitiate"
 	}
-
-	order, response, err = b.client.OrderApi.OrderNew(b.ctx, symbol, params)
-	if err != nil {
-		// >= 300 代表有错误
-		// 400 Bad Request
-		// 503
-		// log.Printf("response.StatusCode: %v", response.StatusCode)
-		return
-	}
-	b.onResponse(response)
-	return
+	return b.orders().PlaceOrder(req)
 }
 
 // PlaceOrder 放置委托单
 // execInst: MarkPrice = 标记价格 IndexPrice = 指数价格 LastPrice = 最新成交 ParticipateDoNotInitiate = 被动委托
 func (b *BitMEX) PlaceOrder(side string, ordType string, stopPx float64, price float64, orderQty int32, timeInForce string, execInst string, symbol string) (order swagger.Order, err error) {
-	var response *http.Response
-
-	params := map[string]interface{}{}
-	params["symbol"] = symbol
-	// params["clOrdID"] = ""	// 客户端委托ID
-	params["side"] = side
-	params["ordType"] = ordType
-	params["orderQty"] = float32(orderQty)
+	req := OrderRequest{
+		Symbol:      symbol,
+		Side:        side,
+		OrdType:     ordType,
+		OrderQty:    float32(orderQty),
+		TimeInForce: timeInForce,
+		ExecInst:    execInst,
+		Text:        `open with bitmex api`,
+	}
 	if stopPx > 0.0 {
-		params["stopPx"] = stopPx
+		req.StopPx = stopPx
 	}
 	if price > 0.0 {
-		params["price"] = price // Limit order only
-	}
-	params["text"] = `open with bitmex api`
-
-	if timeInForce != "" { // "FillOrKill"	// 全数执行或立刻取消
-		params["timeInForce"] = timeInForce
+		req.Price = price // Limit order only
 	}
-
-	if execInst != "" {
-		params["execInst"] = execInst
-	}
-
-	order, response, err = b.client.OrderApi.OrderNew(b.ctx, symbol, params)
-	if err != nil {
-		// >= 300 代表有错误
-		// 400 Bad Request
-		// 503
-		// log.Printf("response.StatusCode: %v", response.StatusCode)
-		return
-	}
-	b.onResponse(response)
-	return
+	return b.orders().PlaceOrder(req)
 }
 
 // PlaceOrder 放置委托单
@@ -359,49 +331,30 @@ func (b *BitMEX) PlaceOrder(side string, ordType string, stopPx float64, price f
 // execInst: MarkPrice = 标记价格 IndexPrice = 指数价格 LastPrice = 最新成交 ParticipateDoNotInitiate = 被动委托
 func (b *BitMEX) PlaceOrder2(side string, ordType string, stopPx float64, price float64, orderQty int32,
 	displayQty int32, timeInForce string, execInst string, symbol string, clOrdID string, text string) (order swagger.Order, err error) {
-	var response *http.Response
-
-	params := map[string]interface{}{}
-	if clOrdID != "" {
-		params["clOrdID"] = clOrdID // 客户端委托ID
+	req := OrderRequest{
+		Symbol:      symbol,
+		Side:        side,
+		OrdType:     ordType,
+		OrderQty:    float32(orderQty),
+		TimeInForce: timeInForce,
+		ExecInst:    execInst,
+		ClOrdID:     clOrdID, // 客户端委托ID
+		Text:        text,
 	}
-	params["symbol"] = symbol
-	params["side"] = side
-	params["ordType"] = ordType
-	params["orderQty"] = float32(orderQty)
 	if displayQty >= 0 {
-		params["displayQty"] = float32(displayQty)
+		qty := float32(displayQty)
+		req.DisplayQty = &qty
 	}
 	if stopPx > 0.0 {
-		params["stopPx"] = stopPx
+		req.StopPx = stopPx
 	}
 	if price > 0.0 {
-		params["price"] = price // Limit order only
+		req.Price = price // Limit order only
 	}
-	if text == "" {
-		params["text"] = `open with bitmex api`
-	} else {
-		params["text"] = text
+	if req.Text == "" {
+		req.Text = `open with bitmex api`
 	}
-
-	if timeInForce != "" { // "FillOrKill"	// 全数执行或立刻取消
-		params["timeInForce"] = timeInForce
-	}
-
-	if execInst != "" {
-		params["execInst"] = execInst
-	}
-
-	order, response, err = b.client.OrderApi.OrderNew(b.ctx, symbol, params)
-	if err != nil {
-		// >= 300 代表有错误
-		// 400 Bad Request
-		// 503
-		// log.Printf("response.StatusCode: %v", response.StatusCode)
-		return
-	}
-	b.onResponse(response)
-	return
+	return b.orders().PlaceOrder(req)
 }
 
 func (b *BitMEX) GetOrder(oid string, symbol string) (order swagger.Order, err error) {
@@ -447,74 +400,70 @@ func (b *BitMEX) GetOrderByClOrdID(clOrdID string, symbol string) (order swagger
 }
 
 func (b *BitMEX) AmendOrder(oid string, price float64) (order swagger.Order, err error) {
-	var response *http.Response
+	return b.orders().AmendOrder(AmendRequest{OrderID: oid, Price: price})
+}
 
-	params := map[string]interface{}{}
-	params["orderID"] = oid
-	params["price"] = price
+func (b *BitMEX) AmendOrder2(orderID string, origClOrdID string, clOrdID string, simpleOrderQty float64, orderQty float32, simpleLeavesQty float64, leavesQty float32, price float64, stopPx float64, pegOffsetValue float64, text string) (order swagger.Order, err error) {
+	return b.orders().AmendOrder(AmendRequest{
+		OrderID:         orderID,
+		OrigClOrdID:     origClOrdID,
+		ClOrdID:         clOrdID,
+		SimpleOrderQty:  simpleOrderQty,
+		OrderQty:        orderQty,
+		SimpleLeavesQty: simpleLeavesQty,
+		LeavesQty:       leavesQty,
+		Price:           price,
+		StopPx:          stopPx,
+		PegOffsetValue:  pegOffsetValue,
+		Text:            text,
+	})
+}
+
+func (b *BitMEX) CancelAllOrders(symbol string) (orders []swagger.Order, err error) {
+	return b.orders().CancelAll(CancelAllRequest{Symbol: symbol, Text: "cancel order with bitmex api"})
+}
 
-	order, response, err = b.client.OrderApi.OrderAmend(b.ctx, params)
+func (b *BitMEX) CancelOrder(oid string) (order swagger.Order, err error) {
+	var orders []swagger.Order
+	orders, err = b.orders().CancelOrder(CancelRequest{OrderID: oid, Text: "cancel order with bitmex api"})
 	if err != nil {
 		return
 	}
-	b.onResponse(response)
+	if len(orders) != 1 {
+		err = errors.New("order error")
+		return
+	}
+	order = orders[0]
 	return
 }
 
-func (b *BitMEX) AmendOrder2(orderID string, origClOrdID string, clOrdID string, simpleOrderQty float64, orderQty float32, simpleLeavesQty float64, leavesQty float32, price float64, stopPx float64, pegOffsetValue float64, text string) (order swagger.Order, err error) {
-	var response *http.Response
-
-	params := map[string]interface{}{}
-	if orderID != "" {
-		params["orderID"] = orderID
-	}
-	if origClOrdID != "" {
-		params["origClOrdID"] = origClOrdID
-	}
-	if clOrdID != "" {
-		params["clOrdID"] = clOrdID
-	}
-	if simpleOrderQty != 0 {
-		params["simpleOrderQty"] = simpleOrderQty
-	}
-	if orderQty != 0 {
-		params["orderQty"] = orderQty
-	}
-	if simpleLeavesQty != 0 {
-		params["simpleLeavesQty"] = simpleLeavesQty
-	}
-	if leavesQty != 0 {
-		params["leavesQty"] = leavesQty
-	}
-	if price != 0 {
-		params["price"] = price
-	}
-	if stopPx != 0 {
-		params["stopPx"] = stopPx
-	}
-	if pegOffsetValue != 0 {
-		params["pegOffsetValue"] = pegOffsetValue
+func (b *BitMEX) CloseOrder(side string, ordType string, price float64, orderQty int32, postOnly bool, timeInForce string, symbol string) (order swagger.Order, err error) {
+	req := OrderRequest{
+		Symbol:      symbol,
+		Side:        side,
+		OrdType:     ordType,
+		OrderQty:    float32(orderQty),
+		TimeInForce: timeInForce, //timeInForce := "FillOrKill"	// 全数执行或立刻取消
+		ExecInst:    "Close",
+		Text:        `close with bitmex api`,
 	}
-	if text != "" {
-		params["text"] = text
+	if price > 0.0 {
+		req.Price = price // Limit order only
 	}
-
-	order, response, err = b.client.OrderApi.OrderAmend(b.ctx, params)
-	if err != nil {
-		return
+	if postOnly {
+		req.ExecInst += ",ParticipateDoNotInitiate"
 	}
-	b.onResponse(response)
-	return
+	return b.orders().PlaceOrder(req)
 }
 
-func (b *BitMEX) CancelAllOrders(symbol string) (orders []swagger.Order, err error) {
+func (b *BitMEX) GetInstrument(symbol string, count int, reverse bool) (result []swagger.Instrument, err error) {
 	var response *http.Response
 
 	params := map[string]interface{}{}
 	params["symbol"] = symbol
-	params["text"] = "cancel order with bitmex api"
-
-	orders, response, err = b.client.OrderApi.OrderCancelAll(b.ctx, params)
+	params["count"] = float32(count)
+	params["reverse"] = reverse
+	result, response, err = b.client.InstrumentApi.InstrumentGet(params)
 	if err != nil {
 		return
 	}
@@ -522,70 +471,67 @@ func (b *BitMEX) CancelAllOrders(symbol string) (orders []swagger.Order, err err
 	return
 }
 
-func (b *BitMEX) CancelOrder(oid string) (order swagger.Order, err error) {
+// GetActiveInstruments 所有活跃合约
+func (b *BitMEX) GetActiveInstruments() (result []swagger.Instrument, err error) {
 	var response *http.Response
-	var orders []swagger.Order
 
-	params := map[string]interface{}{}
-	params["orderID"] = oid
-	params["text"] = "cancel order with bitmex api"
-
-	orders, response, err = b.client.OrderApi.OrderCancel(b.ctx, params)
+	result, response, err = b.client.InstrumentApi.InstrumentGetActive()
 	if err != nil {
 		return
 	}
-	if len(orders) != 1 {
-		err = errors.New("order error")
-		return
-	}
-	order = orders[0]
-	b.onResponse(response)
+	b.onResponsePublic(response)
 	return
 }
 
-func (b *BitMEX) CloseOrder(side string, ordType string, price float64, orderQty int32, postOnly bool, timeInForce string, symbol string) (order swagger.Order, err error) {
+// GetTrades 最近成交
+func (b *BitMEX) GetTrades(symbol string, count int, reverse bool, startTime time.Time, endTime time.Time) (result []swagger.Trade, err error) {
 	var response *http.Response
 
 	params := map[string]interface{}{}
-	params["symbol"] = symbol
-	params["side"] = side
-	params["ordType"] = ordType
-	params["orderQty"] = float32(orderQty)
-	if price > 0.0 {
-		params["price"] = price // Limit order only
+	if symbol != "" {
+		params["symbol"] = symbol
 	}
-	params["text"] = `close with bitmex api`
-
-	//timeInForce := "FillOrKill"	// 全数执行或立刻取消
-	if timeInForce != "" {
-		params["timeInForce"] = timeInForce
+	if count > 0 {
+		params["count"] = float32(count)
 	}
-
-	execInst := "Close"
-	if postOnly {
-		execInst += ",ParticipateDoNotInitiate"
+	params["reverse"] = reverse
+	if !startTime.IsZero() {
+		params["startTime"] = startTime
 	}
-	params["execInst"] = execInst
-	order, response, err = b.client.OrderApi.OrderNew(b.ctx, symbol, params)
+	if !endTime.IsZero() {
+		params["endTime"] = endTime
+	}
+	result, response, err = b.client.TradeApi.TradeGet(params)
 	if err != nil {
 		return
 	}
-	b.onResponse(response)
+	b.onResponsePublic(response)
 	return
 }
 
-func (b *BitMEX) GetInstrument(symbol string, count int, reverse bool) (result []swagger.Instrument, err error) {
+// GetFundingHistory 资金费率历史
+func (b *BitMEX) GetFundingHistory(symbol string, count int, reverse bool, startTime time.Time, endTime time.Time) (result []swagger.Funding, err error) {
 	var response *http.Response
 
 	params := map[string]interface{}{}
-	params["symbol"] = symbol
-	params["count"] = float32(count)
+	if symbol != "" {
+		params["symbol"] = symbol
+	}
+	if count > 0 {
+		params["count"] = float32(count)
+	}
 	params["reverse"] = reverse
-	result, response, err = b.client.InstrumentApi.InstrumentGet(params)
+	if !startTime.IsZero() {
+		params["startTime"] = startTime
+	}
+	if !endTime.IsZero() {
+		params["endTime"] = endTime
+	}
+	result, response, err = b.client.FundingApi.FundingGet(params)
 	if err != nil {
 		return
 	}
-	b.onResponse(response)
+	b.onResponsePublic(response)
 	return
 }
 
@@ -637,6 +583,9 @@ func (b *BitMEX) onResponsePublic(response *http.Response) {
 	if xReset != "" {
 		b.rateLimitPublic.Reset, _ = strconv.ParseInt(xReset, 10, 64)
 	}
+	if m := b.getMetrics(); m != nil {
+		m.SetRateLimit("public", b.rateLimitPublic)
+	}
 }
 
 func (b *BitMEX) onResponse(response *http.Response) {
@@ -656,4 +605,7 @@ func (b *BitMEX) onResponse(response *http.Response) {
 	if xReset != "" {
 		b.rateLimit.Reset, _ = strconv.ParseInt(xReset, 10, 64)
 	}
+	if m := b.getMetrics(); m != nil {
+		m.SetRateLimit("private", b.rateLimit)
+	}
 }
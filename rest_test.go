@@ -2,15 +2,18 @@ package bitmex
 
 import (
 	"math"
+	"net/http"
 	"testing"
 	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
 )
 
 func TestBitMEX_GetVersion(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, _ := newBitmexForTest(t)
 	version, _, err := bitmex.GetVersion()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
 	now := time.Now().UnixNano() / 1000000
@@ -24,202 +27,297 @@ func TestBitMEX_GetVersion(t *testing.T) {
 }
 
 func TestBitMEX_GetOrderBookL2(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "GET", "/orderBook/L2", "orderbook_l2.json")
+	srv.SetRateLimit(60, 42, 1554709447)
+
 	orderBookL2, err := bitmex.getOrderBookL2(5, "XBTUSD")
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if len(orderBookL2) != 6 {
+		t.Errorf("orderbook error %v", orderBookL2)
+	}
+	req, _ := srv.LastRequest("GET", "/orderBook/L2")
+	if p := req.Params(); p["symbol"] != "XBTUSD" || p["depth"] != "5" {
+		t.Errorf("params error %v", p)
+	}
+	rateLimit := bitmex.GetRateLimitPublic()
+	if rateLimit.Remaining != 42 || rateLimit.Reset != 1554709447 {
+		t.Errorf("RateLimit error %v", rateLimit)
 	}
-	t.Log(orderBookL2)
-	rateLimit := bitmex.GetRateLimit()
-	t.Logf("RateLimit: %v", rateLimit)
 }
 
 func TestBitMEX_GetOrderBook(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "GET", "/orderBook/L2", "orderbook_l2.json")
+
 	orderBook, err := bitmex.GetOrderBook(5, "XBTUSD")
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if !orderBook.Valid() {
+		t.Fatalf("orderbook error %v", orderBook)
+	}
+	if orderBook.Ask() != 8999 || orderBook.Bid() != 8998.5 {
+		t.Errorf("ask/bid error %v/%v", orderBook.Ask(), orderBook.Bid())
+	}
+	if orderBook.Asks[2].Price != 9000 || orderBook.Bids[2].Price != 8997.5 {
+		t.Errorf("sort error %v", orderBook)
 	}
-	t.Log(orderBook)
 }
 
 func TestBitMEX_GetBucketed(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "GET", "/trade/bucketed", "trade_bucketed.json")
+
 	startTime := time.Now().Add(-time.Minute * 8).UTC()
 	var endTime time.Time
 	data, err := bitmex.GetBucketed("XBTUSD", "1m", false, "", "", 10, 0, false, startTime, endTime)
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data[1].Close != 9001.5 {
+		t.Errorf("data error %#v", data)
 	}
-	t.Logf("%#v", data)
-	for _, v := range data {
-		t.Logf("Timestamp=%v Open=%v High=%v Low=%v Close=%v", v.Timestamp.Local(), v.Open, v.High, v.Low, v.Close)
+	req, _ := srv.LastRequest("GET", "/trade/bucketed")
+	if p := req.Params(); p["binSize"] != "1m" || p["symbol"] != "XBTUSD" || p["startTime"] == "" {
+		t.Errorf("params error %v", p)
 	}
 }
 
 func TestBitMEX_GetOrders(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "GET", "/order", "orders.json").Private()
+
 	orders, err := bitmex.GetOrders("XBTUSD")
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
-	t.Log(orders)
+	if len(orders) != 2 {
+		t.Errorf("orders error %v", orders)
+	}
+	req, _ := srv.LastRequest("GET", "/order")
+	if p := req.Params(); p["filter"] != `{"open":true}` {
+		t.Errorf("filter error %v", p)
+	}
+	if len(srv.AuthErrors()) != 0 {
+		t.Error(srv.AuthErrors())
+	}
+}
+
+func TestBitMEX_GetOrdersConcurrent(t *testing.T) {
+	bitmex, srv := newBitmexForTest(t)
+	route := handleFixture(t, srv, "GET", "/order", "orders.json").Private()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			if _, err := bitmex.GetOrders("XBTUSD"); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	// hits are read while the server answers
+	waitFor(t, "hits", func() bool { return route.Hits() == 5 })
+	<-done
 }
 
 func TestBitMEX_GetWallet(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "GET", "/user/wallet", "wallet.json").Private()
+
 	wallet, err := bitmex.GetWallet()
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
 	// XBt
-	t.Logf("%#v", wallet)
+	if wallet.Currency != "XBt" || wallet.Amount != 100000000 {
+		t.Errorf("wallet error %#v", wallet)
+	}
 }
 
 func TestBitMEX_GetMargin(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "GET", "/user/margin", "margin.json").Private()
+
 	margin, err := bitmex.GetMargin()
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if margin.AvailableMargin != 99450000 {
+		t.Errorf("margin error %#v", margin)
 	}
-	t.Logf("%#v", margin)
 }
 
 func TestBitMEX_GetPositions(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "GET", "/position", "position.json").Private()
+
 	positions, err := bitmex.GetPositions("XBTUSD")
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if len(positions) != 1 || positions[0].CurrentQty != 100 {
+		t.Errorf("positions error %v", positions)
 	}
-	t.Log(positions)
 }
 
 func TestBitMEX_PositionUpdateLeverage(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	srv.HandleFunc("POST", "/position/leverage", func(req bitmextest.Request) (int, interface{}) {
+		return 200, `{"symbol":"XBTUSD","leverage":` + req.Params()["leverage"] + `,"currentQty":100}`
+	}).Private()
+
 	leverage := 2.0
 	position, err := bitmex.PositionUpdateLeverage(leverage, "XBTUSD")
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
-
-	t.Logf("%#v", position)
-
 	if position.Leverage != leverage {
-		t.Error("Leverage error")
-		return
+		t.Errorf("Leverage error %#v", position)
 	}
 }
 
 func TestBitMEX_NewOrder(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "POST", "/order", "order.json").Private()
+
 	price := 3000.0
 	order, err := bitmex.NewOrder(SIDE_BUY, ORD_TYPE_LIMIT, price, 20, true, "", "XBTUSD")
 	if err != nil {
-		// 403 Forbidden
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
 	if order.Symbol != "XBTUSD" {
 		t.Errorf("symbol error [%v]", order.Symbol)
-		return
 	}
 	if order.Price != price {
 		t.Errorf("price error [%v]", order.Price)
-		return
 	}
-	t.Logf("%#v", order)
+	req, _ := srv.LastRequest("POST", "/order")
+	p := req.Params()
+	if p["side"] != SIDE_BUY || p["ordType"] != ORD_TYPE_LIMIT || p["orderQty"] != "20" ||
+		p["price"] != "3000" || p["execInst"] != "ParticipateDoNotInitiate" {
+		t.Errorf("params error %v", p)
+	}
+}
+
+func TestBitMEX_NewOrderError(t *testing.T) {
+	bitmex, srv := newBitmexForTest(t)
+	srv.HandleError("POST", "/order", http.StatusBadRequest, "ValidationError", "Account has insufficient Available Balance")
+
+	_, err := bitmex.NewOrder(SIDE_BUY, ORD_TYPE_LIMIT, 3000, 20, true, "", "XBTUSD")
+	if err == nil {
+		t.Error("expect 400 Bad Request")
+	}
 }
 
 func TestBitMEX_CancelOrder(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
 	oid := `e4c72847-93f9-0304-d666-5f7d6ceb3ade`
+	srv.HandleFunc("DELETE", "/order", func(req bitmextest.Request) (int, interface{}) {
+		if req.Params()["orderID"] != oid {
+			return http.StatusBadRequest, `{"error":{"message":"Unable to cancel order","name":"HTTPError"}}`
+		}
+		return 200, `[{"orderID":"` + oid + `","symbol":"XBTUSD","ordStatus":"Canceled"}]`
+	}).Private()
+
 	order, err := bitmex.CancelOrder(oid)
 	if err != nil {
-		// 400 Bad Request
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if order.OrderID != oid || order.OrdStatus != OS_CANCELED {
+		t.Errorf("order error %#v", order)
+	}
+	if _, err = bitmex.CancelOrder("unknown"); err == nil {
+		t.Error("expect 400 Bad Request")
 	}
-	t.Logf("%#v", order)
 }
 
 func TestBitMEX_CancelAllOrders(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "DELETE", "/order/all", "orders.json").Private()
+
 	orders, err := bitmex.CancelAllOrders("XBTUSD")
 	if err != nil {
-		// 400 Bad Request
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if len(orders) != 2 {
+		t.Errorf("orders error %v", orders)
 	}
-	t.Logf("%#v", orders)
 }
 
 func TestBitMEX_AmendOrder(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
 	oid := `a17d25a3-6149-3edf-d196-75cc775beb29`
+	srv.HandleFunc("PUT", "/order", func(req bitmextest.Request) (int, interface{}) {
+		p := req.Params()
+		return 200, `{"orderID":"` + p["orderID"] + `","symbol":"XBTUSD","price":` + p["price"] + `}`
+	}).Private()
+
 	newPrice := 3001.0
 	order, err := bitmex.AmendOrder(oid, newPrice)
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
-	if order.Price != newPrice {
-		t.Error("price error")
-		return
+	if order.OrderID != oid || order.Price != newPrice {
+		t.Errorf("order error %#v", order)
 	}
-	t.Logf("%#v", order)
 }
 
 func TestBitMEX_CloseOrder(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	srv.HandleFunc("POST", "/order", func(req bitmextest.Request) (int, interface{}) {
+		p := req.Params()
+		return 200, `{"orderID":"f31997b8-809c-1ce2-20ef-9ce5fba4886c","symbol":"` + p["symbol"] +
+			`","side":"` + p["side"] + `","price":` + p["price"] + `,"execInst":"` + p["execInst"] + `"}`
+	}).Private()
+
 	price := 6000.0
 	order, err := bitmex.CloseOrder(SIDE_SELL, ORD_TYPE_LIMIT, price, 20, true, "", "XBTUSD")
 	if err != nil {
-		// 403 Forbidden
-		t.Error(err)
-		return
+		t.Fatal(err)
 	}
 	if order.Symbol != "XBTUSD" {
 		t.Errorf("symbol error [%v]", order.Symbol)
-		return
 	}
 	if order.Price != price {
 		t.Errorf("price error [%v]", order.Price)
-		return
 	}
-	t.Logf("%#v", order)
+	if order.ExecInst != "Close,ParticipateDoNotInitiate" {
+		t.Errorf("execInst error [%v]", order.ExecInst)
+	}
 }
 
 func TestBitMEX_RequestWithdrawal(t *testing.T) {
-	bitmex := newBitmexForTest2()
+	bitmex, srv := newBitmexForTest2(t)
+	srv.Handle("POST", "/user/requestWithdrawal", 200, `{"transactID":"d6b0da34-0aad-4a39-9cf3-1e3c8f4f4a0c"}`).Private()
+
 	currency := "XBt"
 	amount := float32(1000000.0)
 	address := "3BMEXT9XuBTSkALWTovH1idLSC2tusjKBT"
 	optToken := ""
 	fee := 0.0
 	// 401 Unauthorized
-	trans, err := bitmex.RequestWithdrawal(currency, amount, address, optToken, fee)
-	if err != nil {
-		t.Error(err)
-		return
+	_, err := bitmex.RequestWithdrawal(currency, amount, address, optToken, fee)
+	if err == nil {
+		t.Error("expect 401 Unauthorized")
+	}
+	if len(srv.AuthErrors()) != 1 {
+		t.Errorf("auth errors %v", srv.AuthErrors())
 	}
-	t.Logf("%#v", trans)
 }
 
 func TestBitMEX_GetInstrument(t *testing.T) {
-	bitmex := newBitmexForTest()
+	bitmex, srv := newBitmexForTest(t)
+	handleFixture(t, srv, "GET", "/instrument", "instrument.json")
+
 	i, err := bitmex.GetInstrument("XBTUSD", 1, true)
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	if len(i) != 1 || i[0].FundingRate != 0.0001 {
+		t.Errorf("instrument error %#v", i)
 	}
-	t.Logf("%#v", i)
-	t.Logf("FundingRate: %v", i[0].FundingRate)
 }
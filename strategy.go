@@ -0,0 +1,82 @@
+package bitmex
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// Strategy receives market data and order updates. A strategy places orders
+// through the Trader it was created with, so the same code runs live with
+// RunStrategy and offline with the backtest package.
+type Strategy interface {
+	OnTrade(trades []*swagger.Trade)
+	OnBook(symbol string, ob OrderBook)
+	OnOrderUpdate(orders []*swagger.Order)
+	OnTimer(now time.Time)
+}
+
+// Trader is the order entry a Strategy uses, implemented by *BitMEX and backtest.Engine
+type Trader interface {
+	PlaceOrder(side string, ordType string, stopPx float64, price float64, orderQty int32, timeInForce string, execInst string, symbol string) (swagger.Order, error)
+	AmendOrder(oid string, price float64) (swagger.Order, error)
+	CancelOrder(oid string) (swagger.Order, error)
+	CancelAllOrders(symbol string) ([]swagger.Order, error)
+	GetOrders(symbol string) ([]swagger.Order, error)
+	GetPosition(symbol string) (swagger.Position, error)
+}
+
+var _ Trader = (*BitMEX)(nil)
+
+// RunStrategy feeds s from the websocket until ctx is done, OnTimer is called
+// every timerInterval when it is positive. Subscribe to trade, order and the
+// book of the BookMode, BookMode.Subscription, before StartWS. Callbacks never
+// run concurrently, like in a backtest. Run one strategy per client, stopping
+// it removes the listeners it added.
+func (b *BitMEX) RunStrategy(ctx context.Context, s Strategy, timerInterval time.Duration) error {
+	var mu sync.Mutex
+
+	onTrade := func(trades []*swagger.Trade, action string) {
+		mu.Lock()
+		defer mu.Unlock()
+		s.OnTrade(trades)
+	}
+	onBook := func(ob OrderBook, symbol string) {
+		mu.Lock()
+		defer mu.Unlock()
+		s.OnBook(symbol, ob)
+	}
+	onOrder := func(orders []*swagger.Order, action string) {
+		mu.Lock()
+		defer mu.Unlock()
+		s.OnOrderUpdate(orders)
+	}
+
+	b.On(BitmexWSTrade, onTrade)
+	b.On(BitmexBook, onBook)
+	b.On(BitmexWSOrder, onOrder)
+	defer func() {
+		b.Off(BitmexWSTrade, onTrade)
+		b.Off(BitmexBook, onBook)
+		b.Off(BitmexWSOrder, onOrder)
+	}()
+
+	var timer <-chan time.Time
+	if timerInterval > 0 {
+		t := time.NewTicker(timerInterval)
+		defer t.Stop()
+		timer = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-timer:
+			mu.Lock()
+			s.OnTimer(now)
+			mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package bitmex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+type chanStrategy struct {
+	trades chan []*swagger.Trade
+	timers chan time.Time
+}
+
+func (s *chanStrategy) OnTrade(trades []*swagger.Trade)       { s.trades <- trades }
+func (s *chanStrategy) OnBook(symbol string, ob OrderBook)    {}
+func (s *chanStrategy) OnOrderUpdate(orders []*swagger.Order) {}
+func (s *chanStrategy) OnTimer(now time.Time)                 { s.timers <- now }
+
+func TestBitMEX_RunStrategy(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	srv.Script(bitmextest.ScriptOnSubscribe("trade:XBTUSD"),
+		`{"table":"trade","action":"insert","data":[{"timestamp":"2019-04-09T08:15:12.704Z","symbol":"XBTUSD","side":"Buy","size":10,"price":9000}]}`)
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSTrade, Param: "XBTUSD"}})
+
+	s := &chanStrategy{trades: make(chan []*swagger.Trade, 16), timers: make(chan time.Time, 16)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- b.RunStrategy(ctx, s, 50*time.Millisecond)
+	}()
+
+	startWS(t, b)
+
+	select {
+	case trades := <-s.trades:
+		if len(trades) != 1 || trades[0].Price != 9000 {
+			t.Errorf("trades error %#v", trades)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no trade")
+	}
+	select {
+	case <-s.timers:
+	case <-time.After(time.Second):
+		t.Error("no timer")
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+}
@@ -180,6 +180,9 @@ func parameterToString(obj interface{}, collectionFormat string) string {
 
 // callAPI do the request.
 func (c *APIClient) callAPI(request *http.Request) (*http.Response, error) {
+	if c.cfg.Tracer != nil {
+		return c.tracedCall(c.cfg.Tracer, request)
+	}
 	return c.cfg.HTTPClient.Do(request)
 }
 
@@ -341,7 +344,12 @@ func (c *APIClient) prepareRequest(
 		localVarRequest.Header.Del("Api-Signature")
 
 		// APIKey Authentication
-		if auth, ok := ctx.Value(ContextAPIKey).(APIKey); ok {
+		if c.cfg.Signer != nil {
+			body, _ := postBody.(string)
+			if err = SignRequest(localVarRequest, c.cfg.Signer, c.cfg, method, path, body, queryParams); err != nil {
+				return nil, err
+			}
+		} else if auth, ok := ctx.Value(ContextAPIKey).(APIKey); ok {
 			if postBody != nil {
 				SetAuthHeader(localVarRequest, auth, c.cfg, method, path, postBody.(string), queryParams)
 			} else {
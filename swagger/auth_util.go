@@ -4,6 +4,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
@@ -14,27 +15,76 @@ import (
 	"time"
 )
 
+// apiPathRe takes the signed path out of a url
+var apiPathRe = regexp.MustCompile("/api.*")
+
 func SetAuthHeader(request *http.Request, apiKey APIKey, c *Configuration, httpMethod, path, postBody string,
 	queryParams url.Values) {
-	var expires = strconv.FormatInt(time.Now().Unix()+c.ExpireTime, 10)
+	var expires = strconv.FormatInt(c.now().Unix()+c.ExpireTime, 10)
 	request.Header.Add("api-key", apiKey.Key)
 	request.Header.Add("api-expires", expires)
-	p := regexp.MustCompile("/api.*").FindString(path)
+	p := apiPathRe.FindString(path)
 	request.Header.Add("api-signature", Signature(apiKey.Secret, httpMethod, p, queryParams.Encode(),
 		expires, postBody))
 }
 
+// Signer signs requests in place of an APIKey, so that the secret can live
+// outside of the process or change between requests
+type Signer interface {
+	// Sign returns the api key id and the hex hmac-sha256 of payload made with its secret
+	Sign(payload string) (key string, signature string, err error)
+}
+
+// SignRequest is SetAuthHeader with a Signer
+func SignRequest(request *http.Request, signer Signer, c *Configuration, httpMethod, path, postBody string,
+	queryParams url.Values) error {
+	var expires = strconv.FormatInt(c.now().Unix()+c.ExpireTime, 10)
+	p := apiPathRe.FindString(path)
+	key, signature, err := signer.Sign(SignaturePayload(httpMethod, p, queryParams.Encode(), expires, postBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Add("api-key", key)
+	request.Header.Add("api-expires", expires)
+	request.Header.Add("api-signature", signature)
+	return nil
+}
+
+// Errors of VerifyRequest
+var (
+	ErrRequestExpired   = errors.New("request expired")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// VerifyRequest checks the api-expires and api-signature headers of a request
+// signed with secret, the one of its api-key, like BitMEX does. It's the check
+// of the test and paper servers.
+func VerifyRequest(r *http.Request, secret string, body string, now time.Time) error {
+	expires := r.Header.Get("api-expires")
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || exp < now.Unix() {
+		return ErrRequestExpired
+	}
+	path := apiPathRe.FindString(r.URL.Path)
+	if Signature(secret, r.Method, path, r.URL.RawQuery, expires, body) != r.Header.Get("api-signature") {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
 /**
  *  nonce: nonce or expires
  */
 func Signature(apiSecret, method, path, query, nonce, bodyStr string) string {
-	str := ""
+	return CalSignature(apiSecret, SignaturePayload(method, path, query, nonce, bodyStr))
+}
+
+// SignaturePayload is the string a request signature is computed over
+func SignaturePayload(method, path, query, nonce, bodyStr string) string {
 	if "" == query {
-		str = strings.ToUpper(method) + path + nonce + bodyStr
-	} else {
-		str = strings.ToUpper(method) + path + "?" + query + nonce + bodyStr
+		return strings.ToUpper(method) + path + nonce + bodyStr
 	}
-	return CalSignature(apiSecret, str)
+	return strings.ToUpper(method) + path + "?" + query + nonce + bodyStr
 }
 
 func CalSignature(apiSecret, payload string) string {
@@ -12,6 +12,7 @@ package swagger
 
 import (
 	"net/http"
+	"time"
 )
 
 const ContextOAuth2 int = 1
@@ -39,8 +40,13 @@ type Configuration struct {
 	DefaultHeader map[string]string `json:"defaultHeader,omitempty"`
 	UserAgent     string            `json:"userAgent,omitempty"`
 	HTTPClient    *http.Client
+	Tracer        Tracer
+	// Signer signs private requests instead of the APIKey in the context
+	Signer Signer
 
 	ExpireTime int64
+	// Clock is the server time used for api-expires, nil for the local clock
+	Clock func() time.Time
 }
 
 func NewConfiguration() *Configuration {
@@ -53,6 +59,13 @@ func NewConfiguration() *Configuration {
 	return cfg
 }
 
+func (c *Configuration) now() time.Time {
+	if c.Clock != nil {
+		return c.Clock()
+	}
+	return time.Now()
+}
+
 func (c *Configuration) AddDefaultHeader(key string, value string) {
 	c.DefaultHeader[key] = value
 }
@@ -0,0 +1,133 @@
+package swagger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Tracer starts a span per api call when set in Configuration. It may
+// return the request with a new context, e.g. to inject propagation headers.
+type Tracer interface {
+	Start(req *http.Request, name string) (*http.Request, Span)
+}
+
+// Span is the part of a tracing span the client uses
+type Span interface {
+	SetAttribute(key string, value interface{})
+	// End finishes the span, err is non nil for failed requests and error responses
+	End(err error)
+}
+
+// Span attributes set by callAPI
+const (
+	AttrMethod             = "http.method"
+	AttrStatusCode         = "http.status_code"
+	AttrEndpoint           = "bitmex.endpoint"
+	AttrRateLimitLimit     = "bitmex.ratelimit.limit"
+	AttrRateLimitRemaining = "bitmex.ratelimit.remaining"
+	AttrRateLimitReset     = "bitmex.ratelimit.reset"
+	AttrErrorName          = "bitmex.error.name"
+	AttrErrorMessage       = "bitmex.error.message"
+	AttrOrderID            = "bitmex.order_id"  // comma separated for bulk requests
+	AttrClOrdID            = "bitmex.cl_ord_id" // comma separated for bulk requests
+)
+
+// Endpoint strips the base path, /api/v1/order/all -> /order/all, it's the
+// endpoint of spans and metrics
+func Endpoint(path string) string {
+	if i := strings.Index(path, "/api/v1"); i >= 0 {
+		path = path[i+len("/api/v1"):]
+	}
+	if path == "" {
+		path = "/"
+	}
+	return path
+}
+
+// tracedCall is callAPI with a span
+func (c *APIClient) tracedCall(tracer Tracer, request *http.Request) (*http.Response, error) {
+	ep := Endpoint(request.URL.Path)
+	request, span := tracer.Start(request, "bitmex "+request.Method+" "+ep)
+	if span == nil {
+		return c.cfg.HTTPClient.Do(request)
+	}
+	span.SetAttribute(AttrMethod, request.Method)
+	span.SetAttribute(AttrEndpoint, ep)
+
+	resp, err := c.cfg.HTTPClient.Do(request)
+	if err != nil {
+		span.End(err)
+		return resp, err
+	}
+	span.SetAttribute(AttrStatusCode, resp.StatusCode)
+	for attr, header := range map[string]string{
+		AttrRateLimitLimit:     "X-Ratelimit-Limit",
+		AttrRateLimitRemaining: "X-Ratelimit-Remaining",
+		AttrRateLimitReset:     "X-Ratelimit-Reset",
+	} {
+		if v, err := strconv.ParseInt(resp.Header.Get(header), 10, 64); err == nil {
+			span.SetAttribute(attr, v)
+		}
+	}
+
+	isOrder := strings.HasPrefix(ep, "/order")
+	if resp.StatusCode < 300 && !isOrder {
+		span.End(nil)
+		return resp, nil
+	}
+
+	// the body is read here and put back for the caller
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		span.End(err)
+		return resp, nil
+	}
+
+	if resp.StatusCode >= 300 {
+		var e ModelError
+		if json.Unmarshal(body, &e) == nil && e.Error_ != nil {
+			span.SetAttribute(AttrErrorName, e.Error_.Name)
+			span.SetAttribute(AttrErrorMessage, e.Error_.Message)
+		}
+		span.End(fmt.Errorf("%v", resp.Status))
+		return resp, nil
+	}
+
+	type ids struct {
+		OrderID string `json:"orderID"`
+		ClOrdID string `json:"clOrdID"`
+	}
+	var orders []ids
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		json.Unmarshal(body, &orders)
+	} else {
+		var order ids
+		if json.Unmarshal(body, &order) == nil {
+			orders = append(orders, order)
+		}
+	}
+	var orderIDs, clOrdIDs []string
+	for _, o := range orders {
+		if o.OrderID != "" {
+			orderIDs = append(orderIDs, o.OrderID)
+		}
+		if o.ClOrdID != "" {
+			clOrdIDs = append(clOrdIDs, o.ClOrdID)
+		}
+	}
+	if len(orderIDs) > 0 {
+		span.SetAttribute(AttrOrderID, strings.Join(orderIDs, ","))
+	}
+	if len(clOrdIDs) > 0 {
+		span.SetAttribute(AttrClOrdID, strings.Join(clOrdIDs, ","))
+	}
+	span.End(nil)
+	return resp, nil
+}
@@ -0,0 +1,98 @@
+package bitmex
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// wsAuthExpires is how far ahead of the server time authKeyExpires is
+const wsAuthExpires = 60 * time.Second
+
+// TimeSync keeps the offset of the BitMEX clock to the local one, api-expires
+// and the ws authKeyExpires nonce are computed from the server time so that a
+// drifting host clock doesn't get "This request has expired".
+//
+// GetVersion measures the offset with a millisecond timestamp, every rest
+// response also checks it against its Date header, which is only precise to
+// the second.
+type TimeSync struct {
+	mu      sync.RWMutex
+	offset  time.Duration // server - local
+	rtt     time.Duration
+	updated time.Time
+}
+
+// Now returns the estimated server time
+func (ts *TimeSync) Now() time.Time {
+	return time.Now().Add(ts.Offset())
+}
+
+// Offset returns the measured clock skew, positive when the server is ahead
+func (ts *TimeSync) Offset() time.Duration {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.offset
+}
+
+// RTT returns the round trip time of the last measurement
+func (ts *TimeSync) RTT() time.Duration {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.rtt
+}
+
+// Updated returns when the offset was last measured, zero if never
+func (ts *TimeSync) Updated() time.Time {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.updated
+}
+
+// observe sets the offset from a server timestamp taken half way through a request
+func (ts *TimeSync) observe(sent time.Time, received time.Time, server time.Time) {
+	rtt := received.Sub(sent)
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.offset = server.Sub(sent.Add(rtt / 2))
+	ts.rtt = rtt
+	ts.updated = received
+}
+
+// observeDate corrects the offset when the Date header of a response disagrees
+// with it by more than its truncation and the round trip allow
+func (ts *TimeSync) observeDate(sent time.Time, received time.Time, date string) {
+	server, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	rtt := received.Sub(sent)
+	// the server time was in [server, server+1s) somewhere between sent and received
+	lo := server.Sub(received)
+	hi := server.Add(time.Second).Sub(sent)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if !ts.updated.IsZero() && ts.offset >= lo && ts.offset <= hi {
+		return
+	}
+	ts.offset = (lo + hi) / 2
+	ts.rtt = rtt
+	ts.updated = received
+}
+
+// TimeSync returns the clock skew tracker of the client
+func (b *BitMEX) TimeSync() *TimeSync {
+	return b.timeSync
+}
+
+// SyncTime measures the clock skew with GetVersion
+func (b *BitMEX) SyncTime() error {
+	_, _, err := b.GetVersion()
+	return err
+}
+
+// now is the server time
+func (b *BitMEX) now() time.Time {
+	return b.timeSync.Now()
+}
@@ -0,0 +1,77 @@
+package bitmex
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBitMEX_SyncTime(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	srv.SetClockOffset(30 * time.Second)
+	handleFixture(t, srv, "GET", "/order", "orders.json").Private()
+
+	// signed with the local clock, then corrected by the Date header
+	if _, err := b.GetOrders("XBTUSD"); err == nil {
+		t.Fatal("expect expired")
+	}
+	if d := b.TimeSync().Offset() - 30*time.Second; d < -time.Second || d > time.Second {
+		t.Errorf("offset from Date %v", b.TimeSync().Offset())
+	}
+	if _, err := b.GetOrders("XBTUSD"); err != nil {
+		t.Fatalf("%v, auth errors %v", err, srv.AuthErrors())
+	}
+
+	if err := b.SyncTime(); err != nil {
+		t.Fatal(err)
+	}
+	ts := b.TimeSync()
+	if d := ts.Offset() - 30*time.Second; d < -50*time.Millisecond || d > 50*time.Millisecond {
+		t.Errorf("offset from version %v", ts.Offset())
+	}
+	if ts.RTT() <= 0 || ts.Updated().IsZero() {
+		t.Errorf("rtt %v updated %v", ts.RTT(), ts.Updated())
+	}
+
+	// the precise offset is within the Date window, kept
+	offset := ts.Offset()
+	b.GetOrders("XBTUSD")
+	if ts.Offset() != offset {
+		t.Errorf("offset changed to %v", ts.Offset())
+	}
+
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrder, Param: "XBTUSD"}})
+	startWS(t, b)
+	if !srv.WaitWSMessage("subscribe", 5*time.Second) {
+		t.Fatal("not subscribed")
+	}
+	if errs := srv.AuthErrors(); len(errs) != 1 {
+		t.Errorf("auth errors %v", errs)
+	}
+}
+
+func TestTimeSync_ObserveDate(t *testing.T) {
+	ts := &TimeSync{}
+	sent := time.Date(2019, 4, 9, 10, 0, 0, 0, time.UTC)
+	received := sent.Add(200 * time.Millisecond)
+	date := sent.Add(-10 * time.Second).Format(http.TimeFormat)
+
+	ts.observeDate(sent, received, date)
+	if ts.Offset() < -10200*time.Millisecond || ts.Offset() > -9*time.Second {
+		t.Errorf("offset %v", ts.Offset())
+	}
+	if ts.RTT() != 200*time.Millisecond {
+		t.Errorf("rtt %v", ts.RTT())
+	}
+
+	ts.observe(sent, received, sent.Add(-9500*time.Millisecond))
+	ts.observeDate(sent, received, date)
+	if ts.Offset() != -9600*time.Millisecond {
+		t.Errorf("precise offset replaced by %v", ts.Offset())
+	}
+
+	ts.observeDate(sent, received, "garbage")
+	if ts.Offset() != -9600*time.Millisecond {
+		t.Errorf("offset %v", ts.Offset())
+	}
+}
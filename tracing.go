@@ -0,0 +1,242 @@
+package bitmex
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+// Tracer gets a span per rest call, and a span per ws order event following
+// an order placement, linked to the placing span. The linked spans start when
+// the order was submitted, so their duration is submit-to-ack or submit-to-fill.
+//
+// The module doesn't depend on a tracing library, the README has an
+// OpenTelemetry adapter to copy.
+type Tracer interface {
+	swagger.Tracer
+	// RecordLinked records a finished span, link is a span returned by Start
+	RecordLinked(name string, start time.Time, end time.Time, link swagger.Span, attrs map[string]interface{})
+}
+
+// Linked span names
+const (
+	SpanOrderAck  = "bitmex order ack"
+	SpanOrderFill = "bitmex order fill"
+)
+
+// Linked span attributes, besides swagger.AttrOrderID and swagger.AttrClOrdID
+const (
+	AttrOrdStatus = "bitmex.ord_status"
+	AttrLastQty   = "bitmex.last_qty"
+	AttrLastPx    = "bitmex.last_px"
+	AttrLeavesQty = "bitmex.leaves_qty"
+)
+
+const (
+	// ws events for orders we haven't seen placed yet are kept this long,
+	// the ws often beats the rest response
+	earlyEventTTL = 10 * time.Second
+	// placements without a terminal status are dropped after
+	placementTTL = time.Hour
+)
+
+// SetTracer enables tracing, nil disables it
+func (b *BitMEX) SetTracer(t Tracer) {
+	b.orderTracer.mu.Lock()
+	defer b.orderTracer.mu.Unlock()
+	b.orderTracer.tracer = t
+}
+
+type placement struct {
+	span  swagger.Span
+	start time.Time
+	acked bool
+}
+
+type earlyEvent struct {
+	name  string
+	at    time.Time
+	attrs map[string]interface{}
+}
+
+// orderTracer is the swagger.Tracer of the client, it remembers order placements
+type orderTracer struct {
+	mu         sync.Mutex
+	tracer     Tracer
+	placements map[string]*placement // orderID or clOrdID
+	early      map[string][]earlyEvent
+}
+
+func newOrderTracer() *orderTracer {
+	return &orderTracer{
+		placements: make(map[string]*placement),
+		early:      make(map[string][]earlyEvent),
+	}
+}
+
+func (ot *orderTracer) getTracer() Tracer {
+	ot.mu.Lock()
+	defer ot.mu.Unlock()
+	return ot.tracer
+}
+
+// Start implements swagger.Tracer
+func (ot *orderTracer) Start(req *http.Request, name string) (*http.Request, swagger.Span) {
+	t := ot.getTracer()
+	if t == nil {
+		return req, nil
+	}
+	start := time.Now()
+	req, span := t.Start(req, name)
+	if span == nil || req.Method != http.MethodPost {
+		return req, span
+	}
+	switch swagger.Endpoint(req.URL.Path) {
+	case "/order", "/order/bulk":
+		return req, &placementSpan{Span: span, ot: ot, start: start}
+	}
+	return req, span
+}
+
+// placementSpan registers the order ids callAPI reads from the response
+type placementSpan struct {
+	swagger.Span
+	ot    *orderTracer
+	start time.Time
+}
+
+func (s *placementSpan) SetAttribute(key string, value interface{}) {
+	s.Span.SetAttribute(key, value)
+	if key != swagger.AttrOrderID && key != swagger.AttrClOrdID {
+		return
+	}
+	ids, _ := value.(string)
+	for _, id := range strings.Split(ids, ",") {
+		if id != "" {
+			s.ot.register(id, &placement{span: s.Span, start: s.start})
+		}
+	}
+}
+
+func (ot *orderTracer) register(id string, p *placement) {
+	ot.mu.Lock()
+	t := ot.tracer
+	if len(ot.placements) > 1000 {
+		for k, old := range ot.placements {
+			if time.Since(old.start) > placementTTL {
+				delete(ot.placements, k)
+			}
+		}
+	}
+	ot.placements[id] = p
+	events := ot.early[id]
+	delete(ot.early, id)
+	for _, e := range events {
+		if e.name == SpanOrderAck {
+			p.acked = true
+		}
+	}
+	ot.mu.Unlock()
+
+	if t == nil {
+		return
+	}
+	for _, e := range events {
+		t.RecordLinked(e.name, p.start, e.at, p.span, e.attrs)
+	}
+}
+
+// record finds the placement of an order and records a linked span, or keeps
+// the event until the placement shows up. done drops the placement.
+func (ot *orderTracer) record(name string, orderID string, clOrdID string, attrs map[string]interface{}, done bool) {
+	now := time.Now()
+	ot.mu.Lock()
+	t := ot.tracer
+	if t == nil {
+		ot.mu.Unlock()
+		return
+	}
+	var p *placement
+	for _, id := range []string{orderID, clOrdID} {
+		if id == "" {
+			continue
+		}
+		if p = ot.placements[id]; p != nil {
+			break
+		}
+	}
+	if p == nil {
+		for k, events := range ot.early {
+			if now.Sub(events[0].at) > earlyEventTTL {
+				delete(ot.early, k)
+			}
+		}
+		for _, id := range []string{orderID, clOrdID} {
+			if id != "" {
+				ot.early[id] = append(ot.early[id], earlyEvent{name: name, at: now, attrs: attrs})
+			}
+		}
+		ot.mu.Unlock()
+		return
+	}
+	if name == SpanOrderAck {
+		if p.acked {
+			name = ""
+		}
+		p.acked = true
+	}
+	if done {
+		delete(ot.placements, orderID)
+		delete(ot.placements, clOrdID)
+	}
+	ot.mu.Unlock()
+
+	if name != "" {
+		t.RecordLinked(name, p.start, now, p.span, attrs)
+	}
+}
+
+func isTerminal(ordStatus string) bool {
+	switch ordStatus {
+	case OS_FILLED, OS_CANCELED, OS_REJECTED:
+		return true
+	}
+	return false
+}
+
+// traceOrders records the first ws sight of an order as its ack
+func (b *BitMEX) traceOrders(orders []*swagger.Order) {
+	if b.orderTracer.getTracer() == nil {
+		return
+	}
+	for _, o := range orders {
+		b.orderTracer.record(SpanOrderAck, o.OrderID, o.ClOrdID, map[string]interface{}{
+			swagger.AttrOrderID: o.OrderID,
+			swagger.AttrClOrdID: o.ClOrdID,
+			AttrOrdStatus:       o.OrdStatus,
+		}, isTerminal(o.OrdStatus))
+	}
+}
+
+// traceExecutions records fills
+func (b *BitMEX) traceExecutions(executions []*swagger.Execution) {
+	if b.orderTracer.getTracer() == nil {
+		return
+	}
+	for _, e := range executions {
+		if e.ExecType != "Trade" {
+			continue
+		}
+		b.orderTracer.record(SpanOrderFill, e.OrderID, e.ClOrdID, map[string]interface{}{
+			swagger.AttrOrderID: e.OrderID,
+			swagger.AttrClOrdID: e.ClOrdID,
+			AttrOrdStatus:       e.OrdStatus,
+			AttrLastQty:         e.LastQty,
+			AttrLastPx:          e.LastPx,
+			AttrLeavesQty:       e.LeavesQty,
+		}, isTerminal(e.OrdStatus))
+	}
+}
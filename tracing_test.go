@@ -0,0 +1,180 @@
+package bitmex
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/swagger"
+)
+
+const testOrderID = "e4c72847-93f9-0304-d666-5f7d6ceb3ade" // testdata/order.json
+
+type fakeSpan struct {
+	name  string
+	attrs map[string]interface{}
+	err   error
+	ended bool
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+
+func (s *fakeSpan) End(err error) {
+	s.err = err
+	s.ended = true
+}
+
+type linkedSpan struct {
+	name       string
+	start, end time.Time
+	link       swagger.Span
+	attrs      map[string]interface{}
+}
+
+type fakeTracer struct {
+	mu     sync.Mutex
+	spans  []*fakeSpan
+	linked []linkedSpan
+}
+
+func (t *fakeTracer) Start(req *http.Request, name string) (*http.Request, swagger.Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	span := &fakeSpan{name: name, attrs: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return req, span
+}
+
+func (t *fakeTracer) RecordLinked(name string, start time.Time, end time.Time, link swagger.Span, attrs map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.linked = append(t.linked, linkedSpan{name: name, start: start, end: end, link: link, attrs: attrs})
+}
+
+func (t *fakeTracer) waitLinked(tb testing.TB, n int) []linkedSpan {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		t.mu.Lock()
+		linked := append([]linkedSpan(nil), t.linked...)
+		t.mu.Unlock()
+		if len(linked) >= n {
+			return linked
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("got %d linked spans, want %d", len(linked), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBitMEX_TraceREST(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	tracer := &fakeTracer{}
+	b.SetTracer(tracer)
+	srv.SetRateLimit(60, 58, 1554800000)
+	handleFixture(t, srv, "GET", "/order", "orders.json")
+	srv.HandleError("POST", "/order", 400, "ValidationError", "Account has insufficient Available Balance")
+
+	if _, err := b.GetOrders("XBTUSD"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.NewOrder(SIDE_BUY, ORD_TYPE_LIMIT, 9000, 10, true, "", "XBTUSD"); err == nil {
+		t.Fatal("expect error")
+	}
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("got %d spans", len(tracer.spans))
+	}
+	get, post := tracer.spans[0], tracer.spans[1]
+	if get.name != "bitmex GET /order" || !get.ended || get.err != nil {
+		t.Errorf("bad span %+v", get)
+	}
+	if get.attrs[swagger.AttrStatusCode] != 200 || get.attrs[swagger.AttrRateLimitRemaining] != int64(58) {
+		t.Errorf("bad attributes %v", get.attrs)
+	}
+	if post.name != "bitmex POST /order" || post.err == nil {
+		t.Errorf("bad span %+v", post)
+	}
+	if post.attrs[swagger.AttrErrorName] != "ValidationError" || post.attrs[swagger.AttrStatusCode] != 400 {
+		t.Errorf("bad attributes %v", post.attrs)
+	}
+
+	// disabled
+	b.SetTracer(nil)
+	b.GetOrders("XBTUSD")
+	if len(tracer.spans) != 2 {
+		t.Error("traced after SetTracer(nil)")
+	}
+}
+
+func TestBitMEX_TraceOrderAckAndFill(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	tracer := &fakeTracer{}
+	b.SetTracer(tracer)
+	handleFixture(t, srv, "POST", "/order", "order.json")
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrder, Param: "XBTUSD"}, {Op: BitmexWSExecution, Param: "XBTUSD"}})
+
+	startWS(t, b)
+	if !srv.WaitWSMessage("subscribe", 5*time.Second) {
+		t.Fatal("not subscribed")
+	}
+
+	submitted := time.Now()
+	if _, err := b.NewOrder(SIDE_BUY, ORD_TYPE_LIMIT, 9000, 10, true, "", "XBTUSD"); err != nil {
+		t.Fatal(err)
+	}
+	placing := tracer.spans[0]
+	if placing.attrs[swagger.AttrOrderID] != testOrderID {
+		t.Fatalf("order id not set %v", placing.attrs)
+	}
+
+	srv.Push(fmt.Sprintf(`{"table":"order","action":"insert","data":[{"orderID":"%v","symbol":"XBTUSD","ordStatus":"New","orderQty":10,"price":9000}]}`, testOrderID))
+	srv.Push(fmt.Sprintf(`{"table":"order","action":"update","data":[{"orderID":"%v","symbol":"XBTUSD","ordStatus":"PartiallyFilled"}]}`, testOrderID))
+	srv.Push(fmt.Sprintf(`{"table":"execution","action":"insert","data":[{"execID":"1","orderID":"%v","symbol":"XBTUSD","execType":"Trade","ordStatus":"Filled","lastQty":10,"lastPx":9000,"leavesQty":0}]}`, testOrderID))
+
+	linked := tracer.waitLinked(t, 2)
+	ack, fill := linked[0], linked[1]
+	if ack.name != SpanOrderAck || fill.name != SpanOrderFill {
+		t.Fatalf("got %v, %v", ack.name, fill.name)
+	}
+	for _, s := range linked {
+		if s.link != placing || s.start.Before(submitted) || s.end.Before(s.start) {
+			t.Errorf("bad linked span %+v", s)
+		}
+	}
+	if fill.attrs[AttrLastPx] != 9000.0 || fill.attrs[AttrLeavesQty] != float32(0) {
+		t.Errorf("bad fill attributes %v", fill.attrs)
+	}
+
+	// filled orders are forgotten
+	b.orderTracer.mu.Lock()
+	n := len(b.orderTracer.placements)
+	b.orderTracer.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d placements left", n)
+	}
+}
+
+func TestOrderTracer_EarlyAck(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	tracer := &fakeTracer{}
+	b.SetTracer(tracer)
+	handleFixture(t, srv, "POST", "/order", "order.json")
+
+	// the ws ack beats the rest response
+	b.traceOrders([]*swagger.Order{{OrderID: testOrderID, OrdStatus: OS_NEW}})
+	if _, err := b.NewOrder(SIDE_BUY, ORD_TYPE_LIMIT, 9000, 10, true, "", "XBTUSD"); err != nil {
+		t.Fatal(err)
+	}
+	linked := tracer.waitLinked(t, 1)
+	if linked[0].name != SpanOrderAck || linked[0].link != tracer.spans[0] {
+		t.Errorf("bad linked span %+v", linked[0])
+	}
+	b.traceOrders([]*swagger.Order{{OrderID: testOrderID, OrdStatus: OS_NEW}})
+	if len(tracer.linked) != 1 {
+		t.Error("acked twice")
+	}
+}
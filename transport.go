@@ -0,0 +1,291 @@
+package bitmex
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransportConfig is the rest transport of SetTransport
+type TransportConfig struct {
+	DialTimeout           time.Duration // tcp connect
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration // request written to response headers, 0 for none
+	RequestTimeout        time.Duration // the whole request, body included, 0 for none
+	TCPKeepAlive          time.Duration // probes of idle connections
+	IdleConnTimeout       time.Duration // idle connections are closed after
+	MaxIdleConnsPerHost   int
+	Nagle                 bool // enables Nagle, Go disables it on every tcp connection
+	// HTTP2 multiplexes every request on one connection, a slow response then
+	// holds up the others, WarmConns warms that one connection
+	HTTP2        bool
+	TLSConfig    *tls.Config   // copied, a session cache is added if it has none
+	WarmConns    int           // connections WarmUp opens and KeepWarm keeps
+	WarmInterval time.Duration // of KeepWarm, below the idle timeout of the server
+}
+
+// LowLatencyTransport keeps a few HTTP/1.1 connections and the TLS sessions
+// of the rest host warm, a request fails after 10s but a dead host after 3s
+func LowLatencyTransport() TransportConfig {
+	return TransportConfig{
+		DialTimeout:         3 * time.Second,
+		TLSHandshakeTimeout: 3 * time.Second,
+		RequestTimeout:      10 * time.Second,
+		TCPKeepAlive:        15 * time.Second,
+		IdleConnTimeout:     5 * time.Minute,
+		MaxIdleConnsPerHost: 16,
+		WarmConns:           4,
+		WarmInterval:        20 * time.Second,
+	}
+}
+
+func (c TransportConfig) transport(conns *connTracker) *http.Transport {
+	dialer := &net.Dialer{Timeout: c.DialTimeout, KeepAlive: c.TCPKeepAlive}
+	tlsConfig := &tls.Config{}
+	if c.TLSConfig != nil {
+		tlsConfig = c.TLSConfig.Clone()
+	}
+	if tlsConfig.ClientSessionCache == nil {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: conns.wrap(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if tcp, ok := conn.(*net.TCPConn); ok && c.Nagle {
+				tcp.SetNoDelay(false)
+			}
+			return conn, err
+		}),
+		ForceAttemptHTTP2:     c.HTTP2,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+	}
+	if !c.HTTP2 {
+		// non-nil disables the upgrade
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return tr
+}
+
+// SetTransport replaces the rest client by one with a tuned transport, see
+// LowLatencyTransport. A proxy or dialer set before still applies, the
+// dialer replaces the one of c.
+func (b *BitMEX) SetTransport(c TransportConfig) {
+	b.transport = c
+	b.timeout = c.RequestTimeout
+	b.warmConns = newConnTracker()
+	b.baseClient = &http.Client{Transport: c.transport(b.warmConns), Timeout: c.RequestTimeout}
+	b.applyTransport() // can't fail, the transport is an *http.Transport
+}
+
+// WarmUp sends a GET request on every open connection to the rest host, and
+// opens new ones, TLS sessions included, up to WarmConns
+func (b *BitMEX) WarmUp(ctx context.Context) error {
+	return b.warmIdle(ctx, 0)
+}
+
+// KeepWarm sends a GET request every WarmInterval, 20s by default, on each
+// connection idle for half of it, so that neither side closes it, and opens
+// connections again up to WarmConns, until ctx is done:
+//
+//	go b.KeepWarm(ctx)
+//
+// Every request counts against the public rate limit of the ip, one per
+// idle connection per WarmInterval and none while orders keep the
+// connections busy. Without SetTransport the connections aren't known,
+// WarmConns are sent.
+func (b *BitMEX) KeepWarm(ctx context.Context) error {
+	interval := b.transport.WarmInterval
+	if interval <= 0 {
+		interval = LowLatencyTransport().WarmInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if err := b.warmIdle(ctx, interval/2); err != nil && ctx.Err() == nil {
+			b.log().Warn("rest warm up", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// warmIdle probes the connections unused for idle, and opens the missing
+// ones of WarmConns. The transport hands out the most recently used idle
+// connection first, so each probe holds its connection, its body unread,
+// until the cold ones have all been taken out of the pool.
+func (b *BitMEX) warmIdle(ctx context.Context, idle time.Duration) error {
+	want := b.transport.WarmConns
+	if want < 1 {
+		want = 1
+	}
+	var held []*http.Response
+	defer func() {
+		for _, resp := range held {
+			// any status will do, the connection is reused once the body is read
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}()
+
+	if b.warmConns == nil {
+		for i := 0; i < want; i++ {
+			resp, _, err := b.warmRequest(ctx)
+			if err != nil {
+				return err
+			}
+			held = append(held, resp)
+		}
+		return nil
+	}
+
+	open, cold := b.warmConns.cold(time.Now().Add(-idle))
+	missing := want - open
+	if missing < 0 {
+		missing = 0
+	}
+	// a cold connection closed meanwhile is replaced by one new connection
+	for dialed := 0; len(cold) > 0 || dialed < missing; {
+		resp, conn, err := b.warmRequest(ctx)
+		if err != nil {
+			return err
+		}
+		held = append(held, resp)
+		if _, ok := cold[conn]; ok {
+			delete(cold, conn)
+		} else if conn == nil || b.warmConns.isNew(conn) {
+			if dialed++; dialed > missing {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// warmRequest sends a probe, the caller reads and closes the body. conn is
+// the tracked connection it went over, if any.
+func (b *BitMEX) warmRequest(ctx context.Context) (resp *http.Response, conn *trackedConn, err error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c := info.Conn
+			if tc, ok := c.(*tls.Conn); ok {
+				c = tc.NetConn()
+			}
+			conn, _ = c.(*trackedConn)
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, b.cfg.BasePath+"/", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err = b.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	// unsigned, it counts against the public limit of the ip
+	b.onResponsePublic(resp)
+	return resp, conn, nil
+}
+
+// connTracker knows when each rest connection was last read or written
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+	seen  map[*trackedConn]struct{} // open at the last cold
+}
+
+type trackedConn struct {
+	used int64 // unix nanoseconds, atomic, first for the alignment on 32 bit
+	net.Conn
+	tracker *connTracker
+	once    sync.Once
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[*trackedConn]struct{})}
+}
+
+// wrap tracks the connections of dial, a nil tracker returns dial
+func (t *connTracker) wrap(dial DialContextFunc) DialContextFunc {
+	if t == nil {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := &trackedConn{Conn: conn, tracker: t}
+		c.touch()
+		t.mu.Lock()
+		t.conns[c] = struct{}{}
+		t.mu.Unlock()
+		return c, nil
+	}
+}
+
+// cold returns the number of open connections and those last used before since
+func (t *connTracker) cold(since time.Time) (open int, cold map[*trackedConn]struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seen = make(map[*trackedConn]struct{}, len(t.conns))
+	cold = make(map[*trackedConn]struct{})
+	for c := range t.conns {
+		t.seen[c] = struct{}{}
+		if atomic.LoadInt64(&c.used) < since.UnixNano() {
+			cold[c] = struct{}{}
+		}
+	}
+	return len(t.conns), cold
+}
+
+// isNew reports whether c was dialed since the last cold
+func (t *connTracker) isNew(c *trackedConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.seen[c]
+	return !ok
+}
+
+func (c *trackedConn) touch() {
+	atomic.StoreInt64(&c.used, time.Now().UnixNano())
+}
+
+// Read touches once data came, the transport keeps a Read blocked on idle
+// connections
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	c.touch()
+	return c.Conn.Write(p)
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.tracker.mu.Lock()
+		delete(c.tracker.conns, c)
+		c.tracker.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
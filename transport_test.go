@@ -0,0 +1,248 @@
+package bitmex
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
+)
+
+// newTLSBitmexForTest talks to a https server on a clone of the default
+// transport, trusting its certificate
+func newTLSBitmexForTest(t testing.TB) (*BitMEX, *bitmextest.Server) {
+	srv := bitmextest.NewTLSServer()
+	srv.RequireAuth(testKey, testSecret)
+	t.Cleanup(srv.Close)
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = serverTLSConfig(srv)
+	b := New(&http.Client{Transport: tr, Timeout: 10 * time.Second}, HostTestnet, testKey, testSecret, false)
+	b.SetLogger(NopLogger)
+	b.SetBasePath(srv.BasePath)
+	return b, srv
+}
+
+func serverTLSConfig(srv *bitmextest.Server) *tls.Config {
+	return srv.Client().Transport.(*http.Transport).TLSClientConfig
+}
+
+func newTunedBitmexForTest(t testing.TB, cfg TransportConfig) (*BitMEX, *bitmextest.Server) {
+	b, srv := newTLSBitmexForTest(t)
+	cfg.TLSConfig = serverTLSConfig(srv)
+	b.SetTransport(cfg)
+	return b, srv
+}
+
+func TestBitMEX_SetTransport(t *testing.T) {
+	b, srv := newTunedBitmexForTest(t, LowLatencyTransport())
+	handleFixture(t, srv, "GET", "/order", "orders.json").Private()
+	if err := b.WarmUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	warm := srv.Conns()
+	if warm != 4 {
+		t.Errorf("%d warm connections", warm)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := b.GetOrders("XBTUSD"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if srv.Conns() != warm {
+		t.Errorf("%d connections after %d warm", srv.Conns(), warm)
+	}
+	req, _ := srv.LastRequest("GET", "/order")
+	// the warm connections after the first resumed its tls session
+	if req.Proto != "HTTP/1.1" {
+		t.Errorf("proto %v", req.Proto)
+	}
+
+	// a new connection resumes the tls session
+	b.baseClient.Transport.(*http.Transport).CloseIdleConnections()
+	if _, err := b.GetOrders("XBTUSD"); err != nil {
+		t.Fatal(err)
+	}
+	if req, _ = srv.LastRequest("GET", "/order"); !req.Resume {
+		t.Error("tls session not resumed")
+	}
+}
+
+func TestBitMEX_SetTransportTimeout(t *testing.T) {
+	cfg := LowLatencyTransport()
+	cfg.RequestTimeout = 100 * time.Millisecond
+	b, srv := newTunedBitmexForTest(t, cfg)
+	srv.HandleFunc("GET", "/order", func(r bitmextest.Request) (int, interface{}) {
+		time.Sleep(300 * time.Millisecond)
+		return 200, []interface{}{}
+	})
+	if _, err := b.GetOrders("XBTUSD"); err == nil || !strings.Contains(err.Error(), "Timeout") {
+		t.Errorf("got %v", err)
+	}
+	if b.httpClient.Timeout != cfg.RequestTimeout {
+		t.Errorf("timeout %v", b.httpClient.Timeout)
+	}
+}
+
+func TestBitMEX_KeepWarm(t *testing.T) {
+	cfg := LowLatencyTransport()
+	cfg.WarmConns = 2
+	cfg.WarmInterval = 20 * time.Millisecond
+	b, srv := newTunedBitmexForTest(t, cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	if err := b.KeepWarm(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v", err)
+	}
+	var heads int
+	for _, req := range srv.Requests() {
+		if req.Method == "GET" && strings.TrimSuffix(req.Path, "/") == "/api/v1" {
+			heads++
+		}
+	}
+	if heads < 6 || srv.Conns() > 2 {
+		t.Errorf("%d warm requests on %d connections", heads, srv.Conns())
+	}
+}
+
+func TestBitMEX_KeepWarmBusy(t *testing.T) {
+	cfg := LowLatencyTransport()
+	cfg.WarmConns = 1
+	cfg.WarmInterval = 100 * time.Millisecond
+	b, srv := newTunedBitmexForTest(t, cfg)
+	handleFixture(t, srv, "GET", "/order", "orders.json").Private()
+	srv.SetRateLimit(300, 299, 1)
+
+	heads := func() (n int) {
+		for _, req := range srv.Requests() {
+			if req.Method == "GET" && strings.TrimSuffix(req.Path, "/") == "/api/v1" {
+				n++
+			}
+		}
+		return
+	}
+	if err := b.WarmUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rl := b.GetRateLimitPublic(); heads() != 1 || rl.Remaining != 299 {
+		t.Fatalf("%d warm requests, rate limit %+v", heads(), rl)
+	}
+
+	// the orders keep the connection warm
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- b.KeepWarm(ctx)
+	}()
+	for ctx.Err() == nil {
+		if _, err := b.GetOrders("XBTUSD"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	<-done
+	if heads() != 1 || srv.Conns() != 1 {
+		t.Errorf("%d warm requests on %d connections", heads(), srv.Conns())
+	}
+}
+
+func TestBitMEX_KeepWarmCold(t *testing.T) {
+	cfg := LowLatencyTransport()
+	cfg.WarmConns = 3
+	b, srv := newTunedBitmexForTest(t, cfg)
+	handleFixture(t, srv, "GET", "/order", "orders.json").Private()
+	if err := b.WarmUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Conns() != 3 {
+		t.Fatalf("%d connections", srv.Conns())
+	}
+
+	// all gone cold, then an order warms the most recently used one
+	before := make(map[*trackedConn]int64)
+	b.warmConns.mu.Lock()
+	for c := range b.warmConns.conns {
+		atomic.StoreInt64(&c.used, time.Now().Add(-time.Minute).UnixNano())
+		before[c] = atomic.LoadInt64(&c.used)
+	}
+	b.warmConns.mu.Unlock()
+	if _, err := b.GetOrders("XBTUSD"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.warmIdle(context.Background(), 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	b.warmConns.mu.Lock()
+	defer b.warmConns.mu.Unlock()
+	for c := range b.warmConns.conns {
+		if used := atomic.LoadInt64(&c.used); used <= before[c] || time.Since(time.Unix(0, used)) > time.Second {
+			t.Errorf("connection not warmed, last used %v ago", time.Since(time.Unix(0, used)))
+		}
+	}
+	if len(b.warmConns.conns) != 3 || srv.Conns() != 3 {
+		t.Errorf("%d connections", srv.Conns())
+	}
+}
+
+// BenchmarkRESTLatency measures signed GET /order against a local TLS server,
+// ns/op is the mean, p50/p90/p99 the distribution
+func BenchmarkRESTLatency(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		setup func(client *BitMEX, srv *bitmextest.Server)
+	}{
+		{"new connection", func(client *BitMEX, srv *bitmextest.Server) {
+			client.baseClient.Transport.(*http.Transport).DisableKeepAlives = true
+		}},
+		{"default", func(client *BitMEX, srv *bitmextest.Server) {}},
+		{"low latency", func(client *BitMEX, srv *bitmextest.Server) {
+			cfg := LowLatencyTransport()
+			cfg.TLSConfig = serverTLSConfig(srv)
+			client.SetTransport(cfg)
+		}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			client, srv := newTLSBitmexForTest(b)
+			handleFixture(b, srv, "GET", "/order", "orders.json").Private()
+			bc.setup(client, srv)
+			if err := client.WarmUp(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+
+			latencies := make([]time.Duration, 0, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if _, err := client.GetOrders("XBTUSD"); err != nil {
+					b.Fatal(err)
+				}
+				latencies = append(latencies, time.Since(start))
+			}
+			b.StopTimer()
+			reportPercentiles(b, latencies)
+			b.ReportMetric(float64(srv.Conns()), "conns")
+		})
+	}
+}
+
+func reportPercentiles(b *testing.B, latencies []time.Duration) {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, p := range []struct {
+		unit string
+		q    float64
+	}{
+		{"p50-ns", 0.5},
+		{"p90-ns", 0.9},
+		{"p99-ns", 0.99},
+	} {
+		i := int(p.q * float64(len(latencies)-1))
+		b.ReportMetric(float64(latencies[i]), p.unit)
+	}
+}
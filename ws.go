@@ -1,17 +1,18 @@
 package bitmex
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/frankrap/bitmex-api/swagger"
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 	"github.com/tidwall/gjson"
-	"log"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -64,6 +65,7 @@ type SubscribeInfo struct {
 type WSCmd struct {
 	Command string        `json:"op"`
 	Args    []interface{} `json:"args"`
+	ID      string        `json:"id,omitempty"` // echoed in the response, see request
 }
 
 type Response struct {
@@ -73,100 +75,18 @@ type Response struct {
 	Table     string      `json:"table,omitempty"`
 	Action    string      `json:"action,omitempty"`
 	Data      interface{} `json:"data,omitempty"`
-}
 
-func decodeMessage(message []byte) (Response, error) {
-	var res Response
-	err := json.Unmarshal(message, &res)
-	if err != nil {
-		return res, err
-	}
+	rows *orderBookRows // pooled Data of orderBookL2 frames, see release
+}
 
-	ret := gjson.ParseBytes(message)
+// WSError is an error response of the realtime api
+type WSError struct {
+	Status  int
+	Message string
+}
 
-	if ret.Get("table").Exists() {
-		raw := ret.Get("data").Raw
-		switch res.Table {
-		case BitmexWSInstrument:
-			var instruments []*swagger.Instrument
-			err = json.Unmarshal([]byte(raw), &instruments)
-			if err != nil {
-				return res, err
-			}
-			res.Data = instruments
-		case BitmexWSOrderBookL2:
-			var orderbooks OrderBookData
-			err = json.Unmarshal([]byte(raw), &orderbooks)
-			if err != nil {
-				return res, err
-			}
-			res.Data = orderbooks
-		case BitmexWSOrderBookL2_25:
-			var orderbooks OrderBookData
-			err = json.Unmarshal([]byte(raw), &orderbooks)
-			if err != nil {
-				return res, err
-			}
-			res.Data = orderbooks
-		case BitmexWSQuote:
-			var quotes []*swagger.Quote
-			err = json.Unmarshal([]byte(raw), &quotes)
-			if err != nil {
-				return res, err
-			}
-			res.Data = quotes
-		case BitmexWSTradeBin1m, BitmexWSTradeBin5m, BitmexWSTradeBin1h, BitmexWSTradeBin1d:
-			var tradeBins []*swagger.TradeBin
-			err = json.Unmarshal([]byte(raw), &tradeBins)
-			if err != nil {
-				return res, err
-			}
-			res.Data = tradeBins
-		case BitmexWSTrade:
-			var trades []*swagger.Trade
-			err = json.Unmarshal([]byte(raw), &trades)
-			if err != nil {
-				return res, err
-			}
-			res.Data = trades
-		case BitmexWSExecution:
-			var executions []*swagger.Execution
-			err = json.Unmarshal([]byte(raw), &executions)
-			if err != nil {
-				return res, err
-			}
-			res.Data = executions
-		case BitmexWSOrder:
-			var orders []*swagger.Order
-			err = json.Unmarshal([]byte(raw), &orders)
-			if err != nil {
-				return res, err
-			}
-			res.Data = orders
-		case BitmexWSMargin:
-			var margins []*swagger.Margin
-			err = json.Unmarshal([]byte(raw), &margins)
-			if err != nil {
-				return res, err
-			}
-			res.Data = margins
-		case BitmexWSPosition:
-			var positions []*swagger.Position
-			err = json.Unmarshal([]byte(raw), &positions)
-			if err != nil {
-				return res, err
-			}
-			res.Data = positions
-		case BitmexWSWallet:
-			var wallets []*swagger.Wallet
-			err = json.Unmarshal([]byte(raw), &wallets)
-			if err != nil {
-				return res, err
-			}
-			res.Data = wallets
-		}
-	}
-	return res, err
+func (e *WSError) Error() string {
+	return fmt.Sprintf("ws error %d: %s", e.Status, e.Message)
 }
 
 func (b *BitMEX) sendWSMessage(msg interface{}) error {
@@ -174,158 +94,362 @@ func (b *BitMEX) sendWSMessage(msg interface{}) error {
 	if err != nil {
 		return errors.Wrap(err, "marshalling WSmessage failed")
 	}
-	log.Println(string(msgs))
+	if logged, err := json.Marshal(redactWSCmd(msg)); err == nil {
+		b.log().Debug("ws send", "msg", logged)
+	}
 
-	err = b.ws.WriteMessage(websocket.TextMessage, msgs)
+	if stream := b.getStream(); stream != nil {
+		err = stream.send(msgs)
+	} else {
+		err = b.ws.WriteMessage(websocket.TextMessage, msgs)
+	}
 	if err != nil {
 		return errors.Wrap(err, "sending WSmessage failed")
 	}
 	return nil
 }
 
+// errRequestTimeout is returned by request when no response came in time,
+// the command may or may not have been executed
+var errRequestTimeout = errors.New("ws request timed out")
+
+// request sends cmd with a new id and waits for the response carrying it.
+// sent is false when cmd never left, the caller may safely retry elsewhere.
+func (b *BitMEX) request(cmd WSCmd, timeout time.Duration) (response []byte, sent bool, err error) {
+	cmd.ID = strconv.FormatInt(atomic.AddInt64(&b.requestSeq, 1), 10)
+	ch := make(chan []byte, 1)
+	b.requestsMutex.Lock()
+	if b.requests == nil {
+		b.requests = make(map[string]chan []byte)
+	}
+	b.requests[cmd.ID] = ch
+	b.requestsMutex.Unlock()
+	defer func() {
+		b.requestsMutex.Lock()
+		delete(b.requests, cmd.ID)
+		b.requestsMutex.Unlock()
+	}()
+
+	if err = b.sendWSMessage(cmd); err != nil {
+		return nil, false, err
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case response = <-ch:
+		return response, true, nil
+	case <-t.C:
+		return nil, true, errRequestTimeout
+	}
+}
+
+// deliver hands a response to the request waiting for id
+func (b *BitMEX) deliver(id string, message []byte) bool {
+	b.requestsMutex.Lock()
+	ch, ok := b.requests[id]
+	b.requestsMutex.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- append([]byte(nil), message...): // the reader reuses message
+	default:
+	}
+	return true
+}
+
 // sendAuth sends an authenticated subscription
 func (b *BitMEX) sendAuth() error {
-	if b.Key == "" || b.Secret == "" {
+	if !b.hasCredentials() {
 		return nil
 	}
-	msg := b.getAuthMessage(b.Key, b.Secret)
-	log.Println("sendAuth")
+	msg, err := b.getAuthMessage()
+	if err != nil {
+		return err
+	}
+	b.log().Debug("ws auth", "key", msg.Args[0])
 	return b.sendWSMessage(msg)
 }
 
-func (b *BitMEX) getAuthMessage(key string, secret string) WSCmd {
-	nonce := time.Now().Unix() + 412
+func (b *BitMEX) getAuthMessage() (WSCmd, error) {
+	nonce := b.now().Add(wsAuthExpires).Unix()
 	req := fmt.Sprintf("GET/realtime%d", nonce)
-	sig := hmac.New(sha256.New, []byte(secret))
-	sig.Write([]byte(req))
-	signature := hex.EncodeToString(sig.Sum(nil))
+	key, signature, err := clientSigner{b}.Sign(req)
+	if err != nil {
+		return WSCmd{}, err
+	}
 	var msgKey []interface{}
 	msgKey = append(msgKey, key)
 	msgKey = append(msgKey, nonce)
 	msgKey = append(msgKey, signature)
 
-	return WSCmd{"authKey", msgKey}
+	return WSCmd{Command: "authKey", Args: msgKey}, nil
+}
+
+// Topic is the subscription argument, e.g. "quote:XBTUSD"
+func (s SubscribeInfo) Topic() string {
+	if s.Param == "" {
+		return s.Op
+	}
+	return s.Op + ":" + s.Param
 }
 
 func (b *BitMEX) Subscribe(subscribeTypes []SubscribeInfo) error {
 	message := WSCmd{}
 	message.Command = "subscribe"
 	for _, v := range subscribeTypes {
-		args := v.Op
-		if v.Param != "" {
-			args += ":" + v.Param
-		}
-		message.Args = append(message.Args, args) // v.Op+":"+v.Param "quote:XBTUSD"
+		message.Args = append(message.Args, v.Topic()) // v.Op+":"+v.Param "quote:XBTUSD"
 	}
+	b.subscribeMutex.Lock()
 	b.subscribeCmd = &message
+	b.subscribeMutex.Unlock()
 	b.subscribeHandler()
 	return nil
 }
 
-func (b *BitMEX) subscribeHandler() error {
+// AddSubscriptions subscribes to more topics, on the open connection without
+// resending the others unlike Subscribe. All are subscribed again on reconnect.
+func (b *BitMEX) AddSubscriptions(subscribeTypes []SubscribeInfo) error {
+	b.subscribeMutex.Lock()
+	var current []interface{}
+	if b.subscribeCmd != nil {
+		current = b.subscribeCmd.Args
+	}
+	message := WSCmd{Command: "subscribe"}
+	args := append([]interface{}(nil), current...)
+	for _, v := range subscribeTypes {
+		if !containsArg(args, v.Topic()) {
+			args = append(args, v.Topic())
+			message.Args = append(message.Args, v.Topic())
+		}
+	}
+	b.subscribeCmd = &WSCmd{Command: "subscribe", Args: args}
+	b.subscribeMutex.Unlock()
+
+	if len(message.Args) == 0 || !b.IsConnected() {
+		return nil
+	}
+	b.log().Info("ws subscribe", "args", message.Args)
+	return b.sendWSMessage(message)
+}
+
+// RemoveSubscriptions unsubscribes from topics
+func (b *BitMEX) RemoveSubscriptions(subscribeTypes []SubscribeInfo) error {
+	b.subscribeMutex.Lock()
+	if b.subscribeCmd == nil {
+		b.subscribeMutex.Unlock()
+		return nil
+	}
+	message := WSCmd{Command: "unsubscribe"}
+	var args []interface{}
+	for _, arg := range b.subscribeCmd.Args {
+		removed := false
+		for _, v := range subscribeTypes {
+			if arg == v.Topic() {
+				removed = true
+			}
+		}
+		if removed {
+			message.Args = append(message.Args, arg)
+		} else {
+			args = append(args, arg)
+		}
+	}
+	b.subscribeCmd = &WSCmd{Command: "subscribe", Args: args}
+	b.subscribeMutex.Unlock()
+
+	if len(message.Args) == 0 || !b.IsConnected() {
+		return nil
+	}
+	b.log().Info("ws unsubscribe", "args", message.Args)
+	return b.sendWSMessage(message)
+}
+
+func containsArg(args []interface{}, topic string) bool {
+	for _, arg := range args {
+		if arg == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptions returns the topics subscribed on (re)connect
+func (b *BitMEX) subscriptions() []interface{} {
+	b.subscribeMutex.Lock()
+	defer b.subscribeMutex.Unlock()
 	if b.subscribeCmd == nil {
 		return nil
 	}
+	return append([]interface{}(nil), b.subscribeCmd.Args...)
+}
+
+func (b *BitMEX) subscribeHandler() error {
+	b.subscribeMutex.Lock()
+	cmd := b.subscribeCmd
+	b.subscribeMutex.Unlock()
+	if cmd == nil {
+		return nil
+	}
 	err := b.sendAuth()
 	if err != nil {
 		return err
 	}
-	log.Printf("subscribe %v", *b.subscribeCmd)
-	return b.sendWSMessage(*b.subscribeCmd)
+	if len(cmd.Args) == 0 {
+		return nil
+	}
+	b.log().Info("ws subscribe", "args", cmd.Args)
+	b.expectSubscribed(cmd.Args)
+	return b.sendWSMessage(*cmd)
 }
 
-// StartWS opens the websocket connection, and waits for message events
-func (b *BitMEX) StartWS() {
-	u := url.URL{Scheme: "wss", Host: b.host, Path: "/realtime"}
-	bitmexWSURL := u.String()
-	b.ws.SetProxyURL(b.proxyURL)
-	b.ws.Dial(bitmexWSURL, nil)
+// StartWS opens the websocket connection and handles its messages until ctx
+// is done or CloseWS. The first connection attempt's error is returned, later
+// disconnects are retried. Done and Wait tell when everything has stopped,
+// StartWS can be called again after that.
+func (b *BitMEX) StartWS(ctx context.Context) error {
+	if b.getStream() != nil {
+		return ErrStreamClient
+	}
+	bitmexWSURL := b.wsURL
+	if bitmexWSURL == "" {
+		u := url.URL{Scheme: "wss", Host: b.host, Path: "/realtime"}
+		bitmexWSURL = u.String()
+	}
+	b.applyWSDialer()
+	if err := b.ws.DialContext(ctx, bitmexWSURL, nil); err != nil {
+		b.log().Error("ws dial", "err", err)
+		return err
+	}
 
+	done := b.ws.Done()
+	b.wsWG.Add(2)
 	go func() {
-		t := time.NewTicker(time.Second * 5)
-		defer t.Stop()
-		for {
-			select {
-			case <-t.C:
-				err := b.ws.WriteMessage(websocket.TextMessage, []byte("ping"))
-				if err != nil {
-					// The connection has disconnected if ping errors
-					// and everything will automatically tear down.
-					log.Printf("%v", err)
-				}
-			}
-		}
+		defer b.wsWG.Done()
+		b.heartbeat.watch(&b.ws, b.log(), done)
 	}()
 
 	go func() {
-		for {
-			messageType, message, err := b.ws.ReadMessage()
+		defer b.wsWG.Done()
+		var buf bytes.Buffer // reused, processMessage copies what it keeps
+		for b.ws.WaitConnected() {
+			_, err := b.ws.ReadMessageTo(&buf)
+			message := buf.Bytes()
 			if err != nil {
-				if b.ws.IsClosed() {
-					log.Println("StartWS done")
-					return
+				if !b.ws.IsClosed() {
+					b.log().Warn("ws read", "err", err)
 				}
-				time.Sleep(500 * time.Millisecond)
-				log.Println("read:", err)
 				continue
 			}
-			if messageType == websocket.TextMessage {
-				if string(message) == "pong" {
-					continue
+			if recorder := b.getRecorder(); recorder != nil {
+				if err := recorder.Record(time.Now(), message); err != nil {
+					b.log().Error("ws record", "err", err)
 				}
 			}
-			resp, err := decodeMessage(message)
-			if err != nil {
-				log.Println("decode:", err)
-				continue
+			if err := b.processMessage(message); err != nil {
+				b.log().Warn("ws decode", "err", err)
 			}
+		}
+		b.log().Info("ws closed")
+	}()
+	return nil
+}
 
-			if resp.Success {
-				if b.debugMode {
-					log.Println(string(message))
-				}
-				continue
-			}
+// Done is closed when the websocket is closed, by CloseWS or the context of StartWS
+func (b *BitMEX) Done() <-chan struct{} {
+	return b.ws.Done()
+}
 
-			switch resp.Table {
-			case BitmexWSInstrument:
-				b.processInstrument(&resp)
-			case BitmexWSOrderBookL2_25:
-				b.processOrderbook25(&resp)
-			case BitmexWSOrderBookL2:
-				b.processOrderbook(&resp)
-			case BitmexWSQuote:
-				b.processQuote(&resp)
-			case BitmexWSTradeBin1m, BitmexWSTradeBin5m, BitmexWSTradeBin1h, BitmexWSTradeBin1d:
-				b.processTradeBin(&resp, resp.Table)
-			case BitmexWSTrade:
-				b.processTrade(&resp)
-			case BitmexWSExecution:
-				b.processExecution(&resp)
-			case BitmexWSOrder:
-				b.processOrder(&resp)
-			case BitmexWSMargin:
-				b.processMargin(&resp)
-			case BitmexWSPosition:
-				b.processPosition(&resp)
-			case BitmexWSWallet:
-				b.processWallet(&resp)
-			default:
-				if resp.Subscribe != "" {
-					if b.debugMode {
-						log.Printf("Subscribe message Msg=%#v", resp)
-					}
-				} else {
-					if b.debugMode {
-						log.Printf("Unknown message Msg=%#v", resp)
-						log.Println("resp:", string(message))
-					}
-				}
+// Wait waits for the websocket goroutines to exit after Done
+func (b *BitMEX) Wait() {
+	b.wsWG.Wait()
+	b.ws.Wait()
+}
+
+// processMessage decodes a raw realtime frame and emits its events
+func (b *BitMEX) processMessage(message []byte) error {
+	if string(message) == "pong" {
+		b.heartbeat.pong(time.Now())
+		return nil
+	}
+	receivedAt := time.Now()
+	m := b.getMetrics()
+	resp, err := decodeMessage(message)
+	if err != nil {
+		if m != nil {
+			m.IncDecodeErrors()
+		}
+		return err
+	}
+	if m != nil {
+		b.observeMessage(m, &resp, message, receivedAt)
+	}
+
+	if resp.Table == "" {
+		if id := gjson.GetBytes(message, "request.id"); id.Exists() && b.deliver(id.String(), message) {
+			return nil
+		}
+
+		if resp.Success {
+			b.log().Debug("ws success", "msg", redactWSReply(message))
+			if resp.Subscribe != "" {
+				b.subscribed(resp.Subscribe)
+			} else if strings.HasPrefix(gjson.GetBytes(message, "request.op").String(), "authKey") {
+				b.ws.SetState(ConnEvent{State: ConnAuthenticated})
 			}
+			return nil
+		}
+		if status := gjson.GetBytes(message, "status"); status.Exists() {
+			err := &WSError{Status: int(status.Int()), Message: gjson.GetBytes(message, "error").String()}
+			b.log().Warn("ws error response", "err", err, "request", gjson.GetBytes(redactWSReply(message), "request").Raw)
+			b.connError(err)
+			return nil
+		}
+	}
+	defer resp.release()
 
-			//log.Println("resp:", resp)
+	if hooks := b.getTableHooks(resp.Table); len(hooks) > 0 {
+		data := []byte(gjson.GetBytes(message, "data").Raw)
+		for _, hook := range hooks {
+			hook.fn(resp.Action, data)
 		}
-	}()
+	}
+
+	switch resp.Table {
+	case BitmexWSInstrument:
+		b.processInstrument(&resp, []byte(gjson.GetBytes(message, "data").Raw))
+	case BitmexWSFunding:
+		b.processFunding(&resp)
+	case BitmexWSOrderBookL2_25:
+		b.processOrderbook25(&resp)
+	case BitmexWSOrderBookL2:
+		b.processOrderbook(&resp)
+	case BitmexWSOrderBook10:
+		b.processOrderBook10(&resp)
+	case BitmexWSQuote:
+		b.processQuote(&resp)
+	case BitmexWSTradeBin1m, BitmexWSTradeBin5m, BitmexWSTradeBin1h, BitmexWSTradeBin1d:
+		b.processTradeBin(&resp, resp.Table)
+	case BitmexWSTrade:
+		b.processTrade(&resp)
+	case BitmexWSExecution:
+		b.processExecution(&resp)
+	case BitmexWSOrder:
+		b.processOrder(&resp)
+	case BitmexWSMargin:
+		b.processMargin(&resp)
+	case BitmexWSPosition:
+		b.processPosition(&resp)
+	case BitmexWSWallet:
+		b.processWallet(&resp)
+	default:
+		if resp.Subscribe != "" {
+			b.log().Debug("ws subscribe message", "subscribe", resp.Subscribe)
+		} else {
+			b.log().Debug("ws unknown message", "msg", message)
+		}
+	}
+	return nil
 }
 
 // CloseWS closes the websocket connection
@@ -333,13 +457,82 @@ func (b *BitMEX) CloseWS() {
 	b.ws.CloseWS()
 }
 
-func (b *BitMEX) processInstrument(msg *Response) (err error) {
+// IsConnected reports whether the websocket is currently connected
+func (b *BitMEX) IsConnected() bool {
+	if stream := b.getStream(); stream != nil {
+		return stream.isConnected()
+	}
+	return b.ws.IsConnected()
+}
+
+// tableHook gets the raw rows of a table, a pointer so that it can be removed
+type tableHook struct {
+	fn func(action string, data []byte)
+}
+
+// AddTableHook calls fn with the raw rows of every frame of table, before
+// its event, next to the hooks already there. Updates carry only the changed
+// fields, a zero included, which the decoded rows of the event can't tell
+// from a missing one. remove takes it out.
+func (b *BitMEX) AddTableHook(table string, fn func(action string, data []byte)) (remove func()) {
+	hook := &tableHook{fn: fn}
+	b.tableHooksMutex.Lock()
+	defer b.tableHooksMutex.Unlock()
+	if b.tableHooks == nil {
+		b.tableHooks = make(map[string][]*tableHook)
+	}
+	// copied on write, processMessage ranges over the slice without the lock
+	hooks := append([]*tableHook(nil), b.tableHooks[table]...)
+	b.tableHooks[table] = append(hooks, hook)
+	return func() {
+		b.tableHooksMutex.Lock()
+		defer b.tableHooksMutex.Unlock()
+		hooks := b.tableHooks[table]
+		for i, h := range hooks {
+			if h == hook {
+				b.tableHooks[table] = append(hooks[:i:i], hooks[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (b *BitMEX) getTableHooks(table string) []*tableHook {
+	b.tableHooksMutex.RLock()
+	defer b.tableHooksMutex.RUnlock()
+	return b.tableHooks[table]
+}
+
+// processInstrument feeds the registry and the funding tracker the raw rows, data,
+// so that updates keep the fields they don't carry
+func (b *BitMEX) processInstrument(msg *Response, data []byte) (err error) {
 	instruments, _ := msg.Data.([]*swagger.Instrument)
 	if len(instruments) < 1 {
 		return errors.New("ws.go error - no instrument data")
 	}
 
-	b.emitter.Emit(BitmexWSInstrument, instruments, msg.Action)
+	if err := b.funding.apply(data); err != nil {
+		b.log().Warn("ws funding", "err", err)
+	}
+	if err := b.instruments.apply(msg.Action, data); err != nil {
+		b.log().Warn("ws instrument", "err", err)
+	}
+	b.emit(BitmexWSInstrument, instruments, msg.Action)
+	return nil
+}
+
+func (b *BitMEX) processFunding(msg *Response) (err error) {
+	fundings, _ := msg.Data.([]*swagger.Funding)
+	if len(fundings) < 1 {
+		return errors.New("ws.go error - no funding data")
+	}
+
+	history := make([]swagger.Funding, 0, len(fundings))
+	for _, v := range fundings {
+		history = append(history, *v)
+	}
+	b.funding.AddHistory(history)
+	b.emit(BitmexWSFunding, fundings, msg.Action)
 	return nil
 }
 
@@ -361,20 +554,11 @@ func (b *BitMEX) processOrderbook(msg *Response) (err error) {
 		b.orderBookLocals[symbol] = NewOrderBookLocal()
 	}
 
-	switch msg.Action {
-	case bitmexActionInitialData:
-		if !b.orderBookLoaded[symbol] {
-			b.orderBookLocals[symbol].LoadSnapshot(orderbook)
-			b.orderBookLoaded[symbol] = true
-		}
-	default:
-		if b.orderBookLoaded[symbol] {
-			b.orderBookLocals[symbol].Update(orderbook, msg.Action)
-		}
-	}
+	b.applyOrderbook(symbol, orderbook, msg.Action)
 
 	ob := b.orderBookLocals[symbol].GetOrderbookL2()
-	b.emitter.Emit(BitmexWSOrderBookL2, ob, symbol)
+	b.emit(BitmexWSOrderBookL2, ob, symbol)
+	b.emitBook(BookL2, symbol, b.orderBookLocals[symbol].GetOrderbook)
 	return nil
 }
 
@@ -396,21 +580,36 @@ func (b *BitMEX) processOrderbook25(msg *Response) (err error) {
 		b.orderBookLocals[symbol] = NewOrderBookLocal()
 	}
 
-	switch msg.Action {
+	b.applyOrderbook(symbol, orderbook, msg.Action)
+
+	ob := b.orderBookLocals[symbol].GetOrderbookL2()
+	b.emit(BitmexWSOrderBookL2_25, ob, symbol)
+	b.emitBook(BookL2, symbol, b.orderBookLocals[symbol].GetOrderbook)
+	return nil
+}
+
+// applyOrderbook loads a partial with the level codec of symbol, then applies deltas
+func (b *BitMEX) applyOrderbook(symbol string, orderbook OrderBookData, action string) {
+	book := b.orderBookLocals[symbol]
+	var err error
+	switch action {
 	case bitmexActionInitialData:
-		if !b.orderBookLoaded[symbol] {
-			b.orderBookLocals[symbol].LoadSnapshot(orderbook)
-			b.orderBookLoaded[symbol] = true
+		// again after a reconnect or resubscribe
+		codec, e := b.instruments.resolveLevelCodec(symbol, orderbook)
+		if e != nil {
+			b.log().Warn("ws orderbook level codec", "symbol", symbol, "err", e)
 		}
+		book.SetLevelCodec(codec)
+		err = book.LoadSnapshot(orderbook)
+		b.orderBookLoaded[symbol] = true
 	default:
 		if b.orderBookLoaded[symbol] {
-			b.orderBookLocals[symbol].Update(orderbook, msg.Action)
+			err = book.Update(orderbook, action)
 		}
 	}
-
-	ob := b.orderBookLocals[symbol].GetOrderbookL2()
-	b.emitter.Emit(BitmexWSOrderBookL2_25, ob, symbol)
-	return nil
+	if err != nil {
+		b.log().Warn("ws orderbook", "symbol", symbol, "action", action, "err", err)
+	}
 }
 
 func (b *BitMEX) processQuote(msg *Response) (err error) {
@@ -419,7 +618,14 @@ func (b *BitMEX) processQuote(msg *Response) (err error) {
 		return errors.New("ws.go error - no quote data")
 	}
 
-	b.emitter.Emit(BitmexWSQuote, quotes, msg.Action)
+	b.emit(BitmexWSQuote, quotes, msg.Action)
+	// a frame can carry several quotes of a symbol, the book is the last
+	for i, q := range quotes {
+		if i+1 < len(quotes) && quotes[i+1].Symbol == q.Symbol {
+			continue
+		}
+		b.emitBook(BookQuote, q.Symbol, func() OrderBook { return QuoteOrderBook(q) })
+	}
 	return nil
 }
 
@@ -429,7 +635,7 @@ func (b *BitMEX) processTradeBin(msg *Response, name string) (err error) {
 		return errors.New("ws.go error - no tradeBin data")
 	}
 
-	b.emitter.Emit(name, tradeBins, msg.Action)
+	b.emit(name, tradeBins, msg.Action)
 	return nil
 }
 
@@ -438,7 +644,7 @@ func (b *BitMEX) processTrade(msg *Response) (err error) {
 	if len(trades) < 1 {
 		return errors.New("ws.go error - no trade data")
 	}
-	b.emitter.Emit(BitmexWSTrade, trades, msg.Action)
+	b.emit(BitmexWSTrade, trades, msg.Action)
 	return nil
 }
 
@@ -448,7 +654,9 @@ func (b *BitMEX) processExecution(msg *Response) (err error) {
 		return errors.New("ws.go error - no execution data")
 	}
 
-	b.emitter.Emit(BitmexWSExecution, executions, msg.Action)
+	b.traceExecutions(executions)
+
+	b.emit(BitmexWSExecution, executions, msg.Action)
 	return nil
 }
 
@@ -458,6 +666,8 @@ func (b *BitMEX) processOrder(msg *Response) (err error) {
 		return errors.New("ws.go error - no order data")
 	}
 
+	b.traceOrders(orders)
+
 	switch msg.Action {
 	case bitmexActionInitialData, bitmexActionInsertData:
 		for _, v := range orders {
@@ -508,8 +718,8 @@ func (b *BitMEX) processOrder(msg *Response) (err error) {
 		}
 	}
 
-	//b.emitter.Emit(BitmexWSOrder, orders, msg.Action)
-	b.emitter.Emit(BitmexWSOrder, result, msg.Action)
+	//b.emit(BitmexWSOrder, orders, msg.Action)
+	b.emit(BitmexWSOrder, result, msg.Action)
 	return nil
 }
 
@@ -519,7 +729,7 @@ func (b *BitMEX) processMargin(msg *Response) (err error) {
 		return errors.New("ws.go error - no margin data")
 	}
 
-	b.emitter.Emit(BitmexWSMargin, margins, msg.Action)
+	b.emit(BitmexWSMargin, margins, msg.Action)
 	return nil
 }
 
@@ -529,7 +739,7 @@ func (b *BitMEX) processPosition(msg *Response) (err error) {
 		return errors.New("ws.go error - no position data")
 	}
 
-	b.emitter.Emit(BitmexWSPosition, positions, msg.Action)
+	b.emit(BitmexWSPosition, positions, msg.Action)
 	return nil
 }
 
@@ -539,6 +749,6 @@ func (b *BitMEX) processWallet(msg *Response) (err error) {
 		return errors.New("ws.go error - no wallet data")
 	}
 
-	b.emitter.Emit(BitmexWSWallet, wallets, msg.Action)
+	b.emit(BitmexWSWallet, wallets, msg.Action)
 	return nil
 }
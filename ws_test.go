@@ -1,73 +1,326 @@
 package bitmex
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"os"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/frankrap/bitmex-api/bitmextest"
 )
 
-func testBitMeX() *BitMEX {
-	b := New(nil, HostTestnet, "", "", true)
-	//b.SetHttpProxy("http://127.0.0.1:1081")
-	return b
+func loadScript(t *testing.T, srv *bitmextest.Server, filename string) {
+	f, err := os.Open("testdata/" + filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := srv.LoadScript(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitOrderBook(t *testing.T, c chan OrderBook, check func(ob OrderBook) bool) OrderBook {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case ob := <-c:
+			if check(ob) {
+				return ob
+			}
+		case <-deadline:
+			t.Fatal("orderbook timeout")
+		}
+	}
 }
 
 func TestBitMEXConnect(t *testing.T) {
-	b := testBitMeX()
+	b, srv := newBitmexForTest(t)
+	loadScript(t, srv, "ws_orderbook.jsonl")
+
 	subscribeInfos := []SubscribeInfo{
 		{Op: BitmexWSOrderBookL2, Param: "XBTUSD"},
 	}
 	err := b.Subscribe(subscribeInfos)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 
+	c := make(chan OrderBook, 16)
 	b.On(BitmexWSOrderBookL2, func(ob OrderBookDataL2, symbol string) {
-		m := ob.OrderBook()
-		fmt.Printf("\rOrderbook Asks: %#v Bids: %#v                            ", m.Asks[0], m.Bids[0])
+		c <- ob.OrderBook()
 	})
 
-	b.StartWS()
+	startWS(t, b)
 
-	select {}
+	// after partial, insert, update and delete
+	ob := waitOrderBook(t, c, func(ob OrderBook) bool { return len(ob.Asks) == 2 && ob.Ask() == 8999 })
+	if ob.Ask() != 8999 || ob.Asks[1].Price != 8999.5 {
+		t.Errorf("asks error %#v", ob.Asks)
+	}
+	if ob.Bid() != 8998.5 || ob.Bids[0].Amount != 900 {
+		t.Errorf("bids error %#v", ob.Bids)
+	}
+	if !srv.WaitWSMessage(`"authKey"`, time.Second) {
+		t.Error("no auth message")
+	}
+	if len(srv.AuthErrors()) != 0 {
+		t.Error(srv.AuthErrors())
+	}
 }
 
 func TestBitMEXWS(t *testing.T) {
-	b := testBitMeX()
+	srv := newTestServer(t)
+	b := newBitmexForServer(srv, "", "")
 	subscribeInfos := []SubscribeInfo{
 		{Op: BitmexWSOrderBookL2, Param: "XBTUSD"},
 	}
 	err := b.Subscribe(subscribeInfos)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 
+	c := make(chan OrderBook, 16)
 	b.On(BitmexWSOrderBookL2, func(ob OrderBookDataL2, symbol string) {
-		m := ob.OrderBook()
-		fmt.Printf("\rOrderbook Asks: %#v Bids: %#v                            ", m.Asks[0], m.Bids[0])
+		c <- ob.OrderBook()
 	})
 
-	b.StartWS()
+	startWS(t, b)
+
+	if !srv.WaitWSMessage(`"subscribe"`, 5*time.Second) {
+		t.Fatal("no subscribe message")
+	}
+	for _, m := range srv.WSMessages() {
+		if m != `{"op":"subscribe","args":["orderBookL2:XBTUSD"]}` {
+			t.Errorf("unexpected message %v", m)
+		}
+	}
 
-	select {}
+	// pushed after subscribe
+	srv.Push(`{"table":"orderBookL2","action":"partial","data":[{"symbol":"XBTUSD","id":8799100050,"side":"Sell","size":3400,"price":8999.5},{"symbol":"XBTUSD","id":8799100150,"side":"Buy","size":500,"price":8998.5}]}`)
+	ob := waitOrderBook(t, c, func(ob OrderBook) bool { return ob.Valid() })
+	if ob.Ask() != 8999.5 || ob.Bid() != 8998.5 {
+		t.Errorf("orderbook error %#v", ob)
+	}
 }
 
 func TestBitMEX_Subscribe(t *testing.T) {
-	b := testBitMeX()
+	b, srv := newBitmexForTest(t)
+	srv.Script(bitmextest.ScriptOnSubscribe("orderBookL2_25:XBTUSD"),
+		`{"table":"orderBookL2_25","action":"partial","data":[{"symbol":"XBTUSD","id":8799100050,"side":"Sell","size":3400,"price":8999.5},{"symbol":"XBTUSD","id":8799100150,"side":"Buy","size":500,"price":8998.5}]}`)
+
 	subscribeInfos := []SubscribeInfo{
 		{Op: BitmexWSOrderBookL2_25, Param: "XBTUSD"},
 	}
 	err := b.Subscribe(subscribeInfos)
 	if err != nil {
-		log.Fatal(err)
+		t.Fatal(err)
 	}
 
+	c := make(chan OrderBook, 16)
 	b.On(BitmexWSOrderBookL2_25, func(ob OrderBookDataL2, symbol string) {
-		m := ob.OrderBook()
-		fmt.Printf("\rOrderbook Asks: %#v Bids: %#v                            ", m.Asks[0], m.Bids[0])
+		c <- ob.OrderBook()
 	})
 
-	b.StartWS()
+	startWS(t, b)
+
+	ob := waitOrderBook(t, c, func(ob OrderBook) bool { return ob.Valid() })
+	if ob.Ask() != 8999.5 || ob.Bid() != 8998.5 {
+		t.Errorf("orderbook error %#v", ob)
+	}
+}
+
+// wsGoroutines returns the stacks of running StartWS, Multiplexer, Hub and recws goroutines
+func wsGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	var found []string
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "bitmex-api.(*BitMEX).StartWS") || strings.Contains(g, "bitmex-api.(*Multiplexer).Start") ||
+			strings.Contains(g, "bitmex-api.(*Hub).") || strings.Contains(g, "bitmex-api/recws.") {
+			found = append(found, g)
+		}
+	}
+	return found
+}
+
+// checkWSGoroutines fails if any is left, after letting those of earlier tests exit
+func checkWSGoroutines(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		leaked := wsGoroutines()
+		if len(leaked) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("leaked goroutines\n%v", strings.Join(leaked, "\n\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBitMEX_StartWSNoLeak(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	b.ws.RecIntvlMin = 50 * time.Millisecond
+	b.ws.KeepAliveTimeout = time.Second
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrder, Param: "XBTUSD"}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := b.StartWS(ctx); err != nil {
+		t.Fatal(err)
+	}
+	srv.DropWS()
+	waitFor(t, "reconnect", func() bool { return srv.Dials() == 2 && b.IsConnected() })
+	if len(wsGoroutines()) == 0 {
+		t.Fatal("no goroutines found, the check is broken")
+	}
+
+	cancel()
+	select {
+	case <-b.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not done")
+	}
+	waited := make(chan struct{})
+	go func() {
+		b.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Wait blocked\n%v", strings.Join(wsGoroutines(), "\n\n"))
+	}
+	checkWSGoroutines(t)
+	if b.IsConnected() || b.ConnStats().State != ConnClosed {
+		t.Errorf("state %v", b.ConnStats().State)
+	}
+}
+
+func TestBitMEX_StartWSAgain(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	b.Subscribe([]SubscribeInfo{{Op: BitmexWSOrder, Param: "XBTUSD"}})
+
+	// closed by CloseWS, then by the context, then by CloseWS again
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i, run := range []struct {
+		ctx  context.Context
+		stop func()
+	}{{context.Background(), b.CloseWS}, {ctx, cancel}, {context.Background(), b.CloseWS}} {
+		if err := b.StartWS(run.ctx); err != nil {
+			t.Fatalf("start %d: %v", i+1, err)
+		}
+		waitFor(t, "subscribe", func() bool { return countWSMessages(srv, `"subscribe"`) == i+1 })
+		if !b.IsConnected() {
+			t.Fatalf("start %d not connected", i+1)
+		}
+		run.stop()
+		waitStopped(t, b.Done(), b.Wait)
+	}
+	if srv.Dials() != 3 {
+		t.Errorf("%d dials", srv.Dials())
+	}
+}
+
+// waitStopped fails unless Done closes and Wait returns, leaving no goroutine
+func waitStopped(t *testing.T, done <-chan struct{}, wait func()) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not done")
+	}
+	waited := make(chan struct{})
+	go func() {
+		wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Wait blocked\n%v", strings.Join(wsGoroutines(), "\n\n"))
+	}
+	checkWSGoroutines(t)
+}
+
+func TestMultiplexer_StartNoLeak(t *testing.T) {
+	srv := newTestServer(t)
+	m := NewMultiplexer(HostTestnet)
+	m.SetLogger(NopLogger)
+	m.SetWSURL(srv.MDURL)
+	m.ws.RecIntvlMin = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := m.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	srv.DropWS()
+	waitFor(t, "reconnect", func() bool { return srv.Dials() == 2 && m.IsConnected() })
+	if len(wsGoroutines()) == 0 {
+		t.Fatal("no goroutines found, the check is broken")
+	}
+
+	cancel()
+	waitStopped(t, m.Done(), m.Wait)
+}
 
-	select {}
+func TestMultiplexer_StartFails(t *testing.T) {
+	srv := newTestServer(t)
+	m := NewMultiplexer(HostTestnet)
+	m.SetLogger(NopLogger)
+	m.SetWSURL(srv.MDURL)
+	srv.Close()
+
+	if err := m.Start(context.Background()); err == nil {
+		t.Fatal("expect dial error")
+	}
+	m.Wait()
+	checkWSGoroutines(t)
+}
+
+func TestHub_NoLeak(t *testing.T) {
+	srv := newTestServer(t)
+	hub := NewHub(func() *BitMEX { return newBitmexForServer(srv, "", "") })
+	hub.TopicsPerConn = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := hub.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := hub.Subscribe([]SubscribeInfo{{Op: BitmexWSTrade, Param: "XBTUSD"}, {Op: BitmexWSQuote, Param: "XBTUSD"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if hub.Conns() != 2 {
+		t.Fatalf("%d conns", hub.Conns())
+	}
+	if len(wsGoroutines()) == 0 {
+		t.Fatal("no goroutines found, the check is broken")
+	}
+
+	cancel()
+	waitStopped(t, hub.Done(), hub.Wait)
+	if _, err := hub.Subscribe([]SubscribeInfo{{Op: BitmexWSTrade, Param: "ETHUSD"}}); err != ErrHubClosed {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestBitMEX_StartWSFails(t *testing.T) {
+	b, srv := newBitmexForTest(t)
+	srv.Close()
+
+	if err := b.StartWS(context.Background()); err == nil {
+		t.Fatal("expect dial error")
+	}
+	b.Wait()
+	checkWSGoroutines(t)
 }